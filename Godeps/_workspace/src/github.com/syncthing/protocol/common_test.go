@@ -8,15 +8,16 @@ import (
 )
 
 type TestModel struct {
-	data     []byte
-	folder   string
-	name     string
-	offset   int64
-	size     int
-	hash     []byte
-	flags    uint32
-	options  []Option
-	closedCh chan bool
+	data      []byte
+	folder    string
+	name      string
+	offset    int64
+	size      int
+	hash      []byte
+	flags     uint32
+	options   []Option
+	closedCh  chan bool
+	closedErr error
 }
 
 func newTestModel() *TestModel {
@@ -43,12 +44,16 @@ func (t *TestModel) Request(deviceID DeviceID, folder, name string, offset int64
 }
 
 func (t *TestModel) Close(deviceID DeviceID, err error) {
+	t.closedErr = err
 	close(t.closedCh)
 }
 
 func (t *TestModel) ClusterConfig(deviceID DeviceID, config ClusterConfigMessage) {
 }
 
+func (t *TestModel) DownloadProgress(deviceID DeviceID, folder string, updates []FileDownloadProgressUpdate, flags uint32, options []Option) {
+}
+
 func (t *TestModel) isClosed() bool {
 	select {
 	case <-t.closedCh:
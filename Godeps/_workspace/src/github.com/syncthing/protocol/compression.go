@@ -2,7 +2,16 @@
 
 package protocol
 
-import "fmt"
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	lz4 "github.com/bkaradzic/go-lz4"
+)
 
 type Compression int
 
@@ -51,3 +60,178 @@ func (c *Compression) UnmarshalText(bs []byte) error {
 	*c = compressionUnmarshal[string(bs)]
 	return nil
 }
+
+// CompressionAlgorithm is the algorithm used to compress messages on the
+// wire. Devices announce the algorithms they support in the cluster config,
+// and LZ4 is understood by all of them.
+type CompressionAlgorithm int
+
+const (
+	CompressionLZ4     CompressionAlgorithm = iota // zero value is the default, and the only algorithm supported by older devices
+	CompressionDeflate                             // slower, but compresses better; honors the compression level
+
+	maxCompressionAlgorithm = 0x7 // the algorithm is stored in three bits of the header
+
+	compressionOption = "compression" // ClusterConfig option; the supported algorithms, comma separated
+)
+
+var compressionAlgorithmMarshal = map[CompressionAlgorithm]string{
+	CompressionLZ4:     "lz4",
+	CompressionDeflate: "deflate",
+}
+
+var compressionAlgorithmUnmarshal = map[string]CompressionAlgorithm{
+	"lz4":     CompressionLZ4,
+	"deflate": CompressionDeflate,
+}
+
+// supportedCompressionAlgorithms are the algorithms we support, in order of
+// preference after the configured one.
+var supportedCompressionAlgorithms = []CompressionAlgorithm{CompressionDeflate, CompressionLZ4}
+
+func (a CompressionAlgorithm) String() string {
+	s, ok := compressionAlgorithmMarshal[a]
+	if !ok {
+		return fmt.Sprintf("unknown:%d", a)
+	}
+	return s
+}
+
+func (a CompressionAlgorithm) GoString() string {
+	return fmt.Sprintf("%q", a.String())
+}
+
+func (a CompressionAlgorithm) MarshalText() ([]byte, error) {
+	return []byte(compressionAlgorithmMarshal[a]), nil
+}
+
+func (a *CompressionAlgorithm) UnmarshalText(bs []byte) error {
+	*a = compressionAlgorithmUnmarshal[string(bs)]
+	return nil
+}
+
+// compressionAlgorithmsOption returns the ClusterConfig option value
+// announcing the given algorithms.
+func compressionAlgorithmsOption(algos []CompressionAlgorithm) string {
+	names := make([]string, len(algos))
+	for i, algo := range algos {
+		names[i] = algo.String()
+	}
+	return strings.Join(names, ",")
+}
+
+// compressionPreference returns the algorithms we support, in our order of
+// preference; the preferred one first and the rest as they come in
+// supportedCompressionAlgorithms.
+func compressionPreference(preferred CompressionAlgorithm) []CompressionAlgorithm {
+	algos := []CompressionAlgorithm{preferred}
+	for _, algo := range supportedCompressionAlgorithms {
+		if algo != preferred {
+			algos = append(algos, algo)
+		}
+	}
+	return algos
+}
+
+// selectCompressionAlgorithm returns the algorithm to send messages with,
+// given our preferred one and the ClusterConfig option value announcing the
+// algorithms the other device supports, in its order of preference. Among
+// the algorithms we both support, our preferred one is chosen first, then
+// the one the other device prefers. LZ4 is supported by all devices, so it's
+// used when nothing else is announced.
+func selectCompressionAlgorithm(preferred CompressionAlgorithm, option string) CompressionAlgorithm {
+	var common []CompressionAlgorithm
+	for _, name := range strings.Split(option, ",") {
+		if algo, ok := compressionAlgorithmUnmarshal[strings.TrimSpace(name)]; ok {
+			common = append(common, algo)
+		}
+	}
+
+	for _, algo := range common {
+		if algo == preferred {
+			return preferred
+		}
+	}
+	if len(common) > 0 {
+		return common[0]
+	}
+	return CompressionLZ4
+}
+
+// A compressor compresses messages with a given algorithm, reusing state
+// between messages. It is not safe for concurrent use.
+type compressor struct {
+	level int
+	fw    *flate.Writer
+}
+
+// appendCompressed appends the compressed form of src to dst.
+func (c *compressor) appendCompressed(algo CompressionAlgorithm, dst, src []byte) ([]byte, error) {
+	switch algo {
+	case CompressionLZ4:
+		if maxLen := len(dst) + lz4.CompressBound(len(src)); maxLen > cap(dst) {
+			newDst := make([]byte, len(dst), maxLen)
+			copy(newDst, dst)
+			dst = newDst
+		}
+		bs, err := lz4.Encode(dst[len(dst):cap(dst)], src)
+		if err != nil {
+			return nil, err
+		}
+		return dst[:len(dst)+len(bs)], nil
+
+	case CompressionDeflate:
+		buf := bytes.NewBuffer(dst)
+		if c.fw == nil {
+			level := c.level
+			if level == 0 {
+				level = flate.DefaultCompression
+			}
+			fw, err := flate.NewWriter(buf, level)
+			if err != nil {
+				return nil, err
+			}
+			c.fw = fw
+		} else {
+			c.fw.Reset(buf)
+		}
+		if _, err := c.fw.Write(src); err != nil {
+			return nil, err
+		}
+		if err := c.fw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	return nil, fmt.Errorf("unknown compression algorithm %v", algo)
+}
+
+// decompress returns the decompressed form of src, reusing dst if it's large
+// enough. Messages that decompress to more than maxLen bytes are rejected.
+func decompress(algo CompressionAlgorithm, dst, src []byte, maxLen int) ([]byte, error) {
+	switch algo {
+	case CompressionLZ4:
+		// The uncompressed length is given up front, in little endian.
+		if len(src) >= 4 && int64(binary.LittleEndian.Uint32(src)) > int64(maxLen) {
+			return nil, fmt.Errorf("protocol error: decompressed message exceeds %d bytes", maxLen)
+		}
+		return lz4.Decode(dst, src)
+
+	case CompressionDeflate:
+		buf := bytes.NewBuffer(dst[:0])
+		fr := flate.NewReader(bytes.NewReader(src))
+		defer fr.Close()
+		// Reading one byte more than allowed tells a message of exactly
+		// the maximum length from one that is too long.
+		if _, err := buf.ReadFrom(io.LimitReader(fr, int64(maxLen)+1)); err != nil {
+			return nil, err
+		}
+		if buf.Len() > maxLen {
+			return nil, fmt.Errorf("protocol error: decompressed message exceeds %d bytes", maxLen)
+		}
+		return buf.Bytes(), nil
+	}
+
+	return nil, fmt.Errorf("protocol error: unknown compression algorithm %v", algo)
+}
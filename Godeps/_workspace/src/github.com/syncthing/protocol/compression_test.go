@@ -2,7 +2,10 @@
 
 package protocol
 
-import "testing"
+import (
+	"bytes"
+	"testing"
+)
 
 func TestCompressionMarshal(t *testing.T) {
 	uTestcases := []struct {
@@ -47,3 +50,136 @@ func TestCompressionMarshal(t *testing.T) {
 		}
 	}
 }
+
+func TestCompressionAlgorithmMarshal(t *testing.T) {
+	testcases := []struct {
+		s string
+		a CompressionAlgorithm
+	}{
+		{"lz4", CompressionLZ4},
+		{"deflate", CompressionDeflate},
+	}
+
+	var a CompressionAlgorithm
+	for _, tc := range testcases {
+		if err := a.UnmarshalText([]byte(tc.s)); err != nil {
+			t.Error(err)
+		}
+		if a != tc.a {
+			t.Errorf("%s unmarshalled to %d, not %d", tc.s, a, tc.a)
+		}
+
+		bs, err := tc.a.MarshalText()
+		if err != nil {
+			t.Error(err)
+		}
+		if s := string(bs); s != tc.s {
+			t.Errorf("%d marshalled to %q, not %q", tc.a, s, tc.s)
+		}
+	}
+
+	if err := a.UnmarshalText([]byte("whatever")); err != nil {
+		t.Error(err)
+	}
+	if a != CompressionLZ4 {
+		t.Errorf("Unknown algorithm unmarshalled to %d, not %d", a, CompressionLZ4)
+	}
+}
+
+func TestSelectCompressionAlgorithm(t *testing.T) {
+	testcases := []struct {
+		preferred CompressionAlgorithm
+		option    string
+		selected  CompressionAlgorithm
+	}{
+		{CompressionLZ4, "", CompressionLZ4},
+		{CompressionDeflate, "", CompressionLZ4},
+		{CompressionDeflate, "lz4", CompressionLZ4},
+		{CompressionDeflate, "deflate,lz4", CompressionDeflate},
+		{CompressionDeflate, "something, deflate", CompressionDeflate},
+		{CompressionLZ4, "deflate,lz4", CompressionLZ4},
+		// The other device lacks our preferred algorithm, so its own
+		// preference decides
+		{CompressionLZ4, "deflate", CompressionDeflate},
+		{CompressionDeflate, "something, lz4", CompressionLZ4},
+		{CompressionDeflate, "something", CompressionLZ4},
+	}
+
+	for _, tc := range testcases {
+		if a := selectCompressionAlgorithm(tc.preferred, tc.option); a != tc.selected {
+			t.Errorf("selectCompressionAlgorithm(%v, %q) = %v, not %v", tc.preferred, tc.option, a, tc.selected)
+		}
+	}
+}
+
+func TestCompressionPreference(t *testing.T) {
+	testcases := []struct {
+		preferred CompressionAlgorithm
+		option    string
+	}{
+		{CompressionLZ4, "lz4,deflate"},
+		{CompressionDeflate, "deflate,lz4"},
+	}
+
+	for _, tc := range testcases {
+		if opt := compressionAlgorithmsOption(compressionPreference(tc.preferred)); opt != tc.option {
+			t.Errorf("Incorrect announcement %q for %v, not %q", opt, tc.preferred, tc.option)
+		}
+	}
+}
+
+func TestCompressionRoundtrip(t *testing.T) {
+	data := bytes.Repeat([]byte("some data that compresses quite well "), 1000)
+
+	for _, algo := range supportedCompressionAlgorithms {
+		for _, level := range []int{0, 1, 9} {
+			c := compressor{level: level}
+
+			// Compress twice to exercise reuse of the compressor state
+			for i := 0; i < 2; i++ {
+				hdr := []byte("header")
+				bs, err := c.appendCompressed(algo, hdr, data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.HasPrefix(bs, hdr) {
+					t.Errorf("%v: compressed data lost the prefix", algo)
+				}
+				if len(bs) >= len(data) {
+					t.Errorf("%v: compressed data not smaller; %d >= %d", algo, len(bs), len(data))
+				}
+
+				dec, err := decompress(algo, nil, bs[len(hdr):], len(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(dec, data) {
+					t.Errorf("%v: roundtrip mismatch", algo)
+				}
+			}
+		}
+	}
+
+	if _, err := decompress(maxCompressionAlgorithm, nil, []byte("data"), 1024); err == nil {
+		t.Error("Unexpected nil error for unknown algorithm")
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	data := make([]byte, 1<<20)
+
+	for _, algo := range supportedCompressionAlgorithms {
+		var c compressor
+		bs, err := c.appendCompressed(algo, nil, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := decompress(algo, nil, bs, len(data)); err != nil {
+			t.Errorf("%v: unexpected error at the limit: %v", algo, err)
+		}
+		if _, err := decompress(algo, nil, bs, len(data)-1); err == nil {
+			t.Errorf("%v: unexpected nil error past the limit", algo)
+		}
+	}
+}
@@ -9,6 +9,7 @@ type header struct {
 	msgID       int
 	msgType     int
 	compression bool
+	algorithm   CompressionAlgorithm
 }
 
 func (h header) encodeXDR(xw *xdr.Writer) (int, error) {
@@ -30,6 +31,7 @@ func encodeHeader(h header) uint32 {
 	return uint32(h.version&0xf)<<28 +
 		uint32(h.msgID&0xfff)<<16 +
 		uint32(h.msgType&0xff)<<8 +
+		uint32(h.algorithm&maxCompressionAlgorithm)<<1 + // the three bits after the compression bit
 		isComp
 }
 
@@ -39,5 +41,6 @@ func decodeHeader(u uint32) header {
 		msgID:       int(u>>16) & 0xfff,
 		msgType:     int(u>>8) & 0xff,
 		compression: u&1 == 1,
+		algorithm:   CompressionAlgorithm(u>>1) & maxCompressionAlgorithm,
 	}
 }
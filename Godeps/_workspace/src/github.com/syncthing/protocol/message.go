@@ -8,10 +8,12 @@ package protocol
 import "fmt"
 
 type IndexMessage struct {
-	Folder  string
-	Files   []FileInfo
-	Flags   uint32
-	Options []Option // max:64
+	Folder     string
+	Files      []FileInfo
+	Flags      uint32
+	Options    []Option // max:64
+	WeakHashes []uint32 // The WeakHash of each block of each file, in order
+	MACs       []byte   // The MAC of each file, in order, MACSize bytes each
 }
 
 type FileInfo struct {
@@ -21,6 +23,7 @@ type FileInfo struct {
 	Version      Vector
 	LocalVersion int64
 	Blocks       []BlockInfo
+	MAC          []byte // noencode (sent separately in IndexMessage)
 }
 
 func (f FileInfo) String() string {
@@ -59,9 +62,10 @@ func (f FileInfo) HasPermissionBits() bool {
 }
 
 type BlockInfo struct {
-	Offset int64 // noencode (cache only)
-	Size   int32
-	Hash   []byte // max:64
+	Offset   int64 // noencode (cache only)
+	Size     int32
+	Hash     []byte // max:64
+	WeakHash uint32 // noencode (sent separately in IndexMessage)
 }
 
 func (b BlockInfo) String() string {
@@ -123,4 +127,18 @@ type CloseMessage struct {
 	Code   int32
 }
 
+type DownloadProgressMessage struct {
+	Folder  string                       // max:64
+	Updates []FileDownloadProgressUpdate // max:1000000
+	Flags   uint32
+	Options []Option // max:64
+}
+
+type FileDownloadProgressUpdate struct {
+	UpdateType   uint32
+	Name         string // max:8192
+	Version      Vector
+	BlockIndexes []int32 // max:1000000
+}
+
 type EmptyMessage struct{}
@@ -9,24 +9,30 @@ import (
 	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	lz4 "github.com/bkaradzic/go-lz4"
 )
 
 const (
 	BlockSize = 128 * 1024
+
+	// The size of the MAC of a file, as sent in index messages.
+	MACSize = 32
+
+	// The largest message we accept, both as sent and decompressed.
+	MaxMessageLen = 500 * 1000 * 1000
 )
 
 const (
-	messageTypeClusterConfig = 0
-	messageTypeIndex         = 1
-	messageTypeRequest       = 2
-	messageTypeResponse      = 3
-	messageTypePing          = 4
-	messageTypePong          = 5
-	messageTypeIndexUpdate   = 6
-	messageTypeClose         = 7
+	messageTypeClusterConfig    = 0
+	messageTypeIndex            = 1
+	messageTypeRequest          = 2
+	messageTypeResponse         = 3
+	messageTypePing             = 4
+	messageTypePong             = 5
+	messageTypeIndexUpdate      = 6
+	messageTypeClose            = 7
+	messageTypeDownloadProgress = 8
 )
 
 const (
@@ -59,6 +65,12 @@ const (
 	FlagRequestTemporary uint32 = 1 << iota
 )
 
+// FileDownloadProgressUpdate update types
+const (
+	UpdateTypeAppend uint32 = iota
+	UpdateTypeForget
+)
+
 // ClusterConfigMessage.Folders.Devices flags
 const (
 	FlagShareTrusted  uint32 = 1 << 0
@@ -85,18 +97,24 @@ type Model interface {
 	Request(deviceID DeviceID, folder string, name string, offset int64, size int, hash []byte, flags uint32, options []Option) ([]byte, error)
 	// A cluster configuration message was received
 	ClusterConfig(deviceID DeviceID, config ClusterConfigMessage)
+	// The peer device sent progress updates for the files it is currently downloading
+	DownloadProgress(deviceID DeviceID, folder string, updates []FileDownloadProgressUpdate, flags uint32, options []Option)
 	// The peer device closed the connection
 	Close(deviceID DeviceID, err error)
 }
 
 type Connection interface {
+	Start()
 	ID() DeviceID
 	Name() string
 	Index(folder string, files []FileInfo, flags uint32, options []Option) error
 	IndexUpdate(folder string, files []FileInfo, flags uint32, options []Option) error
 	Request(folder string, name string, offset int64, size int, hash []byte, flags uint32, options []Option) ([]byte, error)
 	ClusterConfig(config ClusterConfigMessage)
+	DownloadProgress(folder string, updates []FileDownloadProgressUpdate, flags uint32, options []Option)
 	Statistics() Statistics
+	Closed() bool
+	Close(err error)
 }
 
 type rawConnection struct {
@@ -118,7 +136,10 @@ type rawConnection struct {
 	closed chan struct{}
 	once   sync.Once
 
-	compression Compression
+	compression   Compression
+	algorithm     CompressionAlgorithm // the preferred algorithm
+	level         int                  // the compression level for the preferred algorithm
+	sendAlgorithm int32                // the algorithm in use for outgoing messages; accessed atomically
 
 	rdbuf0 []byte // used & reused by readMessage
 	rdbuf1 []byte // used & reused by readMessage
@@ -130,8 +151,9 @@ type asyncResult struct {
 }
 
 type hdrMsg struct {
-	hdr header
-	msg encodable
+	hdr  header
+	msg  encodable
+	done chan struct{} // closed when the message has been written, if not nil
 }
 
 type encodable interface {
@@ -145,9 +167,16 @@ type isEofer interface {
 const (
 	pingTimeout  = 30 * time.Second
 	pingIdleTime = 60 * time.Second
+
+	// How long we wait for the close message to be sent before closing the
+	// connection anyway.
+	closeTimeout = 1 * time.Second
 )
 
-func NewConnection(deviceID DeviceID, reader io.Reader, writer io.Writer, receiver Model, name string, compress Compression) Connection {
+// NewConnection creates a connection to the given device. Messages are
+// compressed according to compress. The preferred algorithm is used when
+// the other device supports it, LZ4 otherwise.
+func NewConnection(deviceID DeviceID, reader io.Reader, writer io.Writer, receiver Model, name string, compress Compression, algo CompressionAlgorithm, level int) Connection {
 	cr := &countingReader{Reader: reader}
 	cw := &countingWriter{Writer: writer}
 
@@ -162,14 +191,20 @@ func NewConnection(deviceID DeviceID, reader io.Reader, writer io.Writer, receiv
 		nextID:      make(chan int),
 		closed:      make(chan struct{}),
 		compression: compress,
+		algorithm:   algo,
+		level:       level,
 	}
 
+	return wireFormatConnection{&c}
+}
+
+// Start creates the goroutines for sending and receiving of messages. It must
+// be called exactly once after creating a connection.
+func (c *rawConnection) Start() {
 	go c.readerLoop()
 	go c.writerLoop()
 	go c.pingerLoop()
 	go c.idGenerator()
-
-	return wireFormatConnection{&c}
 }
 
 func (c *rawConnection) ID() DeviceID {
@@ -189,10 +224,12 @@ func (c *rawConnection) Index(folder string, idx []FileInfo, flags uint32, optio
 	}
 	c.idxMut.Lock()
 	c.send(-1, messageTypeIndex, IndexMessage{
-		Folder:  folder,
-		Files:   idx,
-		Flags:   flags,
-		Options: options,
+		Folder:     folder,
+		Files:      idx,
+		Flags:      flags,
+		Options:    options,
+		WeakHashes: weakHashes(idx),
+		MACs:       macs(idx),
 	})
 	c.idxMut.Unlock()
 	return nil
@@ -207,10 +244,12 @@ func (c *rawConnection) IndexUpdate(folder string, idx []FileInfo, flags uint32,
 	}
 	c.idxMut.Lock()
 	c.send(-1, messageTypeIndexUpdate, IndexMessage{
-		Folder:  folder,
-		Files:   idx,
-		Flags:   flags,
-		Options: options,
+		Folder:     folder,
+		Files:      idx,
+		Flags:      flags,
+		Options:    options,
+		WeakHashes: weakHashes(idx),
+		MACs:       macs(idx),
 	})
 	c.idxMut.Unlock()
 	return nil
@@ -255,9 +294,28 @@ func (c *rawConnection) Request(folder string, name string, offset int64, size i
 
 // ClusterConfig send the cluster configuration message to the peer and returns any error
 func (c *rawConnection) ClusterConfig(config ClusterConfigMessage) {
+	// Announce the compression algorithms we understand, in our order of
+	// preference, so that the other side can choose one for the messages it
+	// sends.
+	options := make([]Option, len(config.Options), len(config.Options)+1)
+	copy(options, config.Options)
+	config.Options = append(options, Option{
+		Key:   compressionOption,
+		Value: compressionAlgorithmsOption(compressionPreference(c.algorithm)),
+	})
 	c.send(-1, messageTypeClusterConfig, config)
 }
 
+// DownloadProgress sends the progress updates for the files that are currently being downloaded.
+func (c *rawConnection) DownloadProgress(folder string, updates []FileDownloadProgressUpdate, flags uint32, options []Option) {
+	c.send(-1, messageTypeDownloadProgress, DownloadProgressMessage{
+		Folder:  folder,
+		Updates: updates,
+		Flags:   flags,
+		Options: options,
+	})
+}
+
 func (c *rawConnection) ping() bool {
 	var id int
 	select {
@@ -308,21 +366,23 @@ func (c *rawConnection) readerLoop() (err error) {
 				c.state = stateIdxRcvd
 
 			case messageTypeIndexUpdate:
-				if c.state < stateIdxRcvd {
+				// An IndexUpdate may follow directly after the ClusterConfig
+				// when the other side is resuming a previous index exchange.
+				if c.state < stateCCRcvd {
 					return fmt.Errorf("protocol error: index update message in state %d", c.state)
 				}
 				c.handleIndexUpdate(msg)
 			}
 
 		case RequestMessage:
-			if c.state < stateIdxRcvd {
+			if c.state < stateCCRcvd {
 				return fmt.Errorf("protocol error: request message in state %d", c.state)
 			}
 			// Requests are handled asynchronously
 			go c.handleRequest(hdr.msgID, msg)
 
 		case ResponseMessage:
-			if c.state < stateIdxRcvd {
+			if c.state < stateCCRcvd {
 				return fmt.Errorf("protocol error: response message in state %d", c.state)
 			}
 			c.handleResponse(hdr.msgID, msg)
@@ -337,9 +397,22 @@ func (c *rawConnection) readerLoop() (err error) {
 			if c.state != stateInitial {
 				return fmt.Errorf("protocol error: cluster config message in state %d", c.state)
 			}
-			go c.receiver.ClusterConfig(c.id, msg)
+			algo := selectCompressionAlgorithm(c.algorithm, msg.GetOption(compressionOption))
+			atomic.StoreInt32(&c.sendAlgorithm, int32(algo))
+			if debug {
+				l.Debugf("%s: using compression algorithm %v", c.id, algo)
+			}
+			// The cluster config is handled synchronously, as it may
+			// determine how the index messages following it are treated.
+			c.receiver.ClusterConfig(c.id, msg)
 			c.state = stateCCRcvd
 
+		case DownloadProgressMessage:
+			if c.state < stateCCRcvd {
+				return fmt.Errorf("protocol error: download progress message in state %d", c.state)
+			}
+			c.receiver.DownloadProgress(c.id, msg.Folder, msg.Updates, msg.Flags, msg.Options)
+
 		case CloseMessage:
 			return errors.New(msg.Reason)
 
@@ -372,6 +445,11 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 		return
 	}
 
+	if msglen < 0 || msglen > MaxMessageLen {
+		err = fmt.Errorf("protocol error: message length %d exceeds %d bytes", msglen, MaxMessageLen)
+		return
+	}
+
 	if cap(c.rdbuf0) < msglen {
 		c.rdbuf0 = make([]byte, msglen)
 	} else {
@@ -389,7 +467,7 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 	msgBuf := c.rdbuf0
 	if hdr.compression {
 		c.rdbuf1 = c.rdbuf1[:cap(c.rdbuf1)]
-		c.rdbuf1, err = lz4.Decode(c.rdbuf1, c.rdbuf0)
+		c.rdbuf1, err = decompress(hdr.algorithm, c.rdbuf1, c.rdbuf0, MaxMessageLen)
 		if err != nil {
 			return
 		}
@@ -461,6 +539,14 @@ func (c *rawConnection) readMessage() (hdr header, msg encodable, err error) {
 		}
 		msg = cm
 
+	case messageTypeDownloadProgress:
+		var dp DownloadProgressMessage
+		err = dp.UnmarshalXDR(msgBuf)
+		if xdrErr, ok := err.(isEofer); ok && xdrErr.IsEOF() {
+			err = nil
+		}
+		msg = dp
+
 	default:
 		err = fmt.Errorf("protocol error: %s: unknown message type %#x", c.id, hdr.msgType)
 	}
@@ -472,6 +558,8 @@ func (c *rawConnection) handleIndex(im IndexMessage) {
 	if debug {
 		l.Debugf("Index(%v, %v, %d file, flags %x, opts: %s)", c.id, im.Folder, len(im.Files), im.Flags, im.Options)
 	}
+	setWeakHashes(im.Files, im.WeakHashes)
+	setMACs(im.Files, im.MACs)
 	c.receiver.Index(c.id, im.Folder, filterIndexMessageFiles(im.Files), im.Flags, im.Options)
 }
 
@@ -479,9 +567,85 @@ func (c *rawConnection) handleIndexUpdate(im IndexMessage) {
 	if debug {
 		l.Debugf("queueing IndexUpdate(%v, %v, %d files, flags %x, opts: %s)", c.id, im.Folder, len(im.Files), im.Flags, im.Options)
 	}
+	setWeakHashes(im.Files, im.WeakHashes)
+	setMACs(im.Files, im.MACs)
 	c.receiver.IndexUpdate(c.id, im.Folder, filterIndexMessageFiles(im.Files), im.Flags, im.Options)
 }
 
+// weakHashes returns the weak hashes of all blocks of the files, in order,
+// or nil if none of the blocks have one. They are sent separately from the
+// blocks themselves so that peers not knowing about them can ignore them.
+func weakHashes(fs []FileInfo) []uint32 {
+	var hashes []uint32
+	var seen bool
+	for _, f := range fs {
+		for _, b := range f.Blocks {
+			hashes = append(hashes, b.WeakHash)
+			seen = seen || b.WeakHash != 0
+		}
+	}
+	if !seen {
+		return nil
+	}
+	return hashes
+}
+
+// setWeakHashes sets the weak hash of each block of the files, as returned
+// by weakHashes. Nothing is set if the number of hashes doesn't match the
+// number of blocks.
+func setWeakHashes(fs []FileInfo, hashes []uint32) {
+	n := 0
+	for _, f := range fs {
+		n += len(f.Blocks)
+	}
+	if n != len(hashes) {
+		return
+	}
+
+	for _, f := range fs {
+		for i := range f.Blocks {
+			f.Blocks[i].WeakHash = hashes[0]
+			hashes = hashes[1:]
+		}
+	}
+}
+
+// macs returns the MACs of the files, in order, or nil if none of the files
+// have one. Files without a MAC are given one of all zeroes.
+func macs(fs []FileInfo) []byte {
+	var seen bool
+	for _, f := range fs {
+		seen = seen || len(f.MAC) == MACSize
+	}
+	if !seen {
+		return nil
+	}
+
+	buf := make([]byte, len(fs)*MACSize)
+	for i, f := range fs {
+		if len(f.MAC) == MACSize {
+			copy(buf[i*MACSize:], f.MAC)
+		}
+	}
+	return buf
+}
+
+// setMACs sets the MAC of each file, as returned by macs. Nothing is set if
+// the size doesn't match the number of files.
+func setMACs(fs []FileInfo, macs []byte) {
+	if len(macs) != len(fs)*MACSize {
+		return
+	}
+
+	var zero [MACSize]byte
+	for i := range fs {
+		mac := macs[i*MACSize : (i+1)*MACSize]
+		if string(mac) != string(zero[:]) {
+			fs[i].MAC = mac
+		}
+	}
+}
+
 func filterIndexMessageFiles(fs []FileInfo) []FileInfo {
 	var out []FileInfo
 	for i, f := range fs {
@@ -538,6 +702,12 @@ func (c *rawConnection) handlePong(msgID int) {
 }
 
 func (c *rawConnection) send(msgID int, msgType int, msg encodable) bool {
+	return c.sendDone(msgID, msgType, msg, nil)
+}
+
+// sendDone queues the message for sending like send, and closes done once it
+// has been written.
+func (c *rawConnection) sendDone(msgID int, msgType int, msg encodable, done chan struct{}) bool {
 	if msgID < 0 {
 		select {
 		case id := <-c.nextID:
@@ -554,7 +724,7 @@ func (c *rawConnection) send(msgID int, msgType int, msg encodable) bool {
 	}
 
 	select {
-	case c.outbox <- hdrMsg{hdr, msg}:
+	case c.outbox <- hdrMsg{hdr, msg, done}:
 		return true
 	case <-c.closed:
 		return false
@@ -564,8 +734,8 @@ func (c *rawConnection) send(msgID int, msgType int, msg encodable) bool {
 func (c *rawConnection) writerLoop() {
 	var msgBuf = make([]byte, 8) // buffer for wire format message, kept and reused
 	var uncBuf []byte            // buffer for uncompressed message, kept and reused
+	var comp = compressor{level: c.level}
 	for {
-		var tempBuf []byte
 		var err error
 
 		select {
@@ -589,20 +759,18 @@ func (c *rawConnection) writerLoop() {
 				if compress && len(uncBuf) >= compressionThreshold {
 					// Use compression for large messages
 					hm.hdr.compression = true
+					hm.hdr.algorithm = CompressionAlgorithm(atomic.LoadInt32(&c.sendAlgorithm))
 
-					// Make sure we have enough space for the compressed message plus header in msgBug
-					msgBuf = msgBuf[:cap(msgBuf)]
-					if maxLen := lz4.CompressBound(len(uncBuf)) + 8; maxLen > len(msgBuf) {
-						msgBuf = make([]byte, maxLen)
+					// Compressed is appended to the header in msgBuf
+					msgBuf, err = comp.appendCompressed(hm.hdr.algorithm, msgBuf[:8], uncBuf)
+					if err != nil {
+						c.close(err)
+						return
 					}
-
-					// Compressed is written to msgBuf, we keep tb for the length only
-					tempBuf, err = lz4.Encode(msgBuf[8:], uncBuf)
-					binary.BigEndian.PutUint32(msgBuf[4:8], uint32(len(tempBuf)))
-					msgBuf = msgBuf[0 : len(tempBuf)+8]
+					binary.BigEndian.PutUint32(msgBuf[4:8], uint32(len(msgBuf)-8))
 
 					if debug {
-						l.Debugf("write compressed message; %v (len=%d)", hm.hdr, len(tempBuf))
+						l.Debugf("write compressed message; %v (len=%d)", hm.hdr, len(msgBuf)-8)
 					}
 				} else {
 					// No point in compressing very short messages
@@ -642,6 +810,9 @@ func (c *rawConnection) writerLoop() {
 				c.close(err)
 				return
 			}
+			if hm.done != nil {
+				close(hm.done)
+			}
 		case <-c.closed:
 			return
 		}
@@ -725,6 +896,31 @@ type Statistics struct {
 	At            time.Time
 	InBytesTotal  int64
 	OutBytesTotal int64
+	LastReceived  time.Time // When anything, including a ping or pong, was last read
+}
+
+// Close sends a close message with the reason to the peer and closes the
+// connection. The model is told about the close like for any other.
+func (c *rawConnection) Close(err error) {
+	done := make(chan struct{})
+	if c.sendDone(-1, messageTypeClose, CloseMessage{Reason: err.Error()}, done) {
+		select {
+		case <-done:
+		case <-time.After(closeTimeout):
+		}
+	}
+	c.close(err)
+}
+
+// Closed returns whether the connection has been closed, by either side or
+// due to an error.
+func (c *rawConnection) Closed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
 }
 
 func (c *rawConnection) Statistics() Statistics {
@@ -732,5 +928,6 @@ func (c *rawConnection) Statistics() Statistics {
 		At:            time.Now(),
 		InBytesTotal:  c.cr.Tot(),
 		OutBytesTotal: c.cw.Tot(),
+		LastReceived:  c.cr.Last(),
 	}
 }
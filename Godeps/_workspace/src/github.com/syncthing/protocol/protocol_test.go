@@ -61,14 +61,23 @@ func TestHeaderLayout(t *testing.T) {
 	if a != e {
 		t.Errorf("Header layout incorrect; %08x != %08x", a, e)
 	}
+
+	// Compression algorithm are the three bits after the compression bit
+	e = 0x0000000f
+	a = encodeHeader(header{compression: true, algorithm: 0x7})
+	if a != e {
+		t.Errorf("Header layout incorrect; %08x != %08x", a, e)
+	}
 }
 
 func TestPing(t *testing.T) {
 	ar, aw := io.Pipe()
 	br, bw := io.Pipe()
 
-	c0 := NewConnection(c0ID, ar, bw, nil, "name", CompressAlways).(wireFormatConnection).next.(*rawConnection)
-	c1 := NewConnection(c1ID, br, aw, nil, "name", CompressAlways).(wireFormatConnection).next.(*rawConnection)
+	c0 := NewConnection(c0ID, ar, bw, nil, "name", CompressAlways, CompressionLZ4, 0).(wireFormatConnection).next.(*rawConnection)
+	c0.Start()
+	c1 := NewConnection(c1ID, br, aw, nil, "name", CompressAlways, CompressionLZ4, 0).(wireFormatConnection).next.(*rawConnection)
+	c1.Start()
 
 	if ok := c0.ping(); !ok {
 		t.Error("c0 ping failed")
@@ -91,8 +100,10 @@ func TestPingErr(t *testing.T) {
 			eaw := &ErrPipe{PipeWriter: *aw, max: i, err: e}
 			ebw := &ErrPipe{PipeWriter: *bw, max: j, err: e}
 
-			c0 := NewConnection(c0ID, ar, ebw, m0, "name", CompressAlways).(wireFormatConnection).next.(*rawConnection)
-			NewConnection(c1ID, br, eaw, m1, "name", CompressAlways)
+			c0 := NewConnection(c0ID, ar, ebw, m0, "name", CompressAlways, CompressionLZ4, 0).(wireFormatConnection).next.(*rawConnection)
+			c0.Start()
+			c1 := NewConnection(c1ID, br, eaw, m1, "name", CompressAlways, CompressionLZ4, 0)
+			c1.Start()
 
 			res := c0.ping()
 			if (i < 8 || j < 8) && res {
@@ -167,8 +178,10 @@ func TestVersionErr(t *testing.T) {
 	ar, aw := io.Pipe()
 	br, bw := io.Pipe()
 
-	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways).(wireFormatConnection).next.(*rawConnection)
-	NewConnection(c1ID, br, aw, m1, "name", CompressAlways)
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways, CompressionLZ4, 0).(wireFormatConnection).next.(*rawConnection)
+	c0.Start()
+	c1 := NewConnection(c1ID, br, aw, m1, "name", CompressAlways, CompressionLZ4, 0)
+	c1.Start()
 
 	w := xdr.NewWriter(c0.cw)
 	w.WriteUint32(encodeHeader(header{
@@ -190,8 +203,10 @@ func TestTypeErr(t *testing.T) {
 	ar, aw := io.Pipe()
 	br, bw := io.Pipe()
 
-	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways).(wireFormatConnection).next.(*rawConnection)
-	NewConnection(c1ID, br, aw, m1, "name", CompressAlways)
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways, CompressionLZ4, 0).(wireFormatConnection).next.(*rawConnection)
+	c0.Start()
+	c1 := NewConnection(c1ID, br, aw, m1, "name", CompressAlways, CompressionLZ4, 0)
+	c1.Start()
 
 	w := xdr.NewWriter(c0.cw)
 	w.WriteUint32(encodeHeader(header{
@@ -213,8 +228,14 @@ func TestClose(t *testing.T) {
 	ar, aw := io.Pipe()
 	br, bw := io.Pipe()
 
-	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways).(wireFormatConnection).next.(*rawConnection)
-	NewConnection(c1ID, br, aw, m1, "name", CompressAlways)
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways, CompressionLZ4, 0).(wireFormatConnection).next.(*rawConnection)
+	c0.Start()
+	c1 := NewConnection(c1ID, br, aw, m1, "name", CompressAlways, CompressionLZ4, 0)
+	c1.Start()
+
+	if c0.Closed() {
+		t.Error("Connection should not report closed before close")
+	}
 
 	c0.close(nil)
 
@@ -222,6 +243,9 @@ func TestClose(t *testing.T) {
 	if !m0.isClosed() {
 		t.Fatal("Connection should be closed")
 	}
+	if !c0.Closed() {
+		t.Error("Connection should report closed")
+	}
 
 	// None of these should panic, some should return an error
 
@@ -237,6 +261,31 @@ func TestClose(t *testing.T) {
 	}
 }
 
+func TestCloseReason(t *testing.T) {
+	m0 := newTestModel()
+	m1 := newTestModel()
+
+	ar, aw := io.Pipe()
+	br, bw := io.Pipe()
+
+	c0 := NewConnection(c0ID, ar, bw, m0, "name", CompressAlways, CompressionLZ4, 0)
+	c0.Start()
+	c1 := NewConnection(c1ID, br, aw, m1, "name", CompressAlways, CompressionLZ4, 0)
+	c1.Start()
+
+	c0.Close(errors.New("replaced"))
+
+	if !m0.isClosed() {
+		t.Fatal("Connection should be closed")
+	}
+	if !m1.isClosed() {
+		t.Fatal("Remote connection should be closed")
+	}
+	if m1.closedErr == nil || m1.closedErr.Error() != "replaced" {
+		t.Errorf("Incorrect close reason %v", m1.closedErr)
+	}
+}
+
 func TestElementSizeExceededNested(t *testing.T) {
 	m := ClusterConfigMessage{
 		Folders: []Folder{
@@ -256,14 +305,19 @@ func TestMarshalIndexMessage(t *testing.T) {
 	}
 
 	f := func(m1 IndexMessage) bool {
-		for _, f := range m1.Files {
+		for j, f := range m1.Files {
+			m1.Files[j].MAC = nil
 			for i := range f.Blocks {
 				f.Blocks[i].Offset = 0
+				f.Blocks[i].WeakHash = 0
 				if len(f.Blocks[i].Hash) == 0 {
 					f.Blocks[i].Hash = nil
 				}
 			}
 		}
+		if len(m1.MACs) == 0 {
+			m1.MACs = nil
+		}
 
 		return testMarshal(t, "index", &m1, &IndexMessage{})
 	}
@@ -273,6 +327,85 @@ func TestMarshalIndexMessage(t *testing.T) {
 	}
 }
 
+func TestWeakHashes(t *testing.T) {
+	fs := []FileInfo{
+		{Name: "a", Blocks: []BlockInfo{{WeakHash: 1}, {WeakHash: 2}}},
+		{Name: "b", Flags: FlagDeleted},
+		{Name: "c", Blocks: []BlockInfo{{WeakHash: 3}}},
+	}
+
+	hashes := weakHashes(fs)
+	if !reflect.DeepEqual(hashes, []uint32{1, 2, 3}) {
+		t.Fatalf("Incorrect weak hashes %v", hashes)
+	}
+
+	var m1, m2 IndexMessage
+	m1.Folder = "default"
+	m1.Files = fs
+	m1.WeakHashes = hashes
+	bs, err := m1.MarshalXDR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m2.UnmarshalXDR(bs); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range m2.Files {
+		for _, b := range f.Blocks {
+			if b.WeakHash != 0 {
+				t.Fatal("Weak hash should not be encoded in the block")
+			}
+		}
+	}
+
+	setWeakHashes(m2.Files, m2.WeakHashes)
+	if hashes := weakHashes(m2.Files); !reflect.DeepEqual(hashes, m1.WeakHashes) {
+		t.Errorf("Weak hashes not restored; %v != %v", hashes, m1.WeakHashes)
+	}
+
+	// Hashes that don't match the blocks are ignored
+	setWeakHashes(m2.Files, []uint32{4, 5})
+	if m2.Files[0].Blocks[0].WeakHash != 1 {
+		t.Error("Unexpected weak hash update")
+	}
+
+	// No hashes are sent unless there are any
+	if hashes := weakHashes([]FileInfo{{Blocks: []BlockInfo{{}}}}); hashes != nil {
+		t.Errorf("Unexpected weak hashes %v", hashes)
+	}
+}
+
+func TestMACs(t *testing.T) {
+	mac := bytes.Repeat([]byte{1}, MACSize)
+	fs := []FileInfo{
+		{Name: "a", MAC: mac},
+		{Name: "b"},
+	}
+
+	bs := macs(fs)
+	if len(bs) != 2*MACSize || !bytes.Equal(bs[:MACSize], mac) || !bytes.Equal(bs[MACSize:], make([]byte, MACSize)) {
+		t.Fatalf("Incorrect MACs %x", bs)
+	}
+
+	rs := []FileInfo{{Name: "a"}, {Name: "b"}}
+	setMACs(rs, bs)
+	if !bytes.Equal(rs[0].MAC, mac) || rs[1].MAC != nil {
+		t.Errorf("MACs not restored; %x, %x", rs[0].MAC, rs[1].MAC)
+	}
+
+	// MACs that don't match the files are ignored
+	rs = []FileInfo{{Name: "a"}}
+	setMACs(rs, bs)
+	if rs[0].MAC != nil {
+		t.Error("Unexpected MAC update")
+	}
+
+	// No MACs are sent unless there are any
+	if bs := macs([]FileInfo{{Name: "a"}}); bs != nil {
+		t.Errorf("Unexpected MACs %x", bs)
+	}
+}
+
 func TestMarshalRequestMessage(t *testing.T) {
 	var quickCfg = &quick.Config{MaxCountScale: 10}
 	if testing.Short() {
@@ -336,6 +469,21 @@ func TestMarshalCloseMessage(t *testing.T) {
 	}
 }
 
+func TestMarshalDownloadProgressMessage(t *testing.T) {
+	var quickCfg = &quick.Config{MaxCountScale: 10}
+	if testing.Short() {
+		quickCfg = nil
+	}
+
+	f := func(m1 DownloadProgressMessage) bool {
+		return testMarshal(t, "downloadprogress", &m1, &DownloadProgressMessage{})
+	}
+
+	if err := quick.Check(f, quickCfg); err != nil {
+		t.Error(err)
+	}
+}
+
 type message interface {
 	EncodeXDR(io.Writer) (int, error)
 	DecodeXDR(io.Reader) error
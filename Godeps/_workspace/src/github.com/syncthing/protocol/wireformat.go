@@ -12,6 +12,10 @@ type wireFormatConnection struct {
 	next Connection
 }
 
+func (c wireFormatConnection) Start() {
+	c.next.Start()
+}
+
 func (c wireFormatConnection) ID() DeviceID {
 	return c.next.ID()
 }
@@ -51,6 +55,25 @@ func (c wireFormatConnection) ClusterConfig(config ClusterConfigMessage) {
 	c.next.ClusterConfig(config)
 }
 
+func (c wireFormatConnection) DownloadProgress(folder string, updates []FileDownloadProgressUpdate, flags uint32, options []Option) {
+	var myUpdates = make([]FileDownloadProgressUpdate, len(updates))
+	copy(myUpdates, updates)
+
+	for i := range updates {
+		myUpdates[i].Name = norm.NFC.String(filepath.ToSlash(myUpdates[i].Name))
+	}
+
+	c.next.DownloadProgress(folder, myUpdates, flags, options)
+}
+
 func (c wireFormatConnection) Statistics() Statistics {
 	return c.next.Statistics()
 }
+
+func (c wireFormatConnection) Closed() bool {
+	return c.next.Closed()
+}
+
+func (c wireFormatConnection) Close(err error) {
+	c.next.Close(err)
+}
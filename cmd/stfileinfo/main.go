@@ -21,6 +21,7 @@ func main() {
 	log.SetOutput(os.Stdout)
 
 	standardBlocks := flag.Bool("s", false, "Use standard block size")
+	chunkedBlocks := flag.Bool("c", false, "Use content defined chunking")
 	flag.Parse()
 
 	path := flag.Arg(0)
@@ -68,7 +69,12 @@ func main() {
 		if *standardBlocks || blockSize < protocol.BlockSize {
 			blockSize = protocol.BlockSize
 		}
-		bs, err := scanner.Blocks(fd, blockSize, fi.Size())
+		var bs []protocol.BlockInfo
+		if *chunkedBlocks {
+			bs, err = scanner.ChunkedBlocks(fd, fi.Size())
+		} else {
+			bs, err = scanner.Blocks(fd, blockSize, fi.Size())
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
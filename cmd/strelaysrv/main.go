@@ -0,0 +1,126 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Command strelaysrv runs a relay server, through which devices that can't
+// connect to each other directly can still set up a connection.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/relay"
+)
+
+const tlsRSABits = 3072
+
+func main() {
+	log.SetFlags(log.LstdFlags)
+
+	var listen, keys string
+	flag.StringVar(&listen, "listen", ":22067", "Listen address")
+	flag.StringVar(&keys, "keys", ".", "Directory for cert.pem and key.pem")
+	flag.Parse()
+
+	certFile := filepath.Join(keys, "cert.pem")
+	keyFile := filepath.Join(keys, "key.pem")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		log.Println("Generating certificate:", certFile)
+		cert, err = newCertificate(certFile, keyFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	tlsCfg := &tls.Config{
+		Certificates:           []tls.Certificate{cert},
+		NextProtos:             []string{relay.ProtocolName},
+		ClientAuth:             tls.RequestClientCert,
+		SessionTicketsDisabled: true,
+		InsecureSkipVerify:     true,
+		MinVersion:             tls.VersionTLS12,
+	}
+
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	id := protocol.NewDeviceID(cert.Certificate[0])
+	log.Printf("Relay ID %s listening on %s", id, listener.Addr())
+	log.Printf("URI: relay://%s/?id=%s", listener.Addr(), id)
+
+	log.Fatalln(relay.NewServer(tlsCfg).Serve(listener))
+}
+
+func newCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, tlsRSABits)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: "strelaysrv",
+		},
+		NotBefore: time.Now(),
+		NotAfter:  time.Date(2049, 12, 31, 23, 59, 59, 0, time.UTC),
+
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	certOut, err := os.Create(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
+		certOut.Close()
+		return tls.Certificate{}, err
+	}
+	if err := certOut.Close(); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyOut, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if err := pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}); err != nil {
+		keyOut.Close()
+		return tls.Certificate{}, err
+	}
+	if err := keyOut.Close(); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.LoadX509KeyPair(certFile, keyFile)
+}
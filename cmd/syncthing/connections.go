@@ -11,27 +11,242 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/url"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/model"
 )
 
-func listenConnect(myID protocol.DeviceID, m *model.Model, tlsCfg *tls.Config) {
-	var conns = make(chan *tls.Conn)
+// A dialer sets up a TLS connection to the device at the given address.
+type dialer func(deviceID protocol.DeviceID, uri *url.URL, tlsCfg *tls.Config) (*tls.Conn, error)
 
-	// Listen
-	for _, addr := range cfg.Options().ListenAddress {
-		go listenTLS(conns, addr, tlsCfg)
+// A listener accepts connections on the given address and sends them on the
+// conns channel once the TLS handshake is done. It calls ready once it is
+// listening, and runs until the stop channel is closed, in which case it
+// returns nil, or until it fails.
+type listener func(uri *url.URL, tlsCfg *tls.Config, conns chan<- *tls.Conn, ready func(), stop <-chan struct{}) error
+
+var (
+	dialers   = make(map[string]dialer)
+	listeners = make(map[string]listener)
+)
+
+// registerTransport makes addresses with the given URL scheme usable for
+// dialing and listening.
+func registerTransport(scheme string, d dialer, l listener) {
+	dialers[scheme] = d
+	listeners[scheme] = l
+}
+
+// The connectionSvc listens on the configured addresses and relays, dials
+// out to the configured devices, and hands the resulting connections to the
+// model. Listeners are started and stopped as the configuration changes; a
+// listener that fails is retried, with the error visible in the meantime.
+type connectionSvc struct {
+	model  *model.Model
+	tlsCfg *tls.Config
+	conns  chan *tls.Conn
+
+	mut       sync.Mutex
+	listeners map[string]*listenerEntry // keyed by listen address
+	tcpAddrs  []string                  // the announced TCP listen addresses
+}
+
+type listenerEntry struct {
+	stop chan struct{}
+	err  error
+	up   bool // listening, or for a relay, reachable through it
+}
+
+// The status of a listener, as reported over the REST interface.
+type listenerStatus struct {
+	Error string `json:"error"` // empty when listening
+}
+
+func newConnectionSvc(m *model.Model, tlsCfg *tls.Config) *connectionSvc {
+	s := &connectionSvc{
+		model:     m,
+		tlsCfg:    tlsCfg,
+		conns:     make(chan *tls.Conn),
+		listeners: make(map[string]*listenerEntry),
+		tcpAddrs:  tcpListenAddresses(cfg.Options().ListenAddress),
+	}
+	s.Changed(cfg.Raw())
+	cfg.Subscribe(s)
+	return s
+}
+
+// Changed starts and stops the listeners to match the listen addresses and
+// relays in the configuration.
+func (s *connectionSvc) Changed(newCfg config.Configuration) error {
+	opts := newCfg.Options
+	wanted := make(map[string]struct{})
+	for _, addr := range append(opts.ListenAddress, opts.RelayServers...) {
+		wanted[addr] = struct{}{}
+	}
+
+	s.mut.Lock()
+	for addr, entry := range s.listeners {
+		if _, ok := wanted[addr]; !ok {
+			l.Infoln("Stopping listener on", addr)
+			if entry.stop != nil {
+				close(entry.stop)
+			}
+			delete(s.listeners, addr)
+		}
+	}
+	for addr := range wanted {
+		if _, ok := s.listeners[addr]; ok {
+			continue
+		}
+
+		entry := &listenerEntry{}
+		s.listeners[addr] = entry
+
+		uri, err := parseAddress(addr)
+		if err != nil {
+			l.Warnf("Bad listen address %q: %v", addr, err)
+			entry.err = err
+			continue
+		}
+		listen, ok := listeners[uri.Scheme]
+		if !ok {
+			l.Warnf("Unsupported transport %q in listen address %q", uri.Scheme, addr)
+			entry.err = fmt.Errorf("unsupported transport %q", uri.Scheme)
+			continue
+		}
+
+		entry.stop = make(chan struct{})
+		go s.runListener(addr, uri, listen, entry.stop)
+	}
+	s.mut.Unlock()
+
+	s.announce(opts)
+	return nil
+}
+
+// runListener runs the listener until it is stopped, restarting it after a
+// while when it fails.
+func (s *connectionSvc) runListener(addr string, uri *url.URL, listen listener, stop chan struct{}) {
+	ready := func() {
+		s.setListenerError(addr, stop, nil)
+	}
+	for {
+		err := listen(uri, s.tlsCfg, s.conns, ready, stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		if s.setListenerError(addr, stop, err) {
+			l.Warnf("Listening on %s: %v", addr, err)
+		} else if debugNet {
+			l.Debugf("listening on %s: %v", addr, err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Duration(cfg.Options().ReconnectIntervalS) * time.Second):
+		}
+	}
+}
+
+// setListenerError records the error state of the listener, unless it has
+// been stopped, and returns whether it changed.
+func (s *connectionSvc) setListenerError(addr string, stop chan struct{}, err error) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	entry, ok := s.listeners[addr]
+	if !ok || entry.stop != stop {
+		return false
 	}
+	changed := (entry.err == nil) != (err == nil) || err != nil && err.Error() != entry.err.Error()
+	entry.err = err
+	entry.up = err == nil
+	return changed
+}
+
+// ListenerStatus returns the status of each listener, keyed by listen
+// address.
+func (s *connectionSvc) ListenerStatus() map[string]listenerStatus {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	res := make(map[string]listenerStatus, len(s.listeners))
+	for addr, entry := range s.listeners {
+		var status listenerStatus
+		if entry.err != nil {
+			status.Error = entry.err.Error()
+		}
+		res[addr] = status
+	}
+	return res
+}
+
+// registeredRelays returns the relays we are currently reachable through.
+func (s *connectionSvc) registeredRelays() []string {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	var relays []string
+	for addr, entry := range s.listeners {
+		if entry.up && strings.HasPrefix(addr, "relay://") {
+			relays = append(relays, addr)
+		}
+	}
+	sort.Strings(relays)
+	return relays
+}
+
+// announce updates the addresses we announce through discovery when the TCP
+// listen addresses change. With UPnP the announced port is that of the port
+// mapping, which is set up at startup only.
+func (s *connectionSvc) announce(opts config.OptionsConfiguration) {
+	tcpAddrs := tcpListenAddresses(opts.ListenAddress)
+
+	s.mut.Lock()
+	changed := !reflect.DeepEqual(tcpAddrs, s.tcpAddrs)
+	s.tcpAddrs = tcpAddrs
+	s.mut.Unlock()
+
+	if !changed || opts.UPnPEnabled || discoverer == nil {
+		return
+	}
+
+	externalPort = listenPort(tcpAddrs)
+	discoverer.SetListenAddresses(tcpAddrs)
+	if opts.GlobalAnnEnabled {
+		discoverer.StartGlobal(globalAnnServers(opts), uint16(externalPort))
+	}
+}
+
+func (s *connectionSvc) serve() {
+	var dialed = make(chan *tls.Conn)
+	m := s.model
 
 	// Connect
-	go dialTLS(m, conns, tlsCfg)
+	go s.dialTLS(dialed)
 
 next:
-	for conn := range conns {
+	for {
+		var conn *tls.Conn
+		outgoing := false
+		select {
+		case conn = <-s.conns:
+		case conn = <-dialed:
+			outgoing = true
+		}
+
 		cs := conn.ConnectionState()
 
 		// We should have negotiated the next level protocol "bep/1.0" as part
@@ -63,20 +278,16 @@ next:
 			continue
 		}
 
-		// We should not already be connected to the other party. TODO: This
-		// could use some better handling. If the old connection is dead but
-		// hasn't timed out yet we may want to drop *that* connection and keep
-		// this one. But in case we are two devices connecting to each other
-		// in parallell we don't want to do that or we end up with no
-		// connections still established...
-		if m.ConnectedTo(remoteID) {
-			l.Infof("Connected to already connected device (%s)", remoteID)
-			conn.Close()
-			continue
-		}
-
 		for deviceID, deviceCfg := range cfg.Devices() {
 			if deviceID == remoteID {
+				if deviceCfg.Paused {
+					if debugNet {
+						l.Debugf("Connection from paused device %s at %s", remoteID, conn.RemoteAddr())
+					}
+					conn.Close()
+					continue next
+				}
+
 				// Verify the name on the certificate. By default we set it to
 				// "syncthing" when generating, but the user may have replaced
 				// the certificate and used another name.
@@ -94,34 +305,38 @@ next:
 					continue next
 				}
 
-				// If rate limiting is set, and based on the address we should
-				// limit the connection, then we wrap it in a limiter.
-
-				limit := shouldLimit(conn.RemoteAddr())
-
-				wr := io.Writer(conn)
-				if limit && writeRateLimit != nil {
-					wr = &limitedWriter{conn, writeRateLimit}
+				// If we already have all the connections we want to the
+				// other party, the new one may replace a stale one. It
+				// might also be that we are two devices connecting to each
+				// other in parallel, in which case both of us must keep the
+				// same connection.
+				if m.NumConnections(remoteID) >= m.WantedConnections(remoteID) && !m.ReplaceConnection(remoteID, outgoing) {
+					l.Infof("Connected to already connected device (%s)", remoteID)
+					conn.Close()
+					continue next
 				}
 
-				rd := io.Reader(conn)
-				if limit && readRateLimit != nil {
-					rd = &limitedReader{conn, readRateLimit}
-				}
+				// The connection is wrapped in a limiter, which applies the
+				// global and device rate limits as they are at the time.
+				// Connections in the LAN are normally not limited.
+
+				lan := isLAN(conn.RemoteAddr())
+				wr := &limitedWriter{conn, rateLimiter, remoteID, lan}
+				rd := &limitedReader{conn, rateLimiter, remoteID, lan}
 
 				name := fmt.Sprintf("%s-%s", conn.LocalAddr(), conn.RemoteAddr())
-				protoConn := protocol.NewConnection(remoteID, rd, wr, m, name, deviceCfg.Compression)
+				protoConn := protocol.NewConnection(remoteID, rd, wr, m, name, deviceCfg.Compression, deviceCfg.CompressionAlgorithm, deviceCfg.CompressionLevel)
 
 				l.Infof("Established secure connection to %s at %s", remoteID, name)
 				if debugNet {
-					l.Debugf("cipher suite: %04X in lan: %t", conn.ConnectionState().CipherSuite, !limit)
+					l.Debugf("cipher suite: %04X in lan: %t", conn.ConnectionState().CipherSuite, lan)
 				}
 				events.Default.Log(events.DeviceConnected, map[string]string{
 					"id":   remoteID.String(),
 					"addr": conn.RemoteAddr().String(),
 				})
 
-				m.AddConnection(conn, protoConn)
+				m.AddConnection(conn, protoConn, outgoing)
 				continue next
 			}
 		}
@@ -140,33 +355,31 @@ next:
 	}
 }
 
-func listenTLS(conns chan *tls.Conn, addr string, tlsCfg *tls.Config) {
-	if debugNet {
-		l.Debugln("listening on", addr)
-	}
-
-	tcaddr, err := net.ResolveTCPAddr("tcp", addr)
-	if err != nil {
-		l.Fatalln("listen (BEP):", err)
-	}
-	listener, err := net.ListenTCP("tcp", tcaddr)
-	if err != nil {
-		l.Fatalln("listen (BEP):", err)
-	}
+// acceptTLS accepts connections on the listener and runs the TLS handshake
+// on them, until the listener fails or is stopped. The listener is closed on
+// return.
+func acceptTLS(listener net.Listener, tlsCfg *tls.Config, conns chan<- *tls.Conn, stop <-chan struct{}) error {
+	defer listener.Close()
+	defer closeOnStop(listener, stop)()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			l.Warnln("Accepting connection:", err)
-			continue
+			select {
+			case <-stop:
+				return nil
+			default:
+				return err
+			}
 		}
 
 		if debugNet {
 			l.Debugln("connect from", conn.RemoteAddr())
 		}
 
-		tcpConn := conn.(*net.TCPConn)
-		setTCPOptions(tcpConn)
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			setTCPOptions(tcpConn)
+		}
 
 		tc := tls.Server(conn, tlsCfg)
 		err = tc.Handshake()
@@ -178,78 +391,79 @@ func listenTLS(conns chan *tls.Conn, addr string, tlsCfg *tls.Config) {
 
 		conns <- tc
 	}
+}
 
+// closeOnStop closes c when the stop channel is closed, until the returned
+// function is called.
+func closeOnStop(c io.Closer, stop <-chan struct{}) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
 }
 
-func dialTLS(m *model.Model, conns chan *tls.Conn, tlsCfg *tls.Config) {
+// dialTLS periodically tries to set up the connections we want to each of
+// the devices, at each of their addresses in turn.
+func (s *connectionSvc) dialTLS(conns chan<- *tls.Conn) {
 	delay := time.Second
 	for {
-	nextDevice:
+		ourRelays := s.registeredRelays()
 		for deviceID, deviceCfg := range cfg.Devices() {
-			if deviceID == myID {
+			if deviceID == myID || deviceCfg.Paused {
 				continue
 			}
 
-			if m.ConnectedTo(deviceID) {
+			missing := s.model.WantedConnections(deviceID) - s.model.NumConnections(deviceID)
+			if missing <= 0 {
 				continue
 			}
 
-			var addrs []string
-			for _, addr := range deviceCfg.Addresses {
-				if addr == "dynamic" {
-					if discoverer != nil {
-						t := discoverer.Lookup(deviceID)
-						if len(t) == 0 {
-							continue
-						}
-						addrs = append(addrs, t...)
-					}
-				} else {
-					addrs = append(addrs, addr)
+			lookup := func() []string {
+				if discoverer == nil {
+					return nil
 				}
+				return discoverer.Lookup(deviceID)
 			}
 
-			for _, addr := range addrs {
-				host, port, err := net.SplitHostPort(addr)
-				if err != nil && strings.HasPrefix(err.Error(), "missing port") {
-					// addr is on the form "1.2.3.4"
-					addr = net.JoinHostPort(addr, "22000")
-				} else if err == nil && port == "" {
-					// addr is on the form "1.2.3.4:"
-					addr = net.JoinHostPort(host, "22000")
-				}
-				if debugNet {
-					l.Debugln("dial", deviceCfg.DeviceID, addr)
+			for _, addr := range dialAddresses(deviceCfg.Addresses, lookup, ourRelays) {
+				if missing <= 0 {
+					break
 				}
 
-				raddr, err := net.ResolveTCPAddr("tcp", addr)
+				uri, err := parseAddress(addr)
 				if err != nil {
-					if debugNet {
-						l.Debugln(err)
-					}
+					l.Infof("Bad address %q for device %v: %v", addr, deviceID, err)
 					continue
 				}
-
-				conn, err := net.DialTCP("tcp", nil, raddr)
-				if err != nil {
-					if debugNet {
-						l.Debugln(err)
-					}
+				dial, ok := dialers[uri.Scheme]
+				if !ok {
+					l.Infof("Unsupported transport %q in address %q for device %v", uri.Scheme, addr, deviceID)
 					continue
 				}
 
-				setTCPOptions(conn)
-
-				tc := tls.Client(conn, tlsCfg)
-				err = tc.Handshake()
-				if err != nil {
-					l.Infoln("TLS handshake:", err)
-					tc.Close()
-					continue
+				if debugNet {
+					l.Debugln("dial", deviceCfg.DeviceID, uri)
 				}
 
-				conns <- tc
-				continue nextDevice
+				// All the connections go to the first address that works.
+				for ; missing > 0; missing-- {
+					tc, err := dial(deviceID, uri, s.tlsCfg)
+					if err != nil {
+						if debugNet {
+							l.Debugln(err)
+						}
+						break
+					}
+
+					conns <- tc
+				}
 			}
 		}
 
@@ -261,6 +475,87 @@ func dialTLS(m *model.Model, conns chan *tls.Conn, tlsCfg *tls.Config) {
 	}
 }
 
+// dialAddresses returns the addresses to dial a device at, given its
+// configured addresses, a lookup of its dynamic addresses and the relays we
+// are reachable through. Relays are only used when we can't connect
+// directly, so they come last. Only the relays the device advertises are
+// used or, failing those, the ones we are registered at, as the device may
+// be using them as well.
+func dialAddresses(addrs []string, lookup func() []string, ourRelays []string) []string {
+	var direct, relayed []string
+	add := func(addr string) {
+		if strings.HasPrefix(addr, "relay://") {
+			relayed = append(relayed, addr)
+		} else {
+			direct = append(direct, addr)
+		}
+	}
+	for _, addr := range addrs {
+		if addr == "dynamic" {
+			for _, addr := range lookup() {
+				add(addr)
+			}
+		} else {
+			add(addr)
+		}
+	}
+	if len(relayed) == 0 {
+		relayed = ourRelays
+	}
+
+	var res []string
+	seen := make(map[string]bool)
+	for _, addr := range append(direct, relayed...) {
+		if !seen[addr] {
+			seen[addr] = true
+			res = append(res, addr)
+		}
+	}
+	return res
+}
+
+// parseAddress parses a listen or device address. Addresses without a
+// scheme are TCP addresses, as that was all there was before transports
+// were introduced.
+func parseAddress(addr string) (*url.URL, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "tcp://" + addr
+	}
+	return url.Parse(addr)
+}
+
+// tcpListenAddresses returns the host:port part of the TCP addresses among
+// the given listen addresses. Those are the ones that can be announced and
+// port mapped.
+func tcpListenAddresses(addrs []string) []string {
+	var tcpAddrs []string
+	for _, addr := range addrs {
+		uri, err := parseAddress(addr)
+		if err != nil {
+			continue
+		}
+		switch uri.Scheme {
+		case "tcp", "tcp4", "tcp6":
+			tcpAddrs = append(tcpAddrs, uri.Host)
+		}
+	}
+	return tcpAddrs
+}
+
+// listenPort returns the port of the first of the given TCP listen
+// addresses, or zero if there is none.
+func listenPort(tcpAddrs []string) int {
+	if len(tcpAddrs) == 0 {
+		return 0
+	}
+	addr, err := net.ResolveTCPAddr("tcp", tcpAddrs[0])
+	if err != nil {
+		l.Infoln("Bad listen address:", err)
+		return 0
+	}
+	return addr.Port
+}
+
 func setTCPOptions(conn *net.TCPConn) {
 	var err error
 	if err = conn.SetLinger(0); err != nil {
@@ -277,19 +572,20 @@ func setTCPOptions(conn *net.TCPConn) {
 	}
 }
 
-func shouldLimit(addr net.Addr) bool {
-	if cfg.Options().LimitBandwidthInLan {
+func isLAN(addr net.Addr) bool {
+	if _, ok := addr.(*net.UnixAddr); ok {
+		// Unix sockets are always local
 		return true
 	}
 
 	tcpaddr, ok := addr.(*net.TCPAddr)
 	if !ok {
-		return true
+		return false
 	}
 	for _, lan := range lans {
 		if lan.Contains(tcpaddr.IP) {
-			return false
+			return true
 		}
 	}
-	return !tcpaddr.IP.IsLoopback()
+	return tcpaddr.IP.IsLoopback()
 }
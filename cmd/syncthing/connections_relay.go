@@ -0,0 +1,91 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/relay"
+)
+
+func init() {
+	registerTransport("relay", dialRelay, listenRelay)
+}
+
+// listenRelay keeps us reachable through the relay, and sets up connections
+// for the sessions other devices invite us to through it.
+func listenRelay(uri *url.URL, tlsCfg *tls.Config, conns chan<- *tls.Conn, ready func(), stop <-chan struct{}) error {
+	client, err := relay.Join(uri, tlsCfg)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	defer closeOnStop(client, stop)()
+
+	l.Infoln("Reachable through relay", uri)
+	ready()
+
+	for {
+		inv, err := client.Receive()
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+				return fmt.Errorf("lost connection to relay: %v", err)
+			}
+		}
+
+		if debugNet {
+			l.Debugln("relay invitation from", protocol.DeviceIDFromBytes(inv.From), "via", uri)
+		}
+
+		go func() {
+			tc, err := relaySession(uri, inv, tlsCfg)
+			if err != nil {
+				l.Infoln("Relay session:", err)
+				return
+			}
+			conns <- tc
+		}()
+	}
+}
+
+// dialRelay sets up a connection to the device through the relay.
+func dialRelay(deviceID protocol.DeviceID, uri *url.URL, tlsCfg *tls.Config) (*tls.Conn, error) {
+	inv, err := relay.GetInvitation(uri, tlsCfg, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	return relaySession(uri, inv, tlsCfg)
+}
+
+// relaySession joins the relay session and runs the TLS handshake with the
+// device at the other end over it.
+func relaySession(uri *url.URL, inv relay.SessionInvitation, tlsCfg *tls.Config) (*tls.Conn, error) {
+	conn, err := relay.JoinSession(uri, tlsCfg, inv)
+	if err != nil {
+		return nil, err
+	}
+
+	var tc *tls.Conn
+	if inv.ServerSocket {
+		tc = tls.Server(conn, tlsCfg)
+	} else {
+		tc = tls.Client(conn, tlsCfg)
+	}
+	if err := tc.Handshake(); err != nil {
+		tc.Close()
+		return nil, err
+	}
+
+	return tc, nil
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/proxy"
+)
+
+func init() {
+	// The scheme doubles as the network name, so tcp4 and tcp6 addresses
+	// are restricted to that address family.
+	for _, network := range []string{"tcp", "tcp4", "tcp6"} {
+		registerTransport(network, dialTCP, listenTCP)
+	}
+}
+
+func listenTCP(uri *url.URL, tlsCfg *tls.Config, conns chan<- *tls.Conn, ready func(), stop <-chan struct{}) error {
+	if debugNet {
+		l.Debugln("listening on", uri)
+	}
+
+	tcaddr, err := net.ResolveTCPAddr(uri.Scheme, uri.Host)
+	if err != nil {
+		return err
+	}
+	listener, err := net.ListenTCP(uri.Scheme, tcaddr)
+	if err != nil {
+		return err
+	}
+
+	ready()
+	return acceptTLS(listener, tlsCfg, conns, stop)
+}
+
+func dialTCP(deviceID protocol.DeviceID, uri *url.URL, tlsCfg *tls.Config) (*tls.Conn, error) {
+	addr := uri.Host
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil && strings.HasPrefix(err.Error(), "missing port") {
+		// addr is on the form "1.2.3.4"
+		addr = net.JoinHostPort(addr, "22000")
+	} else if err == nil && port == "" {
+		// addr is on the form "1.2.3.4:"
+		addr = net.JoinHostPort(host, "22000")
+	}
+
+	proxyURL, err := deviceProxy(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	if proxyURL != nil {
+		// The proxy resolves the address, as we may not be able to.
+		conn, err = proxy.Dial(proxyURL, uri.Scheme, addr)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		raddr, err := net.ResolveTCPAddr(uri.Scheme, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		tcpConn, err := net.DialTCP(uri.Scheme, nil, raddr)
+		if err != nil {
+			return nil, err
+		}
+
+		setTCPOptions(tcpConn)
+		conn = tcpConn
+	}
+
+	tc := tls.Client(conn, tlsCfg)
+	err = tc.Handshake()
+	if err != nil {
+		l.Infoln("TLS handshake:", err)
+		tc.Close()
+		return nil, err
+	}
+
+	return tc, nil
+}
@@ -0,0 +1,235 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+func TestParseAddress(t *testing.T) {
+	cases := []struct {
+		addr   string
+		scheme string
+		host   string
+		path   string
+	}{
+		{"1.2.3.4:22000", "tcp", "1.2.3.4:22000", ""},
+		{"[2001:db8::1]:22000", "tcp", "[2001:db8::1]:22000", ""},
+		{"tcp://1.2.3.4:22000", "tcp", "1.2.3.4:22000", ""},
+		{"tcp4://0.0.0.0:22000", "tcp4", "0.0.0.0:22000", ""},
+		{"tcp6://[::]:22000", "tcp6", "[::]:22000", ""},
+		{"unix:///run/syncthing.sock", "unix", "", "/run/syncthing.sock"},
+		{"relay://relay.example.com:22067", "relay", "relay.example.com:22067", ""},
+	}
+
+	for _, tc := range cases {
+		uri, err := parseAddress(tc.addr)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", tc.addr, err)
+			continue
+		}
+		if uri.Scheme != tc.scheme || uri.Host != tc.host || uri.Path != tc.path {
+			t.Errorf("Incorrect parse of %q: %q %q %q", tc.addr, uri.Scheme, uri.Host, uri.Path)
+		}
+		if _, ok := dialers[uri.Scheme]; !ok {
+			t.Errorf("No dialer for %q", uri.Scheme)
+		}
+		if _, ok := listeners[uri.Scheme]; !ok {
+			t.Errorf("No listener for %q", uri.Scheme)
+		}
+	}
+}
+
+func TestTCPListenAddresses(t *testing.T) {
+	addrs := tcpListenAddresses([]string{
+		"0.0.0.0:22000",
+		"tcp6://[::]:22001",
+		"unix:///run/syncthing.sock",
+		"relay://relay.example.com:22067",
+	})
+	if exp := []string{"0.0.0.0:22000", "[::]:22001"}; !reflect.DeepEqual(addrs, exp) {
+		t.Errorf("Incorrect TCP addresses %v != %v", addrs, exp)
+	}
+}
+
+func TestDialAddresses(t *testing.T) {
+	lookup := func() []string {
+		return []string{"192.0.2.1:22000", "relay://relay2.example.com:22067"}
+	}
+	ours := []string{"relay://relay1.example.com:22067", "relay://relay3.example.com:22067"}
+
+	cases := []struct {
+		addrs    []string
+		expected []string
+	}{
+		// Only the relays the device advertises are used, after the direct
+		// addresses.
+		{
+			[]string{"relay://relay1.example.com:22067", "192.0.2.2:22000", "dynamic"},
+			[]string{"192.0.2.2:22000", "192.0.2.1:22000", "relay://relay1.example.com:22067", "relay://relay2.example.com:22067"},
+		},
+		// Without relays of its own, the device may be using ours.
+		{
+			[]string{"192.0.2.2:22000"},
+			[]string{"192.0.2.2:22000", "relay://relay1.example.com:22067", "relay://relay3.example.com:22067"},
+		},
+		// Addresses are dialed only once.
+		{
+			[]string{"dynamic", "192.0.2.1:22000", "relay://relay2.example.com:22067"},
+			[]string{"192.0.2.1:22000", "relay://relay2.example.com:22067"},
+		},
+	}
+
+	for _, tc := range cases {
+		if addrs := dialAddresses(tc.addrs, lookup, ours); !reflect.DeepEqual(addrs, tc.expected) {
+			t.Errorf("dialAddresses(%v) = %v, expected %v", tc.addrs, addrs, tc.expected)
+		}
+	}
+}
+
+func TestRegisteredRelays(t *testing.T) {
+	s := &connectionSvc{
+		listeners: map[string]*listenerEntry{
+			"relay://b.example.com:22067": {up: true},
+			"relay://a.example.com:22067": {up: true},
+			"relay://c.example.com:22067": {err: errors.New("connection refused")},
+			"relay://d.example.com:22067": {},
+			"tcp://0.0.0.0:22000":         {up: true},
+		},
+	}
+
+	expected := []string{"relay://a.example.com:22067", "relay://b.example.com:22067"}
+	if relays := s.registeredRelays(); !reflect.DeepEqual(relays, expected) {
+		t.Errorf("Registered relays %v, expected %v", relays, expected)
+	}
+}
+
+func TestUnixTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, err := newCertificate(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), tlsDefaultCommonName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsCfg := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		ClientAuth:         tls.RequestClientCert,
+		InsecureSkipVerify: true,
+	}
+
+	uri, err := parseAddress("unix://" + filepath.Join(dir, "bep.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := make(chan *tls.Conn, 1)
+	ready := make(chan struct{})
+	stop := make(chan struct{})
+	stopped := make(chan error)
+	go func() {
+		stopped <- listenUnix(uri, tlsCfg, conns, func() { close(ready) }, stop)
+	}()
+	<-ready
+
+	// The listener may not be up yet
+	var tc *tls.Conn
+	for i := 0; i < 50; i++ {
+		if tc, err = dialUnix(protocol.LocalDeviceID, uri, tlsCfg); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+
+	sc := <-conns
+	defer sc.Close()
+	if certs := sc.ConnectionState().PeerCertificates; len(certs) != 1 {
+		t.Errorf("Incorrect number of peer certificates %d != 1", len(certs))
+	}
+
+	close(stop)
+	if err := <-stopped; err != nil {
+		t.Error("Unexpected error from stopped listener:", err)
+	}
+}
+
+func TestListenerReconfiguration(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := busy.Addr().String()
+
+	raw := config.New(protocol.LocalDeviceID)
+	raw.Options.ListenAddress = []string{addr, "bogus://foo"}
+	raw.Options.ReconnectIntervalS = 1
+	raw.Options.UPnPEnabled = false
+	cfg = config.Wrap("/tmp/test", raw)
+	s := newConnectionSvc(nil, &tls.Config{})
+
+	waitFor := func(what string, fn func(map[string]listenerStatus) bool) {
+		for i := 0; i < 300; i++ {
+			if fn(s.ListenerStatus()) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Timed out waiting for %s; status %v", what, s.ListenerStatus())
+	}
+
+	// The address is in use, so the listener fails and reports so, without
+	// taking anything else down.
+	waitFor("bind error", func(st map[string]listenerStatus) bool {
+		return st[addr].Error != ""
+	})
+	if st := s.ListenerStatus()["bogus://foo"]; st.Error == "" {
+		t.Error("Expected an error for an unsupported transport")
+	}
+
+	// Once the address is free, the retry succeeds.
+	busy.Close()
+	waitFor("listener to recover", func(st map[string]listenerStatus) bool {
+		e, ok := st[addr]
+		return ok && e.Error == ""
+	})
+
+	// Removing the address stops the listener and frees the address.
+	raw.Options.ListenAddress = []string{}
+	s.Changed(raw)
+	if st := s.ListenerStatus(); len(st) != 0 {
+		t.Errorf("Unexpected listeners %v", st)
+	}
+	for i := 0; ; i++ {
+		busy, err = net.Listen("tcp", addr)
+		if err == nil {
+			busy.Close()
+			break
+		}
+		if i == 300 {
+			t.Fatal("Listener not stopped:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
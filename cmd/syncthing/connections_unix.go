@@ -0,0 +1,58 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"os"
+
+	"github.com/syncthing/protocol"
+)
+
+func init() {
+	registerTransport("unix", dialUnix, listenUnix)
+}
+
+// The socket path is the path of the URL, as in unix:///run/syncthing.sock.
+
+func listenUnix(uri *url.URL, tlsCfg *tls.Config, conns chan<- *tls.Conn, ready func(), stop <-chan struct{}) error {
+	if debugNet {
+		l.Debugln("listening on", uri)
+	}
+
+	// A socket left behind by an earlier run would make the listen fail.
+	if fi, err := os.Lstat(uri.Path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(uri.Path)
+	}
+
+	listener, err := net.Listen("unix", uri.Path)
+	if err != nil {
+		return err
+	}
+
+	ready()
+	return acceptTLS(listener, tlsCfg, conns, stop)
+}
+
+func dialUnix(deviceID protocol.DeviceID, uri *url.URL, tlsCfg *tls.Config) (*tls.Conn, error) {
+	conn, err := net.Dial("unix", uri.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := tls.Client(conn, tlsCfg)
+	err = tc.Handshake()
+	if err != nil {
+		l.Infoln("TLS handshake:", err)
+		tc.Close()
+		return nil, err
+	}
+
+	return tc, nil
+}
@@ -111,10 +111,14 @@ func startGUI(cfg config.GUIConfiguration, assetDir string, m *model.Model) erro
 	// The GET handlers
 	getRestMux := http.NewServeMux()
 	getRestMux.HandleFunc("/rest/db/completion", withModel(m, restGetDBCompletion))           // device folder
+	getRestMux.HandleFunc("/rest/db/conflicts", withModel(m, restGetDBConflicts))             // folder
+	getRestMux.HandleFunc("/rest/db/errors", withModel(m, restGetDBErrors))                   // folder
 	getRestMux.HandleFunc("/rest/db/file", withModel(m, restGetDBFile))                       // folder file [blocks]
 	getRestMux.HandleFunc("/rest/db/ignores", withModel(m, restGetDBIgnores))                 // folder
+	getRestMux.HandleFunc("/rest/db/localchanged", withModel(m, restGetDBLocalChanged))       // folder
 	getRestMux.HandleFunc("/rest/db/need", withModel(m, restGetDBNeed))                       // folder
 	getRestMux.HandleFunc("/rest/db/status", withModel(m, restGetDBStatus))                   // folder
+	getRestMux.HandleFunc("/rest/db/subscriptions", withModel(m, restGetDBSubscriptions))     // folder
 	getRestMux.HandleFunc("/rest/db/browse", withModel(m, restGetDBBrowse))                   // folder [prefix] [dirsonly] [levels]
 	getRestMux.HandleFunc("/rest/events", restGetEvents)                                      // since [limit]
 	getRestMux.HandleFunc("/rest/stats/device", withModel(m, restGetDeviceStats))             // -
@@ -135,19 +139,24 @@ func startGUI(cfg config.GUIConfiguration, assetDir string, m *model.Model) erro
 
 	// The POST handlers
 	postRestMux := http.NewServeMux()
-	postRestMux.HandleFunc("/rest/db/prio", withModel(m, restPostDBPrio))             // folder file
-	postRestMux.HandleFunc("/rest/db/ignores", withModel(m, restPostDBIgnores))       // folder
-	postRestMux.HandleFunc("/rest/db/override", withModel(m, restPostDBOverride))     // folder
-	postRestMux.HandleFunc("/rest/db/scan", withModel(m, restPostDBScan))             // folder [sub...]
-	postRestMux.HandleFunc("/rest/system/config", withModel(m, restPostSystemConfig)) // <body>
-	postRestMux.HandleFunc("/rest/system/discovery", restPostSystemDiscovery)         // device addr
-	postRestMux.HandleFunc("/rest/system/error", restPostSystemError)                 // <body>
-	postRestMux.HandleFunc("/rest/system/error/clear", restPostSystemErrorClear)      // -
-	postRestMux.HandleFunc("/rest/system/ping", restPing)                             // -
-	postRestMux.HandleFunc("/rest/system/reset", withModel(m, restPostSystemReset))   // [folder]
-	postRestMux.HandleFunc("/rest/system/restart", restPostSystemRestart)             // -
-	postRestMux.HandleFunc("/rest/system/shutdown", restPostSystemShutdown)           // -
-	postRestMux.HandleFunc("/rest/system/upgrade", restPostSystemUpgrade)             // -
+	postRestMux.HandleFunc("/rest/db/conflicts", withModel(m, restPostDBConflicts))         // folder conflict keep
+	postRestMux.HandleFunc("/rest/db/prio", withModel(m, restPostDBPrio))                   // folder file
+	postRestMux.HandleFunc("/rest/db/ignores", withModel(m, restPostDBIgnores))             // folder
+	postRestMux.HandleFunc("/rest/db/override", withModel(m, restPostDBOverride))           // folder
+	postRestMux.HandleFunc("/rest/db/revert", withModel(m, restPostDBRevert))               // folder
+	postRestMux.HandleFunc("/rest/db/scan", withModel(m, restPostDBScan))                   // folder [sub...]
+	postRestMux.HandleFunc("/rest/db/subscriptions", withModel(m, restPostDBSubscriptions)) // folder
+	postRestMux.HandleFunc("/rest/system/config", withModel(m, restPostSystemConfig))       // <body>
+	postRestMux.HandleFunc("/rest/system/discovery", restPostSystemDiscovery)               // device addr
+	postRestMux.HandleFunc("/rest/system/error", restPostSystemError)                       // <body>
+	postRestMux.HandleFunc("/rest/system/error/clear", restPostSystemErrorClear)            // -
+	postRestMux.HandleFunc("/rest/system/pause", withModel(m, restPostSystemPause))         // folder | device
+	postRestMux.HandleFunc("/rest/system/ping", restPing)                                   // -
+	postRestMux.HandleFunc("/rest/system/reset", withModel(m, restPostSystemReset))         // [folder]
+	postRestMux.HandleFunc("/rest/system/resume", withModel(m, restPostSystemResume))       // folder | device
+	postRestMux.HandleFunc("/rest/system/restart", restPostSystemRestart)                   // -
+	postRestMux.HandleFunc("/rest/system/shutdown", restPostSystemShutdown)                 // -
+	postRestMux.HandleFunc("/rest/system/upgrade", restPostSystemUpgrade)                   // -
 
 	// Debug endpoints, not for general use
 	getRestMux.HandleFunc("/rest/debug/peerCompletion", withModel(m, restGetPeerCompletion))
@@ -375,6 +384,43 @@ func restPostDBOverride(m *model.Model, w http.ResponseWriter, r *http.Request)
 	go m.Override(folder)
 }
 
+func restGetDBConflicts(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+
+	conflicts := m.Conflicts(folder)
+	if conflicts == nil {
+		conflicts = []db.Conflict{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(conflicts)
+}
+
+func restPostDBConflicts(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	err := m.ResolveConflict(qs.Get("folder"), qs.Get("conflict"), qs.Get("keep"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+func restPostDBRevert(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+	go m.Revert(folder)
+}
+
+func restGetDBLocalChanged(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+
+	files := m.LocalChangedFiles(folder)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string][]map[string]interface{}{
+		"files": toNeedSlice(files),
+	})
+}
+
 func restGetDBNeed(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	var qs = r.URL.Query()
 	var folder = qs.Get("folder")
@@ -391,6 +437,23 @@ func restGetDBNeed(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(output)
 }
 
+func restGetDBErrors(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	var qs = r.URL.Query()
+	var folder = qs.Get("folder")
+
+	errs, err := m.FolderErrors(folder)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"folder": folder,
+		"errors": errs,
+	})
+}
+
 func restGetSystemConnections(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	var res = m.ConnectionStats()
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -487,6 +550,41 @@ func RestGetSystemConfigInsync(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]bool{"configInSync": configInSync})
 }
 
+func restPostSystemPause(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	setPaused(m, w, r, true)
+}
+
+func restPostSystemResume(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	setPaused(m, w, r, false)
+}
+
+func setPaused(m *model.Model, w http.ResponseWriter, r *http.Request, paused bool) {
+	var qs = r.URL.Query()
+
+	var err error
+	if folder := qs.Get("folder"); folder != "" {
+		if paused {
+			err = m.PauseFolder(folder)
+		} else {
+			err = m.ResumeFolder(folder)
+		}
+	} else {
+		var device protocol.DeviceID
+		device, err = protocol.DeviceIDFromString(qs.Get("device"))
+		if err == nil {
+			if paused {
+				err = m.PauseDevice(device)
+			} else {
+				err = m.ResumeDevice(device)
+			}
+		}
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
 func restPostSystemRestart(w http.ResponseWriter, r *http.Request) {
 	flushResponse(`{"ok": "restarting"}`, w)
 	go restart()
@@ -541,6 +639,9 @@ func restGetSystemStatus(w http.ResponseWriter, r *http.Request) {
 	if cfg.Options().GlobalAnnEnabled && discoverer != nil {
 		res["extAnnounceOK"] = discoverer.ExtAnnounceOK()
 	}
+	if connSvc != nil {
+		res["listeners"] = connSvc.ListenerStatus()
+	}
 	cpuUsageLock.RLock()
 	var cpusum float64
 	for _, p := range cpuUsagePercent {
@@ -650,6 +751,42 @@ func restPostDBIgnores(m *model.Model, w http.ResponseWriter, r *http.Request) {
 	restGetDBIgnores(m, w, r)
 }
 
+func restGetDBSubscriptions(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	subs, err := m.Subscriptions(qs.Get("folder"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string][]string{
+		"subscriptions": subs,
+	})
+}
+
+func restPostDBSubscriptions(m *model.Model, w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	var data map[string][]string
+	err := json.NewDecoder(r.Body).Decode(&data)
+	r.Body.Close()
+
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	err = m.SetSubscriptions(qs.Get("folder"), data["subscriptions"])
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	restGetDBSubscriptions(m, w, r)
+}
+
 func restGetEvents(w http.ResponseWriter, r *http.Request) {
 	qs := r.URL.Query()
 	sinceStr := qs.Get("since")
@@ -9,18 +9,24 @@ package main
 import (
 	"io"
 
-	"github.com/juju/ratelimit"
+	"github.com/syncthing/protocol"
 )
 
 type limitedReader struct {
-	r      io.Reader
-	bucket *ratelimit.Bucket
+	r       io.Reader
+	limiter *limiter
+	device  protocol.DeviceID
+	lan     bool
 }
 
 func (r *limitedReader) Read(buf []byte) (int, error) {
 	n, err := r.r.Read(buf)
-	if r.bucket != nil {
-		r.bucket.Wait(int64(n))
+	device, global := r.limiter.readBuckets(r.device, r.lan)
+	if device != nil {
+		device.Wait(int64(n))
+	}
+	if global != nil {
+		global.Wait(int64(n))
 	}
 	return n, err
 }
@@ -9,17 +9,23 @@ package main
 import (
 	"io"
 
-	"github.com/juju/ratelimit"
+	"github.com/syncthing/protocol"
 )
 
 type limitedWriter struct {
-	w      io.Writer
-	bucket *ratelimit.Bucket
+	w       io.Writer
+	limiter *limiter
+	device  protocol.DeviceID
+	lan     bool
 }
 
 func (w *limitedWriter) Write(buf []byte) (int, error) {
-	if w.bucket != nil {
-		w.bucket.Wait(int64(len(buf)))
+	device, global := w.limiter.writeBuckets(w.device, w.lan)
+	if device != nil {
+		device.Wait(int64(len(buf)))
+	}
+	if global != nil {
+		global.Wait(int64(len(buf)))
 	}
 	return w.w.Write(buf)
 }
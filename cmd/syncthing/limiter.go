@@ -0,0 +1,136 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+// How often the bandwidth schedules are checked for a change of limits.
+const limiterCheckInterval = time.Minute
+
+// A limiter holds the rate limiting buckets for the connections; one pair
+// shared by all devices for the global limits, and nested inside those a
+// pair for each device with limits of its own. The buckets follow the
+// configuration and the bandwidth schedules, so changes take effect on
+// connections that are already established.
+type limiter struct {
+	mut      sync.Mutex
+	cfg      config.Configuration
+	limitLAN bool
+	global   bucketPair
+	devices  map[protocol.DeviceID]bucketPair
+}
+
+// A bucketPair holds the send and receive buckets for a set of limits in
+// kbps. A nil bucket means there is no limit.
+type bucketPair struct {
+	sendKbps, recvKbps int
+	write, read        *ratelimit.Bucket
+}
+
+func newLimiter(cfg *config.Wrapper) *limiter {
+	lim := &limiter{
+		devices: make(map[protocol.DeviceID]bucketPair),
+	}
+	lim.Changed(cfg.Raw())
+	cfg.Subscribe(lim)
+	return lim
+}
+
+// Changed updates the limits to those of the new configuration.
+func (lim *limiter) Changed(cfg config.Configuration) error {
+	lim.mut.Lock()
+	lim.cfg = cfg
+	lim.update(time.Now())
+	lim.mut.Unlock()
+	return nil
+}
+
+// serve applies the bandwidth schedules as time goes by.
+func (lim *limiter) serve() {
+	for t := range time.NewTicker(limiterCheckInterval).C {
+		lim.mut.Lock()
+		lim.update(t)
+		lim.mut.Unlock()
+	}
+}
+
+// update sets the buckets to the limits in effect at the given time. Buckets
+// whose limits are unchanged are kept, so they remember what has been used
+// of them. Requires lim.mut to be held.
+func (lim *limiter) update(t time.Time) {
+	lim.limitLAN = lim.cfg.Options.LimitBandwidthInLan
+	lim.global = lim.global.withLimits(lim.cfg.Options.CurrentLimits(t))
+	if debugNet {
+		l.Debugf("limiter: global limits %d/%d kbps", lim.global.sendKbps, lim.global.recvKbps)
+	}
+
+	seen := make(map[protocol.DeviceID]struct{}, len(lim.cfg.Devices))
+	for _, dev := range lim.cfg.Devices {
+		seen[dev.DeviceID] = struct{}{}
+		old := lim.devices[dev.DeviceID]
+		cur := old.withLimits(dev.CurrentLimits(t))
+		if debugNet && cur != old {
+			l.Debugf("limiter: limits for %s %d/%d kbps", dev.DeviceID, cur.sendKbps, cur.recvKbps)
+		}
+		lim.devices[dev.DeviceID] = cur
+	}
+	for id := range lim.devices {
+		if _, ok := seen[id]; !ok {
+			delete(lim.devices, id)
+		}
+	}
+}
+
+// writeBuckets returns the device and global buckets to wait on for sending
+// to the device; either may be nil.
+func (lim *limiter) writeBuckets(device protocol.DeviceID, lan bool) (*ratelimit.Bucket, *ratelimit.Bucket) {
+	lim.mut.Lock()
+	defer lim.mut.Unlock()
+	if lan && !lim.limitLAN {
+		return nil, nil
+	}
+	return lim.devices[device].write, lim.global.write
+}
+
+// readBuckets returns the device and global buckets to wait on for
+// receiving from the device; either may be nil.
+func (lim *limiter) readBuckets(device protocol.DeviceID, lan bool) (*ratelimit.Bucket, *ratelimit.Bucket) {
+	lim.mut.Lock()
+	defer lim.mut.Unlock()
+	if lan && !lim.limitLAN {
+		return nil, nil
+	}
+	return lim.devices[device].read, lim.global.read
+}
+
+// withLimits returns a bucketPair for the given limits, reusing the buckets
+// of p that are of the right rate.
+func (p bucketPair) withLimits(sendKbps, recvKbps int) bucketPair {
+	if sendKbps != p.sendKbps || p.write == nil && sendKbps > 0 {
+		p.sendKbps = sendKbps
+		p.write = newBucket(sendKbps)
+	}
+	if recvKbps != p.recvKbps || p.read == nil && recvKbps > 0 {
+		p.recvKbps = recvKbps
+		p.read = newBucket(recvKbps)
+	}
+	return p
+}
+
+func newBucket(kbps int) *ratelimit.Bucket {
+	if kbps <= 0 {
+		return nil
+	}
+	return ratelimit.NewBucketWithRate(float64(1000*kbps), int64(5*1000*kbps))
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+)
+
+func TestLimiter(t *testing.T) {
+	device1, _ := protocol.DeviceIDFromString("AIR6LPZ7K4PTTUXQSMUUCPQ5YWOEDFIIQJUG7772YQXXR5YD6AWQ")
+	device2, _ := protocol.DeviceIDFromString("GYRZZQB-IRNPV4Z-T7TC52W-EQYJ3TT-FDQW6MW-DFLMU42-SSSU6EM-FBK2VAY")
+
+	raw := config.New(device1)
+	raw.Options.MaxSendKbps = 1000
+	raw.Devices = []config.DeviceConfiguration{
+		{DeviceID: device1, MaxSendKbps: 100, MaxRecvKbps: 200},
+		{DeviceID: device2},
+	}
+	w := config.Wrap("/tmp/test", raw)
+	lim := newLimiter(w)
+
+	dev, global := lim.writeBuckets(device1, false)
+	if !hasRate(dev, 100) {
+		t.Errorf("Incorrect device send bucket %v", dev)
+	}
+	if !hasRate(global, 1000) {
+		t.Errorf("Incorrect global send bucket %v", global)
+	}
+	dev, global = lim.readBuckets(device1, false)
+	if !hasRate(dev, 200) {
+		t.Errorf("Incorrect device receive bucket %v", dev)
+	}
+	if global != nil {
+		t.Errorf("Unexpected global receive bucket %v", global)
+	}
+	if dev, _ := lim.writeBuckets(device2, false); dev != nil {
+		t.Errorf("Unexpected device send bucket %v", dev)
+	}
+	if dev, global := lim.writeBuckets(device1, true); dev != nil || global != nil {
+		t.Error("Unexpected limits in the LAN")
+	}
+
+	// Unchanged limits keep their buckets, changed ones are replaced on the
+	// live connections.
+	oldDev, oldGlobal := lim.writeBuckets(device1, false)
+	raw.Devices[0].MaxSendKbps = 50
+	raw.Options.LimitBandwidthInLan = true
+	lim.Changed(raw)
+	dev, global = lim.writeBuckets(device1, true)
+	if dev == oldDev || !hasRate(dev, 50) {
+		t.Errorf("Device send bucket not updated: %v", dev)
+	}
+	if global != oldGlobal {
+		t.Error("Global send bucket unnecessarily replaced")
+	}
+
+	// A schedule that is always active overrides the default limits.
+	raw.Options.BandwidthSchedules = []config.BandwidthSchedule{
+		{Start: "00:00", End: "00:00", MaxSendKbps: 0, MaxRecvKbps: 300},
+	}
+	lim.Changed(raw)
+	_, global = lim.writeBuckets(device1, false)
+	if global != nil {
+		t.Errorf("Unexpected global send bucket %v", global)
+	}
+	_, global = lim.readBuckets(device1, false)
+	if !hasRate(global, 300) {
+		t.Errorf("Incorrect global receive bucket %v", global)
+	}
+	raw.Options.BandwidthSchedules[0].Start = "01:00"
+	raw.Options.BandwidthSchedules[0].End = "02:00"
+	lim.mut.Lock()
+	lim.cfg = raw
+	lim.update(time.Date(2015, 6, 5, 12, 0, 0, 0, time.Local))
+	lim.mut.Unlock()
+	if _, global = lim.writeBuckets(device1, false); !hasRate(global, 1000) {
+		t.Errorf("Incorrect global send bucket outside of the schedule %v", global)
+	}
+
+	// Removed devices are forgotten.
+	raw.Devices = raw.Devices[1:]
+	lim.Changed(raw)
+	if dev, _ := lim.writeBuckets(device1, false); dev != nil {
+		t.Errorf("Unexpected send bucket for removed device %v", dev)
+	}
+}
+
+// hasRate returns whether the bucket is limited to about the given rate; the
+// buckets round their rates somewhat.
+func hasRate(b *ratelimit.Bucket, kbps int) bool {
+	if b == nil {
+		return false
+	}
+	diff := b.Rate() - float64(1000*kbps)
+	return diff > -float64(10*kbps) && diff < float64(10*kbps)
+}
@@ -25,7 +25,6 @@ import (
 	"time"
 
 	"github.com/calmh/logger"
-	"github.com/juju/ratelimit"
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/db"
@@ -95,18 +94,18 @@ func init() {
 }
 
 var (
-	cfg            *config.Wrapper
-	myID           protocol.DeviceID
-	confDir        string
-	logFlags       = log.Ltime
-	writeRateLimit *ratelimit.Bucket
-	readRateLimit  *ratelimit.Bucket
-	stop           = make(chan int)
-	discoverer     *discover.Discoverer
-	externalPort   int
-	igd            *upnp.IGD
-	cert           tls.Certificate
-	lans           []*net.IPNet
+	cfg          *config.Wrapper
+	myID         protocol.DeviceID
+	confDir      string
+	logFlags     = log.Ltime
+	rateLimiter  *limiter
+	stop         = make(chan int)
+	discoverer   *discover.Discoverer
+	connSvc      *connectionSvc
+	externalPort int
+	igd          *upnp.IGD
+	cert         tls.Certificate
+	lans         []*net.IPNet
 )
 
 const (
@@ -479,15 +478,15 @@ func syncthingMain() {
 		symlinks.Supported = false
 	}
 
-	if opts.MaxSendKbps > 0 {
-		writeRateLimit = ratelimit.NewBucketWithRate(float64(1000*opts.MaxSendKbps), int64(5*1000*opts.MaxSendKbps))
-	}
-	if opts.MaxRecvKbps > 0 {
-		readRateLimit = ratelimit.NewBucketWithRate(float64(1000*opts.MaxRecvKbps), int64(5*1000*opts.MaxRecvKbps))
-	}
+	setupProxy()
 
+	rateLimiter = newLimiter(cfg)
+	go rateLimiter.serve()
+
+	// The limits may change at runtime, so we always need to know the local
+	// networks.
+	lans, _ = osutil.GetLans()
 	if (opts.MaxRecvKbps > 0 || opts.MaxSendKbps > 0) && !opts.LimitBandwidthInLan {
-		lans, _ = osutil.GetLans()
 		networks := make([]string, 0, len(lans))
 		for _, lan := range lans {
 			networks = append(networks, lan.String())
@@ -544,11 +543,7 @@ func syncthingMain() {
 
 	// The default port we announce, possibly modified by setupUPnP next.
 
-	addr, err := net.ResolveTCPAddr("tcp", opts.ListenAddress[0])
-	if err != nil {
-		l.Fatalln("Bad listen address:", err)
-	}
-	externalPort = addr.Port
+	externalPort = listenPort(tcpListenAddresses(opts.ListenAddress))
 
 	// UPnP
 	igd = nil
@@ -559,14 +554,20 @@ func syncthingMain() {
 
 	// Routine to connect out to configured devices
 	discoverer = discovery(externalPort)
-	go listenConnect(myID, m, tlsCfg)
+	connSvc = newConnectionSvc(m, tlsCfg)
+	go connSvc.serve()
 
 	for _, folder := range cfg.Folders() {
 		// Routine to pull blocks from other devices to synchronize the local
 		// folder. Does not run when we are in read only (publish only) mode.
-		if folder.ReadOnly {
+		if folder.Paused {
+			l.Infof("Folder %s is paused", folder.ID)
+		} else if folder.ReadOnly {
 			l.Okf("Ready to synchronize %s (read only; no external updates accepted)", folder.ID)
 			m.StartFolderRO(folder.ID)
+		} else if folder.ReceiveOnly {
+			l.Okf("Ready to synchronize %s (receive only; local changes are not sent)", folder.ID)
+			m.StartFolderRW(folder.ID)
 		} else {
 			l.Okf("Ready to synchronize %s (read-write)", folder.ID)
 			m.StartFolderRW(folder.ID)
@@ -720,8 +721,9 @@ func generatePingEvents() {
 }
 
 func setupUPnP() {
-	if opts := cfg.Options(); len(opts.ListenAddress) == 1 {
-		_, portStr, err := net.SplitHostPort(opts.ListenAddress[0])
+	opts := cfg.Options()
+	if addrs := tcpListenAddresses(opts.ListenAddress); len(addrs) == 1 {
+		_, portStr, err := net.SplitHostPort(addrs[0])
 		if err != nil {
 			l.Warnln("Bad listen address:", err)
 		} else {
@@ -745,7 +747,7 @@ func setupUPnP() {
 				}
 			}
 		}
-	} else {
+	} else if len(addrs) > 1 {
 		l.Warnln("Multiple listening addresses; not attempting UPnP port mapping")
 	}
 }
@@ -811,7 +813,7 @@ func renewUPnP(port int) {
 		if forwardedPort != 0 {
 			externalPort = forwardedPort
 			discoverer.StopGlobal()
-			discoverer.StartGlobal(opts.GlobalAnnServers, uint16(forwardedPort))
+			discoverer.StartGlobal(globalAnnServers(opts), uint16(forwardedPort))
 			if debugNet {
 				l.Debugf("Updated UPnP port mapping for external port %d on device %s.", forwardedPort, igd.FriendlyIdentifier())
 			}
@@ -837,7 +839,7 @@ func shutdown() {
 
 func discovery(extPort int) *discover.Discoverer {
 	opts := cfg.Options()
-	disc := discover.NewDiscoverer(myID, opts.ListenAddress)
+	disc := discover.NewDiscoverer(myID, tcpListenAddresses(opts.ListenAddress))
 
 	if opts.LocalAnnEnabled {
 		l.Infoln("Starting local discovery announcements")
@@ -846,7 +848,7 @@ func discovery(extPort int) *discover.Discoverer {
 
 	if opts.GlobalAnnEnabled {
 		l.Infoln("Starting global discovery announcements")
-		disc.StartGlobal(opts.GlobalAnnServers, uint16(extPort))
+		disc.StartGlobal(globalAnnServers(opts), uint16(extPort))
 	}
 
 	return disc
@@ -0,0 +1,88 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/proxy"
+	"github.com/syncthing/syncthing/internal/relay"
+	"github.com/syncthing/syncthing/internal/upgrade"
+)
+
+// The device proxy setting that makes us connect directly, even when there
+// is a global proxy.
+const proxyDirect = "direct"
+
+// setupProxy makes relay connections, and upgrade checks if enabled, go
+// through the global proxy.
+func setupProxy() {
+	opts := cfg.Options()
+	if opts.Proxy == "" {
+		return
+	}
+
+	uri, err := url.Parse(opts.Proxy)
+	if err != nil {
+		l.Fatalln("proxy:", err)
+	}
+	l.Infoln("Connecting through proxy", proxy.String(uri))
+
+	relay.Dial = func(network, addr string) (net.Conn, error) {
+		return proxy.Dial(uri, network, addr)
+	}
+
+	if opts.ProxyUpgrades {
+		upgrade.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return proxy.Dial(uri, network, addr)
+				},
+			},
+		}
+	}
+}
+
+// deviceProxy returns the proxy to connect to the device through, or nil to
+// connect directly.
+func deviceProxy(deviceID protocol.DeviceID) (*url.URL, error) {
+	p := cfg.Devices()[deviceID].Proxy
+	if p == "" {
+		p = cfg.Options().Proxy
+	}
+	if p == "" || p == proxyDirect {
+		return nil, nil
+	}
+	return url.Parse(p)
+}
+
+// globalAnnServers returns the global announce servers, set up to go through
+// the proxy if discovery should use it.
+func globalAnnServers(opts config.OptionsConfiguration) []string {
+	if opts.Proxy == "" || !opts.ProxyDiscovery {
+		return opts.GlobalAnnServers
+	}
+
+	servers := make([]string, 0, len(opts.GlobalAnnServers))
+	for _, srv := range opts.GlobalAnnServers {
+		uri, err := url.Parse(srv)
+		if err != nil {
+			// Left for the discoverer to complain about
+			servers = append(servers, srv)
+			continue
+		}
+		params := uri.Query()
+		params.Set("proxy", opts.Proxy)
+		uri.RawQuery = params.Encode()
+		servers = append(servers, uri.String())
+	}
+	return servers
+}
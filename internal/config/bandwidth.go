@@ -0,0 +1,106 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"strings"
+	"time"
+)
+
+// A BandwidthSchedule replaces the send and receive limits during part of
+// the day. Start and End are local times of day such as "08:00"; when End
+// is before Start the period spans midnight, and when they are equal it
+// covers the whole day. Days is a comma separated list of the three letter
+// week days ("mon,tue,wed") the period starts on, empty for every day.
+type BandwidthSchedule struct {
+	Start       string `xml:"start,attr" json:"start"`
+	End         string `xml:"end,attr" json:"end"`
+	Days        string `xml:"days,attr,omitempty" json:"days"`
+	MaxSendKbps int    `xml:"maxSendKbps,attr" json:"maxSendKbps"` // 0 for unlimited
+	MaxRecvKbps int    `xml:"maxRecvKbps,attr" json:"maxRecvKbps"` // 0 for unlimited
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Valid returns whether the start and end times and the days can be parsed.
+func (s BandwidthSchedule) Valid() bool {
+	if _, err := time.Parse("15:04", s.Start); err != nil {
+		return false
+	}
+	if _, err := time.Parse("15:04", s.End); err != nil {
+		return false
+	}
+	if s.Days == "" {
+		return true
+	}
+	for _, day := range strings.Split(s.Days, ",") {
+		if weekday(day) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Active returns whether the schedule is in effect at the given time. An
+// invalid schedule is never active.
+func (s BandwidthSchedule) Active(t time.Time) bool {
+	if !s.Valid() {
+		return false
+	}
+
+	start, _ := time.Parse("15:04", s.Start)
+	end, _ := time.Parse("15:04", s.End)
+	startMin := start.Hour()*60 + start.Minute()
+	endMin := end.Hour()*60 + end.Minute()
+	now := t.Hour()*60 + t.Minute()
+
+	day := t.Weekday()
+	switch {
+	case startMin == endMin:
+	case startMin < endMin:
+		if now < startMin || now >= endMin {
+			return false
+		}
+	case now >= startMin:
+	case now < endMin:
+		// The period started the day before
+		day = (day + 6) % 7
+	default:
+		return false
+	}
+
+	if s.Days == "" {
+		return true
+	}
+	for _, d := range strings.Split(s.Days, ",") {
+		if weekday(d) == int(day) {
+			return true
+		}
+	}
+	return false
+}
+
+func weekday(s string) int {
+	s = strings.ToLower(strings.TrimSpace(s))
+	for i, day := range weekdays {
+		if s == day {
+			return i
+		}
+	}
+	return -1
+}
+
+// currentLimits returns the limits of the first schedule active at the
+// given time, or the default limits if there is none.
+func currentLimits(send, recv int, schedules []BandwidthSchedule, t time.Time) (int, int) {
+	for _, s := range schedules {
+		if s.Active(t) {
+			return s.MaxSendKbps, s.MaxRecvKbps
+		}
+	}
+	return send, recv
+}
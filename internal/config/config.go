@@ -8,6 +8,7 @@
 package config
 
 import (
+	"compress/flate"
 	"encoding/xml"
 	"fmt"
 	"io"
@@ -19,6 +20,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/calmh/logger"
 	"github.com/syncthing/protocol"
@@ -70,18 +72,52 @@ func (orig Configuration) Copy() Configuration {
 }
 
 type FolderConfiguration struct {
-	ID              string                      `xml:"id,attr" json:"id"`
-	RawPath         string                      `xml:"path,attr" json:"path"`
-	Devices         []FolderDeviceConfiguration `xml:"device" json:"devices"`
-	ReadOnly        bool                        `xml:"ro,attr" json:"readOnly"`
-	RescanIntervalS int                         `xml:"rescanIntervalS,attr" json:"rescanIntervalS"`
-	IgnorePerms     bool                        `xml:"ignorePerms,attr" json:"ignorePerms"`
-	AutoNormalize   bool                        `xml:"autoNormalize,attr" json:"autoNormalize"`
-	Versioning      VersioningConfiguration     `xml:"versioning" json:"versioning"`
-	LenientMtimes   bool                        `xml:"lenientMtimes" json:"lenientMTimes"`
-	Copiers         int                         `xml:"copiers" json:"copiers"` // This defines how many files are handled concurrently.
-	Pullers         int                         `xml:"pullers" json:"pullers"` // Defines how many blocks are fetched at the same time, possibly between separate copier routines.
-	Hashers         int                         `xml:"hashers" json:"hashers"` // Less than one sets the value to the number of cores. These are CPU bound due to hashing.
+	ID                 string                      `xml:"id,attr" json:"id"`
+	RawPath            string                      `xml:"path,attr" json:"path"`
+	Devices            []FolderDeviceConfiguration `xml:"device" json:"devices"`
+	ReadOnly           bool                        `xml:"ro,attr" json:"readOnly"`
+	ReceiveOnly        bool                        `xml:"receiveOnly,attr" json:"receiveOnly"` // Local changes are not sent to other devices.
+	RescanIntervalS    int                         `xml:"rescanIntervalS,attr" json:"rescanIntervalS"`
+	IgnorePerms        bool                        `xml:"ignorePerms,attr" json:"ignorePerms"`
+	AutoNormalize      bool                        `xml:"autoNormalize,attr" json:"autoNormalize"`
+	ContentChunking    bool                        `xml:"contentChunking,attr" json:"contentChunking"`
+	EncryptionPassword string                      `xml:"encryptionPassword" json:"encryptionPassword"` // Used to encrypt the folder contents for untrusted devices.
+	Versioning         VersioningConfiguration     `xml:"versioning" json:"versioning"`
+	LenientMtimes      bool                        `xml:"lenientMtimes" json:"lenientMTimes"`
+	Copiers            int                         `xml:"copiers" json:"copiers"` // This defines how many files are handled concurrently.
+	Pullers            int                         `xml:"pullers" json:"pullers"` // Defines how many blocks are fetched at the same time, possibly between separate copier routines.
+	Hashers            int                         `xml:"hashers" json:"hashers"` // Less than one sets the value to the number of cores. These are CPU bound due to hashing.
+	// Scan changes as they happen, in addition to the periodic full scans.
+	// Changes are collected for FSWatcherDelayS seconds (zero meaning the
+	// default of ten) before being scanned.
+	FSWatcherEnabled bool `xml:"fsWatcherEnabled,attr" json:"fsWatcherEnabled"`
+	FSWatcherDelayS  int  `xml:"fsWatcherDelayS,attr" json:"fsWatcherDelayS"`
+	// How to resolve conflicting changes; one of the Conflict* policies, with
+	// the empty string meaning ConflictKeepBoth. ConflictDevice is the device
+	// that wins under ConflictDeviceWins. MaxConflicts limits the number of
+	// conflict copies kept per file; zero means no limit.
+	ConflictPolicy string `xml:"conflictPolicy,attr" json:"conflictPolicy"`
+	ConflictDevice string `xml:"conflictDevice,attr" json:"conflictDevice"`
+	MaxConflicts   int    `xml:"maxConflicts,attr" json:"maxConflicts"`
+	// The order in which needed files are pulled; one of the PullOrder*
+	// values, with the empty string meaning PullOrderAlphabetic. Files
+	// matching the PullFirst patterns are pulled before all others and those
+	// matching PullLast after them. The patterns are as in .stignore.
+	PullOrder string   `xml:"pullOrder,attr" json:"pullOrder"`
+	PullFirst []string `xml:"pullFirst" json:"pullFirst"`
+	PullLast  []string `xml:"pullLast" json:"pullLast"`
+	// The subtrees of the folder to sync, as slash separated paths relative
+	// to the folder root. When empty, the whole folder is synced.
+	Subscriptions []string `xml:"subscription" json:"subscriptions"`
+	// Paused folders are neither scanned nor synced.
+	Paused bool `xml:"paused,attr" json:"paused"`
+	// Set once a device shares the folder with us without trusting us with
+	// its contents. The folder then holds only encrypted data, and stays
+	// that way; it is never scanned.
+	Encrypted bool `xml:"encrypted,attr" json:"encrypted"`
+	// Files are not pulled when that would leave less free space than this
+	// on the folder's filesystem; see ParseSize for the format.
+	MinDiskFree string `xml:"minDiskFree" json:"minDiskFree"`
 
 	Invalid string `xml:"-" json:"invalid"` // Set at runtime when there is an error, not saved
 
@@ -92,6 +128,9 @@ func (orig FolderConfiguration) Copy() FolderConfiguration {
 	c := orig
 	c.Devices = make([]FolderDeviceConfiguration, len(orig.Devices))
 	copy(c.Devices, orig.Devices)
+	c.PullFirst = append([]string(nil), orig.PullFirst...)
+	c.PullLast = append([]string(nil), orig.PullLast...)
+	c.Subscriptions = append([]string(nil), orig.Subscriptions...)
 	return c
 }
 
@@ -154,6 +193,30 @@ func (f *FolderConfiguration) DeviceIDs() []protocol.DeviceID {
 	return f.deviceIDs
 }
 
+// The conflict policies. With ConflictKeepBoth the local file is kept as a
+// conflict copy next to the other one, while the other policies keep only
+// the winning file. ConflictLocalWins should not be used by more than one of
+// the devices sharing a folder, as they would never agree.
+const (
+	ConflictKeepBoth   = "keepBoth"
+	ConflictNewestWins = "newestWins"
+	ConflictDeviceWins = "deviceWins"
+	ConflictLocalWins  = "localWins"
+)
+
+// The orders in which needed files can be pulled.
+const (
+	PullOrderAlphabetic    = "alphabetic"
+	PullOrderRandom        = "random"
+	PullOrderSmallestFirst = "smallestFirst"
+	PullOrderLargestFirst  = "largestFirst"
+	PullOrderOldestFirst   = "oldestFirst"
+	PullOrderNewestFirst   = "newestFirst"
+)
+
+// The free disk space to keep, unless configured otherwise.
+const defaultMinDiskFree = "1%"
+
 type VersioningConfiguration struct {
 	Type   string            `xml:"type,attr" json:"type"`
 	Params map[string]string `json:"params"`
@@ -196,48 +259,74 @@ func (c *VersioningConfiguration) UnmarshalXML(d *xml.Decoder, start xml.StartEl
 }
 
 type DeviceConfiguration struct {
-	DeviceID    protocol.DeviceID    `xml:"id,attr" json:"deviceID"`
-	Name        string               `xml:"name,attr,omitempty" json:"name"`
-	Addresses   []string             `xml:"address,omitempty" json:"addresses"`
-	Compression protocol.Compression `xml:"compression,attr" json:"compression"`
-	CertName    string               `xml:"certName,attr,omitempty" json:"certName"`
-	Introducer  bool                 `xml:"introducer,attr" json:"introducer"`
+	DeviceID             protocol.DeviceID             `xml:"id,attr" json:"deviceID"`
+	Name                 string                        `xml:"name,attr,omitempty" json:"name"`
+	Addresses            []string                      `xml:"address,omitempty" json:"addresses"`
+	Compression          protocol.Compression          `xml:"compression,attr" json:"compression"`
+	CompressionAlgorithm protocol.CompressionAlgorithm `xml:"compressionAlgorithm,attr" json:"compressionAlgorithm"`
+	CompressionLevel     int                           `xml:"compressionLevel,attr,omitempty" json:"compressionLevel"`
+	CertName             string                        `xml:"certName,attr,omitempty" json:"certName"`
+	Introducer           bool                          `xml:"introducer,attr" json:"introducer"`
+	Proxy                string                        `xml:"proxy,attr,omitempty" json:"proxy"`                   // Empty for the global proxy, "direct" for none
+	NumConnections       int                           `xml:"numConnections,attr,omitempty" json:"numConnections"` // 0 for the global ConnectionsPerDevice
+	MaxSendKbps          int                           `xml:"maxSendKbps,attr,omitempty" json:"maxSendKbps"`       // Nested inside the global limit; 0 for unlimited
+	MaxRecvKbps          int                           `xml:"maxRecvKbps,attr,omitempty" json:"maxRecvKbps"`       // Nested inside the global limit; 0 for unlimited
+	BandwidthSchedules   []BandwidthSchedule           `xml:"bandwidthSchedule" json:"bandwidthSchedules"`
+	Paused               bool                          `xml:"paused,attr" json:"paused"` // No connections are made to or accepted from paused devices
 }
 
 func (orig DeviceConfiguration) Copy() DeviceConfiguration {
 	c := orig
 	c.Addresses = make([]string, len(orig.Addresses))
 	copy(c.Addresses, orig.Addresses)
+	if orig.BandwidthSchedules != nil {
+		c.BandwidthSchedules = make([]BandwidthSchedule, len(orig.BandwidthSchedules))
+		copy(c.BandwidthSchedules, orig.BandwidthSchedules)
+	}
 	return c
 }
 
+// CurrentLimits returns the send and receive limits for the device in kbps
+// at the given time, with 0 meaning unlimited.
+func (d DeviceConfiguration) CurrentLimits(t time.Time) (send, recv int) {
+	return currentLimits(d.MaxSendKbps, d.MaxRecvKbps, d.BandwidthSchedules, t)
+}
+
 type FolderDeviceConfiguration struct {
-	DeviceID protocol.DeviceID `xml:"id,attr" json:"deviceID"`
+	DeviceID  protocol.DeviceID `xml:"id,attr" json:"deviceID"`
+	Untrusted bool              `xml:"untrusted,attr" json:"untrusted"` // The device only receives encrypted data
 }
 
 type OptionsConfiguration struct {
-	ListenAddress           []string `xml:"listenAddress" json:"listenAddress" default:"0.0.0.0:22000"`
-	GlobalAnnServers        []string `xml:"globalAnnounceServer" json:"globalAnnounceServers" json:"globalAnnounceServer" default:"udp4://announce.syncthing.net:22026, udp6://announce-v6.syncthing.net:22026"`
-	GlobalAnnEnabled        bool     `xml:"globalAnnounceEnabled" json:"globalAnnounceEnabled" default:"true"`
-	LocalAnnEnabled         bool     `xml:"localAnnounceEnabled" json:"localAnnounceEnabled" default:"true"`
-	LocalAnnPort            int      `xml:"localAnnouncePort" json:"localAnnouncePort" default:"21025"`
-	LocalAnnMCAddr          string   `xml:"localAnnounceMCAddr" json:"localAnnounceMCAddr" default:"[ff32::5222]:21026"`
-	MaxSendKbps             int      `xml:"maxSendKbps" json:"maxSendKbps"`
-	MaxRecvKbps             int      `xml:"maxRecvKbps" json:"maxRecvKbps"`
-	ReconnectIntervalS      int      `xml:"reconnectionIntervalS" json:"reconnectionIntervalS" default:"60"`
-	StartBrowser            bool     `xml:"startBrowser" json:"startBrowser" default:"true"`
-	UPnPEnabled             bool     `xml:"upnpEnabled" json:"upnpEnabled" default:"true"`
-	UPnPLease               int      `xml:"upnpLeaseMinutes" json:"upnpLeaseMinutes" default:"0"`
-	UPnPRenewal             int      `xml:"upnpRenewalMinutes" json:"upnpRenewalMinutes" default:"30"`
-	URAccepted              int      `xml:"urAccepted" json:"urAccepted"` // Accepted usage reporting version; 0 for off (undecided), -1 for off (permanently)
-	URUniqueID              string   `xml:"urUniqueID" json:"urUniqueId"` // Unique ID for reporting purposes, regenerated when UR is turned on.
-	RestartOnWakeup         bool     `xml:"restartOnWakeup" json:"restartOnWakeup" default:"true"`
-	AutoUpgradeIntervalH    int      `xml:"autoUpgradeIntervalH" json:"autoUpgradeIntervalH" default:"12"` // 0 for off
-	KeepTemporariesH        int      `xml:"keepTemporariesH" json:"keepTemporariesH" default:"24"`         // 0 for off
-	CacheIgnoredFiles       bool     `xml:"cacheIgnoredFiles" json:"cacheIgnoredFiles" default:"true"`
-	ProgressUpdateIntervalS int      `xml:"progressUpdateIntervalS" json:"progressUpdateIntervalS" default:"5"`
-	SymlinksEnabled         bool     `xml:"symlinksEnabled" json:"symlinksEnabled" default:"true"`
-	LimitBandwidthInLan     bool     `xml:"limitBandwidthInLan" json:"limitBandwidthInLan" default:"false"`
+	ListenAddress           []string            `xml:"listenAddress" json:"listenAddress" default:"0.0.0.0:22000"`
+	GlobalAnnServers        []string            `xml:"globalAnnounceServer" json:"globalAnnounceServers" json:"globalAnnounceServer" default:"udp4://announce.syncthing.net:22026, udp6://announce-v6.syncthing.net:22026"`
+	GlobalAnnEnabled        bool                `xml:"globalAnnounceEnabled" json:"globalAnnounceEnabled" default:"true"`
+	LocalAnnEnabled         bool                `xml:"localAnnounceEnabled" json:"localAnnounceEnabled" default:"true"`
+	LocalAnnPort            int                 `xml:"localAnnouncePort" json:"localAnnouncePort" default:"21025"`
+	LocalAnnMCAddr          string              `xml:"localAnnounceMCAddr" json:"localAnnounceMCAddr" default:"[ff32::5222]:21026"`
+	MaxSendKbps             int                 `xml:"maxSendKbps" json:"maxSendKbps"`
+	MaxRecvKbps             int                 `xml:"maxRecvKbps" json:"maxRecvKbps"`
+	ReconnectIntervalS      int                 `xml:"reconnectionIntervalS" json:"reconnectionIntervalS" default:"60"`
+	StartBrowser            bool                `xml:"startBrowser" json:"startBrowser" default:"true"`
+	UPnPEnabled             bool                `xml:"upnpEnabled" json:"upnpEnabled" default:"true"`
+	UPnPLease               int                 `xml:"upnpLeaseMinutes" json:"upnpLeaseMinutes" default:"0"`
+	UPnPRenewal             int                 `xml:"upnpRenewalMinutes" json:"upnpRenewalMinutes" default:"30"`
+	URAccepted              int                 `xml:"urAccepted" json:"urAccepted"` // Accepted usage reporting version; 0 for off (undecided), -1 for off (permanently)
+	URUniqueID              string              `xml:"urUniqueID" json:"urUniqueId"` // Unique ID for reporting purposes, regenerated when UR is turned on.
+	RestartOnWakeup         bool                `xml:"restartOnWakeup" json:"restartOnWakeup" default:"true"`
+	AutoUpgradeIntervalH    int                 `xml:"autoUpgradeIntervalH" json:"autoUpgradeIntervalH" default:"12"` // 0 for off
+	KeepTemporariesH        int                 `xml:"keepTemporariesH" json:"keepTemporariesH" default:"24"`         // 0 for off
+	CacheIgnoredFiles       bool                `xml:"cacheIgnoredFiles" json:"cacheIgnoredFiles" default:"true"`
+	ProgressUpdateIntervalS int                 `xml:"progressUpdateIntervalS" json:"progressUpdateIntervalS" default:"5"`
+	SymlinksEnabled         bool                `xml:"symlinksEnabled" json:"symlinksEnabled" default:"true"`
+	LimitBandwidthInLan     bool                `xml:"limitBandwidthInLan" json:"limitBandwidthInLan" default:"false"`
+	RelayServers            []string            `xml:"relayServer" json:"relayServers"`      // relay://host:port URIs of relays to stay reachable through
+	Proxy                   string              `xml:"proxy" json:"proxy"`                   // socks5:// or http:// URL of the proxy to connect to other devices through
+	ProxyDiscovery          bool                `xml:"proxyDiscovery" json:"proxyDiscovery"` // Use the proxy for global discovery; requires a SOCKS5 proxy
+	ProxyUpgrades           bool                `xml:"proxyUpgrades" json:"proxyUpgrades"`   // Use the proxy for upgrade checks and downloads
+	ConnectionsPerDevice    int                 `xml:"connectionsPerDevice" json:"connectionsPerDevice" default:"1"`
+	BandwidthSchedules      []BandwidthSchedule `xml:"bandwidthSchedule" json:"bandwidthSchedules"`
+	MinHomeDiskFree         string              `xml:"minHomeDiskFree" json:"minHomeDiskFree" default:"1%"` // Free space to keep for the database
 }
 
 func (orig OptionsConfiguration) Copy() OptionsConfiguration {
@@ -246,9 +335,19 @@ func (orig OptionsConfiguration) Copy() OptionsConfiguration {
 	copy(c.ListenAddress, orig.ListenAddress)
 	c.GlobalAnnServers = make([]string, len(orig.GlobalAnnServers))
 	copy(c.GlobalAnnServers, orig.GlobalAnnServers)
+	c.RelayServers = make([]string, len(orig.RelayServers))
+	copy(c.RelayServers, orig.RelayServers)
+	c.BandwidthSchedules = make([]BandwidthSchedule, len(orig.BandwidthSchedules))
+	copy(c.BandwidthSchedules, orig.BandwidthSchedules)
 	return c
 }
 
+// CurrentLimits returns the global send and receive limits in kbps at the
+// given time, with 0 meaning unlimited.
+func (o OptionsConfiguration) CurrentLimits(t time.Time) (send, recv int) {
+	return currentLimits(o.MaxSendKbps, o.MaxRecvKbps, o.BandwidthSchedules, t)
+}
+
 type GUIConfiguration struct {
 	Enabled  bool   `xml:"enabled,attr" json:"enabled" default:"true"`
 	Address  string `xml:"address" json:"address" default:"127.0.0.1:8384"`
@@ -331,6 +430,37 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 			folder.ID = "default"
 		}
 
+		switch folder.ConflictPolicy {
+		case "", ConflictKeepBoth, ConflictNewestWins, ConflictLocalWins:
+		case ConflictDeviceWins:
+			if _, err := protocol.DeviceIDFromString(folder.ConflictDevice); err != nil {
+				l.Warnf("Folder %q: invalid conflict device %q: %v; keeping both sides of conflicts", folder.ID, folder.ConflictDevice, err)
+				folder.ConflictPolicy = ConflictKeepBoth
+			}
+		default:
+			l.Warnf("Folder %q: unknown conflict policy %q; keeping both sides of conflicts", folder.ID, folder.ConflictPolicy)
+			folder.ConflictPolicy = ConflictKeepBoth
+		}
+
+		switch folder.PullOrder {
+		case "", PullOrderAlphabetic, PullOrderRandom, PullOrderSmallestFirst, PullOrderLargestFirst, PullOrderOldestFirst, PullOrderNewestFirst:
+		default:
+			l.Warnf("Folder %q: unknown pull order %q; pulling in alphabetic order", folder.ID, folder.PullOrder)
+			folder.PullOrder = PullOrderAlphabetic
+		}
+
+		if folder.MinDiskFree == "" {
+			folder.MinDiskFree = defaultMinDiskFree
+		} else if _, err := ParseSize(folder.MinDiskFree); err != nil {
+			l.Warnf("Folder %q: minimum free disk space: %v; using %s", folder.ID, err, defaultMinDiskFree)
+			folder.MinDiskFree = defaultMinDiskFree
+		}
+
+		if folder.ReadOnly && folder.ReceiveOnly {
+			l.Warnf("Folder %q cannot be both read only and receive only; treating it as read only", folder.ID)
+			folder.ReceiveOnly = false
+		}
+
 		if seen, ok := seenFolders[folder.ID]; ok {
 			l.Warnf("Multiple folders with ID %q; disabling", folder.ID)
 
@@ -401,6 +531,7 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 	for i := range cfg.Folders {
 		cfg.Folders[i].Devices = ensureDevicePresent(cfg.Folders[i].Devices, myID)
 		cfg.Folders[i].Devices = ensureExistingDevices(cfg.Folders[i].Devices, existingDevices)
+		cfg.Folders[i].Devices = ensureUntrustedDuplicates(cfg.Folders[i].ID, cfg.Folders[i].Devices)
 		cfg.Folders[i].Devices = ensureNoDuplicates(cfg.Folders[i].Devices)
 		if cfg.Folders[i].Copiers == 0 {
 			cfg.Folders[i].Copiers = 1
@@ -417,6 +548,32 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 		if len(n.Addresses) == 0 || len(n.Addresses) == 1 && n.Addresses[0] == "" {
 			n.Addresses = []string{"dynamic"}
 		}
+		// The connection fails on the first compressed message otherwise
+		if n.CompressionLevel < flate.DefaultCompression || n.CompressionLevel > flate.BestCompression {
+			l.Warnf("Device %v: invalid compression level %d; using the default", n.DeviceID, n.CompressionLevel)
+			n.CompressionLevel = 0
+		}
+	}
+
+	if cfg.Options.ConnectionsPerDevice < 1 {
+		cfg.Options.ConnectionsPerDevice = 1
+	}
+
+	// Invalid bandwidth schedules are never active
+	if cfg.Options.BandwidthSchedules == nil {
+		cfg.Options.BandwidthSchedules = []BandwidthSchedule{}
+	}
+	for _, s := range cfg.Options.BandwidthSchedules {
+		if !s.Valid() {
+			l.Warnf("Ignoring invalid bandwidth schedule %s-%s %q", s.Start, s.End, s.Days)
+		}
+	}
+	for _, dev := range cfg.Devices {
+		for _, s := range dev.BandwidthSchedules {
+			if !s.Valid() {
+				l.Warnf("Ignoring invalid bandwidth schedule %s-%s %q for device %s", s.Start, s.End, s.Days, dev.DeviceID)
+			}
+		}
 	}
 
 	// Very short reconnection intervals are annoying
@@ -424,8 +581,16 @@ func (cfg *Configuration) prepare(myID protocol.DeviceID) {
 		cfg.Options.ReconnectIntervalS = 5
 	}
 
+	if cfg.Options.MinHomeDiskFree == "" {
+		cfg.Options.MinHomeDiskFree = defaultMinDiskFree
+	} else if _, err := ParseSize(cfg.Options.MinHomeDiskFree); err != nil {
+		l.Warnf("Minimum free disk space for the database: %v; using %s", err, defaultMinDiskFree)
+		cfg.Options.MinHomeDiskFree = defaultMinDiskFree
+	}
+
 	cfg.Options.ListenAddress = uniqueStrings(cfg.Options.ListenAddress)
 	cfg.Options.GlobalAnnServers = uniqueStrings(cfg.Options.GlobalAnnServers)
+	cfg.Options.RelayServers = uniqueStrings(cfg.Options.RelayServers)
 
 	if cfg.GUI.APIKey == "" {
 		cfg.GUI.APIKey = randomString(32)
@@ -455,6 +620,19 @@ func ChangeRequiresRestart(from, to Configuration) bool {
 	to.Options.URAccepted = from.Options.URAccepted
 	to.Options.URUniqueID = from.Options.URUniqueID
 
+	// Bandwidth limits are applied to the live connections.
+	to.Options.MaxSendKbps = from.Options.MaxSendKbps
+	to.Options.MaxRecvKbps = from.Options.MaxRecvKbps
+	to.Options.LimitBandwidthInLan = from.Options.LimitBandwidthInLan
+	to.Options.BandwidthSchedules = from.Options.BandwidthSchedules
+
+	// Listeners follow the listen addresses and relays, but a UPnP port
+	// mapping is only set up at startup.
+	if !to.Options.UPnPEnabled {
+		to.Options.ListenAddress = from.Options.ListenAddress
+	}
+	to.Options.RelayServers = from.Options.RelayServers
+
 	// All of the generic options require restart
 	if !reflect.DeepEqual(from.Options, to.Options) || !reflect.DeepEqual(from.GUI, to.GUI) {
 		return true
@@ -623,6 +801,26 @@ loop:
 	return devices[0:count]
 }
 
+// ensureUntrustedDuplicates marks a device that is listed more than once for
+// the folder, both as trusted and untrusted, as untrusted in all entries. It
+// would otherwise depend on which entry is kept whether the device gets the
+// plain text.
+func ensureUntrustedDuplicates(folder string, devices []FolderDeviceConfiguration) []FolderDeviceConfiguration {
+	untrusted := make(map[protocol.DeviceID]bool)
+	for _, device := range devices {
+		if device.Untrusted {
+			untrusted[device.DeviceID] = true
+		}
+	}
+	for i := range devices {
+		if untrusted[devices[i].DeviceID] && !devices[i].Untrusted {
+			l.Warnf("Folder %q is shared with device %v both trusted and untrusted; treating it as untrusted", folder, devices[i].DeviceID)
+			devices[i].Untrusted = true
+		}
+	}
+	return devices
+}
+
 func ensureNoDuplicates(devices []FolderDeviceConfiguration) []FolderDeviceConfiguration {
 	count := len(devices)
 	i := 0
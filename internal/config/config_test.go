@@ -16,6 +16,7 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/syncthing/protocol"
 )
@@ -51,6 +52,10 @@ func TestDefaultValues(t *testing.T) {
 		ProgressUpdateIntervalS: 5,
 		SymlinksEnabled:         true,
 		LimitBandwidthInLan:     false,
+		RelayServers:            []string{},
+		ConnectionsPerDevice:    1,
+		BandwidthSchedules:      []BandwidthSchedule{},
+		MinHomeDiskFree:         "1%",
 	}
 
 	cfg := New(device1)
@@ -88,6 +93,7 @@ func TestDeviceConfig(t *testing.T) {
 				Pullers:         16,
 				Hashers:         0,
 				AutoNormalize:   true,
+				MinDiskFree:     "1%",
 			},
 		}
 		expectedDevices := []DeviceConfiguration{
@@ -156,6 +162,15 @@ func TestOverriddenValues(t *testing.T) {
 		ProgressUpdateIntervalS: 10,
 		SymlinksEnabled:         false,
 		LimitBandwidthInLan:     true,
+		RelayServers:            []string{"relay://relay.example.com:22067"},
+		Proxy:                   "socks5://proxy.example.com:1080",
+		ProxyDiscovery:          true,
+		ProxyUpgrades:           true,
+		ConnectionsPerDevice:    4,
+		BandwidthSchedules: []BandwidthSchedule{
+			{Start: "08:00", End: "17:00", Days: "mon,tue,wed,thu,fri", MaxSendKbps: 500, MaxRecvKbps: 1000},
+		},
+		MinHomeDiskFree: "5 GB",
 	}
 
 	cfg, err := Load("testdata/overridenvalues.xml", device1)
@@ -211,9 +226,11 @@ func TestDeviceCompression(t *testing.T) {
 			Compression: protocol.CompressMetadata,
 		},
 		device2: {
-			DeviceID:    device2,
-			Addresses:   []string{"dynamic"},
-			Compression: protocol.CompressMetadata,
+			DeviceID:             device2,
+			Addresses:            []string{"dynamic"},
+			Compression:          protocol.CompressMetadata,
+			CompressionAlgorithm: protocol.CompressionDeflate,
+			CompressionLevel:     9,
 		},
 		device3: {
 			DeviceID:    device3,
@@ -239,6 +256,26 @@ func TestDeviceCompression(t *testing.T) {
 	}
 }
 
+func TestDeviceCompressionLevel(t *testing.T) {
+	cfg := Configuration{
+		Devices: []DeviceConfiguration{
+			{DeviceID: device1, CompressionLevel: 9},
+			{DeviceID: device2, CompressionLevel: -1},
+			{DeviceID: device3, CompressionLevel: 10},
+			{DeviceID: device4, CompressionLevel: -2},
+		},
+	}
+
+	cfg.prepare(device1)
+
+	expected := []int{9, -1, 0, 0}
+	for i, dev := range cfg.Devices {
+		if dev.CompressionLevel != expected[i] {
+			t.Errorf("Device %v: incorrect compression level %d != %d", dev.DeviceID, dev.CompressionLevel, expected[i])
+		}
+	}
+}
+
 func TestDeviceAddressesStatic(t *testing.T) {
 	name, _ := os.Hostname()
 	expected := map[protocol.DeviceID]DeviceConfiguration{
@@ -411,6 +448,34 @@ func TestPrepare(t *testing.T) {
 	}
 }
 
+func TestUntrustedDuplicates(t *testing.T) {
+	cfg := Configuration{
+		Devices: []DeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+		Folders: []FolderConfiguration{
+			{
+				ID:      "folder",
+				RawPath: "testdata",
+				Devices: []FolderDeviceConfiguration{
+					{DeviceID: device2},
+					{DeviceID: device2, Untrusted: true},
+				},
+			},
+		},
+	}
+
+	cfg.prepare(device1)
+
+	devices := cfg.Folders[0].Devices
+	if len(devices) != 2 {
+		t.Fatalf("Incorrect devices %v", devices)
+	}
+	for _, dev := range devices {
+		if dev.DeviceID == device2 && !dev.Untrusted {
+			t.Error("Device listed both trusted and untrusted should be untrusted")
+		}
+	}
+}
+
 func TestRequiresRestart(t *testing.T) {
 	wr, err := Load("testdata/v6.xml", device1)
 	if err != nil {
@@ -486,6 +551,81 @@ func TestRequiresRestart(t *testing.T) {
 	if !ChangeRequiresRestart(cfg, newCfg) {
 		t.Error("Changing GUI options requires restart")
 	}
+
+	newCfg = cfg
+	newCfg.Options.MaxSendKbps = cfg.Options.MaxSendKbps + 100
+	newCfg.Options.LimitBandwidthInLan = !cfg.Options.LimitBandwidthInLan
+	newCfg.Options.BandwidthSchedules = []BandwidthSchedule{{Start: "08:00", End: "17:00", MaxSendKbps: 500}}
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing bandwidth limits does not require restart")
+	}
+
+	newCfg = cfg
+	newCfg.Options.UPnPEnabled = false
+	cfg.Options.UPnPEnabled = false
+	newCfg.Options.ListenAddress = []string{"tcp://:23000"}
+	newCfg.Options.RelayServers = []string{"relay://relay.example.com:22067"}
+	if ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing listen addresses does not require restart")
+	}
+	cfg.Options.UPnPEnabled = true
+	newCfg.Options.UPnPEnabled = true
+	if !ChangeRequiresRestart(cfg, newCfg) {
+		t.Error("Changing listen addresses with UPnP requires restart")
+	}
+}
+
+func TestBandwidthSchedule(t *testing.T) {
+	// 2015-06-05 is a Friday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2015, 6, day, hour, min, 0, 0, time.Local)
+	}
+
+	cases := []struct {
+		sched  BandwidthSchedule
+		t      time.Time
+		active bool
+	}{
+		{BandwidthSchedule{Start: "08:00", End: "17:00"}, at(5, 8, 0), true},
+		{BandwidthSchedule{Start: "08:00", End: "17:00"}, at(5, 16, 59), true},
+		{BandwidthSchedule{Start: "08:00", End: "17:00"}, at(5, 17, 0), false},
+		{BandwidthSchedule{Start: "08:00", End: "17:00"}, at(5, 7, 59), false},
+		{BandwidthSchedule{Start: "08:00", End: "17:00", Days: "mon,fri"}, at(5, 12, 0), true},
+		{BandwidthSchedule{Start: "08:00", End: "17:00", Days: "mon,fri"}, at(6, 12, 0), false},
+		{BandwidthSchedule{Start: "22:00", End: "06:00"}, at(5, 23, 0), true},
+		{BandwidthSchedule{Start: "22:00", End: "06:00"}, at(5, 3, 0), true},
+		{BandwidthSchedule{Start: "22:00", End: "06:00"}, at(5, 12, 0), false},
+		{BandwidthSchedule{Start: "22:00", End: "06:00", Days: "fri"}, at(6, 3, 0), true},
+		{BandwidthSchedule{Start: "22:00", End: "06:00", Days: "fri"}, at(5, 3, 0), false},
+		{BandwidthSchedule{Start: "00:00", End: "00:00", Days: "Sat, Sun"}, at(6, 12, 0), true},
+		{BandwidthSchedule{Start: "8", End: "17:00"}, at(5, 12, 0), false},
+		{BandwidthSchedule{Start: "08:00", End: "17:00", Days: "friday"}, at(5, 12, 0), false},
+	}
+
+	for i, tc := range cases {
+		if active := tc.sched.Active(tc.t); active != tc.active {
+			t.Errorf("%d: %+v at %v; active %v != %v", i, tc.sched, tc.t, active, tc.active)
+		}
+	}
+
+	opts := OptionsConfiguration{
+		MaxSendKbps: 100,
+		MaxRecvKbps: 200,
+		BandwidthSchedules: []BandwidthSchedule{
+			{Start: "08:00", End: "17:00", MaxSendKbps: 500},
+			{Start: "00:00", End: "00:00", MaxSendKbps: 1, MaxRecvKbps: 2},
+		},
+	}
+	if send, recv := opts.CurrentLimits(at(5, 12, 0)); send != 500 || recv != 0 {
+		t.Errorf("Incorrect limits during the first schedule; %d, %d", send, recv)
+	}
+	if send, recv := opts.CurrentLimits(at(5, 20, 0)); send != 1 || recv != 2 {
+		t.Errorf("Incorrect limits during the second schedule; %d, %d", send, recv)
+	}
+	opts.BandwidthSchedules = nil
+	if send, recv := opts.CurrentLimits(at(5, 12, 0)); send != 100 || recv != 200 {
+		t.Errorf("Incorrect default limits; %d, %d", send, recv)
+	}
 }
 
 func TestCopy(t *testing.T) {
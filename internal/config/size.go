@@ -0,0 +1,68 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A Size is an amount of disk space, either in bytes or as a percentage of
+// the total size of the filesystem.
+type Size struct {
+	Value   float64
+	Percent bool
+}
+
+var sizeUnits = []struct {
+	suffix string
+	mult   float64
+}{
+	// Longest suffixes first, so that "kB" isn't taken for "B"
+	{"TB", 1e12},
+	{"GB", 1e9},
+	{"MB", 1e6},
+	{"kB", 1e3},
+	{"B", 1},
+}
+
+// ParseSize parses sizes such as "1%", "500 MB" or "1048576". The units are
+// decimal; a number without a unit is in bytes.
+func ParseSize(orig string) (Size, error) {
+	s := strings.TrimSpace(orig)
+
+	var size Size
+	mult := 1.0
+	if strings.HasSuffix(s, "%") {
+		size.Percent = true
+		s = s[:len(s)-1]
+	} else {
+		for _, unit := range sizeUnits {
+			if strings.HasSuffix(s, unit.suffix) {
+				mult = unit.mult
+				s = s[:len(s)-len(unit.suffix)]
+				break
+			}
+		}
+	}
+
+	val, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || val < 0 || size.Percent && val > 100 {
+		return Size{}, fmt.Errorf("invalid size %q", orig)
+	}
+	size.Value = val * mult
+	return size, nil
+}
+
+// Bytes returns the size in bytes, on a filesystem of the given total size.
+func (s Size) Bytes(total int64) int64 {
+	if s.Percent {
+		return int64(s.Value / 100 * float64(total))
+	}
+	return int64(s.Value)
+}
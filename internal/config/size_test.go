@@ -0,0 +1,42 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package config
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	cases := []struct {
+		s     string
+		bytes int64 // of a 1 GB filesystem
+		ok    bool
+	}{
+		{"1%", 1e7, true},
+		{" 2.5 % ", 25e6, true},
+		{"100%", 1e9, true},
+		{"0", 0, true},
+		{"1048576", 1048576, true},
+		{"500 MB", 5e8, true},
+		{"10GB", 1e10, true},
+		{"1.5kB", 1500, true},
+		{"20 B", 20, true},
+		{"", 0, false},
+		{"101%", 0, false},
+		{"-1", 0, false},
+		{"10 XB", 0, false},
+	}
+
+	for _, tc := range cases {
+		size, err := ParseSize(tc.s)
+		if (err == nil) != tc.ok {
+			t.Errorf("ParseSize(%q): unexpected error %v", tc.s, err)
+			continue
+		}
+		if b := size.Bytes(1e9); tc.ok && b != tc.bytes {
+			t.Errorf("ParseSize(%q).Bytes(1e9) = %d, expected %d", tc.s, b, tc.bytes)
+		}
+	}
+}
@@ -106,6 +106,11 @@ func (w *Wrapper) Raw() Configuration {
 	return w.cfg
 }
 
+// ConfigPath returns the path to the configuration file.
+func (w *Wrapper) ConfigPath() string {
+	return w.path
+}
+
 // Replace swaps the current configuration object for the given one.
 func (w *Wrapper) Replace(cfg Configuration) {
 	w.mut.Lock()
@@ -44,16 +44,13 @@ func NewBlockMap(db *leveldb.DB, folder string) *BlockMap {
 // Add files to the block map, ignoring any deleted or invalid files.
 func (m *BlockMap) Add(files []protocol.FileInfo) error {
 	batch := new(leveldb.Batch)
-	buf := make([]byte, 4)
+	buf := make([]byte, blockValueSize)
 	for _, file := range files {
 		if file.IsDirectory() || file.IsDeleted() || file.IsInvalid() {
 			continue
 		}
 
-		for i, block := range file.Blocks {
-			binary.BigEndian.PutUint32(buf, uint32(i))
-			batch.Put(m.blockKey(block.Hash, file.Name), buf)
-		}
+		m.putBlocks(batch, buf, file)
 	}
 	return m.db.Write(batch, nil)
 }
@@ -61,7 +58,7 @@ func (m *BlockMap) Add(files []protocol.FileInfo) error {
 // Update block map state, removing any deleted or invalid files.
 func (m *BlockMap) Update(files []protocol.FileInfo) error {
 	batch := new(leveldb.Batch)
-	buf := make([]byte, 4)
+	buf := make([]byte, blockValueSize)
 	for _, file := range files {
 		if file.IsDirectory() {
 			continue
@@ -74,14 +71,23 @@ func (m *BlockMap) Update(files []protocol.FileInfo) error {
 			continue
 		}
 
-		for i, block := range file.Blocks {
-			binary.BigEndian.PutUint32(buf, uint32(i))
-			batch.Put(m.blockKey(block.Hash, file.Name), buf)
-		}
+		m.putBlocks(batch, buf, file)
 	}
 	return m.db.Write(batch, nil)
 }
 
+// putBlocks adds an entry for each block of the file to the batch. The
+// offsets are calculated from the block sizes, as they are not necessarily
+// populated and blocks may be of varying size.
+func (m *BlockMap) putBlocks(batch *leveldb.Batch, buf []byte, file protocol.FileInfo) {
+	var offset int64
+	for i, block := range file.Blocks {
+		putBlockValue(buf, int32(i), offset)
+		batch.Put(m.blockKey(block.Hash, file.Name), buf)
+		offset += int64(block.Size)
+	}
+}
+
 // Discard block map state, removing the given files
 func (m *BlockMap) Discard(files []protocol.FileInfo) error {
 	batch := new(leveldb.Batch)
@@ -147,11 +153,12 @@ func (f *BlockFinder) Changed(cfg config.Configuration) error {
 }
 
 // An iterator function which iterates over all matching blocks for the given
-// hash. The iterator function has to return either true (if they are happy with
-// the block) or false to continue iterating for whatever reason.
+// hash. The iterator function is given the folder, file, index and offset of
+// the block, and has to return either true (if they are happy with the
+// block) or false to continue iterating for whatever reason.
 // The iterator finally returns the result, whether or not a satisfying block
 // was eventually found.
-func (f *BlockFinder) Iterate(hash []byte, iterFn func(string, string, int32) bool) bool {
+func (f *BlockFinder) Iterate(hash []byte, iterFn func(string, string, int32, int64) bool) bool {
 	f.mut.RLock()
 	folders := f.folders
 	f.mut.RUnlock()
@@ -162,8 +169,8 @@ func (f *BlockFinder) Iterate(hash []byte, iterFn func(string, string, int32) bo
 
 		for iter.Next() && iter.Error() == nil {
 			folder, file := fromBlockKey(iter.Key())
-			index := int32(binary.BigEndian.Uint32(iter.Value()))
-			if iterFn(folder, osutil.NativeFilename(file), index) {
+			index, offset := fromBlockValue(iter.Value())
+			if iterFn(folder, osutil.NativeFilename(file), index, offset) {
 				return true
 			}
 		}
@@ -173,9 +180,9 @@ func (f *BlockFinder) Iterate(hash []byte, iterFn func(string, string, int32) bo
 
 // A method for repairing incorrect blockmap entries, removes the old entry
 // and replaces it with a new entry for the given block
-func (f *BlockFinder) Fix(folder, file string, index int32, oldHash, newHash []byte) error {
-	buf := make([]byte, 4)
-	binary.BigEndian.PutUint32(buf, uint32(index))
+func (f *BlockFinder) Fix(folder, file string, index int32, offset int64, oldHash, newHash []byte) error {
+	buf := make([]byte, blockValueSize)
+	putBlockValue(buf, index, offset)
 
 	batch := new(leveldb.Batch)
 	batch.Delete(toBlockKey(oldHash, folder, file))
@@ -214,3 +221,23 @@ func fromBlockKey(data []byte) (string, string) {
 	}
 	return string(slice), file
 }
+
+// The block value encodes the following information:
+//	   block index (4 bytes)
+//	   block offset (8 bytes)
+const blockValueSize = 4 + 8
+
+func putBlockValue(buf []byte, index int32, offset int64) {
+	binary.BigEndian.PutUint32(buf, uint32(index))
+	binary.BigEndian.PutUint64(buf[4:], uint64(offset))
+}
+
+func fromBlockValue(data []byte) (int32, int64) {
+	index := int32(binary.BigEndian.Uint32(data))
+	if len(data) < blockValueSize {
+		// Entries written before the offset was stored, when all blocks
+		// were of the standard size.
+		return index, int64(index) * protocol.BlockSize
+	}
+	return index, int64(binary.BigEndian.Uint64(data[4:]))
+}
@@ -7,6 +7,7 @@
 package db
 
 import (
+	"encoding/binary"
 	"testing"
 
 	"github.com/syncthing/protocol"
@@ -94,21 +95,21 @@ func TestBlockMapAddUpdateWipe(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	f.Iterate(f1.Blocks[0].Hash, func(folder, file string, index int32) bool {
+	f.Iterate(f1.Blocks[0].Hash, func(folder, file string, index int32, offset int64) bool {
 		if folder != "folder1" || file != "f1" || index != 0 {
 			t.Fatal("Mismatch")
 		}
 		return true
 	})
 
-	f.Iterate(f2.Blocks[0].Hash, func(folder, file string, index int32) bool {
+	f.Iterate(f2.Blocks[0].Hash, func(folder, file string, index int32, offset int64) bool {
 		if folder != "folder1" || file != "f2" || index != 0 {
 			t.Fatal("Mismatch")
 		}
 		return true
 	})
 
-	f.Iterate(f3.Blocks[0].Hash, func(folder, file string, index int32) bool {
+	f.Iterate(f3.Blocks[0].Hash, func(folder, file string, index int32, offset int64) bool {
 		t.Fatal("Unexpected block")
 		return true
 	})
@@ -123,17 +124,17 @@ func TestBlockMapAddUpdateWipe(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	f.Iterate(f1.Blocks[0].Hash, func(folder, file string, index int32) bool {
+	f.Iterate(f1.Blocks[0].Hash, func(folder, file string, index int32, offset int64) bool {
 		t.Fatal("Unexpected block")
 		return false
 	})
 
-	f.Iterate(f2.Blocks[0].Hash, func(folder, file string, index int32) bool {
+	f.Iterate(f2.Blocks[0].Hash, func(folder, file string, index int32, offset int64) bool {
 		t.Fatal("Unexpected block")
 		return false
 	})
 
-	f.Iterate(f3.Blocks[0].Hash, func(folder, file string, index int32) bool {
+	f.Iterate(f3.Blocks[0].Hash, func(folder, file string, index int32, offset int64) bool {
 		if folder != "folder1" || file != "f3" || index != 0 {
 			t.Fatal("Mismatch")
 		}
@@ -180,7 +181,7 @@ func TestBlockFinderLookup(t *testing.T) {
 	}
 
 	counter := 0
-	f.Iterate(f1.Blocks[0].Hash, func(folder, file string, index int32) bool {
+	f.Iterate(f1.Blocks[0].Hash, func(folder, file string, index int32, offset int64) bool {
 		counter++
 		switch counter {
 		case 1:
@@ -208,7 +209,7 @@ func TestBlockFinderLookup(t *testing.T) {
 	}
 
 	counter = 0
-	f.Iterate(f1.Blocks[0].Hash, func(folder, file string, index int32) bool {
+	f.Iterate(f1.Blocks[0].Hash, func(folder, file string, index int32, offset int64) bool {
 		counter++
 		switch counter {
 		case 1:
@@ -230,7 +231,7 @@ func TestBlockFinderLookup(t *testing.T) {
 func TestBlockFinderFix(t *testing.T) {
 	db, f := setup()
 
-	iterFn := func(folder, file string, index int32) bool {
+	iterFn := func(folder, file string, index int32, offset int64) bool {
 		return true
 	}
 
@@ -244,7 +245,7 @@ func TestBlockFinderFix(t *testing.T) {
 		t.Fatal("Block not found")
 	}
 
-	err = f.Fix("folder1", f1.Name, 0, f1.Blocks[0].Hash, f2.Blocks[0].Hash)
+	err = f.Fix("folder1", f1.Name, 0, 0, f1.Blocks[0].Hash, f2.Blocks[0].Hash)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -257,3 +258,43 @@ func TestBlockFinderFix(t *testing.T) {
 		t.Fatal("Block not found")
 	}
 }
+
+func TestBlockFinderOffsets(t *testing.T) {
+	db, f := setup()
+
+	m := NewBlockMap(db, "folder1")
+	err := m.Add([]protocol.FileInfo{f1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The blocks of f1 are of varying size, so the offsets are not simply
+	// multiples of the block size.
+	var expected int64
+	for i, block := range f1.Blocks {
+		found := f.Iterate(block.Hash, func(folder, file string, index int32, offset int64) bool {
+			if index != int32(i) || offset != expected {
+				t.Errorf("Mismatch for block %d; index %d offset %d != %d", i, index, offset, expected)
+			}
+			return true
+		})
+		if !found {
+			t.Fatal("Block not found", i)
+		}
+		expected += int64(block.Size)
+	}
+
+	// Entries without an offset assume standard size blocks.
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, 3)
+	err = db.Put(toBlockKey(f2.Blocks[0].Hash, "folder1", f2.Name), buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Iterate(f2.Blocks[0].Hash, func(folder, file string, index int32, offset int64) bool {
+		if index != 3 || offset != 3*protocol.BlockSize {
+			t.Errorf("Mismatch for legacy entry; index %d offset %d", index, offset)
+		}
+		return true
+	})
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// A Conflict describes a conflict copy made when a file was changed on two
+// devices at the same time.
+type Conflict struct {
+	Name            string            `json:"name"`            // The file in conflict
+	ConflictName    string            `json:"conflictName"`    // The conflict copy
+	Version         protocol.Vector   `json:"version"`         // The version that was kept as Name
+	ConflictVersion protocol.Vector   `json:"conflictVersion"` // The version that was moved to ConflictName
+	Device          protocol.DeviceID `json:"device"`          // The device whose change caused the conflict
+	Time            time.Time         `json:"time"`
+}
+
+// A ConflictSet keeps track of the conflict copies in a folder.
+type ConflictSet struct {
+	db     *leveldb.DB
+	folder []byte
+}
+
+func NewConflictSet(db *leveldb.DB, folder string) *ConflictSet {
+	return &ConflictSet{
+		db:     db,
+		folder: []byte(folder),
+	}
+}
+
+// Add records the conflict, replacing any earlier one with the same conflict
+// copy.
+func (s *ConflictSet) Add(c Conflict) {
+	bs, err := json.Marshal(&c)
+	if err != nil {
+		panic(err)
+	}
+	if err := s.db.Put(conflictKey(s.folder, []byte(c.ConflictName)), bs, nil); err != nil {
+		panic(err)
+	}
+}
+
+// Get returns the conflict with the given conflict copy.
+func (s *ConflictSet) Get(conflictName string) (Conflict, bool) {
+	var c Conflict
+	bs, err := s.db.Get(conflictKey(s.folder, []byte(conflictName)), nil)
+	if err != nil {
+		return c, false
+	}
+	if err := json.Unmarshal(bs, &c); err != nil {
+		return c, false
+	}
+	return c, true
+}
+
+// Remove forgets the conflict with the given conflict copy. It is allowed to
+// remove a nonexistent conflict.
+func (s *ConflictSet) Remove(conflictName string) {
+	s.db.Delete(conflictKey(s.folder, []byte(conflictName)), nil)
+}
+
+// List returns all the conflicts, ordered by conflict copy.
+func (s *ConflictSet) List() []Conflict {
+	dbi := s.db.NewIterator(util.BytesPrefix(conflictKey(s.folder, nil)), nil)
+	defer dbi.Release()
+
+	var conflicts []Conflict
+	for dbi.Next() {
+		var c Conflict
+		if err := json.Unmarshal(dbi.Value(), &c); err != nil {
+			if debugDB {
+				l.Debugf("bad conflict %q: %v", dbi.Key(), err)
+			}
+			continue
+		}
+		conflicts = append(conflicts, c)
+	}
+	return conflicts
+}
+
+// conflictKey returns a byte slice encoding the following information:
+//	   keyTypeConflict (1 byte)
+//	   folder (64 bytes)
+//	   conflict copy name (variable size)
+func conflictKey(folder, name []byte) []byte {
+	k := make([]byte, 1+64+len(name))
+	k[0] = KeyTypeConflict
+	if len(folder) > 64 {
+		panic("folder name too long")
+	}
+	copy(k[1:], folder)
+	copy(k[1+64:], name)
+	return k
+}
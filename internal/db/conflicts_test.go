@@ -0,0 +1,53 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/syncthing/protocol"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestConflictSet(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewConflictSet(ldb, "folder")
+	other := NewConflictSet(ldb, "folder2")
+
+	s.Add(Conflict{Name: "b", ConflictName: "b.sync-conflict-20150101-120000", Version: protocol.Vector{{ID: 1, Value: 2}}})
+	s.Add(Conflict{Name: "a", ConflictName: "a.sync-conflict-20150101-120000"})
+	other.Add(Conflict{Name: "c", ConflictName: "c.sync-conflict-20150101-120000"})
+
+	list := s.List()
+	if len(list) != 2 || list[0].Name != "a" || list[1].Name != "b" {
+		t.Fatalf("Unexpected conflicts %v", list)
+	}
+
+	c, ok := s.Get("b.sync-conflict-20150101-120000")
+	if !ok {
+		t.Fatal("Conflict not found")
+	}
+	if !c.Version.Equal(protocol.Vector{{ID: 1, Value: 2}}) {
+		t.Errorf("Incorrect version %v", c.Version)
+	}
+	if _, ok := s.Get("c.sync-conflict-20150101-120000"); ok {
+		t.Error("Conflict in other folder should not be found")
+	}
+
+	s.Remove("a.sync-conflict-20150101-120000")
+	if list := s.List(); len(list) != 1 || list[0].Name != "b" {
+		t.Errorf("Unexpected conflicts after removal %v", list)
+	}
+	if list := other.List(); len(list) != 1 {
+		t.Errorf("Unexpected conflicts in other folder %v", list)
+	}
+}
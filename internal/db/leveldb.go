@@ -11,11 +11,13 @@ package db
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"runtime"
 	"sort"
 	"sync"
 
+	"github.com/calmh/xdr"
 	"github.com/syncthing/protocol"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
@@ -45,6 +47,8 @@ const (
 	KeyTypeBlock
 	KeyTypeDeviceStatistic
 	KeyTypeFolderStatistic
+	KeyTypeIndexID
+	KeyTypeConflict
 )
 
 type fileVersion struct {
@@ -159,6 +163,30 @@ func globalKeyFolder(key []byte) []byte {
 	return folder[:izero]
 }
 
+// indexIDKey returns a byte slice encoding the following information:
+//	   keyTypeIndexID (1 byte)
+//	   folder (64 bytes)
+//	   device (32 bytes)
+func indexIDKey(folder, device []byte) []byte {
+	k := make([]byte, 1+64+32)
+	k[0] = KeyTypeIndexID
+	if len(folder) > 64 {
+		panic("folder name too long")
+	}
+	copy(k[1:], []byte(folder))
+	copy(k[1+64:], device[:])
+	return k
+}
+
+func indexIDKeyFolder(key []byte) []byte {
+	folder := key[1 : 1+64]
+	izero := bytes.IndexByte(folder, 0)
+	if izero < 0 {
+		return folder
+	}
+	return folder[:izero]
+}
+
 type deletionHandler func(db dbReader, batch dbWriter, folder, device, name []byte, dbi iterator.Iterator) int64
 
 func ldbGenericReplace(db *leveldb.DB, folder, device []byte, fs []protocol.FileInfo, deleteFn deletionHandler) int64 {
@@ -444,7 +472,7 @@ func ldbInsert(batch dbWriter, folder, device []byte, file protocol.FileInfo) in
 	if debugDB {
 		l.Debugf("batch.Put %p %x", batch, nk)
 	}
-	batch.Put(nk, file.MustMarshalXDR())
+	batch.Put(nk, marshalFileInfo(file))
 
 	return file.LocalVersion
 }
@@ -643,7 +671,7 @@ func ldbGet(db *leveldb.DB, folder, device, file []byte) (protocol.FileInfo, boo
 	}
 
 	var f protocol.FileInfo
-	err = f.UnmarshalXDR(bs)
+	err = unmarshalFileInfo(bs, &f)
 	if err != nil {
 		panic(err)
 	}
@@ -969,6 +997,36 @@ func ldbDropFolder(db *leveldb.DB, folder []byte) {
 		}
 	}
 	dbi.Release()
+
+	// Remove the index IDs, so that a fresh index is exchanged with other
+	// devices the next time around.
+	dbi = snap.NewIterator(util.BytesPrefix([]byte{KeyTypeIndexID}), nil)
+	for dbi.Next() {
+		itemFolder := indexIDKeyFolder(dbi.Key())
+		if bytes.Compare(folder, itemFolder) == 0 {
+			db.Delete(dbi.Key(), nil)
+		}
+	}
+	dbi.Release()
+}
+
+// ldbGetIndexID returns the index ID and the index sequence stored for the
+// given folder and device, or zeroes if nothing is stored.
+func ldbGetIndexID(db dbReader, folder, device []byte) (uint64, int64) {
+	bs, err := db.Get(indexIDKey(folder, device), nil)
+	if err != nil || len(bs) != 16 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint64(bs), int64(binary.BigEndian.Uint64(bs[8:]))
+}
+
+func ldbPutIndexID(db *leveldb.DB, folder, device []byte, id uint64, seq int64) {
+	var bs [16]byte
+	binary.BigEndian.PutUint64(bs[:], id)
+	binary.BigEndian.PutUint64(bs[8:], uint64(seq))
+	if err := db.Put(indexIDKey(folder, device), bs[:], nil); err != nil {
+		panic(err)
+	}
 }
 
 func unmarshalTrunc(bs []byte, truncate bool) (FileIntf, error) {
@@ -978,11 +1036,58 @@ func unmarshalTrunc(bs []byte, truncate bool) (FileIntf, error) {
 		return tf, err
 	} else {
 		var tf protocol.FileInfo
-		err := tf.UnmarshalXDR(bs)
+		err := unmarshalFileInfo(bs, &tf)
 		return tf, err
 	}
 }
 
+// marshalFileInfo returns the database representation of the file; the XDR
+// encoded FileInfo followed by the weak hashes of the blocks and the MAC of
+// the file, as those are not part of the FileInfo encoding.
+func marshalFileInfo(f protocol.FileInfo) []byte {
+	var buf bytes.Buffer
+	xw := xdr.NewWriter(&buf)
+	f.EncodeXDRInto(xw)
+	xw.WriteUint32(uint32(len(f.Blocks)))
+	for _, b := range f.Blocks {
+		xw.WriteUint32(b.WeakHash)
+	}
+	xw.WriteBytes(f.MAC)
+	if err := xw.Error(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// unmarshalFileInfo is the inverse of marshalFileInfo. Files stored without
+// weak hashes or MAC are accepted and get none.
+func unmarshalFileInfo(bs []byte, f *protocol.FileInfo) error {
+	xr := xdr.NewReader(bytes.NewReader(bs))
+	if err := f.DecodeXDRFrom(xr); err != nil {
+		return err
+	}
+
+	n := int(xr.ReadUint32())
+	if xr.Error() != nil || n != len(f.Blocks) {
+		return nil
+	}
+	for i := range f.Blocks {
+		f.Blocks[i].WeakHash = xr.ReadUint32()
+	}
+	if xr.Error() != nil {
+		for i := range f.Blocks {
+			f.Blocks[i].WeakHash = 0
+		}
+		return nil
+	}
+
+	mac := xr.ReadBytesMax(protocol.MACSize)
+	if xr.Error() == nil && len(mac) > 0 {
+		f.MAC = mac
+	}
+	return nil
+}
+
 func ldbCheckGlobals(db *leveldb.DB, folder []byte) {
 	defer runtime.GC()
 
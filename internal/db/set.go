@@ -13,6 +13,8 @@
 package db
 
 import (
+	"crypto/rand"
+	"encoding/binary"
 	"sync"
 
 	"github.com/syncthing/protocol"
@@ -67,6 +69,13 @@ func NewFileSet(folder string, db *leveldb.DB) *FileSet {
 	}
 	clock(s.localVersion[protocol.LocalDeviceID])
 
+	if id, _ := ldbGetIndexID(db, []byte(folder), protocol.LocalDeviceID[:]); id == 0 {
+		// This is a new index, or one that has been dropped. Give it a new
+		// identity so that other devices know not to trust what they've
+		// seen of it previously.
+		ldbPutIndexID(db, []byte(folder), protocol.LocalDeviceID[:], newIndexID(), 0)
+	}
+
 	return &s
 }
 
@@ -214,6 +223,39 @@ func (s *FileSet) LocalVersion(device protocol.DeviceID) int64 {
 	return s.localVersion[device]
 }
 
+// IndexID returns the identity of the index for the given device. For the
+// local device this is the identity we announce to others; for remote
+// devices it's the identity they announced when we last received their
+// index. A zero index ID means that none is known.
+func (s *FileSet) IndexID(device protocol.DeviceID) uint64 {
+	id, _ := ldbGetIndexID(s.db, []byte(s.folder), device[:])
+	return id
+}
+
+// SetIndexID records the index identity for the given device. The index
+// sequence for the device is reset to zero.
+func (s *FileSet) SetIndexID(device protocol.DeviceID, id uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ldbPutIndexID(s.db, []byte(s.folder), device[:], id, 0)
+}
+
+// IndexSequence returns the highest local version of the given device's
+// index up to which we are known to have received all files.
+func (s *FileSet) IndexSequence(device protocol.DeviceID) int64 {
+	_, seq := ldbGetIndexID(s.db, []byte(s.folder), device[:])
+	return seq
+}
+
+// SetIndexSequence records that we have received all files of the given
+// device's index up to and including the given local version.
+func (s *FileSet) SetIndexSequence(device protocol.DeviceID, seq int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id, _ := ldbGetIndexID(s.db, []byte(s.folder), device[:])
+	ldbPutIndexID(s.db, []byte(s.folder), device[:], id, seq)
+}
+
 // ListFolders returns the folder IDs seen in the database.
 func ListFolders(db *leveldb.DB) []string {
 	return ldbListFolders(db)
@@ -230,6 +272,19 @@ func DropFolder(db *leveldb.DB, folder string) {
 	bm.Drop()
 }
 
+// newIndexID returns a new random, non-zero index ID.
+func newIndexID() uint64 {
+	var bs [8]byte
+	for {
+		if _, err := rand.Read(bs[:]); err != nil {
+			panic(err)
+		}
+		if id := binary.BigEndian.Uint64(bs[:]); id != 0 {
+			return id
+		}
+	}
+}
+
 func normalizeFilenames(fs []protocol.FileInfo) {
 	for i := range fs {
 		fs[i].Name = osutil.NormalizedFilename(fs[i].Name)
@@ -792,6 +792,127 @@ func TestListDropFolder(t *testing.T) {
 	}
 }
 
+func TestIndexID(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := db.NewFileSet("test", ldb)
+
+	// The local index gets an ID on creation, which is stable across
+	// reopening the set.
+
+	id := s.IndexID(protocol.LocalDeviceID)
+	if id == 0 {
+		t.Fatal("Local index ID should be set")
+	}
+	s = db.NewFileSet("test", ldb)
+	if s.IndexID(protocol.LocalDeviceID) != id {
+		t.Error("Local index ID should not change when reopening")
+	}
+
+	// Remote index IDs and sequences are whatever we set them to.
+
+	if s.IndexID(remoteDevice0) != 0 || s.IndexSequence(remoteDevice0) != 0 {
+		t.Error("Remote index ID and sequence should be unset")
+	}
+	s.SetIndexID(remoteDevice0, 42)
+	s.SetIndexSequence(remoteDevice0, 1234)
+	if v := s.IndexID(remoteDevice0); v != 42 {
+		t.Errorf("Incorrect remote index ID %d != 42", v)
+	}
+	if v := s.IndexSequence(remoteDevice0); v != 1234 {
+		t.Errorf("Incorrect remote index sequence %d != 1234", v)
+	}
+
+	// Setting a new index ID resets the sequence.
+
+	s.SetIndexID(remoteDevice0, 43)
+	if v := s.IndexSequence(remoteDevice0); v != 0 {
+		t.Errorf("Incorrect remote index sequence %d != 0", v)
+	}
+
+	// Dropping the folder gives the local index a new identity.
+
+	db.DropFolder(ldb, "test")
+	s = db.NewFileSet("test", ldb)
+	if v := s.IndexID(protocol.LocalDeviceID); v == 0 || v == id {
+		t.Errorf("Local index ID should be new after drop, not %d", v)
+	}
+	if v := s.IndexID(remoteDevice0); v != 0 {
+		t.Errorf("Remote index ID should be unset after drop, not %d", v)
+	}
+}
+
+func TestWeakHashes(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := db.NewFileSet("test", ldb)
+
+	s.Update(remoteDevice0, []protocol.FileInfo{
+		{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1000}}, Blocks: []protocol.BlockInfo{
+			{Size: 1, Hash: []byte{1}, WeakHash: 11},
+			{Size: 2, Hash: []byte{2}, WeakHash: 22},
+		}},
+		{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1000}}, Blocks: []protocol.BlockInfo{
+			{Size: 3, Hash: []byte{3}},
+		}},
+	})
+
+	f, ok := s.Get(remoteDevice0, "a")
+	if !ok {
+		t.Fatal("File not found")
+	}
+	if len(f.Blocks) != 2 || f.Blocks[0].WeakHash != 11 || f.Blocks[1].WeakHash != 22 {
+		t.Errorf("Incorrect weak hashes in %v", f.Blocks)
+	}
+
+	f, ok = s.GetGlobal("b")
+	if !ok {
+		t.Fatal("File not found")
+	}
+	if len(f.Blocks) != 1 || f.Blocks[0].WeakHash != 0 {
+		t.Errorf("Incorrect weak hashes in %v", f.Blocks)
+	}
+}
+
+func TestMAC(t *testing.T) {
+	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := db.NewFileSet("test", ldb)
+
+	mac := bytes.Repeat([]byte{42}, protocol.MACSize)
+	s.Update(remoteDevice0, []protocol.FileInfo{
+		{Name: "a", Version: protocol.Vector{{ID: myID, Value: 1000}}, MAC: mac, Blocks: []protocol.BlockInfo{
+			{Size: 1, Hash: []byte{1}, WeakHash: 11},
+		}},
+		{Name: "b", Version: protocol.Vector{{ID: myID, Value: 1000}}},
+	})
+
+	f, ok := s.GetGlobal("a")
+	if !ok {
+		t.Fatal("File not found")
+	}
+	if !bytes.Equal(f.MAC, mac) || f.Blocks[0].WeakHash != 11 {
+		t.Errorf("Incorrect MAC %x", f.MAC)
+	}
+
+	f, ok = s.Get(remoteDevice0, "b")
+	if !ok {
+		t.Fatal("File not found")
+	}
+	if f.MAC != nil {
+		t.Errorf("Unexpected MAC %x", f.MAC)
+	}
+}
+
 func TestGlobalNeedWithInvalid(t *testing.T) {
 	ldb, err := leveldb.Open(storage.NewMemStorage(), nil)
 	if err != nil {
@@ -8,6 +8,7 @@ package discover
 
 import (
 	"encoding/hex"
+	"fmt"
 	"io"
 	"net"
 	"net/url"
@@ -16,6 +17,7 @@ import (
 	"time"
 
 	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/proxy"
 )
 
 func init() {
@@ -39,6 +41,7 @@ type UDPClient struct {
 	stop          chan struct{}
 	wg            sync.WaitGroup
 	listenAddress *net.UDPAddr
+	proxy         *url.URL
 
 	globalBroadcastInterval time.Duration
 	errorRetryInterval      time.Duration
@@ -61,6 +64,17 @@ func (d *UDPClient) Start(uri *url.URL, pkt *Announce) error {
 	}
 	d.listenAddress = addr
 
+	if p := params.Get("proxy"); p != "" {
+		// Datagrams can only be relayed by SOCKS5 proxies.
+		d.proxy, err = url.Parse(p)
+		if err != nil {
+			return err
+		}
+		if d.proxy.Scheme != "socks5" {
+			return fmt.Errorf("discover %s: unsupported proxy %s", d.url, proxy.String(d.proxy))
+		}
+	}
+
 	broadcastSeconds, err := strconv.ParseUint(params.Get("broadcast"), 0, 0)
 	if err != nil {
 		d.globalBroadcastInterval = DefaultGlobalBroadcastInterval
@@ -83,7 +97,7 @@ func (d *UDPClient) Start(uri *url.URL, pkt *Announce) error {
 func (d *UDPClient) broadcast(pkt []byte) {
 	defer d.wg.Done()
 
-	conn, err := net.ListenUDP(d.url.Scheme, d.listenAddress)
+	conn, err := d.listen()
 	for err != nil {
 		if debug {
 			l.Debugf("discover %s: broadcast listen: %v; trying again in %v", d.url, err, d.errorRetryInterval)
@@ -93,7 +107,7 @@ func (d *UDPClient) broadcast(pkt []byte) {
 			return
 		case <-time.After(d.errorRetryInterval):
 		}
-		conn, err = net.ListenUDP(d.url.Scheme, d.listenAddress)
+		conn, err = d.listen()
 	}
 	defer conn.Close()
 
@@ -163,7 +177,7 @@ func (d *UDPClient) Lookup(device protocol.DeviceID) []string {
 		return nil
 	}
 
-	conn, err := net.DialUDP(d.url.Scheme, d.listenAddress, extIP)
+	conn, err := d.dial(extIP)
 	if err != nil {
 		if debug {
 			l.Debugf("discover %s: Lookup(%s): %s", d.url, device, err)
@@ -222,6 +236,20 @@ func (d *UDPClient) Lookup(device protocol.DeviceID) []string {
 	return addrs
 }
 
+func (d *UDPClient) listen() (net.PacketConn, error) {
+	if d.proxy != nil {
+		return proxy.ListenPacket(d.proxy)
+	}
+	return net.ListenUDP(d.url.Scheme, d.listenAddress)
+}
+
+func (d *UDPClient) dial(raddr *net.UDPAddr) (net.Conn, error) {
+	if d.proxy != nil {
+		return proxy.DialUDP(d.proxy, raddr)
+	}
+	return net.DialUDP(d.url.Scheme, d.listenAddress, raddr)
+}
+
 func (d *UDPClient) Stop() {
 	if d.stop != nil {
 		close(d.stop)
@@ -163,6 +163,15 @@ func (d *Discoverer) StartGlobal(servers []string, extPort uint16) {
 	}
 }
 
+// SetListenAddresses changes the addresses we announce. The local
+// announcements pick up the change by themselves, the global ones when
+// StartGlobal is called again.
+func (d *Discoverer) SetListenAddresses(addresses []string) {
+	d.mut.Lock()
+	d.listenAddrs = addresses
+	d.mut.Unlock()
+}
+
 func (d *Discoverer) StopGlobal() {
 	d.mut.Lock()
 	defer d.mut.Unlock()
@@ -309,15 +318,17 @@ func (d *Discoverer) announcementPkt() *Announce {
 }
 
 func (d *Discoverer) sendLocalAnnouncements() {
-	var addrs = resolveAddrs(d.listenAddrs)
+	for {
+		d.mut.RLock()
+		addrs := resolveAddrs(d.listenAddrs)
+		d.mut.RUnlock()
 
-	var pkt = Announce{
-		Magic: AnnouncementMagic,
-		This:  Device{d.myID[:], addrs},
-	}
-	msg := pkt.MustMarshalXDR()
+		var pkt = Announce{
+			Magic: AnnouncementMagic,
+			This:  Device{d.myID[:], addrs},
+		}
+		msg := pkt.MustMarshalXDR()
 
-	for {
 		for _, b := range d.beacons {
 			b.Send(msg)
 		}
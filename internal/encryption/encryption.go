@@ -0,0 +1,326 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package encryption implements the encryption of file names, block hashes
+// and file contents for devices that are not trusted with the plain text of
+// a folder.
+//
+// All encryption is deterministic, so that the same file always gives the
+// same encrypted name, blocks and hashes. This lets the untrusted device
+// store, deduplicate and pass on the encrypted data like it would any other
+// data, without being able to read it. The synthetic IV of each encrypted
+// name and hash also serves as a check that it has not been tampered with;
+// the block data is checked against the decrypted hash. The rest of the file
+// metadata is authenticated by a MAC that is sent along with the file.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/syncthing/protocol"
+)
+
+const (
+	ivSize = aes.BlockSize
+
+	// The number of PBKDF2 rounds used to derive the key from the password.
+	keyRounds = 1 << 16
+
+	// Encrypted name components longer than this are split over several
+	// directories, as most file systems don't allow names longer than 255
+	// bytes. The limit leaves room for the temporary and conflict file names
+	// made from the component.
+	maxNameComponent = 200
+
+	// The suffix that marks a directory as holding the rest of a split name
+	// component. It's not part of the base32 alphabet.
+	nameContinuation = "-"
+)
+
+var (
+	ErrInvalidName = errors.New("invalid encrypted name")
+	ErrInvalidHash = errors.New("invalid encrypted hash")
+	ErrInvalidFile = errors.New("invalid encrypted file metadata")
+)
+
+// Encrypted name components are base32 encoded, with the padding removed.
+// Being all upper case, they survive case insensitive file systems.
+var nameEncoding = base32.StdEncoding
+
+// A Key encrypts and decrypts the contents of a single folder.
+type Key struct {
+	name siv
+	hash siv
+	data siv
+	meta siv
+}
+
+// NewKey returns the key for the given folder and password.
+func NewKey(folder, password string) *Key {
+	master := pbkdf2([]byte(password), []byte("syncthing"+folder), keyRounds)
+	return &Key{
+		name: newSIV(master, "name"),
+		hash: newSIV(master, "hash"),
+		data: newSIV(master, "data"),
+		meta: newSIV(master, "meta"),
+	}
+}
+
+// EncryptName returns the encrypted version of the file name. Each path
+// component is encrypted separately, so the directory structure is kept.
+// Long components are split over several directories; see NameDirs.
+func (k *Key) EncryptName(name string) string {
+	parts := strings.Split(filepath.ToSlash(name), "/")
+	enc := make([]string, 0, len(parts))
+	for i, part := range parts {
+		// The IV depends on the full path up to and including this
+		// component, so that the same name in different directories gives
+		// different results.
+		prefix := strings.Join(parts[:i+1], "/")
+		iv := k.name.iv([]byte(prefix))
+		ct := k.name.xor(iv, []byte(part))
+		e := strings.TrimRight(nameEncoding.EncodeToString(append(iv, ct...)), "=")
+		for len(e) > maxNameComponent {
+			enc = append(enc, e[:maxNameComponent]+nameContinuation)
+			e = e[maxNameComponent:]
+		}
+		enc = append(enc, e)
+	}
+	return filepath.FromSlash(strings.Join(enc, "/"))
+}
+
+// DecryptName returns the plain text version of an encrypted file name.
+func (k *Key) DecryptName(name string) (string, error) {
+	var dec []string
+	var cur string
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if strings.HasSuffix(part, nameContinuation) {
+			if len(part) != maxNameComponent+len(nameContinuation) {
+				return "", ErrInvalidName
+			}
+			cur += strings.TrimSuffix(part, nameContinuation)
+			continue
+		}
+		if len(part) > maxNameComponent {
+			return "", ErrInvalidName
+		}
+		part = cur + part
+		cur = ""
+
+		if pad := len(part) % 8; pad != 0 {
+			part += strings.Repeat("=", 8-pad)
+		}
+		bs, err := nameEncoding.DecodeString(part)
+		if err != nil || len(bs) < ivSize {
+			return "", ErrInvalidName
+		}
+
+		iv := bs[:ivSize]
+		dec = append(dec, string(k.name.xor(iv, bs[ivSize:])))
+		prefix := strings.Join(dec, "/")
+		if !hmac.Equal(iv, k.name.iv([]byte(prefix))) {
+			return "", ErrInvalidName
+		}
+	}
+	if cur != "" {
+		return "", ErrInvalidName
+	}
+	return filepath.FromSlash(strings.Join(dec, "/")), nil
+}
+
+// NameDirs returns the directories that the encrypted name is split over,
+// outermost first. They are not in the index, so whoever stores the
+// encrypted files must create them as needed.
+func NameDirs(name string) []string {
+	var dirs []string
+	parts := strings.Split(filepath.ToSlash(name), "/")
+	for i, part := range parts[:len(parts)-1] {
+		if strings.HasSuffix(part, nameContinuation) {
+			dirs = append(dirs, filepath.FromSlash(strings.Join(parts[:i+1], "/")))
+		}
+	}
+	return dirs
+}
+
+// EncryptHash returns the encrypted version of a block hash.
+func (k *Key) EncryptHash(hash []byte) []byte {
+	iv := k.hash.iv(hash)
+	return append(iv, k.hash.xor(iv, hash)...)
+}
+
+// DecryptHash returns the plain text version of an encrypted block hash.
+func (k *Key) DecryptHash(enc []byte) ([]byte, error) {
+	if len(enc) < ivSize {
+		return nil, ErrInvalidHash
+	}
+	iv := enc[:ivSize]
+	hash := k.hash.xor(iv, enc[ivSize:])
+	if !hmac.Equal(iv, k.hash.iv(hash)) {
+		return nil, ErrInvalidHash
+	}
+	return hash, nil
+}
+
+// EncryptBlock encrypts the block data in place. The hash is the plain text
+// hash of the block. The encrypted block is of the same size.
+func (k *Key) EncryptBlock(data, hash []byte) {
+	k.data.xorInPlace(k.data.iv(hash), data)
+}
+
+// DecryptBlock decrypts the block data in place. The hash is the plain text
+// hash of the block, which the data should be verified against afterwards.
+func (k *Key) DecryptBlock(data, hash []byte) {
+	k.data.xorInPlace(k.data.iv(hash), data)
+}
+
+// EncryptFile returns the file as it is presented to an untrusted device,
+// with the name and block hashes encrypted. The blocks keep their sizes, as
+// encrypting the data doesn't change it. The weak hashes are dropped, as
+// they would reveal things about the contents.
+//
+// The file carries the MAC of the plain text metadata, so that the
+// untrusted device can't change the flags, modification time, version or
+// blocks of the file, for example to delete it everywhere.
+func (k *Key) EncryptFile(f protocol.FileInfo) protocol.FileInfo {
+	f.MAC = k.fileMAC(f)
+	f.Name = k.EncryptName(f.Name)
+	blocks := make([]protocol.BlockInfo, len(f.Blocks))
+	for i, b := range f.Blocks {
+		blocks[i] = protocol.BlockInfo{
+			Offset: b.Offset,
+			Size:   b.Size,
+			Hash:   k.EncryptHash(b.Hash),
+		}
+	}
+	f.Blocks = blocks
+	return f
+}
+
+// DecryptFile returns the plain text version of a file that was encrypted
+// with EncryptFile.
+func (k *Key) DecryptFile(f protocol.FileInfo) (protocol.FileInfo, error) {
+	if len(f.MAC) != protocol.MACSize {
+		return protocol.FileInfo{}, ErrInvalidFile
+	}
+	mac := f.MAC
+	f.MAC = nil
+
+	name, err := k.DecryptName(f.Name)
+	if err != nil {
+		return protocol.FileInfo{}, err
+	}
+	f.Name = name
+
+	blocks := make([]protocol.BlockInfo, len(f.Blocks))
+	for i, b := range f.Blocks {
+		hash, err := k.DecryptHash(b.Hash)
+		if err != nil {
+			return protocol.FileInfo{}, err
+		}
+		blocks[i] = protocol.BlockInfo{
+			Offset: b.Offset,
+			Size:   b.Size,
+			Hash:   hash,
+		}
+	}
+	f.Blocks = blocks
+
+	if !hmac.Equal(mac, k.fileMAC(f)) {
+		return protocol.FileInfo{}, ErrInvalidFile
+	}
+	return f, nil
+}
+
+// fileMAC returns the MAC of the plain text file metadata.
+func (k *Key) fileMAC(f protocol.FileInfo) []byte {
+	mac := hmac.New(sha256.New, k.meta.mac)
+	name := filepath.ToSlash(f.Name)
+	binary.Write(mac, binary.BigEndian, uint32(len(name)))
+	mac.Write([]byte(name))
+	binary.Write(mac, binary.BigEndian, f.Flags)
+	binary.Write(mac, binary.BigEndian, f.Modified)
+	binary.Write(mac, binary.BigEndian, uint32(len(f.Version)))
+	for _, c := range f.Version {
+		binary.Write(mac, binary.BigEndian, c.ID)
+		binary.Write(mac, binary.BigEndian, c.Value)
+	}
+	binary.Write(mac, binary.BigEndian, uint32(len(f.Blocks)))
+	for _, b := range f.Blocks {
+		binary.Write(mac, binary.BigEndian, b.Size)
+		binary.Write(mac, binary.BigEndian, uint32(len(b.Hash)))
+		mac.Write(b.Hash)
+	}
+	return mac.Sum(nil)
+}
+
+// siv implements deterministic encryption; the IV is the MAC of the plain
+// text, and the plain text is encrypted with AES in CTR mode.
+type siv struct {
+	mac   []byte
+	block cipher.Block
+}
+
+func newSIV(master []byte, purpose string) siv {
+	block, err := aes.NewCipher(hmacSHA256(master, []byte(purpose+"-enc")))
+	if err != nil {
+		panic(err) // can't happen, the key is of a valid size
+	}
+	return siv{
+		mac:   hmacSHA256(master, []byte(purpose+"-mac")),
+		block: block,
+	}
+}
+
+func (s siv) iv(data []byte) []byte {
+	return hmacSHA256(s.mac, data)[:ivSize]
+}
+
+func (s siv) xor(iv, data []byte) []byte {
+	out := make([]byte, len(data))
+	cipher.NewCTR(s.block, iv).XORKeyStream(out, data)
+	return out
+}
+
+func (s siv) xorInPlace(iv, data []byte) {
+	cipher.NewCTR(s.block, iv).XORKeyStream(data, data)
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pbkdf2 returns a 32 byte key derived from the password, as per RFC 2898
+// with HMAC-SHA256.
+func pbkdf2(password, salt []byte, rounds int) []byte {
+	mac := hmac.New(sha256.New, password)
+	var idx [4]byte
+	binary.BigEndian.PutUint32(idx[:], 1)
+	mac.Write(salt)
+	mac.Write(idx[:])
+	u := mac.Sum(nil)
+
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < rounds; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
@@ -0,0 +1,307 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package encryption
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/syncthing/protocol"
+)
+
+var testKey = NewKey("default", "password")
+
+func TestPBKDF2(t *testing.T) {
+	// Test vector from RFC 7914
+	key := pbkdf2([]byte("passwd"), []byte("salt"), 1)
+	if exp := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"; hex.EncodeToString(key) != exp {
+		t.Errorf("Incorrect key %x != %s", key, exp)
+	}
+
+	key = pbkdf2([]byte("password"), []byte("syncthingdefault"), 3)
+	if exp := "b68224b639ec6b904cf7936b0ebe27b1f3eda8e74f587200e795d1c19143f813"; hex.EncodeToString(key) != exp {
+		t.Errorf("Incorrect key %x != %s", key, exp)
+	}
+}
+
+func TestName(t *testing.T) {
+	names := []string{
+		"foo",
+		"foo/bar",
+		"foo/bar/baz.txt",
+		"räksmörgås",
+		strings.Repeat("x", 100),
+	}
+
+	for _, name := range names {
+		name = filepath.FromSlash(name)
+		enc := testKey.EncryptName(name)
+		if enc == name {
+			t.Errorf("Name %q not encrypted", name)
+		}
+		if strings.Count(enc, string(filepath.Separator)) != strings.Count(name, string(filepath.Separator)) {
+			t.Errorf("Directory structure not kept for %q: %q", name, enc)
+		}
+		if strings.ToUpper(enc) != enc {
+			t.Errorf("Encrypted name %q is not upper case", enc)
+		}
+		if enc2 := testKey.EncryptName(name); enc2 != enc {
+			t.Errorf("Encryption of %q is not deterministic; %q != %q", name, enc, enc2)
+		}
+
+		dec, err := testKey.DecryptName(enc)
+		if err != nil {
+			t.Errorf("Decrypting %q: %v", enc, err)
+		} else if dec != name {
+			t.Errorf("Incorrect decryption %q != %q", dec, name)
+		}
+	}
+}
+
+func TestNameLong(t *testing.T) {
+	long := strings.Repeat("x", 255)
+	names := []string{
+		long,
+		"foo/" + long,
+		long + "/" + long + "/bar",
+	}
+
+	for _, name := range names {
+		name = filepath.FromSlash(name)
+		enc := testKey.EncryptName(name)
+		for _, part := range strings.Split(filepath.ToSlash(enc), "/") {
+			if len(part) > 255-len(".syncthing..tmp") {
+				t.Errorf("Too long component %q in %q", part, enc)
+			}
+		}
+		if strings.ToUpper(enc) != enc {
+			t.Errorf("Encrypted name %q is not upper case", enc)
+		}
+
+		dec, err := testKey.DecryptName(enc)
+		if err != nil {
+			t.Errorf("Decrypting %q: %v", enc, err)
+		} else if dec != name {
+			t.Errorf("Incorrect decryption %q != %q", dec, name)
+		}
+
+		// The directories of the split name are the same for all files in
+		// the same directory.
+		dirs := NameDirs(enc)
+		if len(dirs) == 0 {
+			t.Errorf("No directories for split name %q", enc)
+		}
+		sub := testKey.EncryptName(filepath.Join(name, "baz"))
+		if !strings.HasPrefix(sub, enc+string(filepath.Separator)) {
+			t.Errorf("Incorrect name %q in directory %q", sub, enc)
+		}
+		if !reflect.DeepEqual(NameDirs(sub), dirs) {
+			t.Errorf("Incorrect directories %v != %v", NameDirs(sub), dirs)
+		}
+	}
+
+	if dirs := NameDirs(testKey.EncryptName(filepath.FromSlash("foo/bar"))); dirs != nil {
+		t.Errorf("Unexpected directories %v", dirs)
+	}
+
+	// The split can't be moved or left unfinished
+	enc := filepath.ToSlash(testKey.EncryptName(long))
+	parts := strings.Split(enc, "/")
+	invalid := []string{
+		parts[0],
+		parts[0][:len(parts[0])-2] + "-/" + parts[0][len(parts[0])-2:len(parts[0])-1] + parts[1],
+		strings.TrimSuffix(parts[0], "-") + parts[1],
+	}
+	for _, name := range invalid {
+		if dec, err := testKey.DecryptName(filepath.FromSlash(name)); err == nil {
+			t.Errorf("Unexpected decryption of %q as %q", name, dec)
+		}
+	}
+}
+
+func TestNameDirectories(t *testing.T) {
+	// The same name in different directories is encrypted differently, but
+	// files in the same directory share the directory part.
+	a := strings.Split(filepath.ToSlash(testKey.EncryptName(filepath.FromSlash("a/foo"))), "/")
+	b := strings.Split(filepath.ToSlash(testKey.EncryptName(filepath.FromSlash("b/foo"))), "/")
+	c := strings.Split(filepath.ToSlash(testKey.EncryptName(filepath.FromSlash("a/bar"))), "/")
+
+	if a[1] == b[1] {
+		t.Error("Same encryption for the same name in different directories")
+	}
+	if a[0] != c[0] {
+		t.Error("Different encryption for the same directory")
+	}
+}
+
+func TestNameInvalid(t *testing.T) {
+	enc := testKey.EncryptName("foo")
+
+	invalid := []string{
+		"foo",
+		"",
+		enc[:len(enc)-1],
+		"A" + enc[1:],
+		enc + "/foo",
+	}
+	if enc[0] == 'A' {
+		invalid[3] = "B" + enc[1:]
+	}
+
+	for _, name := range invalid {
+		if dec, err := testKey.DecryptName(name); err == nil {
+			t.Errorf("Unexpected decryption of %q as %q", name, dec)
+		}
+	}
+
+	if _, err := NewKey("default", "other").DecryptName(enc); err == nil {
+		t.Error("Unexpected decryption with other password")
+	}
+	if _, err := NewKey("other", "password").DecryptName(enc); err == nil {
+		t.Error("Unexpected decryption with other folder")
+	}
+}
+
+func TestHash(t *testing.T) {
+	hash := sha256.Sum256([]byte("some data"))
+
+	enc := testKey.EncryptHash(hash[:])
+	if len(enc) > 64 {
+		t.Errorf("Encrypted hash too long; %d > 64", len(enc))
+	}
+	if bytes.Contains(enc, hash[:]) {
+		t.Error("Hash not encrypted")
+	}
+
+	dec, err := testKey.DecryptHash(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dec, hash[:]) {
+		t.Errorf("Incorrect decryption %x != %x", dec, hash)
+	}
+
+	enc[len(enc)-1]++
+	if _, err := testKey.DecryptHash(enc); err == nil {
+		t.Error("Unexpected decryption of modified hash")
+	}
+}
+
+func TestBlock(t *testing.T) {
+	data := []byte("some data that we want to keep secret")
+	hash := sha256.Sum256(data)
+
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	testKey.EncryptBlock(buf, hash[:])
+	if bytes.Equal(buf, data) {
+		t.Fatal("Block not encrypted")
+	}
+
+	// The same data with the same hash always gives the same result.
+	buf2 := make([]byte, len(data))
+	copy(buf2, data)
+	testKey.EncryptBlock(buf2, hash[:])
+	if !bytes.Equal(buf, buf2) {
+		t.Error("Encryption is not deterministic")
+	}
+
+	testKey.DecryptBlock(buf, hash[:])
+	if !bytes.Equal(buf, data) {
+		t.Error("Incorrect decryption")
+	}
+}
+
+func TestFile(t *testing.T) {
+	f := protocol.FileInfo{
+		Name:     filepath.FromSlash("foo/bar"),
+		Flags:    0644,
+		Modified: 1234,
+		Version:  protocol.Vector{{ID: 1, Value: 2}},
+		Blocks: []protocol.BlockInfo{
+			{Offset: 0, Size: 10, Hash: []byte("0123456789abcdef0123456789abcdef"), WeakHash: 42},
+			{Offset: 10, Size: 5, Hash: []byte("fedcba9876543210fedcba9876543210"), WeakHash: 43},
+		},
+	}
+
+	enc := testKey.EncryptFile(f)
+	if enc.Name == f.Name || enc.Flags != f.Flags || enc.Modified != f.Modified || !enc.Version.Equal(f.Version) || len(enc.MAC) != protocol.MACSize {
+		t.Errorf("Incorrect encrypted file %v", enc)
+	}
+	for i, b := range enc.Blocks {
+		if b.Size != f.Blocks[i].Size || b.Offset != f.Blocks[i].Offset {
+			t.Errorf("Incorrect encrypted block %v", b)
+		}
+		if bytes.Equal(b.Hash, f.Blocks[i].Hash) || b.WeakHash != 0 {
+			t.Errorf("Block %v not encrypted", b)
+		}
+	}
+	if string(f.Blocks[0].Hash) != "0123456789abcdef0123456789abcdef" {
+		t.Error("Original file modified")
+	}
+
+	dec, err := testKey.DecryptFile(enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec.Name != f.Name {
+		t.Errorf("Incorrect name %q != %q", dec.Name, f.Name)
+	}
+	if !dec.Version.Equal(f.Version) {
+		t.Errorf("Incorrect version %v != %v", dec.Version, f.Version)
+	}
+	if dec.MAC != nil {
+		t.Errorf("Unexpected MAC %x", dec.MAC)
+	}
+	for i, b := range dec.Blocks {
+		if !bytes.Equal(b.Hash, f.Blocks[i].Hash) {
+			t.Errorf("Incorrect hash %x != %x", b.Hash, f.Blocks[i].Hash)
+		}
+	}
+
+	enc.Blocks[1].Hash = enc.Blocks[0].Hash[:20]
+	if _, err := testKey.DecryptFile(enc); err == nil {
+		t.Error("Unexpected decryption of modified file")
+	}
+}
+
+func TestFileMetadata(t *testing.T) {
+	f := protocol.FileInfo{
+		Name:     "foo",
+		Flags:    0644,
+		Modified: 1234,
+		Version:  protocol.Vector{{ID: 1, Value: 2}},
+		Blocks: []protocol.BlockInfo{
+			{Offset: 0, Size: 10, Hash: []byte("0123456789abcdef0123456789abcdef")},
+		},
+	}
+
+	tamper := []func(*protocol.FileInfo){
+		func(f *protocol.FileInfo) { f.Flags |= protocol.FlagDeleted },
+		func(f *protocol.FileInfo) { f.Modified++ },
+		func(f *protocol.FileInfo) { f.Version = f.Version.Update(3) },
+		func(f *protocol.FileInfo) { f.Version[0].Value++ },
+		func(f *protocol.FileInfo) { f.Version = f.Version[1:] },
+		func(f *protocol.FileInfo) { f.Blocks = f.Blocks[:0] },
+		func(f *protocol.FileInfo) { f.Blocks[0].Size++ },
+		func(f *protocol.FileInfo) { f.MAC = nil },
+		func(f *protocol.FileInfo) { f.MAC[0]++ },
+		func(f *protocol.FileInfo) { f.MAC = f.MAC[:4] },
+	}
+	for i, fn := range tamper {
+		enc := testKey.EncryptFile(f)
+		fn(&enc)
+		if _, err := testKey.DecryptFile(enc); err == nil {
+			t.Errorf("%d: Unexpected decryption of tampered file", i)
+		}
+	}
+}
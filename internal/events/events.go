@@ -33,6 +33,12 @@ const (
 	DownloadProgress
 	FolderSummary
 	FolderCompletion
+	ConflictDetected
+	FolderErrors
+	FolderPaused
+	FolderResumed
+	DevicePaused
+	DeviceResumed
 
 	AllEvents = (1 << iota) - 1
 )
@@ -73,6 +79,18 @@ func (t EventType) String() string {
 		return "FolderSummary"
 	case FolderCompletion:
 		return "FolderCompletion"
+	case ConflictDetected:
+		return "ConflictDetected"
+	case FolderErrors:
+		return "FolderErrors"
+	case FolderPaused:
+		return "FolderPaused"
+	case FolderResumed:
+		return "FolderResumed"
+	case DevicePaused:
+		return "DevicePaused"
+	case DeviceResumed:
+		return "DeviceResumed"
 	default:
 		return "Unknown"
 	}
@@ -8,46 +8,152 @@ package model
 
 import (
 	"sync"
+	"time"
 
 	"github.com/syncthing/protocol"
 )
 
-// deviceActivity tracks the number of outstanding requests per device and can
-// answer which device is least busy. It is safe for use from multiple
-// goroutines.
+const (
+	// Assumed for devices we haven't received any blocks from yet.
+	defaultThroughput = 1 << 20 // bytes per second
+	defaultRTT        = 100 * time.Millisecond
+
+	// Weight of each new sample in the smoothed throughput and RTT.
+	activitySmoothing = 0.25
+
+	// A request taking this many times longer than expected is considered
+	// slow, and the block will be requested from another device as well.
+	slowRequestFactor = 4
+	minRequestTimeout = 2 * time.Second
+)
+
+// deviceActivity tracks the number of outstanding requests per device,
+// along with the measured throughput and round trip time, and can answer
+// which device is expected to deliver a block the soonest. It is safe for
+// use from multiple goroutines.
 type deviceActivity struct {
-	act map[protocol.DeviceID]int
+	act map[protocol.DeviceID]*deviceStats
 	mut sync.Mutex
 }
 
+type deviceStats struct {
+	requests   int           // Number of outstanding requests
+	busySince  time.Time     // When we last started waiting for a response
+	throughput float64       // Smoothed rate of received block data, in bytes per second
+	rtt        time.Duration // Smoothed response time not explained by the transfer itself
+	measured   bool          // Whether rtt has been measured yet
+}
+
 func newDeviceActivity() *deviceActivity {
 	return &deviceActivity{
-		act: make(map[protocol.DeviceID]int),
+		act: make(map[protocol.DeviceID]*deviceStats),
 	}
 }
 
-func (m *deviceActivity) leastBusy(availability []protocol.DeviceID) protocol.DeviceID {
+// leastBusy returns the device expected to deliver a new block request the
+// soonest, considering the requests it already has outstanding.
+func (m *deviceActivity) leastBusy(availability []Availability) Availability {
 	m.mut.Lock()
-	low := 2<<30 - 1
-	var selected protocol.DeviceID
-	for _, device := range availability {
-		if usage := m.act[device]; usage < low {
-			low = usage
-			selected = device
+	var low time.Duration
+	var selected Availability
+	for i, info := range availability {
+		if exp := m.expectedLocked(info.ID); i == 0 || exp < low {
+			low = exp
+			selected = info
 		}
 	}
 	m.mut.Unlock()
 	return selected
 }
 
+// timeout returns how long we should wait for a new request to the device
+// before considering it slow.
+func (m *deviceActivity) timeout(device protocol.DeviceID) time.Duration {
+	m.mut.Lock()
+	timeout := slowRequestFactor * m.expectedLocked(device)
+	m.mut.Unlock()
+	if timeout < minRequestTimeout {
+		return minRequestTimeout
+	}
+	return timeout
+}
+
 func (m *deviceActivity) using(device protocol.DeviceID) {
 	m.mut.Lock()
-	m.act[device]++
+	s := m.statsLocked(device)
+	if s.requests == 0 {
+		s.busySince = time.Now()
+	}
+	s.requests++
 	m.mut.Unlock()
 }
 
 func (m *deviceActivity) done(device protocol.DeviceID) {
 	m.mut.Lock()
-	m.act[device]--
+	m.statsLocked(device).requests--
 	m.mut.Unlock()
 }
+
+// measure records that a response of the given size was received from the
+// device, the given duration after the request was sent. Must be called
+// before the corresponding done.
+func (m *deviceActivity) measure(device protocol.DeviceID, size int, d time.Duration) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	s := m.statsLocked(device)
+	now := time.Now()
+
+	// The throughput is the amount of data received since the previous
+	// response, over the time the device has been busy serving us.
+	if busy := now.Sub(s.busySince); busy > 0 && size > 0 {
+		sample := float64(size) / busy.Seconds()
+		if s.throughput == 0 {
+			s.throughput = sample
+		} else {
+			s.throughput += activitySmoothing * (sample - s.throughput)
+		}
+	}
+	s.busySince = now
+
+	// Whatever part of the response time isn't spent transferring the data
+	// is latency.
+	sample := d - time.Duration(float64(size)/m.throughputLocked(s)*float64(time.Second))
+	if sample < 0 {
+		sample = 0
+	}
+	if !s.measured {
+		s.rtt = sample
+		s.measured = true
+	} else {
+		s.rtt += time.Duration(activitySmoothing * float64(sample-s.rtt))
+	}
+}
+
+// expectedLocked returns the time we expect it to take for the device to
+// respond to a new block request.
+func (m *deviceActivity) expectedLocked(device protocol.DeviceID) time.Duration {
+	s := m.statsLocked(device)
+	rtt := s.rtt
+	if !s.measured {
+		rtt = defaultRTT
+	}
+	queued := float64(s.requests+1) * protocol.BlockSize
+	return rtt + time.Duration(queued/m.throughputLocked(s)*float64(time.Second))
+}
+
+func (m *deviceActivity) throughputLocked(s *deviceStats) float64 {
+	if s.throughput == 0 {
+		return defaultThroughput
+	}
+	return s.throughput
+}
+
+func (m *deviceActivity) statsLocked(device protocol.DeviceID) *deviceStats {
+	s, ok := m.act[device]
+	if !ok {
+		s = &deviceStats{}
+		m.act[device] = s
+	}
+	return s
+}
@@ -8,6 +8,7 @@ package model
 
 import (
 	"testing"
+	"time"
 
 	"github.com/syncthing/protocol"
 )
@@ -16,43 +17,105 @@ func TestDeviceActivity(t *testing.T) {
 	n0 := protocol.DeviceID([32]byte{1, 2, 3, 4})
 	n1 := protocol.DeviceID([32]byte{5, 6, 7, 8})
 	n2 := protocol.DeviceID([32]byte{9, 10, 11, 12})
-	devices := []protocol.DeviceID{n0, n1, n2}
+	devices := []Availability{
+		{ID: n0},
+		{ID: n1},
+		{ID: n2},
+	}
 	na := newDeviceActivity()
 
-	if lb := na.leastBusy(devices); lb != n0 {
-		t.Errorf("Least busy device should be n0 (%v) not %v", n0, lb)
+	if lb := na.leastBusy(devices); lb.ID != n0 {
+		t.Errorf("Least busy device should be n0 (%v) not %v", n0, lb.ID)
 	}
-	if lb := na.leastBusy(devices); lb != n0 {
-		t.Errorf("Least busy device should still be n0 (%v) not %v", n0, lb)
+	if lb := na.leastBusy(devices); lb.ID != n0 {
+		t.Errorf("Least busy device should still be n0 (%v) not %v", n0, lb.ID)
 	}
 
-	na.using(na.leastBusy(devices))
-	if lb := na.leastBusy(devices); lb != n1 {
-		t.Errorf("Least busy device should be n1 (%v) not %v", n1, lb)
+	na.using(na.leastBusy(devices).ID)
+	if lb := na.leastBusy(devices); lb.ID != n1 {
+		t.Errorf("Least busy device should be n1 (%v) not %v", n1, lb.ID)
 	}
 
-	na.using(na.leastBusy(devices))
-	if lb := na.leastBusy(devices); lb != n2 {
-		t.Errorf("Least busy device should be n2 (%v) not %v", n2, lb)
+	na.using(na.leastBusy(devices).ID)
+	if lb := na.leastBusy(devices); lb.ID != n2 {
+		t.Errorf("Least busy device should be n2 (%v) not %v", n2, lb.ID)
 	}
 
-	na.using(na.leastBusy(devices))
-	if lb := na.leastBusy(devices); lb != n0 {
-		t.Errorf("Least busy device should be n0 (%v) not %v", n0, lb)
+	na.using(na.leastBusy(devices).ID)
+	if lb := na.leastBusy(devices); lb.ID != n0 {
+		t.Errorf("Least busy device should be n0 (%v) not %v", n0, lb.ID)
 	}
 
 	na.done(n1)
-	if lb := na.leastBusy(devices); lb != n1 {
-		t.Errorf("Least busy device should be n1 (%v) not %v", n1, lb)
+	if lb := na.leastBusy(devices); lb.ID != n1 {
+		t.Errorf("Least busy device should be n1 (%v) not %v", n1, lb.ID)
 	}
 
 	na.done(n2)
-	if lb := na.leastBusy(devices); lb != n1 {
-		t.Errorf("Least busy device should still be n1 (%v) not %v", n1, lb)
+	if lb := na.leastBusy(devices); lb.ID != n1 {
+		t.Errorf("Least busy device should still be n1 (%v) not %v", n1, lb.ID)
 	}
 
 	na.done(n0)
-	if lb := na.leastBusy(devices); lb != n0 {
-		t.Errorf("Least busy device should be n0 (%v) not %v", n0, lb)
+	if lb := na.leastBusy(devices); lb.ID != n0 {
+		t.Errorf("Least busy device should be n0 (%v) not %v", n0, lb.ID)
+	}
+}
+
+func TestDeviceActivityMeasured(t *testing.T) {
+	fast := protocol.DeviceID([32]byte{1, 2, 3, 4})
+	slow := protocol.DeviceID([32]byte{5, 6, 7, 8})
+	devices := []Availability{{ID: slow}, {ID: fast}}
+	na := newDeviceActivity()
+
+	// The fast device delivers a block in 10 ms, the slow one in a second
+	na.act[fast] = &deviceStats{throughput: protocol.BlockSize / 0.01, rtt: time.Millisecond, measured: true}
+	na.act[slow] = &deviceStats{throughput: protocol.BlockSize / 1.0, rtt: 100 * time.Millisecond, measured: true}
+
+	if lb := na.leastBusy(devices); lb.ID != fast {
+		t.Errorf("Least busy device should be fast (%v) not %v", fast, lb.ID)
+	}
+
+	// The fast device should be preferred until it has a lot of outstanding
+	// requests.
+	for i := 0; i < 50; i++ {
+		na.using(fast)
+	}
+	if lb := na.leastBusy(devices); lb.ID != fast {
+		t.Errorf("Least busy device should still be fast (%v) not %v", fast, lb.ID)
+	}
+	for i := 0; i < 100; i++ {
+		na.using(fast)
+	}
+	if lb := na.leastBusy(devices); lb.ID != slow {
+		t.Errorf("Least busy device should be slow (%v) not %v", slow, lb.ID)
+	}
+
+	if to := na.timeout(slow); to < slowRequestFactor*time.Second {
+		t.Errorf("Timeout for slow device too short: %v", to)
+	}
+	if to := na.timeout(protocol.DeviceID{}); to != minRequestTimeout {
+		t.Errorf("Timeout for unmeasured device should be %v not %v", minRequestTimeout, to)
+	}
+}
+
+func TestDeviceActivityMeasure(t *testing.T) {
+	n0 := protocol.DeviceID([32]byte{1, 2, 3, 4})
+	na := newDeviceActivity()
+
+	na.using(n0)
+	na.act[n0].busySince = time.Now().Add(-time.Second)
+	na.measure(n0, protocol.BlockSize, time.Second)
+	na.done(n0)
+
+	s := na.act[n0]
+	if s.requests != 0 {
+		t.Errorf("Unexpected outstanding requests %d", s.requests)
+	}
+	if s.throughput < protocol.BlockSize*0.9 || s.throughput > protocol.BlockSize*1.1 {
+		t.Errorf("Unexpected throughput %f", s.throughput)
+	}
+	if !s.measured || s.rtt > 100*time.Millisecond {
+		t.Errorf("Unexpected rtt %v", s.rtt)
 	}
 }
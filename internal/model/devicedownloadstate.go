@@ -0,0 +1,121 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"sync"
+
+	"github.com/syncthing/protocol"
+)
+
+// deviceFolderFileDownloadState holds the set of blocks of a single file
+// version that a remote device has announced as available in its temporary
+// file.
+type deviceFolderFileDownloadState struct {
+	blockIndexes map[int32]struct{}
+	version      protocol.Vector
+}
+
+// deviceFolderDownloadState holds the download state of all the files of a
+// single folder that a remote device is currently downloading.
+type deviceFolderDownloadState struct {
+	mut   sync.RWMutex
+	files map[string]deviceFolderFileDownloadState
+}
+
+// Has returns whether the given block of the given file version is available
+// in the remote temporary file.
+func (p *deviceFolderDownloadState) Has(file string, version protocol.Vector, index int32) bool {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+
+	local, ok := p.files[file]
+	if !ok || !local.version.Equal(version) {
+		return false
+	}
+
+	_, ok = local.blockIndexes[index]
+	return ok
+}
+
+// Update applies the given download progress updates to the state.
+func (p *deviceFolderDownloadState) Update(updates []protocol.FileDownloadProgressUpdate) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+
+	for _, update := range updates {
+		local, ok := p.files[update.Name]
+		switch update.UpdateType {
+		case protocol.UpdateTypeForget:
+			if ok && local.version.Equal(update.Version) {
+				delete(p.files, update.Name)
+			}
+
+		case protocol.UpdateTypeAppend:
+			if !ok || !local.version.Equal(update.Version) {
+				// A new file, or a new version of it; whatever we knew
+				// about the old one is no longer relevant.
+				local = deviceFolderFileDownloadState{
+					blockIndexes: make(map[int32]struct{}, len(update.BlockIndexes)),
+					version:      update.Version,
+				}
+				p.files[update.Name] = local
+			}
+			for _, index := range update.BlockIndexes {
+				local.blockIndexes[index] = struct{}{}
+			}
+		}
+	}
+}
+
+// deviceDownloadState keeps track of the blocks a remote device has
+// available in the temporary files of the files it is currently downloading,
+// as announced in DownloadProgress messages. It is safe for use from multiple
+// goroutines.
+type deviceDownloadState struct {
+	mut     sync.RWMutex
+	folders map[string]*deviceFolderDownloadState
+}
+
+func newDeviceDownloadState() *deviceDownloadState {
+	return &deviceDownloadState{
+		folders: make(map[string]*deviceFolderDownloadState),
+	}
+}
+
+// Update applies the given download progress updates for the folder.
+func (t *deviceDownloadState) Update(folder string, updates []protocol.FileDownloadProgressUpdate) {
+	t.mut.Lock()
+	f, ok := t.folders[folder]
+	if !ok {
+		f = &deviceFolderDownloadState{
+			files: make(map[string]deviceFolderFileDownloadState),
+		}
+		t.folders[folder] = f
+	}
+	t.mut.Unlock()
+
+	f.Update(updates)
+}
+
+// Has returns whether the given block of the given file version in the folder
+// is available in the remote temporary file.
+func (t *deviceDownloadState) Has(folder, file string, version protocol.Vector, index int32) bool {
+	if t == nil {
+		return false
+	}
+
+	t.mut.RLock()
+	f, ok := t.folders[folder]
+	t.mut.RUnlock()
+
+	if !ok {
+		return false
+	}
+
+	return f.Has(file, version, index)
+}
@@ -0,0 +1,108 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/syncthing/protocol"
+)
+
+func TestDeviceDownloadState(t *testing.T) {
+	v1 := protocol.Vector{{ID: 1, Value: 1}}
+	v2 := protocol.Vector{{ID: 1, Value: 2}}
+
+	s := newDeviceDownloadState()
+
+	s.Update("folder", []protocol.FileDownloadProgressUpdate{
+		{UpdateType: protocol.UpdateTypeAppend, Name: "file", Version: v1, BlockIndexes: []int32{0, 1}},
+	})
+	s.Update("folder", []protocol.FileDownloadProgressUpdate{
+		{UpdateType: protocol.UpdateTypeAppend, Name: "file", Version: v1, BlockIndexes: []int32{3}},
+	})
+
+	for _, tc := range []struct {
+		folder, file string
+		version      protocol.Vector
+		index        int32
+		has          bool
+	}{
+		{"folder", "file", v1, 0, true},
+		{"folder", "file", v1, 1, true},
+		{"folder", "file", v1, 2, false},
+		{"folder", "file", v1, 3, true},
+		{"folder", "file", v2, 0, false},
+		{"folder", "other", v1, 0, false},
+		{"other", "file", v1, 0, false},
+	} {
+		if has := s.Has(tc.folder, tc.file, tc.version, tc.index); has != tc.has {
+			t.Errorf("Has(%q, %q, %v, %d) = %v, expected %v", tc.folder, tc.file, tc.version, tc.index, has, tc.has)
+		}
+	}
+
+	// A new version replaces the old one
+	s.Update("folder", []protocol.FileDownloadProgressUpdate{
+		{UpdateType: protocol.UpdateTypeAppend, Name: "file", Version: v2, BlockIndexes: []int32{2}},
+	})
+	if s.Has("folder", "file", v1, 0) || s.Has("folder", "file", v2, 0) || !s.Has("folder", "file", v2, 2) {
+		t.Error("Unexpected state after version change")
+	}
+
+	// Forgetting another version does nothing
+	s.Update("folder", []protocol.FileDownloadProgressUpdate{
+		{UpdateType: protocol.UpdateTypeForget, Name: "file", Version: v1},
+	})
+	if !s.Has("folder", "file", v2, 2) {
+		t.Error("Unexpected forget of current version")
+	}
+
+	s.Update("folder", []protocol.FileDownloadProgressUpdate{
+		{UpdateType: protocol.UpdateTypeForget, Name: "file", Version: v2},
+	})
+	if s.Has("folder", "file", v2, 2) {
+		t.Error("Unexpected state after forget")
+	}
+
+	var nilState *deviceDownloadState
+	if nilState.Has("folder", "file", v2, 2) {
+		t.Error("Unexpected availability in nil state")
+	}
+}
+
+func TestDeviceDownloadStateConcurrent(t *testing.T) {
+	v1 := protocol.Vector{{ID: 1, Value: 1}}
+
+	// Updates for a new folder arriving over several connections at once
+	// must all be kept.
+	for i := 0; i < 100; i++ {
+		s := newDeviceDownloadState()
+		folder := fmt.Sprintf("folder%d", i)
+
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				<-start
+				s.Update(folder, []protocol.FileDownloadProgressUpdate{
+					{UpdateType: protocol.UpdateTypeAppend, Name: name, Version: v1, BlockIndexes: []int32{0}},
+				})
+			}(fmt.Sprintf("file%d", j))
+		}
+		close(start)
+		wg.Wait()
+
+		for j := 0; j < 4; j++ {
+			if name := fmt.Sprintf("file%d", j); !s.Has(folder, name, v1, 0) {
+				t.Fatalf("Update for %s in %s lost", name, folder)
+			}
+		}
+	}
+}
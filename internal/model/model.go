@@ -8,6 +8,7 @@ package model
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -17,20 +18,26 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/encryption"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/ignore"
 	"github.com/syncthing/syncthing/internal/osutil"
+	"github.com/syncthing/syncthing/internal/proxy"
 	"github.com/syncthing/syncthing/internal/scanner"
 	"github.com/syncthing/syncthing/internal/stats"
 	"github.com/syncthing/syncthing/internal/symlinks"
 	"github.com/syncthing/syncthing/internal/versioner"
+	"github.com/syncthing/syncthing/internal/watcher"
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
@@ -42,11 +49,48 @@ const (
 	indexBatchSize    = 1000       // Either way, don't include more files than this
 )
 
+// Options used to let index exchanges resume where they left off.
+const (
+	indexIDOption         = "indexID"         // Device option in ClusterConfig; the identity of the device's index
+	maxLocalVersionOption = "maxLocalVersion" // Index/IndexUpdate option; the index is complete up to this local version
+)
+
+// ClusterConfig option announcing that the device understands
+// DownloadProgress messages and temporary block requests.
+const downloadProgressOption = "downloadProgress"
+
+// ClusterConfig option announcing the number of connections the device wants
+// to have to us.
+const connectionsOption = "connections"
+
+// A new connection is safe from being replaced for this long. Within it, the
+// devices may still be connecting to each other at the same time.
+const connectionGracePeriod = 10 * time.Second
+
+// A connection on which nothing has been received for this long has gone
+// quiet. An idle connection that is alive at both ends sees a ping or pong
+// well within it.
+const connectionQuietTime = 90 * time.Second
+
+// defaultWatcherDelay is how long changes seen by the filesystem watcher are
+// collected before scanning them, unless configured otherwise.
+const defaultWatcherDelay = 10 * time.Second
+
+var (
+	errReplaced     = errors.New("replaced by a new connection")
+	errDevicePaused = errors.New("device paused")
+	errFolderPaused = errors.New("folder paused")
+	errOutOfSpace   = errors.New("insufficient free disk space")
+	errDBOutOfSpace = errors.New("insufficient free disk space for the database")
+)
+
 type service interface {
 	Serve()
 	Stop()
-	Jobs() ([]string, []string) // In progress, Queued
+	Jobs() ([]string, []string, []string) // In progress, Queued, Delayed
 	BringToFront(string)
+	IndexUpdated() // Called when a remote index for the folder has changed
+	Errors() []FileError
 
 	setState(folderState)
 	getState() (folderState, time.Time)
@@ -71,13 +115,26 @@ type Model struct {
 	deviceStatRefs map[protocol.DeviceID]*stats.DeviceStatisticsReference // deviceID -> statsRef
 	folderIgnores  map[string]*ignore.Matcher                             // folder -> matcher object
 	folderRunners  map[string]service                                     // folder -> puller or scanner
+	folderWatchers map[string]*watcher.Watcher                            // folder -> change watcher, if enabled
 	folderStatRefs map[string]*stats.FolderStatisticsReference            // folder -> statsRef
+	untrustedKeys  map[protocol.DeviceID]map[string]*encryption.Key       // deviceID -> folder -> key
+	encrypted      map[string]bool                                        // folder -> we only hold encrypted data
 	fmut           sync.RWMutex                                           // protects the above
 
-	protoConn map[protocol.DeviceID]protocol.Connection
-	rawConn   map[protocol.DeviceID]io.Closer
-	deviceVer map[protocol.DeviceID]string
-	pmut      sync.RWMutex // protects protoConn and rawConn
+	conns       map[protocol.DeviceID][]*deviceConnection
+	deviceVer   map[protocol.DeviceID]string
+	deviceConns map[protocol.DeviceID]int  // the number of connections the device wants
+	indexing    map[protocol.DeviceID]bool // whether the index exchange with the device has started
+	// deviceID -> folders whose full index the device has sent us
+	receivedIndexes map[protocol.DeviceID]map[string]bool
+	// deviceID -> folders whose index exchange moved to another connection ->
+	// rounds of the exchange left until it has settled
+	movingIndexes map[protocol.DeviceID]map[string]int
+	// deviceID -> blocks available in the device's temporary files
+	deviceDownloads map[protocol.DeviceID]*deviceDownloadState
+	pmut            sync.RWMutex // protects conns and the above
+
+	reqSeq uint32 // for spreading requests over the connections to a device
 
 	addedFolder bool
 	started     bool
@@ -108,10 +165,17 @@ func NewModel(cfg *config.Wrapper, id protocol.DeviceID, deviceName, clientName,
 		deviceStatRefs:  make(map[protocol.DeviceID]*stats.DeviceStatisticsReference),
 		folderIgnores:   make(map[string]*ignore.Matcher),
 		folderRunners:   make(map[string]service),
+		folderWatchers:  make(map[string]*watcher.Watcher),
 		folderStatRefs:  make(map[string]*stats.FolderStatisticsReference),
-		protoConn:       make(map[protocol.DeviceID]protocol.Connection),
-		rawConn:         make(map[protocol.DeviceID]io.Closer),
+		untrustedKeys:   make(map[protocol.DeviceID]map[string]*encryption.Key),
+		encrypted:       make(map[string]bool),
+		conns:           make(map[protocol.DeviceID][]*deviceConnection),
 		deviceVer:       make(map[protocol.DeviceID]string),
+		deviceConns:     make(map[protocol.DeviceID]int),
+		indexing:        make(map[protocol.DeviceID]bool),
+		receivedIndexes: make(map[protocol.DeviceID]map[string]bool),
+		movingIndexes:   make(map[protocol.DeviceID]map[string]int),
+		deviceDownloads: make(map[protocol.DeviceID]*deviceDownloadState),
 	}
 	if cfg.Options().ProgressUpdateIntervalS > -1 {
 		go m.progressEmitter.Serve()
@@ -159,6 +223,7 @@ func (m *Model) StartFolderRW(folder string) {
 	}
 
 	go p.Serve()
+	m.startWatcher(cfg)
 }
 
 // StartRO starts read only processing on the current model. When in
@@ -180,12 +245,166 @@ func (m *Model) StartFolderRO(folder string) {
 	m.fmut.Unlock()
 
 	go s.Serve()
+	m.startWatcher(cfg)
+}
+
+// startWatcher starts watching the folder for changes, if enabled, so that
+// they are scanned shortly after they happen instead of at the next full
+// scan.
+func (m *Model) startWatcher(cfg config.FolderConfiguration) {
+	if !cfg.FSWatcherEnabled {
+		return
+	}
+
+	delay := time.Duration(cfg.FSWatcherDelayS) * time.Second
+	if delay <= 0 {
+		delay = defaultWatcherDelay
+	}
+
+	folder := cfg.ID
+	ignored := func(name string) bool {
+		// Our own temporary files and the things the scanner skips anyway
+		if defTempNamer.IsTemporary(name) || filepath.Base(name) == ".stfolder" || strings.HasPrefix(name, ".stversions") {
+			return true
+		}
+		m.fmut.RLock()
+		ignores := m.folderIgnores[folder]
+		m.fmut.RUnlock()
+		return ignores != nil && ignores.Match(name)
+	}
+	scan := func(subs []string) error {
+		if err := m.CheckFolderHealth(folder); err != nil {
+			return err
+		}
+		return m.ScanFolderSubs(folder, subs)
+	}
+
+	w := watcher.New(cfg.Path(), delay, ignored, scan)
+	m.fmut.Lock()
+	m.folderWatchers[folder] = w
+	m.fmut.Unlock()
+	go w.Serve()
+}
+
+// PauseFolder stops scanning and pulling the folder until it is resumed. The
+// paused state is saved in the configuration.
+func (m *Model) PauseFolder(folder string) error {
+	m.fmut.Lock()
+	cfg, ok := m.folderCfgs[folder]
+	if !ok {
+		m.fmut.Unlock()
+		return fmt.Errorf("Folder %s does not exist", folder)
+	}
+	if cfg.Paused {
+		m.fmut.Unlock()
+		return nil
+	}
+	cfg.Paused = true
+	m.folderCfgs[folder] = cfg
+	runner := m.folderRunners[folder]
+	delete(m.folderRunners, folder)
+	w := m.folderWatchers[folder]
+	delete(m.folderWatchers, folder)
+	m.fmut.Unlock()
+
+	if runner != nil {
+		runner.Stop()
+	}
+	if w != nil {
+		w.Stop()
+	}
+
+	l.Infof("Paused folder %q", folder)
+	events.Default.Log(events.FolderPaused, map[string]string{
+		"folder": folder,
+	})
+	return m.saveFolderPaused(folder, true)
+}
+
+// ResumeFolder starts scanning and pulling the paused folder again.
+func (m *Model) ResumeFolder(folder string) error {
+	m.fmut.Lock()
+	cfg, ok := m.folderCfgs[folder]
+	if !ok {
+		m.fmut.Unlock()
+		return fmt.Errorf("Folder %s does not exist", folder)
+	}
+	if !cfg.Paused {
+		m.fmut.Unlock()
+		return nil
+	}
+	cfg.Paused = false
+	m.folderCfgs[folder] = cfg
+	m.fmut.Unlock()
+
+	if cfg.ReadOnly {
+		m.StartFolderRO(folder)
+	} else {
+		m.StartFolderRW(folder)
+	}
+
+	l.Infof("Resumed folder %q", folder)
+	events.Default.Log(events.FolderResumed, map[string]string{
+		"folder": folder,
+	})
+	return m.saveFolderPaused(folder, false)
+}
+
+func (m *Model) saveFolderPaused(folder string, paused bool) error {
+	cfg, ok := m.cfg.Folders()[folder]
+	if !ok {
+		return nil
+	}
+	cfg.Paused = paused
+	m.cfg.SetFolder(cfg)
+	return m.saveConfig()
+}
+
+// saveFolderEncrypted records in the config that the folder holds encrypted
+// data.
+func (m *Model) saveFolderEncrypted(folder string) error {
+	m.fmut.Lock()
+	if cfg, ok := m.folderCfgs[folder]; ok {
+		cfg.Encrypted = true
+		m.folderCfgs[folder] = cfg
+	}
+	m.fmut.Unlock()
+
+	cfg, ok := m.cfg.Folders()[folder]
+	if !ok {
+		return nil
+	}
+	cfg.Encrypted = true
+	m.cfg.SetFolder(cfg)
+	return m.saveConfig()
+}
+
+// A deviceConnection is one of the connections to a device.
+type deviceConnection struct {
+	protocol.Connection
+	raw         io.Closer
+	dialer      protocol.DeviceID // the device that set up the connection
+	established time.Time
+
+	// The folders whose index exchange goes over this connection. That of
+	// each folder goes over a single connection, so that its index updates
+	// arrive in order.
+	indexes map[string]*indexSender
+}
+
+// An indexSender sends the index of a folder, and the updates to it, over a
+// connection to the device sharing the folder.
+type indexSender struct {
+	conn   *deviceConnection
+	folder string
 }
 
 type ConnectionInfo struct {
 	protocol.Statistics
 	Address       string
+	Proxy         string // The proxy the connection goes through, if any
 	ClientVersion string
+	Connections   int
 }
 
 func (info ConnectionInfo) MarshalJSON() ([]byte, error) {
@@ -194,7 +413,9 @@ func (info ConnectionInfo) MarshalJSON() ([]byte, error) {
 		"inBytesTotal":  info.InBytesTotal,
 		"outBytesTotal": info.OutBytesTotal,
 		"address":       info.Address,
+		"proxy":         info.Proxy,
 		"clientVersion": info.ClientVersion,
+		"connections":   info.Connections,
 	})
 }
 
@@ -208,14 +429,25 @@ func (m *Model) ConnectionStats() map[string]interface{} {
 	m.fmut.RLock()
 
 	var res = make(map[string]interface{})
-	conns := make(map[string]ConnectionInfo, len(m.protoConn))
-	for device, conn := range m.protoConn {
+	conns := make(map[string]ConnectionInfo, len(m.conns))
+	for device, dconns := range m.conns {
 		ci := ConnectionInfo{
-			Statistics:    conn.Statistics(),
 			ClientVersion: m.deviceVer[device],
+			Connections:   len(dconns),
+		}
+		// The totals are over the connections currently up.
+		for _, conn := range dconns {
+			stats := conn.Statistics()
+			ci.At = stats.At
+			ci.InBytesTotal += stats.InBytesTotal
+			ci.OutBytesTotal += stats.OutBytesTotal
 		}
-		if nc, ok := m.rawConn[device].(remoteAddrer); ok {
-			ci.Address = nc.RemoteAddr().String()
+		if nc, ok := dconns[0].raw.(remoteAddrer); ok {
+			addr := nc.RemoteAddr()
+			ci.Address = addr.String()
+			if pa, ok := addr.(proxy.Addr); ok {
+				ci.Proxy = pa.Proxy
+			}
 		}
 
 		conns[device.String()] = ci
@@ -267,8 +499,15 @@ func (m *Model) Completion(device protocol.DeviceID, folder string) float64 {
 		return 0 // Folder doesn't exist, so we hardly have any of it
 	}
 
+	// We only know which parts of the folder we are subscribed to ourselves;
+	// other devices are assumed to want all of it.
+	var subs []string
+	if device == protocol.LocalDeviceID {
+		subs = m.subscriptions(folder)
+	}
+
 	rf.WithGlobalTruncated(func(f db.FileIntf) bool {
-		if !f.IsDeleted() {
+		if !f.IsDeleted() && subscribed(subs, f.(db.FileInfoTruncated).Name) {
 			tot += f.Size()
 		}
 		return true
@@ -280,7 +519,7 @@ func (m *Model) Completion(device protocol.DeviceID, folder string) float64 {
 
 	var need int64
 	rf.WithNeedTruncated(device, func(f db.FileIntf) bool {
-		if !f.IsDeleted() {
+		if !f.IsDeleted() && subscribed(subs, f.(db.FileInfoTruncated).Name) {
 			need += f.Size()
 		}
 		return true
@@ -356,7 +595,11 @@ func (m *Model) NeedSize(folder string) (nfiles int, bytes int64) {
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
 	if rf, ok := m.folderFiles[folder]; ok {
+		subs := m.folderCfgs[folder].Subscriptions
 		rf.WithNeedTruncated(protocol.LocalDeviceID, func(f db.FileIntf) bool {
+			if !subscribed(subs, f.(db.FileInfoTruncated).Name) {
+				return true
+			}
 			fs, de, by := sizeOfFile(f)
 			nfiles += fs + de
 			bytes += by
@@ -370,6 +613,23 @@ func (m *Model) NeedSize(folder string) (nfiles int, bytes int64) {
 	return
 }
 
+// FolderErrors returns the files in the folder that failed to sync, with the
+// reason for the last failure.
+func (m *Model) FolderErrors(folder string) ([]FileError, error) {
+	m.fmut.RLock()
+	_, ok := m.folderCfgs[folder]
+	runner, running := m.folderRunners[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Folder %s does not exist", folder)
+	}
+	if !running {
+		// A paused folder isn't trying to sync anything
+		return []FileError{}, nil
+	}
+	return runner.Errors(), nil
+}
+
 // NeedFiles returns the list of currently needed files in progress, queued,
 // and to be queued on next puller iteration. Also takes a soft cap which is
 // only respected when adding files from the model rather than the runner queue.
@@ -383,7 +643,7 @@ func (m *Model) NeedFolderFiles(folder string, max int) ([]db.FileInfoTruncated,
 
 		runner, ok := m.folderRunners[folder]
 		if ok {
-			progressNames, queuedNames := runner.Jobs()
+			progressNames, queuedNames, _ := runner.Jobs()
 
 			progress = make([]db.FileInfoTruncated, len(progressNames))
 			queued = make([]db.FileInfoTruncated, len(queuedNames))
@@ -405,9 +665,13 @@ func (m *Model) NeedFolderFiles(folder string, max int) ([]db.FileInfoTruncated,
 		}
 		left := max - len(progress) - len(queued)
 		if max < 1 || left > 0 {
+			subs := m.folderCfgs[folder].Subscriptions
 			rf.WithNeedTruncated(protocol.LocalDeviceID, func(f db.FileIntf) bool {
-				left--
 				ft := f.(db.FileInfoTruncated)
+				if !subscribed(subs, ft.Name) {
+					return true
+				}
+				left--
 				if !seen[ft.Name] {
 					rest = append(rest, ft)
 				}
@@ -442,12 +706,22 @@ func (m *Model) Index(deviceID protocol.DeviceID, folder string, fs []protocol.F
 
 	m.fmut.RLock()
 	files, ok := m.folderFiles[folder]
+	runner := m.folderRunners[folder]
 	m.fmut.RUnlock()
 
 	if !ok {
 		l.Fatalf("Index for nonexistant folder %q", folder)
 	}
 
+	if key := m.untrustedKey(folder, deviceID); key != nil {
+		var err error
+		if fs, err = decryptFiles(key, fs); err != nil {
+			l.Infof("Index for folder %q from untrusted device %v: %v", folder, deviceID, err)
+			m.closeDevice(deviceID, err)
+			return
+		}
+	}
+
 	for i := 0; i < len(fs); {
 		if fs[i].Flags&^protocol.FlagsAll != 0 {
 			if debug {
@@ -466,7 +740,19 @@ func (m *Model) Index(deviceID protocol.DeviceID, folder string, fs []protocol.F
 		}
 	}
 
+	m.fullIndexReceived(deviceID, folder)
+
+	// A full index replaces everything we knew about the device's index, so
+	// until it has been completely received we have seen nothing of it.
+	files.SetIndexSequence(deviceID, 0)
 	files.Replace(deviceID, fs)
+	if updateIndexSequence(files, deviceID, options) {
+		m.indexRoundDone(deviceID, folder)
+	}
+
+	if runner != nil {
+		runner.IndexUpdated()
+	}
 
 	events.Default.Log(events.RemoteIndexUpdated, map[string]interface{}{
 		"device":  deviceID.String(),
@@ -495,12 +781,26 @@ func (m *Model) IndexUpdate(deviceID protocol.DeviceID, folder string, fs []prot
 
 	m.fmut.RLock()
 	files, ok := m.folderFiles[folder]
+	runner := m.folderRunners[folder]
 	m.fmut.RUnlock()
 
 	if !ok {
 		l.Fatalf("IndexUpdate for nonexistant folder %q", folder)
 	}
 
+	if key := m.untrustedKey(folder, deviceID); key != nil {
+		var err error
+		if fs, err = decryptFiles(key, fs); err != nil {
+			l.Infof("IndexUpdate for folder %q from untrusted device %v: %v", folder, deviceID, err)
+			m.closeDevice(deviceID, err)
+			return
+		}
+	}
+
+	// The updates may overtake each other when the index exchange of the
+	// folder moves to another connection, so only then are they checked
+	// against what we have.
+	moving := m.indexMoving(deviceID, folder)
 	for i := 0; i < len(fs); {
 		if fs[i].Flags&^protocol.FlagsAll != 0 {
 			if debug {
@@ -514,12 +814,25 @@ func (m *Model) IndexUpdate(deviceID protocol.DeviceID, folder string, fs []prot
 			}
 			fs[i] = fs[len(fs)-1]
 			fs = fs[:len(fs)-1]
+		} else if moving && staleUpdate(files, deviceID, fs[i]) {
+			if debug {
+				l.Debugln("dropping stale update", fs[i])
+			}
+			fs[i] = fs[len(fs)-1]
+			fs = fs[:len(fs)-1]
 		} else {
 			i++
 		}
 	}
 
 	files.Update(deviceID, fs)
+	if updateIndexSequence(files, deviceID, options) {
+		m.indexRoundDone(deviceID, folder)
+	}
+
+	if runner != nil {
+		runner.IndexUpdated()
+	}
 
 	events.Default.Log(events.RemoteIndexUpdated, map[string]interface{}{
 		"device":  deviceID.String(),
@@ -529,6 +842,105 @@ func (m *Model) IndexUpdate(deviceID protocol.DeviceID, folder string, fs []prot
 	})
 }
 
+// updateIndexSequence records how far we have a complete copy of the remote
+// device's index, when the index message says so. It returns whether the
+// message completed a round of the index exchange.
+func updateIndexSequence(files *db.FileSet, deviceID protocol.DeviceID, options []protocol.Option) bool {
+	val := getOption(options, maxLocalVersionOption)
+	if val == "" {
+		return false
+	}
+	seq, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		l.Infof("protocol error: invalid %s option %q from %s", maxLocalVersionOption, val, deviceID)
+		return false
+	}
+	files.SetIndexSequence(deviceID, seq)
+	return true
+}
+
+// staleUpdate returns whether the update of the file is no newer than what
+// we have of it from the device.
+func staleUpdate(files *db.FileSet, deviceID protocol.DeviceID, f protocol.FileInfo) bool {
+	cur, ok := files.Get(deviceID, f.Name)
+	return ok && f.LocalVersion != 0 && f.LocalVersion <= cur.LocalVersion
+}
+
+// fullIndexReceived records the start of a full index of the folder from the
+// device. Every connection the index exchange moves to starts over with one,
+// so a second one means that the exchange has moved. Updates sent over the
+// previous connection may then still arrive, up to the full index and the
+// round of updates after it.
+func (m *Model) fullIndexReceived(deviceID protocol.DeviceID, folder string) {
+	m.pmut.Lock()
+	defer m.pmut.Unlock()
+	if m.receivedIndexes[deviceID][folder] {
+		if m.movingIndexes[deviceID] == nil {
+			m.movingIndexes[deviceID] = make(map[string]int)
+		}
+		m.movingIndexes[deviceID][folder] = 2
+		return
+	}
+	if m.receivedIndexes[deviceID] == nil {
+		m.receivedIndexes[deviceID] = make(map[string]bool)
+	}
+	m.receivedIndexes[deviceID][folder] = true
+}
+
+// indexRoundDone records that a round of the index exchange of the folder
+// with the device has been received.
+func (m *Model) indexRoundDone(deviceID protocol.DeviceID, folder string) {
+	m.pmut.Lock()
+	defer m.pmut.Unlock()
+	rounds, ok := m.movingIndexes[deviceID][folder]
+	switch {
+	case !ok:
+	case rounds > 1:
+		m.movingIndexes[deviceID][folder] = rounds - 1
+	default:
+		delete(m.movingIndexes[deviceID], folder)
+	}
+}
+
+// indexMoving returns whether the index exchange of the folder with the
+// device has recently moved to another connection.
+func (m *Model) indexMoving(deviceID protocol.DeviceID, folder string) bool {
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+	_, ok := m.movingIndexes[deviceID][folder]
+	return ok
+}
+
+// decryptFiles decrypts the index received from an untrusted device. A file
+// that doesn't decrypt wasn't encrypted by us, or has been tampered with, so
+// the whole index is rejected as a protocol error.
+func decryptFiles(key *encryption.Key, fs []protocol.FileInfo) ([]protocol.FileInfo, error) {
+	for i, f := range fs {
+		dec, err := key.DecryptFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("protocol error: file %q: %v", f.Name, err)
+		}
+		fs[i] = dec
+	}
+	return fs, nil
+}
+
+// untrustedKey returns the key that the folder is encrypted with for the
+// given device, or nil if the device is trusted with the plain text.
+func (m *Model) untrustedKey(folder string, deviceID protocol.DeviceID) *encryption.Key {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+	return m.untrustedKeys[deviceID][folder]
+}
+
+// folderEncrypted returns whether the folder is shared with us by a device
+// that doesn't trust us, so that we only hold data we can't decrypt.
+func (m *Model) folderEncrypted(folder string) bool {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+	return m.encrypted[folder]
+}
+
 func (m *Model) folderSharedWith(folder string, deviceID protocol.DeviceID) bool {
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
@@ -542,11 +954,23 @@ func (m *Model) folderSharedWith(folder string, deviceID protocol.DeviceID) bool
 
 func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterConfigMessage) {
 	m.pmut.Lock()
+	if m.indexing[deviceID] {
+		// Each connection to the device starts with a cluster config. We
+		// have already acted on one and started the index exchange.
+		m.pmut.Unlock()
+		return
+	}
 	if cm.ClientName == "syncthing" {
 		m.deviceVer[deviceID] = cm.ClientVersion
 	} else {
 		m.deviceVer[deviceID] = cm.ClientName + " " + cm.ClientVersion
 	}
+	if n, err := strconv.Atoi(cm.GetOption(connectionsOption)); err == nil && n > 0 {
+		m.deviceConns[deviceID] = n
+	} else {
+		// Devices that don't say only want the one
+		m.deviceConns[deviceID] = 1
+	}
 
 	event := map[string]string{
 		"id":            deviceID.String(),
@@ -554,8 +978,10 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 		"clientVersion": cm.ClientVersion,
 	}
 
-	if conn, ok := m.rawConn[deviceID].(*tls.Conn); ok {
-		event["addr"] = conn.RemoteAddr().String()
+	if conns := m.conns[deviceID]; len(conns) > 0 {
+		if conn, ok := conns[0].raw.(*tls.Conn); ok {
+			event["addr"] = conn.RemoteAddr().String()
+		}
 	}
 
 	m.pmut.Unlock()
@@ -598,9 +1024,11 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 
 					l.Infof("Adding device %v to config (vouched for by introducer %v)", id, deviceID)
 					newDeviceCfg := config.DeviceConfiguration{
-						DeviceID:    id,
-						Compression: m.cfg.Devices()[deviceID].Compression,
-						Addresses:   []string{"dynamic"},
+						DeviceID:             id,
+						Compression:          m.cfg.Devices()[deviceID].Compression,
+						CompressionAlgorithm: m.cfg.Devices()[deviceID].CompressionAlgorithm,
+						CompressionLevel:     m.cfg.Devices()[deviceID].CompressionLevel,
+						Addresses:            []string{"dynamic"},
 					}
 
 					// The introducers' introducers are also our introducers.
@@ -643,39 +1071,324 @@ func (m *Model) ClusterConfig(deviceID protocol.DeviceID, cm protocol.ClusterCon
 	if changed {
 		m.cfg.Save()
 	}
+
+	// A device that doesn't trust us with a folder sends us the folder
+	// encrypted. We store it as is, but can't verify what we get. Once the
+	// folder holds encrypted data it stays encrypted, as trusting us later
+	// doesn't make that data plain text. A device that we don't trust has no
+	// say in the matter.
+	var encrypted []string
+	m.fmut.Lock()
+	for _, folder := range cm.Folders {
+		if _, ok := m.folderCfgs[folder.ID]; !ok || m.untrustedKeys[deviceID][folder.ID] != nil {
+			continue
+		}
+		for _, device := range folder.Devices {
+			if !bytes.Equal(device.ID, m.id[:]) {
+				continue
+			}
+			trusted := device.Flags&protocol.FlagShareTrusted != 0
+			if !trusted && !m.encrypted[folder.ID] {
+				l.Infof("Device %v does not trust us with folder %q; the folder contents will be encrypted", deviceID, folder.ID)
+				m.encrypted[folder.ID] = true
+				encrypted = append(encrypted, folder.ID)
+			} else if trusted && m.encrypted[folder.ID] {
+				l.Warnf("Device %v trusts us with folder %q, which holds encrypted data; remove and re-add the folder to sync it in plain text", deviceID, folder.ID)
+			}
+		}
+	}
+	m.fmut.Unlock()
+
+	for _, folder := range encrypted {
+		m.saveFolderEncrypted(folder)
+	}
+
+	// The index exchange of the folders is spread over the connections
+	// there are; connections added later take over some of the folders.
+	m.pmut.Lock()
+	conns := m.conns[deviceID]
+	if len(conns) == 0 {
+		m.pmut.Unlock()
+		return
+	}
+	conn := conns[0]
+	m.indexing[deviceID] = true
+	m.fmut.RLock()
+	senders := m.assignIndexes(deviceID, m.deviceFolders[deviceID])
+	m.fmut.RUnlock()
+	m.pmut.Unlock()
+
+	m.fmut.RLock()
+	if cm.GetOption(downloadProgressOption) == "true" {
+		// The progress updates contain plain text file names, so they're
+		// not sent for folders where the device is untrusted.
+		var folders []string
+		for _, folder := range m.deviceFolders[deviceID] {
+			if m.untrustedKeys[deviceID][folder] == nil {
+				folders = append(folders, folder)
+			}
+		}
+		m.progressEmitter.temporaryIndexSubscribe(conn, folders)
+	}
+	startLocalVers := make(map[string]int64)
+	for _, folder := range m.deviceFolders[deviceID] {
+		for _, cf := range cm.Folders {
+			if cf.ID == folder {
+				startLocalVers[folder] = m.resumeIndexes(deviceID, cf, m.folderFiles[folder])
+				break
+			}
+		}
+	}
+	m.fmut.RUnlock()
+
+	m.startIndexSenders(deviceID, senders, startLocalVers)
+}
+
+// assignIndexes gives each of the folders a connection to the device to send
+// its index over, and spreads the folders evenly over the connections. The
+// senders of the folders that got a new connection are returned, to be
+// started by startIndexSenders; the previous senders of the folders stop on
+// their own. The caller must hold pmut.
+func (m *Model) assignIndexes(device protocol.DeviceID, folders []string) []*indexSender {
+	conns := m.conns[device]
+	if len(conns) == 0 {
+		return nil
+	}
+
+	// The least and most busy connections
+	least := func() *deviceConnection {
+		res := conns[0]
+		for _, conn := range conns {
+			if len(conn.indexes) < len(res.indexes) {
+				res = conn
+			}
+		}
+		return res
+	}
+	most := func() *deviceConnection {
+		res := conns[0]
+		for _, conn := range conns {
+			if len(conn.indexes) > len(res.indexes) {
+				res = conn
+			}
+		}
+		return res
+	}
+	assign := func(conn *deviceConnection, folder string) *indexSender {
+		if conn.indexes == nil {
+			conn.indexes = make(map[string]*indexSender)
+		}
+		s := &indexSender{conn: conn, folder: folder}
+		conn.indexes[folder] = s
+		return s
+	}
+
+	var senders []*indexSender
+	for _, folder := range folders {
+		senders = append(senders, assign(least(), folder))
+	}
+
+	for {
+		from, to := most(), least()
+		if len(from.indexes)-len(to.indexes) <= 1 {
+			break
+		}
+		var moved string
+		for folder := range from.indexes {
+			if moved == "" || folder < moved {
+				moved = folder
+			}
+		}
+		delete(from.indexes, moved)
+		senders = append(senders, assign(to, moved))
+	}
+
+	return senders
+}
+
+// startIndexSenders starts sending the index of each folder to the device.
+// Where the device left off is given by startLocalVers; the index of folders
+// not in there is sent in full.
+func (m *Model) startIndexSenders(device protocol.DeviceID, senders []*indexSender, startLocalVers map[string]int64) {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+	for _, s := range senders {
+		s := s
+		active := func() bool {
+			return m.sendsIndex(s)
+		}
+		go sendIndexes(s.conn, s.folder, m.folderFiles[s.folder], m.folderIgnores[s.folder], m.untrustedKeys[device][s.folder], startLocalVers[s.folder], active)
+	}
+}
+
+// sendsIndex returns whether the sender still carries the index exchange of
+// its folder.
+func (m *Model) sendsIndex(s *indexSender) bool {
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
+	return s.conn.indexes[s.folder] == s
+}
+
+// resumeIndexes compares what the remote device announced about the given
+// folder with what we know. It returns the local version after which our
+// index should be sent to the device, or zero if the full index needs to be
+// sent. Our copy of the device's index is dropped if the device announces a
+// different index ID than what we have on record.
+func (m *Model) resumeIndexes(deviceID protocol.DeviceID, folder protocol.Folder, fs *db.FileSet) int64 {
+	var startLocalVer int64
+	for _, dev := range folder.Devices {
+		var id protocol.DeviceID
+		copy(id[:], dev.ID)
+
+		switch id {
+		case m.id:
+			// This is what the device knows about our index. We can only
+			// continue from where it left off if it's talking about the same
+			// index as the one we have.
+			if parseIndexID(dev.Options) == fs.IndexID(protocol.LocalDeviceID) && dev.MaxLocalVersion <= fs.LocalVersion(protocol.LocalDeviceID) {
+				startLocalVer = dev.MaxLocalVersion
+			}
+
+		case deviceID:
+			// This is the device's own index. If it's not the one we have
+			// seen before, what we have is useless.
+			if indexID := parseIndexID(dev.Options); indexID != fs.IndexID(deviceID) {
+				if debug {
+					l.Debugf("%v new index ID %x for %s/%q; dropping index", m, indexID, deviceID, folder.ID)
+				}
+				fs.Replace(deviceID, nil)
+				fs.SetIndexID(deviceID, indexID)
+			}
+		}
+	}
+
+	if debug {
+		l.Debugf("%v resume index for %s/%q at %d", m, deviceID, folder.ID, startLocalVer)
+	}
+	return startLocalVer
 }
 
 // Close removes the peer from the model and closes the underlying connection if possible.
+// The index received from the peer is kept, so that the index exchange can
+// resume where it left off when the peer reconnects.
 // Implements the protocol.Model interface.
 func (m *Model) Close(device protocol.DeviceID, err error) {
+	m.pmut.Lock()
+	var closed []*deviceConnection
+	for _, conn := range m.conns[device] {
+		if conn.Closed() {
+			closed = append(closed, conn)
+		}
+	}
+	if len(closed) == 0 {
+		// The connection was already dropped along with the others.
+		m.pmut.Unlock()
+		return
+	}
+	senders, remaining := m.removeConnections(device, closed)
+	m.pmut.Unlock()
+
+	for _, conn := range closed {
+		closeRawConn(conn.raw)
+	}
+	m.closeConnections(device, closed, senders, remaining, err)
+}
+
+// removeConnections removes the given connections to the device from the
+// model, and returns the connections that remain. The index exchange of the
+// folders that went over the removed connections moves to the remaining
+// ones; the new senders are returned, for closeConnections to start. The
+// caller must hold pmut.
+func (m *Model) removeConnections(device protocol.DeviceID, remove []*deviceConnection) ([]*indexSender, []*deviceConnection) {
+	var open []*deviceConnection
+	var orphaned []string
+	for _, conn := range m.conns[device] {
+		removed := false
+		for _, r := range remove {
+			if conn == r {
+				removed = true
+				break
+			}
+		}
+		if removed {
+			for folder := range conn.indexes {
+				orphaned = append(orphaned, folder)
+			}
+			conn.indexes = nil
+		} else {
+			open = append(open, conn)
+		}
+	}
+
+	if len(open) > 0 {
+		m.conns[device] = open
+		sort.Strings(orphaned)
+		return m.assignIndexes(device, orphaned), open
+	}
+
+	delete(m.conns, device)
+	delete(m.deviceVer, device)
+	delete(m.deviceDownloads, device)
+	delete(m.indexing, device)
+	delete(m.receivedIndexes, device)
+	delete(m.movingIndexes, device)
+	return nil, nil
+}
+
+// closeConnections hands what went over the closed connections over to the
+// remaining ones, or announces the disconnect if none remain. The index of
+// the folders that moved is sent in full again, as we can't know how much
+// of it made it over the closed connection.
+func (m *Model) closeConnections(device protocol.DeviceID, closed []*deviceConnection, senders []*indexSender, remaining []*deviceConnection, err error) {
+	if len(remaining) > 0 {
+		l.Infof("Connection to %s closed: %v; %d remaining", device, err, len(remaining))
+		for _, conn := range closed {
+			m.progressEmitter.temporaryIndexReplace(conn, remaining[0])
+		}
+		m.startIndexSenders(device, senders, nil)
+		return
+	}
+
 	l.Infof("Connection to %s closed: %v", device, err)
 	events.Default.Log(events.DeviceDisconnected, map[string]string{
 		"id":    device.String(),
 		"error": err.Error(),
 	})
 
+	m.progressEmitter.temporaryIndexUnsubscribe(device)
+}
+
+// closeDevice closes all connections to the device.
+func (m *Model) closeDevice(device protocol.DeviceID, err error) {
 	m.pmut.Lock()
-	m.fmut.RLock()
-	for _, folder := range m.deviceFolders[device] {
-		m.folderFiles[folder].Replace(device, nil)
+	conns := m.conns[device]
+	senders, remaining := m.removeConnections(device, conns)
+	m.pmut.Unlock()
+
+	for _, conn := range conns {
+		go closeConnection(conn, err)
 	}
-	m.fmut.RUnlock()
+	if len(conns) > 0 {
+		m.closeConnections(device, conns, senders, remaining, err)
+	}
+}
 
-	conn, ok := m.rawConn[device]
-	if ok {
-		if conn, ok := conn.(*tls.Conn); ok {
-			// If the underlying connection is a *tls.Conn, Close() does more
-			// than it says on the tin. Specifically, it sends a TLS alert
-			// message, which might block forever if the connection is dead
-			// and we don't have a deadline site.
-			conn.SetWriteDeadline(time.Now().Add(250 * time.Millisecond))
-		}
-		conn.Close()
+// closeConnection tells the device why the connection is closed, and closes
+// it.
+func closeConnection(conn *deviceConnection, err error) {
+	conn.Close(err)
+	closeRawConn(conn.raw)
+}
+
+func closeRawConn(conn io.Closer) {
+	if conn, ok := conn.(*tls.Conn); ok {
+		// If the underlying connection is a *tls.Conn, Close() does more
+		// than it says on the tin. Specifically, it sends a TLS alert
+		// message, which might block forever if the connection is dead
+		// and we don't have a deadline site.
+		conn.SetWriteDeadline(time.Now().Add(250 * time.Millisecond))
 	}
-	delete(m.protoConn, device)
-	delete(m.rawConn, device)
-	delete(m.deviceVer, device)
-	m.pmut.Unlock()
+	conn.Close()
 }
 
 // Request returns the specified data segment by reading it from local disk.
@@ -690,8 +1403,8 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 		return nil, protocol.ErrNoSuchFile
 	}
 
-	if flags != 0 {
-		// We don't currently support or expect any flags.
+	if flags&^protocol.FlagRequestTemporary != 0 {
+		// We don't currently support or expect any other flags.
 		return nil, fmt.Errorf("protocol error: unknown flags 0x%x in Request message", flags)
 	}
 
@@ -705,6 +1418,20 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 		return nil, protocol.ErrNoSuchFile
 	}
 
+	if key := m.untrustedKey(folder, deviceID); key != nil {
+		return m.requestUntrusted(deviceID, folder, name, offset, size, hash, flags, key, folderFiles)
+	}
+
+	if flags&protocol.FlagRequestTemporary != 0 {
+		return m.requestTemporary(deviceID, folder, name, offset, size, hash, folderFiles)
+	}
+
+	return m.requestLocal(deviceID, folder, name, offset, size, folderFiles)
+}
+
+// requestLocal returns the specified data segment by reading it from the
+// file in the folder.
+func (m *Model) requestLocal(deviceID protocol.DeviceID, folder, name string, offset int64, size int, folderFiles *db.FileSet) ([]byte, error) {
 	lf, ok := folderFiles.Get(protocol.LocalDeviceID, name)
 	if !ok {
 		return nil, protocol.ErrNoSuchFile
@@ -759,6 +1486,121 @@ func (m *Model) Request(deviceID protocol.DeviceID, folder, name string, offset
 	return buf, nil
 }
 
+// requestUntrusted serves a request from a device that the folder is
+// encrypted for. The name and hash in the request are encrypted; the data is
+// read from the plain text file, verified against the hash and returned
+// encrypted.
+func (m *Model) requestUntrusted(deviceID protocol.DeviceID, folder, name string, offset int64, size int, hash []byte, flags uint32, key *encryption.Key, folderFiles *db.FileSet) ([]byte, error) {
+	if flags != 0 {
+		// Untrusted devices don't get our download progress, so they have
+		// no business asking for temporary files.
+		return nil, protocol.ErrNoSuchFile
+	}
+
+	name, err := key.DecryptName(name)
+	if err != nil {
+		if debug {
+			l.Debugf("%v REQ(in; untrusted): %s: %q: %v", m, deviceID, folder, err)
+		}
+		return nil, protocol.ErrNoSuchFile
+	}
+	hash, err = key.DecryptHash(hash)
+	if err != nil {
+		if debug {
+			l.Debugf("%v REQ(in; untrusted): %s: %q / %q: %v", m, deviceID, folder, name, err)
+		}
+		return nil, protocol.ErrNoSuchFile
+	}
+
+	if lf, ok := folderFiles.Get(protocol.LocalDeviceID, name); ok && lf.IsSymlink() {
+		return nil, protocol.ErrNoSuchFile
+	}
+
+	buf, err := m.requestLocal(deviceID, folder, name, offset, size, folderFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	// The encryption is only safe as long as the same hash always means the
+	// same data, so we never encrypt anything that doesn't match it.
+	if _, err := scanner.VerifyBuffer(buf, protocol.BlockInfo{Size: int32(size), Hash: hash}); err != nil {
+		if debug {
+			l.Debugf("%v REQ(in; untrusted): %s: %q / %q o=%d s=%d; hash mismatch", m, deviceID, folder, name, offset, size)
+		}
+		return nil, protocol.ErrNoSuchFile
+	}
+
+	key.EncryptBlock(buf, hash)
+	return buf, nil
+}
+
+// requestTemporary returns the specified data segment by reading it from the
+// temporary file of a download in progress. As the temporary file may
+// contain anything, the data is only returned if it matches the hash given
+// in the request.
+func (m *Model) requestTemporary(deviceID protocol.DeviceID, folder, name string, offset int64, size int, hash []byte, folderFiles *db.FileSet) ([]byte, error) {
+	// We only serve temporary files for files that are part of the global
+	// index, which is what we can be downloading.
+	gf, ok := folderFiles.GetGlobal(name)
+	if !ok || gf.IsInvalid() || gf.IsDeleted() || gf.IsDirectory() || gf.IsSymlink() {
+		return nil, protocol.ErrNoSuchFile
+	}
+
+	if len(hash) == 0 || offset > gf.Size() {
+		return nil, protocol.ErrNoSuchFile
+	}
+
+	if debug {
+		l.Debugf("%v REQ(in; temp): %s: %q / %q o=%d s=%d", m, deviceID, folder, name, offset, size)
+	}
+	m.fmut.RLock()
+	fn := filepath.Join(m.folderCfgs[folder].Path(), defTempNamer.TempName(name))
+	m.fmut.RUnlock()
+
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, protocol.ErrNoSuchFile
+	}
+	defer fd.Close()
+
+	buf := make([]byte, size)
+	_, err = fd.ReadAt(buf, offset)
+	if err != nil {
+		return nil, protocol.ErrNoSuchFile
+	}
+
+	if _, err := scanner.VerifyBuffer(buf, protocol.BlockInfo{Size: int32(size), Hash: hash}); err != nil {
+		if debug {
+			l.Debugf("%v REQ(in; temp): %s: %q / %q o=%d s=%d; hash mismatch", m, deviceID, folder, name, offset, size)
+		}
+		return nil, protocol.ErrNoSuchFile
+	}
+
+	return buf, nil
+}
+
+// DownloadProgress records which blocks of the files the remote device is
+// downloading are available in its temporary files, so that we can request
+// them from there.
+// Implements the protocol.Model interface.
+func (m *Model) DownloadProgress(deviceID protocol.DeviceID, folder string, updates []protocol.FileDownloadProgressUpdate, flags uint32, options []protocol.Option) {
+	if !m.folderSharedWith(folder, deviceID) || m.untrustedKey(folder, deviceID) != nil {
+		return
+	}
+
+	m.pmut.RLock()
+	downloads, ok := m.deviceDownloads[deviceID]
+	m.pmut.RUnlock()
+	if !ok {
+		return
+	}
+
+	if debug {
+		l.Debugf("%v DownloadProgress(%s, %q, %d updates)", m, deviceID, folder, len(updates))
+	}
+	downloads.Update(folder, updates)
+}
+
 // ReplaceLocal replaces the local folder index with the given list of files.
 func (m *Model) ReplaceLocal(folder string, fs []protocol.FileInfo) {
 	m.fmut.RLock()
@@ -790,15 +1632,213 @@ func (cf cFiler) CurrentFile(file string) (protocol.FileInfo, bool) {
 	return cf.m.CurrentFolderFile(cf.r, file)
 }
 
-// ConnectedTo returns true if we are connected to the named device.
-func (m *Model) ConnectedTo(deviceID protocol.DeviceID) bool {
+// receiveOnlyFiler is the CurrentFiler for receive only folders. Local
+// changes there are kept in the index as invalid files; they are otherwise
+// up to date and should only be rescanned when they change again.
+type receiveOnlyFiler struct {
+	cFiler
+}
+
+// Implements scanner.CurrentFiler
+func (cf receiveOnlyFiler) CurrentFile(file string) (protocol.FileInfo, bool) {
+	f, ok := cf.cFiler.CurrentFile(file)
+	f.Flags &^= protocol.FlagInvalid
+	return f, ok
+}
+
+// receiveOnlyChange returns the scanned change to a file in a receive only
+// folder as it should be recorded in the index. Changes that bring the file
+// in line with the global version take that version; all others are marked
+// invalid so that they are neither announced nor overwritten by the puller.
+func receiveOnlyChange(fs *db.FileSet, f protocol.FileInfo, ignorePerms bool) protocol.FileInfo {
+	if gf, ok := fs.GetGlobal(f.Name); ok && sameContents(f, gf, ignorePerms) {
+		f.Flags &^= protocol.FlagInvalid
+		f.Version = gf.Version
+		return f
+	}
+	f.Flags |= protocol.FlagInvalid
+	return f
+}
+
+// isLocalChange returns whether the file, as we have it, is a change to a
+// receive only folder that differs from the global version.
+func isLocalChange(fs *db.FileSet, ignores *ignore.Matcher, f protocol.FileInfo, ignorePerms bool) bool {
+	if !f.IsInvalid() || ignoredOrUnsupported(ignores, f.Name, f.IsSymlink()) {
+		return false
+	}
+	gf, ok := fs.GetGlobal(f.Name)
+	if !ok {
+		// A local addition, unless it's since been deleted again
+		return !f.IsDeleted()
+	}
+	return !sameContents(f, gf, ignorePerms)
+}
+
+// sameContents returns whether the two files are the same type of thing
+// with the same contents, regardless of version and modification time.
+func sameContents(a, b protocol.FileInfo, ignorePerms bool) bool {
+	if a.IsDeleted() || b.IsDeleted() {
+		return a.IsDeleted() && b.IsDeleted()
+	}
+	if a.IsDirectory() != b.IsDirectory() || a.IsSymlink() != b.IsSymlink() {
+		return false
+	}
+	if a.IsSymlink() && !scanner.SymlinkTypeEqual(a.Flags, b.Flags) {
+		return false
+	}
+	if !ignorePerms && a.HasPermissionBits() && b.HasPermissionBits() && !scanner.PermsEqual(a.Flags, b.Flags) {
+		return false
+	}
+	return scanner.BlocksEqual(a.Blocks, b.Blocks)
+}
+
+// ignoredOrUnsupported returns whether the file is invalid regardless of
+// whether it has been changed locally.
+func ignoredOrUnsupported(ignores *ignore.Matcher, name string, isLink bool) bool {
+	return (ignores != nil && ignores.Match(name)) || symlinkInvalid(isLink)
+}
+
+// ConnectedTo returns true if we are connected to the named device.
+func (m *Model) ConnectedTo(deviceID protocol.DeviceID) bool {
+	return m.NumConnections(deviceID) > 0
+}
+
+// WantedConnections returns the number of connections we should have to the
+// named device; as many as both sides want.
+func (m *Model) WantedConnections(deviceID protocol.DeviceID) int {
+	n := m.wantedConnections(deviceID)
+	m.pmut.RLock()
+	if remote, ok := m.deviceConns[deviceID]; ok && remote < n {
+		n = remote
+	}
+	m.pmut.RUnlock()
+	return n
+}
+
+// wantedConnections returns the number of connections we want to the device,
+// as configured.
+func (m *Model) wantedConnections(deviceID protocol.DeviceID) int {
+	if n := m.cfg.Devices()[deviceID].NumConnections; n > 0 {
+		return n
+	}
+	return m.cfg.Options().ConnectionsPerDevice
+}
+
+// ReplaceConnection is called when there is a new connection to a device
+// that we already have all the wanted connections to. It closes a connection
+// for the new one to replace and returns true, or returns false if the new
+// connection should be dropped instead. The rules are such that the devices
+// at both ends of the connections come to the same decision.
+func (m *Model) ReplaceConnection(deviceID protocol.DeviceID, outgoing bool) bool {
+	dialer := deviceID
+	if outgoing {
+		dialer = m.id
+	}
+
+	m.pmut.Lock()
+	conns := m.conns[deviceID]
+	var old *deviceConnection
+	if !outgoing {
+		// The device only connects to us when it's missing connections, so
+		// one of ours is probably dead at its end. Only a connection that
+		// has gone quiet is replaced, preferably one carrying the index
+		// exchange of few folders, as those are sent again in full. If all
+		// of them are still receiving, the new connection is dropped.
+		for _, conn := range conns {
+			if time.Since(conn.established) < connectionGracePeriod {
+				continue
+			}
+			if time.Since(conn.Statistics().LastReceived) < connectionQuietTime {
+				continue
+			}
+			if old == nil || len(conn.indexes) < len(old.indexes) {
+				old = conn
+			}
+		}
+	}
+	if old == nil {
+		// The devices are connecting to each other at the same time. The
+		// connections set up by the device with the lower ID win.
+		for i := len(conns) - 1; i >= 0; i-- {
+			if time.Since(conns[i].established) < connectionGracePeriod && dialer.Compare(conns[i].dialer) < 0 {
+				old = conns[i]
+				break
+			}
+		}
+	}
+	if old == nil {
+		m.pmut.Unlock()
+		return false
+	}
+
+	closed := []*deviceConnection{old}
+	senders, remaining := m.removeConnections(deviceID, closed)
+	m.pmut.Unlock()
+
+	go closeConnection(old, errReplaced)
+	m.closeConnections(deviceID, closed, senders, remaining, errReplaced)
+	return true
+}
+
+// PauseDevice closes the connections to the device. No new connections are
+// made to or accepted from it until it is resumed. The paused state is saved
+// in the configuration.
+func (m *Model) PauseDevice(device protocol.DeviceID) error {
+	devCfg, ok := m.cfg.Devices()[device]
+	if !ok {
+		return fmt.Errorf("Device %s does not exist", device)
+	}
+	if devCfg.Paused {
+		return nil
+	}
+	devCfg.Paused = true
+	m.cfg.SetDevice(devCfg)
+
+	m.closeDevice(device, errDevicePaused)
+
+	l.Infof("Paused device %s", device)
+	events.Default.Log(events.DevicePaused, map[string]string{
+		"device": device.String(),
+	})
+	return m.saveConfig()
+}
+
+// ResumeDevice allows connections to the paused device again.
+func (m *Model) ResumeDevice(device protocol.DeviceID) error {
+	devCfg, ok := m.cfg.Devices()[device]
+	if !ok {
+		return fmt.Errorf("Device %s does not exist", device)
+	}
+	if !devCfg.Paused {
+		return nil
+	}
+	devCfg.Paused = false
+	m.cfg.SetDevice(devCfg)
+
+	l.Infof("Resumed device %s", device)
+	events.Default.Log(events.DeviceResumed, map[string]string{
+		"device": device.String(),
+	})
+	return m.saveConfig()
+}
+
+func (m *Model) saveConfig() error {
+	if err := m.cfg.Save(); err != nil {
+		l.Warnln("Saving config:", err)
+		return err
+	}
+	return nil
+}
+
+// NumConnections returns the number of connections to the named device.
+func (m *Model) NumConnections(deviceID protocol.DeviceID) int {
 	m.pmut.RLock()
-	_, ok := m.protoConn[deviceID]
+	n := len(m.conns[deviceID])
 	m.pmut.RUnlock()
-	if ok {
+	if n > 0 {
 		m.deviceWasSeen(deviceID)
 	}
-	return ok
+	return n
 }
 
 func (m *Model) GetIgnores(folder string) ([]string, []string, error) {
@@ -873,33 +1913,124 @@ func (m *Model) SetIgnores(folder string, content []string) error {
 	return m.ScanFolder(folder)
 }
 
-// AddConnection adds a new peer connection to the model. An initial index will
-// be sent to the connected peer, thereafter index updates whenever the local
-// folder changes.
-func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection) {
-	deviceID := protoConn.ID()
+// Subscriptions returns the subtrees of the folder that are synced. An empty
+// list means the whole folder.
+func (m *Model) Subscriptions(folder string) ([]string, error) {
+	m.fmut.RLock()
+	cfg, ok := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Folder %s does not exist", folder)
+	}
+	return append([]string{}, cfg.Subscriptions...), nil
+}
 
-	m.pmut.Lock()
-	if _, ok := m.protoConn[deviceID]; ok {
-		panic("add existing device")
+// SetSubscriptions sets the subtrees of the folder to sync and saves the
+// configuration. Files outside of them that are already present are left
+// alone, but are no longer updated.
+func (m *Model) SetSubscriptions(folder string, subs []string) error {
+	var clean []string
+	for _, sub := range subs {
+		sub = strings.Trim(filepath.ToSlash(sub), "/")
+		if sub == "" || sub == "." {
+			// Subscribing to the root is subscribing to everything.
+			clean = nil
+			break
+		}
+		clean = append(clean, sub)
+	}
+
+	m.fmut.Lock()
+	cfg, ok := m.folderCfgs[folder]
+	if !ok {
+		m.fmut.Unlock()
+		return fmt.Errorf("Folder %s does not exist", folder)
+	}
+	cfg.Subscriptions = clean
+	m.folderCfgs[folder] = cfg
+	runner := m.folderRunners[folder]
+	m.fmut.Unlock()
+
+	if debug {
+		l.Debugf("%v SetSubscriptions(%q): %v", m, folder, clean)
+	}
+
+	if folderCfg, ok := m.cfg.Folders()[folder]; ok {
+		folderCfg.Subscriptions = clean
+		m.cfg.SetFolder(folderCfg)
+		if err := m.cfg.Save(); err != nil {
+			l.Warnln("Saving config:", err)
+			return err
+		}
 	}
-	m.protoConn[deviceID] = protoConn
-	if _, ok := m.rawConn[deviceID]; ok {
-		panic("add existing device")
+
+	if runner != nil {
+		// Newly subscribed files may need pulling.
+		runner.IndexUpdated()
+	}
+	return nil
+}
+
+func (m *Model) subscriptions(folder string) []string {
+	m.fmut.RLock()
+	defer m.fmut.RUnlock()
+	return m.folderCfgs[folder].Subscriptions
+}
+
+// subscribed returns true if the named file is inside one of the subscribed
+// subtrees, or is one of the directories leading up to them.
+func subscribed(subs []string, name string) bool {
+	if len(subs) == 0 {
+		return true
+	}
+	sep := string(filepath.Separator)
+	for _, sub := range subs {
+		sub = osutil.NativeFilename(strings.Trim(sub, "/"))
+		if sub == "" || name == sub || strings.HasPrefix(name, sub+sep) || strings.HasPrefix(sub, name+sep) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddConnection adds a new peer connection to the model. Once the peer's
+// cluster config has been received, an initial index (or the part of it the
+// peer hasn't seen yet) will be sent to the connected peer, thereafter index
+// updates whenever the local folder changes. There may be several
+// connections to the same peer, with the requests spread over them. Outgoing
+// connections are the ones we set up.
+func (m *Model) AddConnection(rawConn io.Closer, protoConn protocol.Connection, outgoing bool) {
+	deviceID := protoConn.ID()
+	dialer := deviceID
+	if outgoing {
+		dialer = m.id
 	}
-	m.rawConn[deviceID] = rawConn
+
+	m.pmut.Lock()
+	if _, ok := m.conns[deviceID]; !ok {
+		m.deviceDownloads[deviceID] = newDeviceDownloadState()
+	}
+	m.conns[deviceID] = append(m.conns[deviceID], &deviceConnection{
+		Connection:  protoConn,
+		raw:         rawConn,
+		dialer:      dialer,
+		established: time.Now(),
+	})
+
+	protoConn.Start()
 
 	cm := m.clusterConfig(deviceID)
 	protoConn.ClusterConfig(cm)
 
-	m.fmut.RLock()
-	for _, folder := range m.deviceFolders[deviceID] {
-		fs := m.folderFiles[folder]
-		go sendIndexes(protoConn, folder, fs, m.folderIgnores[folder])
+	// The new connection takes over the index exchange of some folders, if
+	// it has already started over the others.
+	var senders []*indexSender
+	if m.indexing[deviceID] {
+		senders = m.assignIndexes(deviceID, nil)
 	}
-	m.fmut.RUnlock()
 	m.pmut.Unlock()
 
+	m.startIndexSenders(deviceID, senders, nil)
 	m.deviceWasSeen(deviceID)
 }
 
@@ -936,24 +2067,33 @@ func (m *Model) receivedFile(folder, filename string) {
 	m.folderStatRef(folder).ReceivedFile(filename)
 }
 
-func sendIndexes(conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher) {
+// sendIndexes sends the index for the given folder to the connected device,
+// followed by index updates as long as the connection is up and active says
+// the folder's index still goes over it. Only files with a local version
+// higher than startLocalVer are sent; if startLocalVer is zero the index is
+// sent in full. If key is not nil, the device is untrusted and is sent the
+// encrypted index.
+func sendIndexes(conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher, key *encryption.Key, startLocalVer int64, active func() bool) {
 	deviceID := conn.ID()
 	name := conn.Name()
 	var err error
 
 	if debug {
-		l.Debugf("sendIndexes for %s-%s/%q starting", deviceID, name, folder)
+		l.Debugf("sendIndexes for %s-%s/%q starting at %d", deviceID, name, folder, startLocalVer)
 	}
 
-	minLocalVer, err := sendIndexTo(true, 0, conn, folder, fs, ignores)
+	minLocalVer, err := sendIndexTo(startLocalVer == 0, startLocalVer, conn, folder, fs, ignores, key)
 
 	for err == nil {
 		time.Sleep(5 * time.Second)
+		if !active() {
+			break
+		}
 		if fs.LocalVersion(protocol.LocalDeviceID) <= minLocalVer {
 			continue
 		}
 
-		minLocalVer, err = sendIndexTo(false, minLocalVer, conn, folder, fs, ignores)
+		minLocalVer, err = sendIndexTo(false, minLocalVer, conn, folder, fs, ignores, key)
 	}
 
 	if debug {
@@ -961,12 +2101,12 @@ func sendIndexes(conn protocol.Connection, folder string, fs *db.FileSet, ignore
 	}
 }
 
-func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher) (int64, error) {
+func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, folder string, fs *db.FileSet, ignores *ignore.Matcher, key *encryption.Key) (int64, error) {
 	deviceID := conn.ID()
 	name := conn.Name()
 	batch := make([]protocol.FileInfo, 0, indexBatchSize)
 	currentBatchSize := 0
-	maxLocalVer := int64(0)
+	maxLocalVer := minLocalVer
 	var err error
 
 	fs.WithHave(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
@@ -986,6 +2126,15 @@ func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, fold
 			return true
 		}
 
+		if key != nil {
+			if f.IsSymlink() {
+				// The symlink target is in the file data, which isn't
+				// something we can encrypt.
+				return true
+			}
+			f = key.EncryptFile(f)
+		}
+
 		if len(batch) == indexBatchSize || currentBatchSize > indexTargetSize {
 			if initial {
 				if err = conn.Index(folder, batch, 0, nil); err != nil {
@@ -1013,13 +2162,24 @@ func sendIndexTo(initial bool, minLocalVer int64, conn protocol.Connection, fold
 		return true
 	})
 
+	// The last message carries the highest local version we've looked at,
+	// telling the other side that it now has our complete index up to that
+	// point. This is sent even when the batch is empty, as we may have
+	// skipped ignored files.
+	options := []protocol.Option{
+		{
+			Key:   maxLocalVersionOption,
+			Value: strconv.FormatInt(maxLocalVer, 10),
+		},
+	}
+
 	if initial && err == nil {
-		err = conn.Index(folder, batch, 0, nil)
+		err = conn.Index(folder, batch, 0, options)
 		if debug && err == nil {
 			l.Debugf("sendIndexes for %s-%s/%q: %d files (small initial index)", deviceID, name, folder, len(batch))
 		}
-	} else if len(batch) > 0 && err == nil {
-		err = conn.IndexUpdate(folder, batch, 0, nil)
+	} else if maxLocalVer > minLocalVer && err == nil {
+		err = conn.IndexUpdate(folder, batch, 0, options)
 		if debug && err == nil {
 			l.Debugf("sendIndexes for %s-%s/%q: %d files (last batch)", deviceID, name, folder, len(batch))
 		}
@@ -1041,10 +2201,13 @@ func (m *Model) updateLocals(folder string, fs []protocol.FileInfo) {
 
 func (m *Model) requestGlobal(deviceID protocol.DeviceID, folder, name string, offset int64, size int, hash []byte, flags uint32, options []protocol.Option) ([]byte, error) {
 	m.pmut.RLock()
-	nc, ok := m.protoConn[deviceID]
+	var nc protocol.Connection
+	if conns := m.conns[deviceID]; len(conns) > 0 {
+		nc = conns[atomic.AddUint32(&m.reqSeq, 1)%uint32(len(conns))]
+	}
 	m.pmut.RUnlock()
 
-	if !ok {
+	if nc == nil {
 		return nil, fmt.Errorf("requestGlobal: no such device: %s", deviceID)
 	}
 
@@ -1052,6 +2215,17 @@ func (m *Model) requestGlobal(deviceID protocol.DeviceID, folder, name string, o
 		l.Debugf("%v REQ(out): %s: %q / %q o=%d s=%d h=%x f=%x op=%s", m, deviceID, folder, name, offset, size, hash, flags, options)
 	}
 
+	if key := m.untrustedKey(folder, deviceID); key != nil {
+		// The device only knows the encrypted file and returns encrypted
+		// data. The caller verifies the decrypted data against the hash.
+		buf, err := nc.Request(folder, key.EncryptName(name), offset, size, key.EncryptHash(hash), flags, options)
+		if err != nil {
+			return nil, err
+		}
+		key.DecryptBlock(buf, hash)
+		return buf, nil
+	}
+
 	return nc.Request(folder, name, offset, size, hash, flags, options)
 }
 
@@ -1066,10 +2240,25 @@ func (m *Model) AddFolder(cfg config.FolderConfiguration) {
 	m.fmut.Lock()
 	m.folderCfgs[cfg.ID] = cfg
 	m.folderFiles[cfg.ID] = db.NewFileSet(cfg.ID, m.db)
-
-	m.folderDevices[cfg.ID] = make([]protocol.DeviceID, len(cfg.Devices))
-	for i, device := range cfg.Devices {
-		m.folderDevices[cfg.ID][i] = device.DeviceID
+	m.encrypted[cfg.ID] = cfg.Encrypted
+
+	var key *encryption.Key
+	m.folderDevices[cfg.ID] = make([]protocol.DeviceID, 0, len(cfg.Devices))
+	for _, device := range cfg.Devices {
+		if device.Untrusted {
+			if cfg.EncryptionPassword == "" {
+				l.Warnf("Not sharing folder %q with untrusted device %v, as the folder has no encryption password", cfg.ID, device.DeviceID)
+				continue
+			}
+			if key == nil {
+				key = encryption.NewKey(cfg.ID, cfg.EncryptionPassword)
+			}
+			if m.untrustedKeys[device.DeviceID] == nil {
+				m.untrustedKeys[device.DeviceID] = make(map[string]*encryption.Key)
+			}
+			m.untrustedKeys[device.DeviceID][cfg.ID] = key
+		}
+		m.folderDevices[cfg.ID] = append(m.folderDevices[cfg.ID], device.DeviceID)
 		m.deviceFolders[device.DeviceID] = append(m.deviceFolders[device.DeviceID], cfg.ID)
 	}
 
@@ -1139,9 +2328,21 @@ func (m *Model) ScanFolderSubs(folder string, subs []string) error {
 	// scan them before they have started, so that's what we need to check for
 	// here.
 	if !ok {
+		if folderCfg.Paused {
+			return errFolderPaused
+		}
 		return errors.New("no such folder")
 	}
 
+	if m.folderEncrypted(folder) {
+		// The folder holds what untrusted devices get; scanning it would
+		// announce the encrypted data as changes of our own.
+		if debug {
+			l.Debugf("%v not scanning encrypted folder %q", m, folder)
+		}
+		return nil
+	}
+
 	_ = ignores.Load(filepath.Join(folderCfg.Path(), ".stignore")) // Ignore error, there might not be an .stignore
 
 	// Required to make sure that we start indexing at a directory we're already
@@ -1167,18 +2368,24 @@ nextSub:
 	}
 	subs = unifySubs
 
+	var currentFiler scanner.CurrentFiler = cFiler{m, folder}
+	if folderCfg.ReceiveOnly {
+		currentFiler = receiveOnlyFiler{cFiler{m, folder}}
+	}
+
 	w := &scanner.Walker{
-		Dir:           folderCfg.Path(),
-		Subs:          subs,
-		Matcher:       ignores,
-		BlockSize:     protocol.BlockSize,
-		TempNamer:     defTempNamer,
-		TempLifetime:  time.Duration(m.cfg.Options().KeepTemporariesH) * time.Hour,
-		CurrentFiler:  cFiler{m, folder},
-		IgnorePerms:   folderCfg.IgnorePerms,
-		AutoNormalize: folderCfg.AutoNormalize,
-		Hashers:       folderCfg.Hashers,
-		ShortID:       m.shortID,
+		Dir:             folderCfg.Path(),
+		Subs:            subs,
+		Matcher:         ignores,
+		BlockSize:       protocol.BlockSize,
+		ContentChunking: folderCfg.ContentChunking,
+		TempNamer:       defTempNamer,
+		TempLifetime:    time.Duration(m.cfg.Options().KeepTemporariesH) * time.Hour,
+		CurrentFiler:    currentFiler,
+		IgnorePerms:     folderCfg.IgnorePerms,
+		AutoNormalize:   folderCfg.AutoNormalize,
+		Hashers:         folderCfg.Hashers,
+		ShortID:         m.shortID,
 	}
 
 	runner.setState(FolderScanning)
@@ -1192,6 +2399,9 @@ nextSub:
 	batchSize := 100
 	batch := make([]protocol.FileInfo, 0, batchSize)
 	for f := range fchan {
+		if folderCfg.ReceiveOnly {
+			f = receiveOnlyChange(fs, f, folderCfg.IgnorePerms)
+		}
 		events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
 			"folder":   folder,
 			"name":     f.Name,
@@ -1238,7 +2448,10 @@ nextSub:
 
 		seenPrefix = true
 		if !f.IsDeleted() {
-			if f.IsInvalid() {
+			if f.IsInvalid() && (!folderCfg.ReceiveOnly || ignoredOrUnsupported(ignores, f.Name, f.IsSymlink())) {
+				// Ignored or otherwise invalid. Local changes in receive
+				// only folders are invalid too, but we still want to notice
+				// when they are deleted.
 				return true
 			}
 
@@ -1282,6 +2495,9 @@ nextSub:
 					Modified: f.Modified,
 					Version:  f.Version.Update(m.shortID),
 				}
+				if folderCfg.ReceiveOnly {
+					nf = receiveOnlyChange(fs, nf, folderCfg.IgnorePerms)
+				}
 				events.Default.Log(events.LocalIndexUpdated, map[string]interface{}{
 					"folder":   folder,
 					"name":     f.Name,
@@ -1302,7 +2518,7 @@ nextSub:
 }
 
 // clusterConfig returns a ClusterConfigMessage that is correct for the given peer device
-func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMessage {
+func (m *Model) clusterConfig(deviceID protocol.DeviceID) protocol.ClusterConfigMessage {
 	cm := protocol.ClusterConfigMessage{
 		ClientName:    m.clientName,
 		ClientVersion: m.clientVersion,
@@ -1311,11 +2527,20 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 				Key:   "name",
 				Value: m.deviceName,
 			},
+			{
+				Key:   downloadProgressOption,
+				Value: "true",
+			},
+			{
+				Key:   connectionsOption,
+				Value: strconv.Itoa(m.wantedConnections(deviceID)),
+			},
 		},
 	}
 
 	m.fmut.RLock()
-	for _, folder := range m.deviceFolders[device] {
+	for _, folder := range m.deviceFolders[deviceID] {
+		fs := m.folderFiles[folder]
 		cr := protocol.Folder{
 			ID: folder,
 		}
@@ -1325,12 +2550,26 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 			device := device
 			// TODO: Set read only bit when relevant
 			cn := protocol.Device{
-				ID:    device[:],
-				Flags: protocol.FlagShareTrusted,
+				ID: device[:],
+			}
+			// We can't pass on trust in data we only hold encrypted
+			if m.untrustedKeys[device][folder] == nil && !m.encrypted[folder] {
+				cn.Flags |= protocol.FlagShareTrusted
 			}
 			if deviceCfg := m.cfg.Devices()[device]; deviceCfg.Introducer {
 				cn.Flags |= protocol.FlagIntroducer
 			}
+			// Announce the identity and extent of our own index, and of the
+			// peer's index as far as we have it, so that the index exchange
+			// can resume where it left off.
+			switch device {
+			case m.id:
+				cn.MaxLocalVersion = fs.LocalVersion(protocol.LocalDeviceID)
+				cn.Options = indexIDOptions(fs.IndexID(protocol.LocalDeviceID))
+			case deviceID:
+				cn.MaxLocalVersion = fs.IndexSequence(deviceID)
+				cn.Options = indexIDOptions(fs.IndexID(deviceID))
+			}
 			cr.Devices = append(cr.Devices, cn)
 		}
 		cm.Folders = append(cm.Folders, cr)
@@ -1343,7 +2582,11 @@ func (m *Model) clusterConfig(device protocol.DeviceID) protocol.ClusterConfigMe
 func (m *Model) State(folder string) (string, time.Time) {
 	m.fmut.RLock()
 	runner, ok := m.folderRunners[folder]
+	paused := m.folderCfgs[folder].Paused
 	m.fmut.RUnlock()
+	if paused {
+		return "paused", time.Time{}
+	}
 	if !ok {
 		return "", time.Time{}
 	}
@@ -1357,6 +2600,11 @@ func (m *Model) Override(folder string) {
 	runner := m.folderRunners[folder]
 	m.fmut.RUnlock()
 
+	if runner == nil {
+		// Not started, or paused
+		return
+	}
+
 	runner.setState(FolderScanning)
 	batch := make([]protocol.FileInfo, 0, indexBatchSize)
 	fs.WithNeed(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
@@ -1387,6 +2635,180 @@ func (m *Model) Override(folder string) {
 	runner.setState(FolderIdle)
 }
 
+// LocalChangedFiles returns the files in a receive only folder that have
+// been changed locally and differ from the global version.
+func (m *Model) LocalChangedFiles(folder string) []db.FileInfoTruncated {
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	cfg := m.folderCfgs[folder]
+	ignores := m.folderIgnores[folder]
+	m.fmut.RUnlock()
+
+	if !ok || !cfg.ReceiveOnly {
+		return nil
+	}
+
+	var files []db.FileInfoTruncated
+	fs.WithHave(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+		f := fi.(protocol.FileInfo)
+		if isLocalChange(fs, ignores, f, cfg.IgnorePerms) {
+			files = append(files, db.ToTruncated(f))
+		}
+		return true
+	})
+	return files
+}
+
+// Revert undoes the local changes in a receive only folder. Changed and
+// deleted files are pulled again from the other devices, while files that
+// only exist locally are removed.
+func (m *Model) Revert(folder string) {
+	m.fmut.RLock()
+	fs := m.folderFiles[folder]
+	cfg := m.folderCfgs[folder]
+	ignores := m.folderIgnores[folder]
+	runner := m.folderRunners[folder]
+	m.fmut.RUnlock()
+
+	if runner == nil || !cfg.ReceiveOnly {
+		return
+	}
+
+	runner.setState(FolderScanning)
+	var additions []string
+	batch := make([]protocol.FileInfo, 0, indexBatchSize)
+	fs.WithHave(protocol.LocalDeviceID, func(fi db.FileIntf) bool {
+		f := fi.(protocol.FileInfo)
+		if !isLocalChange(fs, ignores, f, cfg.IgnorePerms) {
+			return true
+		}
+		if len(batch) == indexBatchSize {
+			fs.Update(protocol.LocalDeviceID, batch)
+			batch = batch[:0]
+		}
+
+		if gf, ok := fs.GetGlobal(f.Name); !ok || gf.IsDeleted() {
+			// There's nothing to pull in its place
+			if !f.IsDeleted() {
+				additions = append(additions, f.Name)
+			}
+			f.Flags |= protocol.FlagDeleted
+			f.Blocks = nil
+		}
+		// Without a version of its own, the file is no longer a local change
+		// but simply out of date; the puller replaces it with the global
+		// version.
+		f.Version = protocol.Vector{}
+		f.LocalVersion = 0
+		batch = append(batch, f)
+		return true
+	})
+	if len(batch) > 0 {
+		fs.Update(protocol.LocalDeviceID, batch)
+	}
+
+	// Files are iterated in order, so by going backwards we remove the
+	// contents of directories before the directories themselves.
+	for i := len(additions) - 1; i >= 0; i-- {
+		err := osutil.InWritableDir(os.Remove, filepath.Join(cfg.Path(), additions[i]))
+		if err != nil && !os.IsNotExist(err) {
+			l.Infof("Revert (folder %q, file %q): %v", folder, additions[i], err)
+		}
+	}
+	runner.setState(FolderIdle)
+	runner.IndexUpdated()
+}
+
+// Conflicts returns the conflicts in the folder whose conflict copies still
+// exist.
+func (m *Model) Conflicts(folder string) []db.Conflict {
+	m.fmut.RLock()
+	cfg, ok := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	set := db.NewConflictSet(m.db, folder)
+	var conflicts []db.Conflict
+	for _, c := range set.List() {
+		if _, err := os.Lstat(filepath.Join(cfg.Path(), c.ConflictName)); os.IsNotExist(err) {
+			// Resolved by other means
+			set.Remove(c.ConflictName)
+			continue
+		}
+		conflicts = append(conflicts, c)
+	}
+	return conflicts
+}
+
+// ResolveConflict resolves a conflict by keeping either the "original" file
+// or the "conflict" copy in its place. The other one is removed, and the
+// result is scanned so that it propagates to the other devices.
+func (m *Model) ResolveConflict(folder, conflictName, keep string) error {
+	m.fmut.RLock()
+	cfg, ok := m.folderCfgs[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return errors.New("no such folder")
+	}
+
+	set := db.NewConflictSet(m.db, folder)
+	c, ok := set.Get(conflictName)
+	if !ok {
+		return errors.New("no such conflict")
+	}
+
+	conflictPath := filepath.Join(cfg.Path(), c.ConflictName)
+	var err error
+	switch keep {
+	case "original":
+		err = osutil.InWritableDir(os.Remove, conflictPath)
+	case "conflict":
+		err = osutil.InWritableDir(func(path string) error {
+			return osutil.TryRename(path, filepath.Join(cfg.Path(), c.Name))
+		}, conflictPath)
+	default:
+		return fmt.Errorf("cannot keep %q; must be original or conflict", keep)
+	}
+	if err != nil {
+		return err
+	}
+
+	set.Remove(c.ConflictName)
+	return m.ScanFolderSubs(folder, []string{c.Name, c.ConflictName})
+}
+
+// conflictDetected records a conflict copy made by the puller.
+func (m *Model) conflictDetected(folder string, c db.Conflict) {
+	db.NewConflictSet(m.db, folder).Add(c)
+	events.Default.Log(events.ConflictDetected, map[string]interface{}{
+		"folder":       folder,
+		"name":         c.Name,
+		"conflictName": c.ConflictName,
+		"device":       c.Device.String(),
+	})
+}
+
+// conflictRemoved forgets a conflict copy that no longer exists.
+func (m *Model) conflictRemoved(folder, conflictName string) {
+	db.NewConflictSet(m.db, folder).Remove(conflictName)
+}
+
+// deviceByShortID returns the device with the given short ID, which is us or
+// one of the configured devices, or the zero device ID if there is none.
+func (m *Model) deviceByShortID(id uint64) protocol.DeviceID {
+	if id == m.shortID {
+		return m.id
+	}
+	for device := range m.cfg.Devices() {
+		if device.Short() == id {
+			return device
+		}
+	}
+	return protocol.DeviceID{}
+}
+
 // CurrentLocalVersion returns the change version for the given folder.
 // This is guaranteed to increment if the contents of the local folder has
 // changed.
@@ -1404,9 +2826,12 @@ func (m *Model) CurrentLocalVersion(folder string) int64 {
 }
 
 // RemoteLocalVersion returns the change version for the given folder, as
-// sent by remote peers. This is guaranteed to increment if the contents of
-// the remote or global folder has changed.
+// sent by currently connected remote peers. This is guaranteed to increment
+// if the contents of the remote or global folder has changed, or if a peer
+// that has files we may need has connected.
 func (m *Model) RemoteLocalVersion(folder string) int64 {
+	m.pmut.RLock()
+	defer m.pmut.RUnlock()
 	m.fmut.RLock()
 	defer m.fmut.RUnlock()
 
@@ -1419,6 +2844,11 @@ func (m *Model) RemoteLocalVersion(folder string) int64 {
 
 	var ver int64
 	for _, n := range m.folderDevices[folder] {
+		if _, ok := m.conns[n]; !ok {
+			// We keep the index of disconnected devices, but we can't pull
+			// anything from them.
+			continue
+		}
 		ver += fs.LocalVersion(n)
 	}
 
@@ -1503,7 +2933,7 @@ func (m *Model) Availability(folder, file string) []protocol.DeviceID {
 
 	availableDevices := []protocol.DeviceID{}
 	for _, device := range fs.Availability(file) {
-		_, ok := m.protoConn[device]
+		_, ok := m.conns[device]
 		if ok {
 			availableDevices = append(availableDevices, device)
 		}
@@ -1511,12 +2941,61 @@ func (m *Model) Availability(folder, file string) []protocol.DeviceID {
 	return availableDevices
 }
 
-// Bump the given files priority in the job queue
-func (m *Model) BringToFront(folder, file string) {
+// Availability is a device that has a given block available, either in the
+// file itself or in the temporary file of a download in progress.
+type Availability struct {
+	ID            protocol.DeviceID
+	FromTemporary bool
+}
+
+// blockAvailability returns the connected devices that have the given block
+// of the given file version. The block offsets of the file must have been
+// populated.
+func (m *Model) blockAvailability(folder string, file protocol.FileInfo, block protocol.BlockInfo) []Availability {
+	// Acquire this lock first, as the value returned from foldersFiles can
+	// get heavily modified on Close()
 	m.pmut.RLock()
 	defer m.pmut.RUnlock()
 
+	m.fmut.RLock()
+	fs, ok := m.folderFiles[folder]
+	devices := m.folderDevices[folder]
+	m.fmut.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	var availabilities []Availability
+	seen := make(map[protocol.DeviceID]struct{})
+	for _, device := range fs.Availability(file.Name) {
+		if _, ok := m.conns[device]; ok {
+			availabilities = append(availabilities, Availability{ID: device})
+			seen[device] = struct{}{}
+		}
+	}
+
+	index, ok := blockIndex(file.Blocks, block)
+	if !ok {
+		return availabilities
+	}
+	for _, device := range devices {
+		if _, ok := seen[device]; ok {
+			continue
+		}
+		if m.deviceDownloads[device].Has(folder, file.Name, file.Version, index) {
+			availabilities = append(availabilities, Availability{ID: device, FromTemporary: true})
+		}
+	}
+
+	return availabilities
+}
+
+// Bump the given files priority in the job queue
+func (m *Model) BringToFront(folder, file string) {
+	m.fmut.RLock()
 	runner, ok := m.folderRunners[folder]
+	m.fmut.RUnlock()
+
 	if ok {
 		runner.BringToFront(file)
 	}
@@ -1555,6 +3034,10 @@ func (m *Model) CheckFolderHealth(id string) error {
 		err = folder.CreateMarker()
 	}
 
+	if err == nil {
+		err = m.checkFreeSpace(folder)
+	}
+
 	if err == nil {
 		if folder.Invalid != "" {
 			l.Infof("Starting folder %q after error %q", folder.ID, folder.Invalid)
@@ -1604,6 +3087,32 @@ func (m *Model) String() string {
 	return fmt.Sprintf("model@%p", m)
 }
 
+func getOption(options []protocol.Option, key string) string {
+	for _, option := range options {
+		if option.Key == key {
+			return option.Value
+		}
+	}
+	return ""
+}
+
+func indexIDOptions(id uint64) []protocol.Option {
+	if id == 0 {
+		return nil
+	}
+	return []protocol.Option{
+		{
+			Key:   indexIDOption,
+			Value: strconv.FormatUint(id, 16),
+		},
+	}
+}
+
+func parseIndexID(options []protocol.Option) uint64 {
+	id, _ := strconv.ParseUint(getOption(options, indexIDOption), 16, 64)
+	return id
+}
+
 func symlinkInvalid(isLink bool) bool {
 	if !symlinks.Supported && isLink {
 		SymlinkWarning.Do(func() {
@@ -1613,3 +3122,40 @@ func symlinkInvalid(isLink bool) bool {
 	}
 	return false
 }
+
+// checkFreeSpace returns an error if there is less free space than
+// configured on the filesystem of the folder, unless it's read only, or on
+// that of the database.
+func (m *Model) checkFreeSpace(folder config.FolderConfiguration) error {
+	if !folder.ReadOnly {
+		if headroom, ok := diskHeadroom(folder.Path(), parseMinDiskFree(folder.MinDiskFree)); ok && headroom <= 0 {
+			return errOutOfSpace
+		}
+	}
+	home := filepath.Dir(m.cfg.ConfigPath())
+	if headroom, ok := diskHeadroom(home, parseMinDiskFree(m.cfg.Options().MinHomeDiskFree)); ok && headroom <= 0 {
+		return errDBOutOfSpace
+	}
+	return nil
+}
+
+// diskHeadroom returns how much more can be written to the filesystem of
+// the path before less than min remains free. The boolean is false if the
+// free space can't be determined.
+func diskHeadroom(path string, min config.Size) (int64, bool) {
+	free, total, err := osutil.DiskFree(path)
+	if err != nil {
+		if debug {
+			l.Debugf("free space in %s: %v", path, err)
+		}
+		return 0, false
+	}
+	return free - min.Bytes(total), true
+}
+
+// parseMinDiskFree returns the minimum free space in the configured format,
+// or zero if it's unset or invalid.
+func parseMinDiskFree(s string) config.Size {
+	size, _ := config.ParseSize(s)
+	return size
+}
@@ -8,20 +8,27 @@ package model
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/encryption"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/scanner"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/storage"
 )
@@ -163,6 +170,343 @@ func TestRequest(t *testing.T) {
 	}
 }
 
+func TestRequestTemporary(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+	m.StartFolderRO("default")
+	m.ScanFolder("default")
+
+	data, err := ioutil.ReadFile("testdata/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempName := filepath.Join("testdata", defTempNamer.TempName("foo"))
+	if err := ioutil.WriteFile(tempName, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tempName)
+
+	hash := testDataExpected["foo"].Blocks[0].Hash
+
+	// Block matching the hash
+	bs, err := m.Request(device1, "default", "foo", 0, len(data), hash, protocol.FlagRequestTemporary, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if bytes.Compare(bs, data) != 0 {
+		t.Errorf("Incorrect data from temporary request: %q", string(bs))
+	}
+
+	// Block not matching the hash
+	bs, err = m.Request(device1, "default", "foo", 0, len(data)-1, hash, protocol.FlagRequestTemporary, nil)
+	if err == nil {
+		t.Error("Unexpected nil error on mismatched temporary read")
+	}
+	if bs != nil {
+		t.Errorf("Unexpected non nil data on mismatched temporary read: %q", string(bs))
+	}
+
+	// File not in the index
+	bs, err = m.Request(device1, "default", "nonexistent", 0, len(data), hash, protocol.FlagRequestTemporary, nil)
+	if err == nil {
+		t.Error("Unexpected nil error on nonexistent temporary read")
+	}
+	if bs != nil {
+		t.Errorf("Unexpected non nil data on nonexistent temporary read: %q", string(bs))
+	}
+
+	// Unknown flags
+	_, err = m.Request(device1, "default", "foo", 0, len(data), hash, 1<<8, nil)
+	if err == nil {
+		t.Error("Unexpected nil error on unknown request flags")
+	}
+}
+
+func TestRequestUntrusted(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.EncryptionPassword = "password"
+	fcfg.Devices = []config.FolderDeviceConfiguration{
+		{DeviceID: device1},
+		{DeviceID: device2, Untrusted: true},
+	}
+
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+	m.ScanFolder("default")
+
+	key := encryption.NewKey("default", "password")
+	hash := testDataExpected["foo"].Blocks[0].Hash
+
+	// The trusted device gets the plain text as usual
+	bs, err := m.Request(device1, "default", "foo", 0, 7, hash, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) != "foobar\n" {
+		t.Errorf("Incorrect data from request: %q", string(bs))
+	}
+
+	// The untrusted device asks for the encrypted name and gets the
+	// encrypted data
+	bs, err = m.Request(device2, "default", key.EncryptName("foo"), 0, 7, key.EncryptHash(hash), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bs) == "foobar\n" {
+		t.Error("Data not encrypted")
+	}
+	key.DecryptBlock(bs, hash)
+	if string(bs) != "foobar\n" {
+		t.Errorf("Incorrect data from untrusted request: %q", string(bs))
+	}
+
+	// Plain text names are refused
+	if _, err := m.Request(device2, "default", "foo", 0, 7, key.EncryptHash(hash), 0, nil); err == nil {
+		t.Error("Unexpected nil error on plain text name")
+	}
+
+	// As is data that doesn't match the hash
+	if _, err := m.Request(device2, "default", key.EncryptName("foo"), 0, 6, key.EncryptHash(hash), 0, nil); err == nil {
+		t.Error("Unexpected nil error on mismatched hash")
+	}
+
+	// Temporary files are not served
+	if _, err := m.Request(device2, "default", key.EncryptName("foo"), 0, 7, key.EncryptHash(hash), protocol.FlagRequestTemporary, nil); err == nil {
+		t.Error("Unexpected nil error on temporary request")
+	}
+}
+
+func TestRequestGlobalUntrusted(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.EncryptionPassword = "password"
+	fcfg.Devices = []config.FolderDeviceConfiguration{
+		{DeviceID: device1, Untrusted: true},
+	}
+
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	key := encryption.NewKey("default", "password")
+	data := []byte("some data to return")
+	hash := sha256.Sum256(data)
+
+	enc := make([]byte, len(data))
+	copy(enc, data)
+	key.EncryptBlock(enc, hash[:])
+
+	fc := FakeConnection{
+		id:          device1,
+		requestData: enc,
+	}
+	m.AddConnection(ioutil.NopCloser(nil), fc, false)
+
+	bs, err := m.requestGlobal(device1, "default", "foo", 0, len(data), hash[:], 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, data) {
+		t.Errorf("Incorrect decrypted data %q", bs)
+	}
+}
+
+func TestIndexUntrusted(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+
+	fcfg := defaultFolderConfig.Copy()
+	fcfg.EncryptionPassword = "password"
+	fcfg.Devices = []config.FolderDeviceConfiguration{
+		{DeviceID: device1, Untrusted: true},
+	}
+
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	key := encryption.NewKey("default", "password")
+	hash := testDataExpected["foo"].Blocks[0].Hash
+	enc := key.EncryptFile(protocol.FileInfo{
+		Name:    "encrypted",
+		Version: protocol.Vector{{ID: 1, Value: 1}},
+		Blocks:  []protocol.BlockInfo{{Size: 7, Hash: hash}},
+	})
+	m.Index(device1, "default", []protocol.FileInfo{enc}, 0, nil)
+
+	f, ok := m.CurrentGlobalFile("default", "encrypted")
+	if !ok {
+		t.Fatal("Encrypted file not found")
+	}
+	if !bytes.Equal(f.Blocks[0].Hash, hash) {
+		t.Errorf("Incorrect decrypted hash %x != %x", f.Blocks[0].Hash, hash)
+	}
+
+	invalid := []protocol.FileInfo{
+		encryption.NewKey("default", "other").EncryptFile(protocol.FileInfo{Name: "otherkey"}),
+		{Name: "plain"},
+		enc,
+	}
+	// A forged delete of the file we already have
+	invalid[2].Flags |= protocol.FlagDeleted
+	invalid[2].Version = invalid[2].Version.Update(2)
+
+	for _, fs := range invalid {
+		fc := &FakeConnection{id: device1, closed: make(chan struct{})}
+		m.AddConnection(ioutil.NopCloser(nil), fc, false)
+
+		m.IndexUpdate(device1, "default", []protocol.FileInfo{fs}, 0, nil)
+		if m.ConnectedTo(device1) {
+			t.Errorf("Device still connected after sending %q", fs.Name)
+		}
+	}
+
+	if _, ok := m.CurrentGlobalFile("default", "otherkey"); ok {
+		t.Error("Unexpected file encrypted with other key")
+	}
+	if _, ok := m.CurrentGlobalFile("default", "plain"); ok {
+		t.Error("Unexpected plain text file")
+	}
+	if f, _ := m.CurrentGlobalFile("default", "encrypted"); f.IsDeleted() {
+		t.Error("Unexpected forged delete")
+	}
+}
+
+func TestClusterConfigUntrusted(t *testing.T) {
+	cfg := config.New(device1)
+	cfg.Devices = []config.DeviceConfiguration{
+		{DeviceID: device1},
+		{DeviceID: device2},
+	}
+	cfg.Folders = []config.FolderConfiguration{
+		{
+			ID:                 "folder1",
+			EncryptionPassword: "password",
+			Devices: []config.FolderDeviceConfiguration{
+				{DeviceID: device1},
+				{DeviceID: device2, Untrusted: true},
+			},
+		},
+		{
+			// No password; the untrusted device is left out
+			ID: "folder2",
+			Devices: []config.FolderDeviceConfiguration{
+				{DeviceID: device1},
+				{DeviceID: device2, Untrusted: true},
+			},
+		},
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+
+	m := NewModel(config.Wrap("/tmp/test", cfg), protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg.Folders[0])
+	m.AddFolder(cfg.Folders[1])
+
+	cm := m.clusterConfig(device1)
+	if l := len(cm.Folders); l != 2 {
+		t.Fatalf("Incorrect number of folders %d != 2", l)
+	}
+
+	r := cm.Folders[0]
+	if l := len(r.Devices); l != 2 {
+		t.Fatalf("Incorrect number of devices %d != 2", l)
+	}
+	if r.Devices[0].Flags&protocol.FlagShareTrusted == 0 {
+		t.Error("Device1 should be flagged as trusted")
+	}
+	if r.Devices[1].Flags&protocol.FlagShareTrusted != 0 {
+		t.Error("Device2 should not be flagged as trusted")
+	}
+
+	if l := len(cm.Folders[1].Devices); l != 1 {
+		t.Errorf("Incorrect number of devices %d != 1", l)
+	}
+
+	if cm := m.clusterConfig(device2); len(cm.Folders) != 1 {
+		t.Errorf("Incorrect number of folders %d != 1", len(cm.Folders))
+	}
+}
+
+func TestClusterConfigEncrypted(t *testing.T) {
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		RawPath: "testdata",
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}, {DeviceID: device2}},
+	}
+	cfg := config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}})
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, device2, "device", "syncthing", "dev", db)
+	m.AddFolder(fcfg)
+
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{
+		Folders: []protocol.Folder{
+			{
+				ID: "default",
+				Devices: []protocol.Device{
+					{ID: device1[:], Flags: protocol.FlagShareTrusted},
+					{ID: device2[:]},
+				},
+			},
+		},
+	})
+
+	if !m.folderEncrypted("default") {
+		t.Error("Folder should be encrypted")
+	}
+	if !cfg.Folders()["default"].Encrypted {
+		t.Error("Encrypted folder should be saved in the config")
+	}
+
+	// Being trusted later doesn't change that
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{
+		Folders: []protocol.Folder{
+			{
+				ID:      "default",
+				Devices: []protocol.Device{{ID: device2[:], Flags: protocol.FlagShareTrusted}},
+			},
+		},
+	})
+	if !m.folderEncrypted("default") {
+		t.Error("Folder should stay encrypted")
+	}
+
+	// We can't pass on trust in the encrypted data
+	if cm := m.clusterConfig(device1); cm.Folders[0].Devices[0].Flags&protocol.FlagShareTrusted != 0 {
+		t.Error("Device should not be flagged as trusted for an encrypted folder")
+	}
+
+	// The encrypted data isn't scanned as our own
+	m.StartFolderRO("default")
+	if err := m.ScanFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.CurrentFolderFile("default", "foo"); ok {
+		t.Error("Encrypted folder should not be scanned")
+	}
+
+	// A folder that isn't encrypted yet, and the word of an untrusted device
+	m2 := NewModel(cfg, device2, "device", "syncthing", "dev", db)
+	fcfg.ID = "plain"
+	fcfg.EncryptionPassword = "password"
+	fcfg.Devices = []config.FolderDeviceConfiguration{{DeviceID: device1, Untrusted: true}, {DeviceID: device2}}
+	m2.AddFolder(fcfg)
+	m2.ClusterConfig(device1, protocol.ClusterConfigMessage{
+		Folders: []protocol.Folder{
+			{
+				ID:      "plain",
+				Devices: []protocol.Device{{ID: device2[:]}},
+			},
+		},
+	})
+	if m2.folderEncrypted("plain") {
+		t.Error("Untrusted device should not make the folder encrypted")
+	}
+}
+
 func genFiles(n int) []protocol.FileInfo {
 	files := make([]protocol.FileInfo, n)
 	t := time.Now().Unix()
@@ -170,7 +514,7 @@ func genFiles(n int) []protocol.FileInfo {
 		files[i] = protocol.FileInfo{
 			Name:     fmt.Sprintf("file%d", i),
 			Modified: t,
-			Blocks:   []protocol.BlockInfo{{0, 100, []byte("some hash bytes")}},
+			Blocks:   []protocol.BlockInfo{{Offset: 0, Size: 100, Hash: []byte("some hash bytes")}},
 		}
 	}
 
@@ -248,13 +592,15 @@ func BenchmarkIndexUpdate10000f00001(b *testing.B) {
 }
 
 type FakeConnection struct {
-	id          protocol.DeviceID
-	requestData []byte
+	id           protocol.DeviceID
+	requestData  []byte
+	closed       chan struct{}
+	lastReceived time.Time
 }
 
-func (FakeConnection) Close() error {
-	return nil
-}
+func (FakeConnection) Close(error) {}
+
+func (FakeConnection) Start() {}
 
 func (f FakeConnection) ID() protocol.DeviceID {
 	return f.id
@@ -282,12 +628,320 @@ func (f FakeConnection) Request(folder, name string, offset int64, size int, has
 
 func (FakeConnection) ClusterConfig(protocol.ClusterConfigMessage) {}
 
+func (FakeConnection) DownloadProgress(string, []protocol.FileDownloadProgressUpdate, uint32, []protocol.Option) {
+}
+
 func (FakeConnection) Ping() bool {
 	return true
 }
 
-func (FakeConnection) Statistics() protocol.Statistics {
-	return protocol.Statistics{}
+func (f FakeConnection) Statistics() protocol.Statistics {
+	return protocol.Statistics{LastReceived: f.lastReceived}
+}
+
+func (f FakeConnection) Closed() bool {
+	select {
+	case <-f.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestMultipleConnections(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+
+	fc1 := &FakeConnection{id: device1, requestData: []byte("first"), closed: make(chan struct{})}
+	fc2 := &FakeConnection{id: device1, requestData: []byte("second"), closed: make(chan struct{})}
+	m.AddConnection(ioutil.NopCloser(nil), fc1, false)
+	m.AddConnection(ioutil.NopCloser(nil), fc2, false)
+	if n := m.NumConnections(device1); n != 2 {
+		t.Fatalf("Incorrect number of connections %d != 2", n)
+	}
+
+	// The index exchange starts on the first connection; the cluster config
+	// of the second one changes nothing.
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{ClientName: "syncthing", ClientVersion: "v0.11.0"})
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{ClientName: "other", ClientVersion: "v1"})
+	if ver := m.ConnectionStats()["connections"].(map[string]ConnectionInfo)[device1.String()].ClientVersion; ver != "v0.11.0" {
+		t.Errorf("Incorrect client version %q", ver)
+	}
+
+	// Requests are spread over both connections
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		data, err := m.requestGlobal(device1, "default", "foo", 0, 5, nil, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[string(data)] = true
+	}
+	if !seen["first"] || !seen["second"] {
+		t.Errorf("Requests not spread over the connections: %v", seen)
+	}
+
+	// Losing the second connection leaves us connected over the first
+	close(fc2.closed)
+	m.Close(device1, errors.New("closed"))
+	if n := m.NumConnections(device1); n != 1 {
+		t.Fatalf("Incorrect number of connections %d != 1", n)
+	}
+	for i := 0; i < 2; i++ {
+		if data, _ := m.requestGlobal(device1, "default", "foo", 0, 5, nil, 0, nil); string(data) != "first" {
+			t.Errorf("Request over closed connection")
+		}
+	}
+
+	// Losing the first one, carrying the index exchange, moves it to the
+	// remaining connection.
+	fc3 := &FakeConnection{id: device1, closed: make(chan struct{})}
+	m.AddConnection(ioutil.NopCloser(nil), fc3, false)
+	close(fc1.closed)
+	m.Close(device1, errors.New("closed"))
+	if !m.ConnectedTo(device1) {
+		t.Fatal("Device disconnected after losing the index connection")
+	}
+	if conns := m.conns[device1]; len(conns) != 1 || conns[0].indexes["default"] == nil {
+		t.Error("Index exchange not moved to the remaining connection")
+	}
+
+	// Losing that one too disconnects the device
+	close(fc3.closed)
+	m.Close(device1, errors.New("closed"))
+	if m.ConnectedTo(device1) {
+		t.Error("Device still connected after losing all connections")
+	}
+}
+
+func TestIndexSpreading(t *testing.T) {
+	cfg := config.New(protocol.LocalDeviceID)
+	cfg.Devices = []config.DeviceConfiguration{{DeviceID: device1}}
+	for _, id := range []string{"a", "b", "c", "d"} {
+		cfg.Folders = append(cfg.Folders, config.FolderConfiguration{
+			ID:      id,
+			RawPath: "testdata",
+			Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+		})
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	for _, fcfg := range cfg.Folders {
+		m.AddFolder(fcfg)
+	}
+
+	indexes := func() []int {
+		m.pmut.RLock()
+		defer m.pmut.RUnlock()
+		var res []int
+		for _, conn := range m.conns[device1] {
+			res = append(res, len(conn.indexes))
+		}
+		sort.Ints(res)
+		return res
+	}
+
+	// The index exchange starts over the one connection there is
+	m.AddConnection(ioutil.NopCloser(nil), &FakeConnection{id: device1}, false)
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{ClientName: "syncthing", ClientVersion: "v0.11.0"})
+	if n := indexes(); !reflect.DeepEqual(n, []int{4}) {
+		t.Errorf("Incorrect folders per connection %v", n)
+	}
+
+	// Added connections take over some of the folders
+	m.AddConnection(ioutil.NopCloser(nil), &FakeConnection{id: device1}, false)
+	if n := indexes(); !reflect.DeepEqual(n, []int{2, 2}) {
+		t.Errorf("Incorrect folders per connection %v", n)
+	}
+	m.AddConnection(ioutil.NopCloser(nil), &FakeConnection{id: device1}, false)
+	if n := indexes(); !reflect.DeepEqual(n, []int{1, 1, 2}) {
+		t.Errorf("Incorrect folders per connection %v", n)
+	}
+
+	// Every folder goes over exactly one connection
+	seen := make(map[string]int)
+	for _, conn := range m.conns[device1] {
+		for folder := range conn.indexes {
+			seen[folder]++
+		}
+	}
+	if len(seen) != 4 || seen["a"] != 1 || seen["b"] != 1 || seen["c"] != 1 || seen["d"] != 1 {
+		t.Errorf("Incorrect folder assignment %v", seen)
+	}
+}
+
+func TestIndexUpdateStale(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+
+	done := []protocol.Option{{Key: maxLocalVersionOption, Value: "100"}}
+	v1 := protocol.Vector{{ID: 1, Value: 1}}
+	v2 := protocol.Vector{{ID: 1, Value: 2}}
+	m.Index(device1, "default", []protocol.FileInfo{{Name: "file", Version: v1, LocalVersion: 10}}, 0, done)
+	if m.indexMoving(device1, "default") {
+		t.Error("Index exchange moving after the first index")
+	}
+
+	// The index is sent again when the exchange moves to another
+	// connection. An update sent before it, overtaking it over the previous
+	// connection, changes nothing.
+	m.Index(device1, "default", []protocol.FileInfo{{Name: "file", Version: v2, LocalVersion: 20}}, 0, done)
+	if !m.indexMoving(device1, "default") {
+		t.Error("Index exchange not moving after a second index")
+	}
+	m.IndexUpdate(device1, "default", []protocol.FileInfo{{Name: "file", Version: v1, LocalVersion: 10}}, 0, nil)
+	if f, ok := m.folderFiles["default"].Get(device1, "file"); !ok || !f.Version.Equal(v2) {
+		t.Errorf("Stale update applied: %v", f)
+	}
+
+	v3 := protocol.Vector{{ID: 1, Value: 3}}
+	m.IndexUpdate(device1, "default", []protocol.FileInfo{{Name: "file", Version: v3, LocalVersion: 30}}, 0, done)
+	if f, ok := m.folderFiles["default"].Get(device1, "file"); !ok || !f.Version.Equal(v3) {
+		t.Errorf("Update not applied: %v", f)
+	}
+
+	// After the round of updates following the index, the exchange has
+	// settled and the updates are no longer checked.
+	if m.indexMoving(device1, "default") {
+		t.Error("Index exchange still moving")
+	}
+}
+
+func TestReplaceConnection(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	// Our ID, protocol.LocalDeviceID, is higher than that of device1.
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+
+	// Connecting to each other at the same time, the connection set up by
+	// device1 wins at both ends.
+	fc := &FakeConnection{id: device1}
+	m.AddConnection(ioutil.NopCloser(nil), fc, false)
+	if m.ReplaceConnection(device1, true) {
+		t.Error("Our connection replaced that of the lower device")
+	}
+	m.conns[device1][0].dialer = protocol.LocalDeviceID
+	if !m.ReplaceConnection(device1, false) {
+		t.Error("The connection of the lower device did not replace ours")
+	}
+	if m.ConnectedTo(device1) {
+		t.Error("Replaced connection still there")
+	}
+
+	// A connection that has been up for a while is replaced by a new one
+	// from the device, but not by one of ours.
+	m.AddConnection(ioutil.NopCloser(nil), fc, false)
+	m.conns[device1][0].established = time.Now().Add(-time.Minute)
+	if m.ReplaceConnection(device1, true) {
+		t.Error("Our new connection replaced an old one")
+	}
+	if !m.ReplaceConnection(device1, false) {
+		t.Error("Stale connection not replaced")
+	}
+
+	// The connection carrying the index exchange is kept if possible.
+	fc1 := &FakeConnection{id: device1}
+	fc2 := &FakeConnection{id: device1}
+	m.AddConnection(ioutil.NopCloser(nil), fc1, false)
+	m.AddConnection(ioutil.NopCloser(nil), fc2, false)
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{ClientName: "syncthing", ClientVersion: "v0.11.0"})
+	for _, conn := range m.conns[device1] {
+		conn.established = time.Now().Add(-time.Minute)
+	}
+	if !m.ReplaceConnection(device1, false) {
+		t.Error("Stale connection not replaced")
+	}
+	if conns := m.conns[device1]; len(conns) != 1 || conns[0].Connection != fc1 {
+		t.Error("Incorrect connection replaced")
+	}
+
+	// A connection that is still receiving is not replaced
+	fc1.lastReceived = time.Now()
+	if m.ReplaceConnection(device1, false) {
+		t.Error("Active connection replaced")
+	}
+}
+
+func TestReplaceQuietConnection(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+
+	// Of several connections that have been up for a while, only the one
+	// that has gone quiet is replaced, even though it carries the index
+	// exchange.
+	fcs := make([]*FakeConnection, 4)
+	for i := range fcs {
+		fcs[i] = &FakeConnection{id: device1, lastReceived: time.Now()}
+		m.AddConnection(ioutil.NopCloser(nil), fcs[i], false)
+	}
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{ClientName: "syncthing", ClientVersion: "v0.11.0"})
+	for _, conn := range m.conns[device1] {
+		conn.established = time.Now().Add(-time.Hour)
+	}
+	if len(m.conns[device1][0].indexes) == 0 {
+		t.Fatal("Index exchange not on the first connection")
+	}
+	stale := fcs[0]
+	stale.lastReceived = time.Now().Add(-2 * connectionQuietTime)
+
+	if !m.ReplaceConnection(device1, false) {
+		t.Fatal("Quiet connection not replaced")
+	}
+	conns := m.conns[device1]
+	if len(conns) != len(fcs)-1 {
+		t.Fatalf("Incorrect number of connections %d != %d", len(conns), len(fcs)-1)
+	}
+	for _, conn := range conns {
+		if conn.Connection == stale {
+			t.Error("Quiet connection still there")
+		}
+	}
+
+	// With all of the remaining connections active, the new one is refused
+	if m.ReplaceConnection(device1, false) {
+		t.Error("Active connection replaced")
+	}
+	if n := m.NumConnections(device1); n != len(fcs)-1 {
+		t.Errorf("Incorrect number of connections %d != %d", n, len(fcs)-1)
+	}
+}
+
+func TestWantedConnections(t *testing.T) {
+	cfg := config.New(protocol.LocalDeviceID)
+	cfg.Devices = []config.DeviceConfiguration{{DeviceID: device1}, {DeviceID: device2, NumConnections: 2}}
+	cfg.Options.ConnectionsPerDevice = 4
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(config.Wrap("/tmp/test", cfg), protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+
+	if n := m.WantedConnections(device1); n != 4 {
+		t.Errorf("Incorrect number of wanted connections %d != 4", n)
+	}
+	if n := m.WantedConnections(device2); n != 2 {
+		t.Errorf("Incorrect number of wanted connections %d != 2", n)
+	}
+	cm := m.clusterConfig(device1)
+	if v := cm.GetOption(connectionsOption); v != "4" {
+		t.Errorf("Incorrect connections option %q", v)
+	}
+
+	// The device wants fewer connections
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{
+		Options: []protocol.Option{{Key: connectionsOption, Value: "3"}},
+	})
+	if n := m.WantedConnections(device1); n != 3 {
+		t.Errorf("Incorrect number of wanted connections %d != 3", n)
+	}
+
+	// Devices that don't say get just the one
+	m.ClusterConfig(device1, protocol.ClusterConfigMessage{})
+	if n := m.WantedConnections(device1); n != 1 {
+		t.Errorf("Incorrect number of wanted connections %d != 1", n)
+	}
 }
 
 func BenchmarkRequest(b *testing.B) {
@@ -303,7 +957,7 @@ func BenchmarkRequest(b *testing.B) {
 		files[i] = protocol.FileInfo{
 			Name:     fmt.Sprintf("file%d", i),
 			Modified: t,
-			Blocks:   []protocol.BlockInfo{{0, 100, []byte("some hash bytes")}},
+			Blocks:   []protocol.BlockInfo{{Offset: 0, Size: 100, Hash: []byte("some hash bytes")}},
 		}
 	}
 
@@ -311,7 +965,7 @@ func BenchmarkRequest(b *testing.B) {
 		id:          device1,
 		requestData: []byte("some data to return"),
 	}
-	m.AddConnection(fc, fc)
+	m.AddConnection(ioutil.NopCloser(nil), fc, false)
 	m.Index(device1, "default", files, 0, nil)
 
 	b.ResetTimer()
@@ -460,6 +1114,85 @@ func TestClusterConfig(t *testing.T) {
 	}
 }
 
+func TestClusterConfigIndexResume(t *testing.T) {
+	cfg := config.New(device1)
+	cfg.Devices = []config.DeviceConfiguration{
+		{DeviceID: device1},
+		{DeviceID: device2},
+	}
+	cfg.Folders = []config.FolderConfiguration{
+		{
+			ID: "folder1",
+			Devices: []config.FolderDeviceConfiguration{
+				{DeviceID: device1},
+				{DeviceID: device2},
+			},
+		},
+	}
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+
+	m := NewModel(config.Wrap("/tmp/test", cfg), device1, "device", "syncthing", "dev", db)
+	m.AddFolder(cfg.Folders[0])
+	fs := m.folderFiles["folder1"]
+
+	fs.Update(protocol.LocalDeviceID, []protocol.FileInfo{{Name: "a", Version: protocol.Vector{{ID: 1, Value: 1}}}})
+	fs.Update(device2, []protocol.FileInfo{{Name: "b", Version: protocol.Vector{{ID: 2, Value: 1}}, LocalVersion: 17}})
+	fs.SetIndexID(device2, 0xdead)
+	fs.SetIndexSequence(device2, 17)
+
+	// Our cluster config should announce our own index and what we know of
+	// the other device's.
+
+	cm := m.clusterConfig(device2)
+	devs := cm.Folders[0].Devices
+	if id := parseIndexID(devs[0].Options); id != fs.IndexID(protocol.LocalDeviceID) {
+		t.Errorf("Incorrect local index ID %x", id)
+	}
+	if v := devs[0].MaxLocalVersion; v != fs.LocalVersion(protocol.LocalDeviceID) {
+		t.Errorf("Incorrect local max version %d", v)
+	}
+	if id := parseIndexID(devs[1].Options); id != 0xdead {
+		t.Errorf("Incorrect remote index ID %x != dead", id)
+	}
+	if v := devs[1].MaxLocalVersion; v != 17 {
+		t.Errorf("Incorrect remote max version %d != 17", v)
+	}
+
+	// If the other device has seen our current index, we resume from where
+	// it left off and keep what we have of its index.
+
+	localVer := fs.LocalVersion(protocol.LocalDeviceID)
+	folder := protocol.Folder{
+		ID: "folder1",
+		Devices: []protocol.Device{
+			{ID: device1[:], MaxLocalVersion: localVer, Options: indexIDOptions(fs.IndexID(protocol.LocalDeviceID))},
+			{ID: device2[:], MaxLocalVersion: 17, Options: indexIDOptions(0xdead)},
+		},
+	}
+	if v := m.resumeIndexes(device2, folder, fs); v != localVer {
+		t.Errorf("Incorrect resume point %d != %d", v, localVer)
+	}
+	if _, ok := fs.Get(device2, "b"); !ok {
+		t.Error("Remote index should be kept")
+	}
+
+	// If it talks about another index of ours, or has a new index itself,
+	// we start from scratch in both directions.
+
+	folder.Devices[0].Options = indexIDOptions(0xbeef)
+	folder.Devices[1].Options = indexIDOptions(0xf00d)
+	if v := m.resumeIndexes(device2, folder, fs); v != 0 {
+		t.Errorf("Incorrect resume point %d != 0", v)
+	}
+	if _, ok := fs.Get(device2, "b"); ok {
+		t.Error("Remote index should be dropped")
+	}
+	if id := fs.IndexID(device2); id != 0xf00d {
+		t.Errorf("Incorrect remote index ID %x != f00d", id)
+	}
+}
+
 func TestIgnores(t *testing.T) {
 	arrEqual := func(a, b []string) bool {
 		if len(a) != len(b) {
@@ -667,6 +1400,156 @@ func TestROScanRecovery(t *testing.T) {
 	}
 }
 
+func TestReceiveOnlyRevert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-receiveonly-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Regardless of umask
+		os.Chmod(filepath.Join(dir, name), 0644)
+	}
+	blocks := func(content string) []protocol.BlockInfo {
+		bs, _ := scanner.Blocks(strings.NewReader(content), protocol.BlockSize, int64(len(content)))
+		return bs
+	}
+
+	fcfg := config.FolderConfiguration{
+		ID:          "ro",
+		RawPath:     dir,
+		ReceiveOnly: true,
+		Devices: []config.FolderDeviceConfiguration{
+			{DeviceID: device1},
+		},
+	}
+	cfg := config.Wrap("/tmp/test", config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{
+			{DeviceID: device1},
+		},
+	})
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+	m.fmut.Lock()
+	m.folderRunners["ro"] = newROFolder(m, "ro", time.Hour)
+	m.fmut.Unlock()
+
+	localChanges := func() []string {
+		var names []string
+		for _, f := range m.LocalChangedFiles("ro") {
+			names = append(names, f.Name)
+		}
+		return names
+	}
+
+	version := protocol.Vector{{ID: 42, Value: 1}}
+	m.Index(device1, "ro", []protocol.FileInfo{
+		{Name: "changed", Flags: 0644, Version: version, Blocks: blocks("remote")},
+		{Name: "removed", Flags: 0644, Version: version, Blocks: blocks("removed")},
+		{Name: "same", Flags: 0644, Version: version, Blocks: blocks("same")},
+	}, 0, nil)
+
+	write("added", "added")
+	write("changed", "local")
+	write("removed", "removed")
+	write("same", "same")
+	if err := m.ScanFolder("ro"); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(filepath.Join(dir, "removed"))
+	if err := m.ScanFolder("ro"); err != nil {
+		t.Fatal(err)
+	}
+
+	if changes, expected := localChanges(), []string{"added", "changed", "removed"}; !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Incorrect local changes %v != %v", changes, expected)
+	}
+	if f, _ := m.CurrentFolderFile("ro", "same"); f.IsInvalid() || !f.Version.Equal(version) {
+		t.Errorf("Unchanged file should have the global version; %v", f)
+	}
+	if f, _ := m.CurrentGlobalFile("ro", "changed"); !f.Version.Equal(version) {
+		t.Errorf("Local change should not affect the global version; %v", f)
+	}
+
+	m.Revert("ro")
+
+	if _, err := os.Stat(filepath.Join(dir, "added")); !os.IsNotExist(err) {
+		t.Error("Local addition should have been removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "changed")); err != nil {
+		t.Error("Local change should remain until pulled")
+	}
+	// Reverted changes remain local changes until the puller replaces them
+	if changes, expected := localChanges(), []string{"changed", "removed"}; !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Incorrect local changes %v != %v", changes, expected)
+	}
+	for _, name := range []string{"changed", "removed"} {
+		if f, _ := m.CurrentFolderFile("ro", name); len(f.Version) != 0 {
+			t.Errorf("Reverted file %q should have no version of its own; %v", name, f.Version)
+		}
+	}
+}
+
+func TestConflictResolution(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-conflicts-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fcfg := config.FolderConfiguration{ID: "default", RawPath: dir}
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+	m.fmut.Lock()
+	m.folderRunners["default"] = newROFolder(m, "default", time.Hour)
+	m.fmut.Unlock()
+
+	for _, keep := range []string{"original", "conflict"} {
+		ioutil.WriteFile(filepath.Join(dir, "file"), []byte("original"), 0644)
+		ioutil.WriteFile(filepath.Join(dir, "file.sync-conflict"), []byte("conflict"), 0644)
+		m.conflictDetected("default", db.Conflict{Name: "file", ConflictName: "file.sync-conflict"})
+
+		if conflicts := m.Conflicts("default"); len(conflicts) != 1 {
+			t.Fatalf("Expected one conflict, not %v", conflicts)
+		}
+		if err := m.ResolveConflict("default", "file.sync-conflict", "neither"); err == nil {
+			t.Error("Unexpected nil error for invalid choice")
+		}
+		if err := m.ResolveConflict("default", "file.sync-conflict", keep); err != nil {
+			t.Fatal(err)
+		}
+
+		if bs, _ := ioutil.ReadFile(filepath.Join(dir, "file")); string(bs) != keep {
+			t.Errorf("Keeping %s resulted in %q", keep, bs)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "file.sync-conflict")); !os.IsNotExist(err) {
+			t.Errorf("Keeping %s should remove the conflict copy", keep)
+		}
+		if conflicts := m.Conflicts("default"); len(conflicts) != 0 {
+			t.Errorf("Unexpected conflicts after resolution %v", conflicts)
+		}
+		if f, ok := m.CurrentFolderFile("default", "file.sync-conflict"); ok && !f.IsDeleted() {
+			t.Errorf("Keeping %s should leave the conflict copy out of the index", keep)
+		}
+	}
+
+	// A conflict copy that has disappeared is no longer listed
+	ioutil.WriteFile(filepath.Join(dir, "other.sync-conflict"), nil, 0644)
+	m.conflictDetected("default", db.Conflict{Name: "other", ConflictName: "other.sync-conflict"})
+	os.Remove(filepath.Join(dir, "other.sync-conflict"))
+	if conflicts := m.Conflicts("default"); len(conflicts) != 0 {
+		t.Errorf("Unexpected conflicts %v", conflicts)
+	}
+}
+
 func TestRWScanRecovery(t *testing.T) {
 	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
 	set := db.NewFileSet("default", ldb)
@@ -1151,7 +2034,7 @@ func genDeepFiles(n, d int) []protocol.FileInfo {
 		}
 
 		files[i].Modified = t
-		files[i].Blocks = []protocol.BlockInfo{{0, 100, []byte("some hash bytes")}}
+		files[i].Blocks = []protocol.BlockInfo{{Offset: 0, Size: 100, Hash: []byte("some hash bytes")}}
 	}
 
 	return files
@@ -1216,3 +2099,214 @@ func BenchmarkTree_00100_10(b *testing.B) {
 		m.GlobalDirectoryTree("default", "", -1, false)
 	}
 }
+
+func TestSubscriptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-subscriptions-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fcfg := config.FolderConfiguration{
+		ID:      "default",
+		RawPath: dir,
+		Devices: []config.FolderDeviceConfiguration{{DeviceID: device1}},
+	}
+	cfg := config.Wrap(filepath.Join(dir, "config.xml"), config.Configuration{
+		Folders: []config.FolderConfiguration{fcfg},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	})
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+
+	version := protocol.Vector{{ID: device1.Short(), Value: 1}}
+	m.Index(device1, "default", []protocol.FileInfo{
+		{Name: "a", Flags: protocol.FlagDirectory, Version: version},
+		{Name: filepath.Join("a", "file"), Version: version, Blocks: []protocol.BlockInfo{{Size: 100}}},
+		{Name: "b", Flags: protocol.FlagDirectory, Version: version},
+		{Name: filepath.Join("b", "file"), Version: version, Blocks: []protocol.BlockInfo{{Size: 300}}},
+	}, 0, nil)
+
+	if files, bytes := m.NeedSize("default"); files != 4 || bytes != 128+100+128+300 {
+		t.Errorf("Incorrect need before subscribing: %d files, %d bytes", files, bytes)
+	}
+
+	if err := m.SetSubscriptions("default", []string{"/a/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if subs, _ := m.Subscriptions("default"); !reflect.DeepEqual(subs, []string{"a"}) {
+		t.Errorf("Incorrect subscriptions %v", subs)
+	}
+	if files, bytes := m.NeedSize("default"); files != 2 || bytes != 128+100 {
+		t.Errorf("Incorrect need after subscribing: %d files, %d bytes", files, bytes)
+	}
+	if _, _, rest := m.NeedFolderFiles("default", 0); len(rest) != 2 {
+		t.Errorf("Incorrect needed files %v", rest)
+	}
+	if comp := m.Completion(protocol.LocalDeviceID, "default"); comp != 0 {
+		t.Errorf("Incorrect completion %f", comp)
+	}
+
+	saved, err := config.Load(filepath.Join(dir, "config.xml"), protocol.LocalDeviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subs := saved.Folders()["default"].Subscriptions; !reflect.DeepEqual(subs, []string{"a"}) {
+		t.Errorf("Incorrect saved subscriptions %v", subs)
+	}
+
+	if _, err := m.Subscriptions("nonexistent"); err == nil {
+		t.Error("Unexpected nil error for nonexistent folder")
+	}
+}
+
+func TestSubscribed(t *testing.T) {
+	subs := []string{"a/b", "c"}
+	for name, expected := range map[string]bool{
+		"a":     true,
+		"a/b":   true,
+		"a/b/c": true,
+		"a/bc":  false,
+		"a/c":   false,
+		"c":     true,
+		"c/d":   true,
+		"d":     false,
+	} {
+		if res := subscribed(subs, filepath.FromSlash(name)); res != expected {
+			t.Errorf("subscribed(%v, %q) = %v, expected %v", subs, name, res, expected)
+		}
+	}
+	if !subscribed(nil, "anything") {
+		t.Error("Everything should be subscribed to without subscriptions")
+	}
+}
+
+func TestPauseFolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-pause-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fcfg := config.FolderConfiguration{ID: "default", RawPath: dir, ReadOnly: true}
+	cfgFile := filepath.Join(dir, "config.xml")
+	cfg := config.Wrap(cfgFile, config.Configuration{
+		Version: config.CurrentVersion,
+		Folders: []config.FolderConfiguration{fcfg},
+	})
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+	m.StartFolderRO("default")
+
+	sub := events.Default.Subscribe(events.FolderPaused | events.FolderResumed)
+	defer events.Default.Unsubscribe(sub)
+
+	if err := m.PauseFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+	if ev, err := sub.Poll(time.Second); err != nil || ev.Type != events.FolderPaused {
+		t.Errorf("Expected FolderPaused event, not %v (%v)", ev, err)
+	}
+	if state, _ := m.State("default"); state != "paused" {
+		t.Errorf("Incorrect state %q for paused folder", state)
+	}
+	if err := m.ScanFolder("default"); err != errFolderPaused {
+		t.Errorf("Unexpected scan error %v for paused folder", err)
+	}
+	if errs, err := m.FolderErrors("default"); err != nil || len(errs) != 0 {
+		t.Errorf("Unexpected errors %v (%v) for paused folder", errs, err)
+	}
+	if saved, err := config.Load(cfgFile, protocol.LocalDeviceID); err != nil {
+		t.Fatal(err)
+	} else if !saved.Folders()["default"].Paused {
+		t.Error("Paused state not saved")
+	}
+
+	if err := m.ResumeFolder("default"); err != nil {
+		t.Fatal(err)
+	}
+	if ev, err := sub.Poll(time.Second); err != nil || ev.Type != events.FolderResumed {
+		t.Errorf("Expected FolderResumed event, not %v (%v)", ev, err)
+	}
+	m.fmut.RLock()
+	_, running := m.folderRunners["default"]
+	m.fmut.RUnlock()
+	if !running {
+		t.Error("Resumed folder not running")
+	}
+	if saved, err := config.Load(cfgFile, protocol.LocalDeviceID); err != nil {
+		t.Fatal(err)
+	} else if saved.Folders()["default"].Paused {
+		t.Error("Resumed state not saved")
+	}
+
+	if err := m.PauseFolder("nonexistent"); err == nil {
+		t.Error("Unexpected nil error for nonexistent folder")
+	}
+
+	// Files may be prioritized while the folder is paused and resumed
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			m.BringToFront("default", "foo")
+		}
+		close(done)
+	}()
+	m.PauseFolder("default")
+	m.ResumeFolder("default")
+	<-done
+}
+
+func TestPauseDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-pause-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfgFile := filepath.Join(dir, "config.xml")
+	cfg := config.Wrap(cfgFile, config.Configuration{
+		Version: config.CurrentVersion,
+		Folders: []config.FolderConfiguration{defaultFolderConfig},
+		Devices: []config.DeviceConfiguration{{DeviceID: device1}},
+	})
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(defaultFolderConfig)
+	m.AddConnection(ioutil.NopCloser(nil), &FakeConnection{id: device1}, false)
+
+	sub := events.Default.Subscribe(events.DevicePaused | events.DeviceResumed)
+	defer events.Default.Unsubscribe(sub)
+
+	if err := m.PauseDevice(device1); err != nil {
+		t.Fatal(err)
+	}
+	if m.ConnectedTo(device1) {
+		t.Error("Paused device still connected")
+	}
+	if ev, err := sub.Poll(time.Second); err != nil || ev.Type != events.DevicePaused {
+		t.Errorf("Expected DevicePaused event, not %v (%v)", ev, err)
+	}
+	if saved, err := config.Load(cfgFile, protocol.LocalDeviceID); err != nil {
+		t.Fatal(err)
+	} else if !saved.Devices()[device1].Paused {
+		t.Error("Paused state not saved")
+	}
+
+	if err := m.ResumeDevice(device1); err != nil {
+		t.Fatal(err)
+	}
+	if ev, err := sub.Poll(time.Second); err != nil || ev.Type != events.DeviceResumed {
+		t.Errorf("Expected DeviceResumed event, not %v (%v)", ev, err)
+	}
+	if cfg.Devices()[device1].Paused {
+		t.Error("Resumed device still paused")
+	}
+
+	if err := m.PauseDevice(device2); err == nil {
+		t.Error("Unexpected nil error for unknown device")
+	}
+}
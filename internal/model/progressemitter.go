@@ -12,6 +12,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/events"
 )
@@ -22,19 +23,27 @@ type ProgressEmitter struct {
 	last     map[string]map[string]*pullerProgress
 	mut      sync.Mutex
 
+	connections        map[protocol.DeviceID]protocol.Connection
+	foldersByConns     map[protocol.DeviceID][]string
+	sentDownloadStates map[protocol.DeviceID]*sentDownloadState
+
 	timer *time.Timer
 
 	stop chan struct{}
 }
 
 // Creates a new progress emitter which emits DownloadProgress events every
-// interval.
+// interval, and sends DownloadProgress messages to the subscribed
+// connections.
 func NewProgressEmitter(cfg *config.Wrapper) *ProgressEmitter {
 	t := &ProgressEmitter{
-		stop:     make(chan struct{}),
-		registry: make(map[string]*sharedPullerState),
-		last:     make(map[string]map[string]*pullerProgress),
-		timer:    time.NewTimer(time.Millisecond),
+		stop:               make(chan struct{}),
+		registry:           make(map[string]*sharedPullerState),
+		last:               make(map[string]map[string]*pullerProgress),
+		timer:              time.NewTimer(time.Millisecond),
+		connections:        make(map[protocol.DeviceID]protocol.Connection),
+		foldersByConns:     make(map[protocol.DeviceID][]string),
+		sentDownloadStates: make(map[protocol.DeviceID]*sentDownloadState),
 	}
 	t.Changed(cfg.Raw())
 	cfg.Subscribe(t)
@@ -72,12 +81,53 @@ func (t *ProgressEmitter) Serve() {
 			} else if debug {
 				l.Debugln("progress emitter: nothing new")
 			}
+			msgs := t.downloadProgressMessages()
 			if len(t.registry) != 0 {
 				t.timer.Reset(t.interval)
 			}
 			t.mut.Unlock()
+
+			// Sending blocks while the connection is busy, which must not
+			// hold up the pullers registering and deregistering.
+			for _, msg := range msgs {
+				msg.conn.DownloadProgress(msg.folder, msg.updates, 0, nil)
+			}
+		}
+	}
+}
+
+// A downloadProgressMessage holds the download progress updates to send to a
+// connection for a folder.
+type downloadProgressMessage struct {
+	conn    protocol.Connection
+	folder  string
+	updates []protocol.FileDownloadProgressUpdate
+}
+
+// downloadProgressMessages returns the messages that tell the subscribed
+// connections which blocks are available in the temporary files of the files
+// we are currently downloading. Must be called with the lock held.
+func (t *ProgressEmitter) downloadProgressMessages() []downloadProgressMessage {
+	pullers := make(map[string][]*sharedPullerState)
+	for _, puller := range t.registry {
+		pullers[puller.folder] = append(pullers[puller.folder], puller)
+	}
+
+	var msgs []downloadProgressMessage
+	for id, conn := range t.connections {
+		state := t.sentDownloadStates[id]
+		for _, folder := range t.foldersByConns[id] {
+			updates := state.update(folder, pullers[folder])
+			if len(updates) == 0 {
+				continue
+			}
+			if debug {
+				l.Debugf("progress emitter: sending %d download progress updates for %q to %s", len(updates), folder, id)
+			}
+			msgs = append(msgs, downloadProgressMessage{conn, folder, updates})
 		}
 	}
+	return msgs
 }
 
 // Interface method to handle configuration changes
@@ -121,6 +171,45 @@ func (t *ProgressEmitter) Deregister(s *sharedPullerState) {
 	delete(t.registry, filepath.Join(s.folder, s.file.Name))
 }
 
+// temporaryIndexSubscribe starts sending DownloadProgress messages for the
+// given folders to the connection.
+func (t *ProgressEmitter) temporaryIndexSubscribe(conn protocol.Connection, folders []string) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if debug {
+		l.Debugln("progress emitter: subscribing", conn.ID(), folders)
+	}
+	t.connections[conn.ID()] = conn
+	t.foldersByConns[conn.ID()] = folders
+	t.sentDownloadStates[conn.ID()] = newSentDownloadState()
+}
+
+// temporaryIndexReplace sends the DownloadProgress messages that went to the
+// old connection, which is closed, over the new one to the same device.
+func (t *ProgressEmitter) temporaryIndexReplace(old, new protocol.Connection) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if t.connections[old.ID()] == old {
+		if debug {
+			l.Debugln("progress emitter: replacing connection to", old.ID())
+		}
+		t.connections[old.ID()] = new
+	}
+}
+
+// temporaryIndexUnsubscribe stops sending DownloadProgress messages to the
+// given device.
+func (t *ProgressEmitter) temporaryIndexUnsubscribe(device protocol.DeviceID) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if debug {
+		l.Debugln("progress emitter: unsubscribing", device)
+	}
+	delete(t.connections, device)
+	delete(t.foldersByConns, device)
+	delete(t.sentDownloadStates, device)
+}
+
 // Returns number of bytes completed in the given folder.
 func (t *ProgressEmitter) BytesCompleted(folder string) (bytes int64) {
 	t.mut.Lock()
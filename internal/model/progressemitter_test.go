@@ -7,9 +7,11 @@
 package model
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
+	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/events"
 )
@@ -56,7 +58,7 @@ func TestProgressEmitter(t *testing.T) {
 	expectEvent(w, t, 1)
 	expectTimeout(w, t)
 
-	s.copyDone()
+	s.copyDone(protocol.BlockInfo{})
 
 	expectEvent(w, t, 1)
 	expectTimeout(w, t)
@@ -71,7 +73,7 @@ func TestProgressEmitter(t *testing.T) {
 	expectEvent(w, t, 1)
 	expectTimeout(w, t)
 
-	s.pullDone()
+	s.pullDone(protocol.BlockInfo{})
 
 	expectEvent(w, t, 1)
 	expectTimeout(w, t)
@@ -82,3 +84,118 @@ func TestProgressEmitter(t *testing.T) {
 	expectTimeout(w, t)
 
 }
+
+// blockingConnection blocks when sending download progress, until unblocked.
+type blockingConnection struct {
+	FakeConnection
+	sending chan struct{}
+	unblock chan struct{}
+}
+
+func (c blockingConnection) DownloadProgress(string, []protocol.FileDownloadProgressUpdate, uint32, []protocol.Option) {
+	select {
+	case c.sending <- struct{}{}:
+	default:
+	}
+	<-c.unblock
+}
+
+func TestProgressEmitterBlockedConnection(t *testing.T) {
+	c := config.Wrap("/tmp/test", config.Configuration{})
+	c.SetOptions(config.OptionsConfiguration{
+		ProgressUpdateIntervalS: 0,
+	})
+
+	p := NewProgressEmitter(c)
+	go p.Serve()
+
+	conn := blockingConnection{
+		FakeConnection: FakeConnection{id: device1},
+		sending:        make(chan struct{}, 1),
+		unblock:        make(chan struct{}),
+	}
+	p.temporaryIndexSubscribe(conn, []string{"folder"})
+
+	block := protocol.BlockInfo{Size: 42}
+	s := &sharedPullerState{
+		folder: "folder",
+		file:   protocol.FileInfo{Name: "file", Blocks: []protocol.BlockInfo{block}},
+	}
+	s.copyDone(block)
+	p.Register(s)
+
+	select {
+	case <-conn.sending:
+	case <-time.After(time.Second):
+		t.Fatal("Download progress not sent")
+	}
+
+	// The connection is stuck sending, which must not block the pullers
+	done := make(chan struct{})
+	go func() {
+		p.Deregister(s)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Deregister blocked by a busy connection")
+	}
+
+	close(conn.unblock)
+	p.Stop()
+}
+
+func TestSentDownloadState(t *testing.T) {
+	v1 := protocol.Vector{{ID: 1, Value: 1}}
+	v2 := protocol.Vector{{ID: 1, Value: 2}}
+
+	blocks := []protocol.BlockInfo{
+		{Offset: 0, Size: protocol.BlockSize},
+		{Offset: protocol.BlockSize, Size: protocol.BlockSize},
+		{Offset: 2 * protocol.BlockSize, Size: 42},
+	}
+	s := &sharedPullerState{
+		folder: "folder",
+		file:   protocol.FileInfo{Name: "file", Version: v1, Blocks: blocks},
+	}
+	sent := newSentDownloadState()
+
+	expectUpdates := func(updates []protocol.FileDownloadProgressUpdate, expected ...protocol.FileDownloadProgressUpdate) {
+		if len(updates) != len(expected) {
+			t.Fatalf("Unexpected updates %v, expected %v", updates, expected)
+		}
+		for i := range updates {
+			if updates[i].UpdateType != expected[i].UpdateType || !updates[i].Version.Equal(expected[i].Version) || fmt.Sprint(updates[i].BlockIndexes) != fmt.Sprint(expected[i].BlockIndexes) {
+				t.Fatalf("Unexpected update %v, expected %v", updates[i], expected[i])
+			}
+		}
+	}
+
+	// Nothing downloaded yet, nothing to announce
+	expectUpdates(sent.update("folder", []*sharedPullerState{s}))
+
+	s.copyDone(blocks[2])
+	expectUpdates(sent.update("folder", []*sharedPullerState{s}),
+		protocol.FileDownloadProgressUpdate{UpdateType: protocol.UpdateTypeAppend, Version: v1, BlockIndexes: []int32{2}})
+	expectUpdates(sent.update("folder", []*sharedPullerState{s}))
+
+	s.pullDone(blocks[0])
+	expectUpdates(sent.update("folder", []*sharedPullerState{s}),
+		protocol.FileDownloadProgressUpdate{UpdateType: protocol.UpdateTypeAppend, Version: v1, BlockIndexes: []int32{0}})
+
+	// A new version of the file is being downloaded
+	s2 := &sharedPullerState{
+		folder: "folder",
+		file:   protocol.FileInfo{Name: "file", Version: v2, Blocks: blocks},
+	}
+	s2.copyDone(blocks[1])
+	expectUpdates(sent.update("folder", []*sharedPullerState{s2}),
+		protocol.FileDownloadProgressUpdate{UpdateType: protocol.UpdateTypeForget, Version: v1},
+		protocol.FileDownloadProgressUpdate{UpdateType: protocol.UpdateTypeAppend, Version: v2, BlockIndexes: []int32{1}})
+
+	// The download is done
+	expectUpdates(sent.update("folder", nil),
+		protocol.FileDownloadProgressUpdate{UpdateType: protocol.UpdateTypeForget, Version: v2})
+	expectUpdates(sent.update("folder", nil))
+}
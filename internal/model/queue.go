@@ -6,21 +6,46 @@
 
 package model
 
-import "sync"
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/syncthing/protocol"
+)
+
+const (
+	minRetryDelay = 10 * time.Second
+	maxRetryDelay = time.Hour
+)
 
 type jobQueue struct {
 	progress []string
-	queued   []string
+	queued   []jobQueueEntry
+	delayed  map[string]jobBackoff // Failed files, not to be retried until later
 	mut      sync.Mutex
 }
 
+type jobBackoff struct {
+	failures int
+	until    time.Time
+	version  protocol.Vector // The version of the file that failed
+}
+
+type jobQueueEntry struct {
+	name     string
+	size     int64
+	modified int64
+}
+
 func newJobQueue() *jobQueue {
 	return &jobQueue{}
 }
 
-func (q *jobQueue) Push(file string) {
+func (q *jobQueue) Push(file string, size, modified int64) {
 	q.mut.Lock()
-	q.queued = append(q.queued, file)
+	q.queued = append(q.queued, jobQueueEntry{file, size, modified})
 	q.mut.Unlock()
 }
 
@@ -33,7 +58,7 @@ func (q *jobQueue) Pop() (string, bool) {
 	}
 
 	var f string
-	f = q.queued[0]
+	f = q.queued[0].name
 	q.queued = q.queued[1:]
 	q.progress = append(q.progress, f)
 
@@ -45,7 +70,7 @@ func (q *jobQueue) BringToFront(filename string) {
 	defer q.mut.Unlock()
 
 	for i, cur := range q.queued {
-		if cur == filename {
+		if cur.name == filename {
 			if i > 0 {
 				// Shift the elements before the selected element one step to
 				// the right, overwriting the selected element
@@ -71,7 +96,9 @@ func (q *jobQueue) Done(file string) {
 	}
 }
 
-func (q *jobQueue) Jobs() ([]string, []string) {
+// Jobs returns the files in progress, the queued files and the files backing
+// off after failing, the latter sorted by name.
+func (q *jobQueue) Jobs() ([]string, []string, []string) {
 	q.mut.Lock()
 	defer q.mut.Unlock()
 
@@ -79,7 +106,137 @@ func (q *jobQueue) Jobs() ([]string, []string) {
 	copy(progress, q.progress)
 
 	queued := make([]string, len(q.queued))
-	copy(queued, q.queued)
+	for i, e := range q.queued {
+		queued[i] = e.name
+	}
+
+	delayed := make([]string, 0, len(q.delayed))
+	for name := range q.delayed {
+		delayed = append(delayed, name)
+	}
+	sort.Strings(delayed)
+
+	return progress, queued, delayed
+}
+
+// Delay records a failure of the given version of the file and returns the
+// time before which it shouldn't be retried. The delay doubles with each
+// consecutive failure of the same version, from minRetryDelay up to
+// maxRetryDelay. Failures that don't escalate, such as there being nobody to
+// pull the file from right now, keep the delay where it is.
+func (q *jobQueue) Delay(file string, version protocol.Vector, escalate bool) time.Time {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	if q.delayed == nil {
+		q.delayed = make(map[string]jobBackoff)
+	}
 
-	return progress, queued
+	b := q.delayed[file]
+	if !b.version.Equal(version) {
+		b = jobBackoff{version: version.Copy()}
+	}
+	delay := maxRetryDelay
+	if b.failures < 16 {
+		if d := minRetryDelay << uint(b.failures); d < maxRetryDelay {
+			delay = d
+		}
+	}
+	if escalate {
+		b.failures++
+	}
+	b.until = time.Now().Add(delay)
+	q.delayed[file] = b
+
+	return b.until
+}
+
+// Delayed returns true if the given version of the file failed recently and
+// shouldn't be retried yet. A new version of the file starts over without
+// delay.
+func (q *jobQueue) Delayed(file string, version protocol.Vector) bool {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	b, ok := q.delayed[file]
+	if ok && !b.version.Equal(version) {
+		delete(q.delayed, file)
+		return false
+	}
+	return ok && time.Now().Before(b.until)
+}
+
+// Forget clears the backoff state of the file, as it has synced or is no
+// longer needed.
+func (q *jobQueue) Forget(file string) {
+	q.mut.Lock()
+	delete(q.delayed, file)
+	q.mut.Unlock()
 }
+
+// NextRetry returns the time at which the first of the delayed files may be
+// retried, or false if there are none.
+func (q *jobQueue) NextRetry() (time.Time, bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	var next time.Time
+	for _, b := range q.delayed {
+		if next.IsZero() || b.until.Before(next) {
+			next = b.until
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Shuffle puts the queued files in random order.
+func (q *jobQueue) Shuffle() {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	for i := len(q.queued) - 1; i > 0; i-- {
+		j := rand.Intn(i + 1)
+		q.queued[i], q.queued[j] = q.queued[j], q.queued[i]
+	}
+}
+
+// The sorts are stable, so that files that compare equal stay in the order
+// they were pushed.
+
+func (q *jobQueue) SortSmallestFirst() {
+	q.sort(func(a, b jobQueueEntry) bool { return a.size < b.size })
+}
+
+func (q *jobQueue) SortLargestFirst() {
+	q.sort(func(a, b jobQueueEntry) bool { return a.size > b.size })
+}
+
+func (q *jobQueue) SortOldestFirst() {
+	q.sort(func(a, b jobQueueEntry) bool { return a.modified < b.modified })
+}
+
+func (q *jobQueue) SortNewestFirst() {
+	q.sort(func(a, b jobQueueEntry) bool { return a.modified > b.modified })
+}
+
+// Prioritize moves the queued files with a lower rank ahead of those with a
+// higher one, keeping the order among files of the same rank.
+func (q *jobQueue) Prioritize(rank func(file string) int) {
+	q.sort(func(a, b jobQueueEntry) bool { return rank(a.name) < rank(b.name) })
+}
+
+func (q *jobQueue) sort(less func(a, b jobQueueEntry) bool) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+
+	sort.Stable(jobQueueSorter{q.queued, less})
+}
+
+type jobQueueSorter struct {
+	entries []jobQueueEntry
+	less    func(a, b jobQueueEntry) bool
+}
+
+func (s jobQueueSorter) Len() int           { return len(s.entries) }
+func (s jobQueueSorter) Less(i, j int) bool { return s.less(s.entries[i], s.entries[j]) }
+func (s jobQueueSorter) Swap(i, j int)      { s.entries[i], s.entries[j] = s.entries[j], s.entries[i] }
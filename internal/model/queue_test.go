@@ -9,18 +9,22 @@ package model
 import (
 	"fmt"
 	"reflect"
+	"sort"
 	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
 )
 
 func TestJobQueue(t *testing.T) {
 	// Some random actions
 	q := newJobQueue()
-	q.Push("f1")
-	q.Push("f2")
-	q.Push("f3")
-	q.Push("f4")
+	q.Push("f1", 0, 0)
+	q.Push("f2", 0, 0)
+	q.Push("f3", 0, 0)
+	q.Push("f4", 0, 0)
 
-	progress, queued := q.Jobs()
+	progress, queued, _ := q.Jobs()
 	if len(progress) != 0 || len(queued) != 4 {
 		t.Fatal("Wrong length")
 	}
@@ -30,7 +34,7 @@ func TestJobQueue(t *testing.T) {
 		if !ok || n != fmt.Sprintf("f%d", i) {
 			t.Fatal("Wrong element")
 		}
-		progress, queued = q.Jobs()
+		progress, queued, _ = q.Jobs()
 		if len(progress) != 1 || len(queued) != 3 {
 			t.Log(progress)
 			t.Log(queued)
@@ -38,19 +42,19 @@ func TestJobQueue(t *testing.T) {
 		}
 
 		q.Done(n)
-		progress, queued = q.Jobs()
+		progress, queued, _ = q.Jobs()
 		if len(progress) != 0 || len(queued) != 3 {
 			t.Fatal("Wrong length", len(progress), len(queued))
 		}
 
-		q.Push(n)
-		progress, queued = q.Jobs()
+		q.Push(n, 0, 0)
+		progress, queued, _ = q.Jobs()
 		if len(progress) != 0 || len(queued) != 4 {
 			t.Fatal("Wrong length")
 		}
 
 		q.Done("f5") // Does not exist
-		progress, queued = q.Jobs()
+		progress, queued, _ = q.Jobs()
 		if len(progress) != 0 || len(queued) != 4 {
 			t.Fatal("Wrong length")
 		}
@@ -61,7 +65,7 @@ func TestJobQueue(t *testing.T) {
 	}
 
 	for i := 4; i > 0; i-- {
-		progress, queued = q.Jobs()
+		progress, queued, _ = q.Jobs()
 		if len(progress) != 4-i || len(queued) != i {
 			t.Fatal("Wrong length")
 		}
@@ -69,7 +73,7 @@ func TestJobQueue(t *testing.T) {
 		s := fmt.Sprintf("f%d", i)
 
 		q.BringToFront(s)
-		progress, queued = q.Jobs()
+		progress, queued, _ = q.Jobs()
 		if len(progress) != 4-i || len(queued) != i {
 			t.Fatal("Wrong length")
 		}
@@ -78,13 +82,13 @@ func TestJobQueue(t *testing.T) {
 		if !ok || n != s {
 			t.Fatal("Wrong element")
 		}
-		progress, queued = q.Jobs()
+		progress, queued, _ = q.Jobs()
 		if len(progress) != 5-i || len(queued) != i-1 {
 			t.Fatal("Wrong length")
 		}
 
 		q.Done("f5") // Does not exist
-		progress, queued = q.Jobs()
+		progress, queued, _ = q.Jobs()
 		if len(progress) != 5-i || len(queued) != i-1 {
 			t.Fatal("Wrong length")
 		}
@@ -106,13 +110,13 @@ func TestJobQueue(t *testing.T) {
 		t.Fatal("Wrong length")
 	}
 
-	progress, queued = q.Jobs()
+	progress, queued, _ = q.Jobs()
 	if len(progress) != 0 || len(queued) != 0 {
 		t.Fatal("Wrong length")
 	}
 	q.BringToFront("")
 	q.Done("f5") // Does not exist
-	progress, queued = q.Jobs()
+	progress, queued, _ = q.Jobs()
 	if len(progress) != 0 || len(queued) != 0 {
 		t.Fatal("Wrong length")
 	}
@@ -120,51 +124,102 @@ func TestJobQueue(t *testing.T) {
 
 func TestBringToFront(t *testing.T) {
 	q := newJobQueue()
-	q.Push("f1")
-	q.Push("f2")
-	q.Push("f3")
-	q.Push("f4")
+	q.Push("f1", 0, 0)
+	q.Push("f2", 0, 0)
+	q.Push("f3", 0, 0)
+	q.Push("f4", 0, 0)
 
-	_, queued := q.Jobs()
+	_, queued, _ := q.Jobs()
 	if !reflect.DeepEqual(queued, []string{"f1", "f2", "f3", "f4"}) {
 		t.Errorf("Incorrect order %v at start", queued)
 	}
 
 	q.BringToFront("f1") // corner case: does nothing
 
-	_, queued = q.Jobs()
+	_, queued, _ = q.Jobs()
 	if !reflect.DeepEqual(queued, []string{"f1", "f2", "f3", "f4"}) {
 		t.Errorf("Incorrect order %v", queued)
 	}
 
 	q.BringToFront("f3")
 
-	_, queued = q.Jobs()
+	_, queued, _ = q.Jobs()
 	if !reflect.DeepEqual(queued, []string{"f3", "f1", "f2", "f4"}) {
 		t.Errorf("Incorrect order %v", queued)
 	}
 
 	q.BringToFront("f2")
 
-	_, queued = q.Jobs()
+	_, queued, _ = q.Jobs()
 	if !reflect.DeepEqual(queued, []string{"f2", "f3", "f1", "f4"}) {
 		t.Errorf("Incorrect order %v", queued)
 	}
 
 	q.BringToFront("f4") // corner case: last element
 
-	_, queued = q.Jobs()
+	_, queued, _ = q.Jobs()
 	if !reflect.DeepEqual(queued, []string{"f4", "f2", "f3", "f1"}) {
 		t.Errorf("Incorrect order %v", queued)
 	}
 }
 
+func TestQueueSorting(t *testing.T) {
+	push := func() *jobQueue {
+		q := newJobQueue()
+		q.Push("f1", 20, 300)
+		q.Push("f2", 10, 100)
+		q.Push("f3", 30, 200)
+		q.Push("f4", 10, 300)
+		return q
+	}
+
+	cases := []struct {
+		sort     func(q *jobQueue)
+		expected []string
+	}{
+		{(*jobQueue).SortSmallestFirst, []string{"f2", "f4", "f1", "f3"}},
+		{(*jobQueue).SortLargestFirst, []string{"f3", "f1", "f2", "f4"}},
+		{(*jobQueue).SortOldestFirst, []string{"f2", "f3", "f1", "f4"}},
+		{(*jobQueue).SortNewestFirst, []string{"f1", "f4", "f3", "f2"}},
+	}
+
+	for i, tc := range cases {
+		q := push()
+		tc.sort(q)
+		if _, queued, _ := q.Jobs(); !reflect.DeepEqual(queued, tc.expected) {
+			t.Errorf("%d: incorrect order %v != %v", i, queued, tc.expected)
+		}
+	}
+
+	q := push()
+	q.Shuffle()
+	_, queued, _ := q.Jobs()
+	sort.Strings(queued)
+	if !reflect.DeepEqual(queued, []string{"f1", "f2", "f3", "f4"}) {
+		t.Errorf("Shuffle lost files; %v", queued)
+	}
+
+	q = push()
+	q.Prioritize(func(file string) int {
+		switch file {
+		case "f3":
+			return 0
+		case "f1":
+			return 2
+		}
+		return 1
+	})
+	if _, queued, _ := q.Jobs(); !reflect.DeepEqual(queued, []string{"f3", "f2", "f4", "f1"}) {
+		t.Errorf("Incorrect prioritized order %v", queued)
+	}
+}
+
 func BenchmarkJobQueueBump(b *testing.B) {
 	files := genFiles(b.N)
 
 	q := newJobQueue()
 	for _, f := range files {
-		q.Push(f.Name)
+		q.Push(f.Name, 0, 0)
 	}
 
 	b.ResetTimer()
@@ -180,7 +235,7 @@ func BenchmarkJobQueuePushPopDone10k(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		q := newJobQueue()
 		for _, f := range files {
-			q.Push(f.Name)
+			q.Push(f.Name, 0, 0)
 		}
 		for _ = range files {
 			n, _ := q.Pop()
@@ -189,3 +244,61 @@ func BenchmarkJobQueuePushPopDone10k(b *testing.B) {
 	}
 
 }
+
+func TestQueueBackoff(t *testing.T) {
+	q := newJobQueue()
+	if _, ok := q.NextRetry(); ok {
+		t.Error("Unexpected retry without failures")
+	}
+
+	v1 := protocol.Vector{{ID: 1, Value: 1}}
+	v2 := protocol.Vector{{ID: 1, Value: 2}}
+
+	now := time.Now()
+	first := q.Delay("f2", v1, true)
+	second := q.Delay("f2", v1, true)
+	q.Delay("f1", v1, true)
+	if first.Before(now.Add(minRetryDelay)) || second.Before(now.Add(2*minRetryDelay)) {
+		t.Errorf("Delays not doubling: %v, %v", first.Sub(now), second.Sub(now))
+	}
+	if !q.Delayed("f1", v1) || !q.Delayed("f2", v1) || q.Delayed("f3", v1) {
+		t.Error("Incorrect delayed state")
+	}
+	if _, _, delayed := q.Jobs(); !reflect.DeepEqual(delayed, []string{"f1", "f2"}) {
+		t.Errorf("Incorrect delayed files %v", delayed)
+	}
+	if next, ok := q.NextRetry(); !ok || next.After(second) || next.Before(first) {
+		t.Errorf("Incorrect next retry %v", next)
+	}
+
+	for i := 0; i < 100; i++ {
+		if until := q.Delay("f1", v1, true); until.After(time.Now().Add(maxRetryDelay)) {
+			t.Fatalf("Delay %v exceeds maximum", until.Sub(time.Now()))
+		}
+	}
+
+	// A new version is retried right away, and starts over if it fails
+	if q.Delayed("f1", v2) {
+		t.Error("New version still delayed")
+	}
+	if until := q.Delay("f1", v2, true); until.After(time.Now().Add(minRetryDelay)) {
+		t.Errorf("Delay %v for new version doesn't start over", until.Sub(time.Now()))
+	}
+
+	// Failures that don't escalate keep the delay as it is
+	for i := 0; i < 3; i++ {
+		if until := q.Delay("f3", v1, false); until.After(time.Now().Add(minRetryDelay)) {
+			t.Fatalf("Delay %v escalated", until.Sub(time.Now()))
+		}
+	}
+
+	q.Forget("f1")
+	q.Forget("f2")
+	q.Forget("f3")
+	if q.Delayed("f1", v2) {
+		t.Error("Forgotten file still delayed")
+	}
+	if _, _, delayed := q.Jobs(); len(delayed) != 0 {
+		t.Errorf("Incorrect delayed files %v", delayed)
+	}
+}
@@ -19,6 +19,7 @@ type roFolder struct {
 	intv   time.Duration
 	model  *Model
 	stop   chan struct{}
+	done   chan struct{} // Closed when Serve returns
 }
 
 func newROFolder(model *Model, folder string, interval time.Duration) *roFolder {
@@ -28,6 +29,7 @@ func newROFolder(model *Model, folder string, interval time.Duration) *roFolder
 		intv:         interval,
 		model:        model,
 		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
 	}
 }
 
@@ -36,6 +38,7 @@ func (s *roFolder) Serve() {
 		l.Debugln(s, "starting")
 		defer l.Debugln(s, "exiting")
 	}
+	defer close(s.done)
 
 	timer := time.NewTimer(time.Millisecond)
 	defer timer.Stop()
@@ -87,8 +90,10 @@ func (s *roFolder) Serve() {
 	}
 }
 
+// Stop stops the folder and waits for Serve to return.
 func (s *roFolder) Stop() {
 	close(s.stop)
+	<-s.done
 }
 
 func (s *roFolder) String() string {
@@ -97,6 +102,13 @@ func (s *roFolder) String() string {
 
 func (s *roFolder) BringToFront(string) {}
 
-func (s *roFolder) Jobs() ([]string, []string) {
-	return nil, nil
+func (s *roFolder) IndexUpdated() {}
+
+// Errors returns nothing, as read only folders never pull files.
+func (s *roFolder) Errors() []FileError {
+	return nil
+}
+
+func (s *roFolder) Jobs() ([]string, []string, []string) {
+	return nil, nil, nil
 }
@@ -7,32 +7,40 @@
 package model
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/syncthing/protocol"
 	"github.com/syncthing/syncthing/internal/config"
 	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/encryption"
 	"github.com/syncthing/syncthing/internal/events"
 	"github.com/syncthing/syncthing/internal/ignore"
 	"github.com/syncthing/syncthing/internal/osutil"
 	"github.com/syncthing/syncthing/internal/scanner"
 	"github.com/syncthing/syncthing/internal/symlinks"
 	"github.com/syncthing/syncthing/internal/versioner"
+	"github.com/syncthing/syncthing/internal/weakhash"
 )
 
 // TODO: Stop on errors
 
 const (
-	pauseIntv     = 60 * time.Second
 	nextPullIntv  = 10 * time.Second
 	checkPullIntv = 1 * time.Second
+
+	// How long to wait for more index updates after the first one, before
+	// starting a pull.
+	indexDebounceIntv = 50 * time.Millisecond
 )
 
 // A pullBlockState is passed to the puller routine for each block that needs
@@ -49,6 +57,32 @@ type copyBlocksState struct {
 	blocks []protocol.BlockInfo
 }
 
+// A conflictResolution says how a file that is in conflict with the one we
+// have is handled.
+type conflictResolution int
+
+const (
+	conflictNone       conflictResolution = iota // Not in conflict
+	conflictKeepBoth                             // The current file is moved to a conflict copy
+	conflictKeepLocal                            // The current file stays; the other is discarded
+	conflictKeepRemote                           // The other file replaces the current one
+)
+
+// A FileError is a file that failed to sync, with the reason for the last
+// failure.
+type FileError struct {
+	Path  string    `json:"path"`
+	Err   string    `json:"error"`
+	Time  time.Time `json:"time"`  // The last attempt
+	Retry time.Time `json:"retry"` // The next attempt, at the earliest
+}
+
+type fileErrorList []FileError
+
+func (l fileErrorList) Len() int           { return len(l) }
+func (l fileErrorList) Less(a, b int) bool { return l[a].Path < l[b].Path }
+func (l fileErrorList) Swap(a, b int)      { l[a], l[b] = l[b], l[a] }
+
 var (
 	activity    = newDeviceActivity()
 	errNoDevice = errors.New("no available source device")
@@ -66,16 +100,41 @@ type rwFolder struct {
 	versioner     versioner.Versioner
 	ignorePerms   bool
 	lenientMtimes bool
+	receiveOnly   bool
 	copiers       int
 	pullers       int
 	shortID       uint64
 
-	stop      chan struct{}
-	queue     *jobQueue
-	dbUpdates chan protocol.FileInfo
+	conflictPolicy string
+	conflictDevice uint64 // Short ID of the device winning conflicts under config.ConflictDeviceWins
+	maxConflicts   int
+
+	pullOrder string
+	pullFirst *ignore.Matcher // nil when there are no such patterns
+	pullLast  *ignore.Matcher
+
+	minDiskFree config.Size
+
+	stop        chan struct{}
+	done        chan struct{} // Closed when Serve returns
+	queue       *jobQueue
+	dbUpdates   chan protocol.FileInfo
+	remoteIndex chan struct{} // An index update has been received
+
+	errors       map[string]FileError // Files that failed to sync, by name
+	errorsMut    sync.Mutex
+	errorsLogged bool // The last FolderErrors event listed errors
+
+	reserved    map[string]int64 // Disk space still to be written by the files being pulled, by name
+	reservedMut sync.Mutex
 }
 
 func newRWFolder(m *Model, shortID uint64, cfg config.FolderConfiguration) *rwFolder {
+	var conflictDevice uint64
+	if id, err := protocol.DeviceIDFromString(cfg.ConflictDevice); err == nil {
+		conflictDevice = id.Short()
+	}
+
 	return &rwFolder{
 		stateTracker: stateTracker{folder: cfg.ID},
 
@@ -87,12 +146,25 @@ func newRWFolder(m *Model, shortID uint64, cfg config.FolderConfiguration) *rwFo
 		scanIntv:      time.Duration(cfg.RescanIntervalS) * time.Second,
 		ignorePerms:   cfg.IgnorePerms,
 		lenientMtimes: cfg.LenientMtimes,
+		receiveOnly:   cfg.ReceiveOnly,
 		copiers:       cfg.Copiers,
 		pullers:       cfg.Pullers,
 		shortID:       shortID,
 
-		stop:  make(chan struct{}),
-		queue: newJobQueue(),
+		conflictPolicy: cfg.ConflictPolicy,
+		conflictDevice: conflictDevice,
+		maxConflicts:   cfg.MaxConflicts,
+
+		pullOrder: cfg.PullOrder,
+		pullFirst: priorityMatcher(cfg.ID, cfg.PullFirst),
+		pullLast:  priorityMatcher(cfg.ID, cfg.PullLast),
+
+		minDiskFree: parseMinDiskFree(cfg.MinDiskFree),
+
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		queue:       newJobQueue(),
+		remoteIndex: make(chan struct{}, 1),
 	}
 }
 
@@ -103,6 +175,7 @@ func (p *rwFolder) Serve() {
 		l.Debugln(p, "starting")
 		defer l.Debugln(p, "exiting")
 	}
+	defer close(p.done)
 
 	pullTimer := time.NewTimer(checkPullIntv)
 	scanTimer := time.NewTimer(time.Millisecond) // The first scan should be done immediately.
@@ -131,17 +204,29 @@ func (p *rwFolder) Serve() {
 	// We don't start pulling files until a scan has been completed.
 	initialScanCompleted := false
 
+	// Whether the pull timer has been set to go off shortly because of an
+	// index update.
+	pullSoon := false
+
 	for {
 		select {
 		case <-p.stop:
 			return
 
-		// TODO: We could easily add a channel here for notifications from
-		// Index(), so that we immediately start a pull when new index
-		// information is available. Before that though, I'd like to build a
-		// repeatable benchmark of how long it takes to sync a change from
-		// device A to device B, so we have something to work against.
+		case <-p.remoteIndex:
+			// Pull a short while after the index update, so that a burst of
+			// updates results in a single pull. Further updates during the
+			// wait don't postpone it.
+			if !pullSoon {
+				if debug {
+					l.Debugln(p, "remote index updated, pulling in", indexDebounceIntv)
+				}
+				pullSoon = true
+				pullTimer.Reset(indexDebounceIntv)
+			}
+
 		case <-pullTimer.C:
+			pullSoon = false
 			if !initialScanCompleted {
 				if debug {
 					l.Debugln(p, "skip (initial)")
@@ -174,6 +259,14 @@ func (p *rwFolder) Serve() {
 				continue
 			}
 
+			if err := p.model.CheckFolderHealth(p.folder); err != nil {
+				if debug {
+					l.Debugln(p, "skip (folder error):", err)
+				}
+				pullTimer.Reset(nextPullIntv)
+				continue
+			}
+
 			if debug {
 				l.Debugln(p, "pulling", prevVer, curVer)
 			}
@@ -204,24 +297,32 @@ func (p *rwFolder) Serve() {
 						l.Debugln(p, "adjusting curVer", lv)
 						curVer = lv
 					}
-					prevVer = curVer
+					next := nextPullIntv
+					if retry, ok := p.queue.NextRetry(); ok {
+						// Some files failed and are backing off, so we're
+						// not in sync yet. Pull again when the first of
+						// them is due to be retried.
+						next = retry.Sub(time.Now())
+					} else {
+						prevVer = curVer
+					}
 					if debug {
-						l.Debugln(p, "next pull in", nextPullIntv)
+						l.Debugln(p, "next pull in", next)
 					}
-					pullTimer.Reset(nextPullIntv)
+					pullTimer.Reset(next)
 					break
 				}
 
 				if tries > 10 {
 					// We've tried a bunch of times to get in sync, but
-					// we're not making it. Probably there are write
-					// errors preventing us. Flag this with a warning and
-					// wait a bit longer before retrying.
-					l.Warnf("Folder %q isn't making progress - check logs for possible root cause. Pausing puller for %v.", p.folder, pauseIntv)
+					// we're not making it, even though failing files are
+					// backing off. Flag this with a warning and try again
+					// a little later.
+					l.Warnf("Folder %q isn't making progress - check logs for possible root cause. Retrying in %v.", p.folder, nextPullIntv)
 					if debug {
-						l.Debugln(p, "next pull in", pauseIntv)
+						l.Debugln(p, "next pull in", nextPullIntv)
 					}
-					pullTimer.Reset(pauseIntv)
+					pullTimer.Reset(nextPullIntv)
 					break
 				}
 			}
@@ -262,8 +363,12 @@ func (p *rwFolder) Serve() {
 	}
 }
 
+// Stop stops the folder and waits for Serve to return, so that nothing is
+// written to the folder afterwards. A puller iteration in progress finishes
+// the files it has started on.
 func (p *rwFolder) Stop() {
 	close(p.stop)
+	<-p.done
 }
 
 func (p *rwFolder) String() string {
@@ -332,6 +437,10 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 	// !!!
 
 	changed := 0
+	subs := p.model.subscriptions(p.folder)
+
+	// Errors for files we no longer need are forgotten after this iteration.
+	stale := p.errorNames()
 
 	fileDeletions := map[string]protocol.FileInfo{}
 	dirDeletions := []protocol.FileInfo{}
@@ -353,6 +462,26 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 			return true
 		}
 
+		if !subscribed(subs, file.Name) {
+			// Outside of the subtrees we sync. Skip it, continue iteration.
+			return true
+		}
+
+		delete(stale, file.Name)
+
+		if p.queue.Delayed(file.Name, file.Version) {
+			// This file failed recently. Skip it until it's due to be
+			// retried, continue iteration.
+			return true
+		}
+
+		if p.receiveOnly {
+			if cur, ok := p.model.CurrentFolderFile(p.folder, file.Name); ok && cur.IsInvalid() && len(cur.Version) > 0 {
+				// A local change that hasn't been reverted. Leave it be.
+				return true
+			}
+		}
+
 		if debug {
 			l.Debugln(p, "handling", file.Name)
 		}
@@ -383,16 +512,35 @@ func (p *rwFolder) pullerIteration(ignores *ignore.Matcher) int {
 			p.handleDir(file)
 		default:
 			// A new or changed file or symlink. This is the only case where we
-			// do stuff concurrently in the background
-			p.queue.Push(file.Name)
+			// do stuff concurrently in the background. We keep the indexes of
+			// disconnected devices, so there may not be anyone to pull the
+			// file from right now; skip it until there is.
+			if len(p.model.Availability(p.folder, file.Name)) == 0 {
+				if debug {
+					l.Debugln(p, "no connected device has", file.Name)
+				}
+				return true
+			}
+			p.queue.Push(file.Name, file.Size(), file.Modified)
 		}
 
 		changed++
 		return true
 	})
 
+	p.sortQueue()
+
+	stopped := false
 nextFile:
 	for {
+		select {
+		case <-p.stop:
+			// The rest is handled when the folder is started again.
+			stopped = true
+			break nextFile
+		default:
+		}
+
 		fileName, ok := p.queue.Pop()
 		if !ok {
 			break
@@ -450,6 +598,11 @@ nextFile:
 	// Wait for the finisherChan to finish.
 	doneWg.Wait()
 
+	if stopped {
+		fileDeletions = nil
+		dirDeletions = nil
+	}
+
 	for _, file := range fileDeletions {
 		if debug {
 			l.Debugln("Deleting file", file.Name)
@@ -469,6 +622,9 @@ nextFile:
 	close(p.dbUpdates)
 	updateWg.Wait()
 
+	p.clearErrors(stale)
+	p.logErrors()
+
 	return changed
 }
 
@@ -481,6 +637,9 @@ func (p *rwFolder) handleDir(file protocol.FileInfo) {
 		"details": db.ToTruncated(file),
 	})
 	defer func() {
+		if err != nil {
+			p.newError(file, err)
+		}
 		events.Default.Log(events.ItemFinished, map[string]interface{}{
 			"folder": p.folder,
 			"item":   file.Name,
@@ -499,6 +658,11 @@ func (p *rwFolder) handleDir(file protocol.FileInfo) {
 		l.Debugf("need dir\n\t%v\n\t%v", file, curFile)
 	}
 
+	if err = p.createNameDirs(file.Name); err != nil {
+		l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
+		return
+	}
+
 	info, err := os.Lstat(realName)
 	switch {
 	// There is already something under that name, but it's a file/link.
@@ -544,7 +708,7 @@ func (p *rwFolder) handleDir(file protocol.FileInfo) {
 
 	if p.ignorePerms {
 		p.dbUpdates <- file
-	} else if err := os.Chmod(realName, mode); err == nil {
+	} else if err = os.Chmod(realName, mode); err == nil {
 		p.dbUpdates <- file
 	} else {
 		l.Infof("Puller (folder %q, dir %q): %v", p.folder, file.Name, err)
@@ -560,6 +724,9 @@ func (p *rwFolder) deleteDir(file protocol.FileInfo) {
 		"details": db.ToTruncated(file),
 	})
 	defer func() {
+		if err != nil && !os.IsNotExist(err) {
+			p.newError(file, err)
+		}
 		events.Default.Log(events.ItemFinished, map[string]interface{}{
 			"folder": p.folder,
 			"item":   file.Name,
@@ -580,6 +747,7 @@ func (p *rwFolder) deleteDir(file protocol.FileInfo) {
 	}
 	err = osutil.InWritableDir(os.Remove, realName)
 	if err == nil || os.IsNotExist(err) {
+		p.removeNameDirs(file.Name)
 		p.dbUpdates <- file
 	} else {
 		l.Infof("Puller (folder %q, dir %q): delete: %v", p.folder, file.Name, err)
@@ -588,6 +756,9 @@ func (p *rwFolder) deleteDir(file protocol.FileInfo) {
 
 // deleteFile attempts to delete the given file
 func (p *rwFolder) deleteFile(file protocol.FileInfo) {
+	// The version may be merged below; failures are recorded against the
+	// global version we were asked for.
+	global := file.Version.Copy()
 	var err error
 	events.Default.Log(events.ItemStarted, map[string]interface{}{
 		"folder":  p.folder,
@@ -595,6 +766,11 @@ func (p *rwFolder) deleteFile(file protocol.FileInfo) {
 		"details": db.ToTruncated(file),
 	})
 	defer func() {
+		if err != nil && !os.IsNotExist(err) {
+			failed := file
+			failed.Version = global
+			p.newError(failed, err)
+		}
 		events.Default.Log(events.ItemFinished, map[string]interface{}{
 			"folder": p.folder,
 			"item":   file.Name,
@@ -605,21 +781,37 @@ func (p *rwFolder) deleteFile(file protocol.FileInfo) {
 	realName := filepath.Join(p.dir, file.Name)
 
 	cur, ok := p.model.CurrentFolderFile(p.folder, file.Name)
-	if ok && p.inConflict(cur.Version, file.Version) {
-		// There is a conflict here. Move the file to a conflict copy instead
-		// of deleting. Also merge with the version vector we had, to indicate
-		// we have resolved the conflict.
+	conflict := conflictNone
+	if ok {
+		conflict = p.resolveConflict(cur, file)
+	}
+
+	var by uint64
+	if conflict != conflictNone {
+		// There is a conflict here. Merge with the version vector we had, to
+		// indicate we have resolved the conflict.
+		by = conflictingDevice(cur.Version, file.Version)
 		file.Version = file.Version.Merge(cur.Version)
-		err = osutil.InWritableDir(moveForConflict, realName)
-	} else if p.versioner != nil {
+	}
+
+	switch {
+	case conflict == conflictKeepLocal:
+		// The deletion lost, so there's nothing to do on disk.
+		p.keepLocal(cur, file)
+		return
+	case conflict == conflictKeepBoth:
+		// Move the file to a conflict copy instead of deleting.
+		err = p.fileConflict(file.Name, cur.Version, file.Version, by)
+	case p.versioner != nil:
 		err = osutil.InWritableDir(p.versioner.Archive, realName)
-	} else {
+	default:
 		err = osutil.InWritableDir(os.Remove, realName)
 	}
 
 	if err != nil && !os.IsNotExist(err) {
 		l.Infof("Puller (folder %q, file %q): delete: %v", p.folder, file.Name, err)
 	} else {
+		p.removeNameDirs(file.Name)
 		p.dbUpdates <- file
 	}
 }
@@ -639,6 +831,9 @@ func (p *rwFolder) renameFile(source, target protocol.FileInfo) {
 		"details": db.ToTruncated(source),
 	})
 	defer func() {
+		if err != nil {
+			p.newError(target, err)
+		}
 		events.Default.Log(events.ItemFinished, map[string]interface{}{
 			"folder": p.folder,
 			"item":   source.Name,
@@ -658,12 +853,13 @@ func (p *rwFolder) renameFile(source, target protocol.FileInfo) {
 	from := filepath.Join(p.dir, source.Name)
 	to := filepath.Join(p.dir, target.Name)
 
-	if p.versioner != nil {
+	err = p.createNameDirs(target.Name)
+	if err == nil && p.versioner != nil {
 		err = osutil.Copy(from, to)
 		if err == nil {
 			err = osutil.InWritableDir(p.versioner.Archive, from)
 		}
-	} else {
+	} else if err == nil {
 		err = osutil.TryRename(from, to)
 	}
 
@@ -672,6 +868,7 @@ func (p *rwFolder) renameFile(source, target protocol.FileInfo) {
 		// of the source and the creation of the target. Fix-up the metadata,
 		// and update the local index of the target file.
 
+		p.removeNameDirs(source.Name)
 		p.dbUpdates <- source
 
 		err = p.shortcutFile(target)
@@ -690,6 +887,7 @@ func (p *rwFolder) renameFile(source, target protocol.FileInfo) {
 			return
 		}
 
+		p.removeNameDirs(source.Name)
 		p.dbUpdates <- source
 	}
 }
@@ -719,6 +917,37 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 		} else {
 			err = p.shortcutFile(file)
 		}
+		if err != nil {
+			p.newError(file, err)
+		}
+		events.Default.Log(events.ItemFinished, map[string]interface{}{
+			"folder": p.folder,
+			"item":   file.Name,
+			"error":  err,
+		})
+		return
+	}
+
+	conflict := p.resolveConflict(curFile, file)
+	if conflict == conflictKeepLocal {
+		p.queue.Done(file.Name)
+		p.keepLocal(curFile, file)
+		events.Default.Log(events.ItemFinished, map[string]interface{}{
+			"folder": p.folder,
+			"item":   file.Name,
+			"error":  nil,
+		})
+		return
+	}
+
+	err := p.checkFreeSpace(file)
+	if err == nil {
+		err = p.createNameDirs(file.Name)
+	}
+	if err != nil {
+		l.Infof("Puller (folder %q, file %q): %v", p.folder, file.Name, err)
+		p.queue.Done(file.Name)
+		p.newError(file, err)
 		events.Default.Log(events.ItemFinished, map[string]interface{}{
 			"folder": p.folder,
 			"item":   file.Name,
@@ -735,27 +964,32 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 
 	reused := 0
 	var blocks []protocol.BlockInfo
+	var available []int32
 
 	// Check for an old temporary file which might have some blocks we could
-	// reuse.
-	tempBlocks, err := scanner.HashFile(tempName, protocol.BlockSize)
+	// reuse. We look for each block where it's supposed to be rather than
+	// rehashing the file, as the blocks may be of varying size.
+	tempFd, err := os.Open(tempName)
 	if err == nil {
-		// Check for any reusable blocks in the temp file
-		tempCopyBlocks, _ := scanner.BlockDiff(tempBlocks, file.Blocks)
-
-		// block.String() returns a string unique to the block
-		existingBlocks := make(map[string]struct{}, len(tempCopyBlocks))
-		for _, block := range tempCopyBlocks {
-			existingBlocks[block.String()] = struct{}{}
-		}
+		buf := make([]byte, protocol.BlockSize)
+		for i, block := range file.Blocks {
+			if int(block.Size) > cap(buf) {
+				buf = make([]byte, block.Size)
+			}
+			buf = buf[:block.Size]
 
-		// Since the blocks are already there, we don't need to get them.
-		for _, block := range file.Blocks {
-			_, ok := existingBlocks[block.String()]
-			if !ok {
+			// Since the blocks are already there, we don't need to get them.
+			_, err := tempFd.ReadAt(buf, block.Offset)
+			if err == nil {
+				_, err = scanner.VerifyBuffer(buf, block)
+			}
+			if err != nil {
 				blocks = append(blocks, block)
+			} else {
+				available = append(available, int32(i))
 			}
 		}
+		tempFd.Close()
 
 		// The sharedpullerstate will know which flags to use when opening the
 		// temp file depending if we are reusing any blocks or not.
@@ -765,11 +999,18 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 			// sharedpuller not to panic when it fails to exlusively create a
 			// file which already exists
 			os.Remove(tempName)
+			available = nil
 		}
 	} else {
 		blocks = file.Blocks
 	}
 
+	var need int64
+	for _, block := range blocks {
+		need += int64(block.Size)
+	}
+	p.reserveSpace(file.Name, need)
+
 	s := sharedPullerState{
 		file:        file,
 		folder:      p.folder,
@@ -780,6 +1021,8 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 		reused:      reused,
 		ignorePerms: p.ignorePerms,
 		version:     curFile.Version,
+		conflict:    conflict,
+		available:   available,
 	}
 
 	if debug {
@@ -793,6 +1036,38 @@ func (p *rwFolder) handleFile(file protocol.FileInfo, copyChan chan<- copyBlocks
 	copyChan <- cs
 }
 
+// createNameDirs creates the directories that a long name in an encrypted
+// folder is split over, as they have no entries of their own.
+func (p *rwFolder) createNameDirs(name string) error {
+	if !p.model.folderEncrypted(p.folder) {
+		return nil
+	}
+	mkdir := func(path string) error {
+		return os.Mkdir(path, 0755)
+	}
+	for _, dir := range encryption.NameDirs(name) {
+		err := osutil.InWritableDir(mkdir, filepath.Join(p.dir, dir))
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeNameDirs removes the directories that a long name in an encrypted
+// folder was split over, as far as they are empty.
+func (p *rwFolder) removeNameDirs(name string) {
+	if !p.model.folderEncrypted(p.folder) {
+		return
+	}
+	dirs := encryption.NameDirs(name)
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := osutil.InWritableDir(os.Remove, filepath.Join(p.dir, dirs[i])); err != nil {
+			return
+		}
+	}
+}
+
 // shortcutFile sets file mode and modification time, when that's the only
 // thing that has changed.
 func (p *rwFolder) shortcutFile(file protocol.FileInfo) (err error) {
@@ -867,27 +1142,37 @@ func (p *rwFolder) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pull
 		}
 		p.model.fmut.RUnlock()
 
+		// Content defined chunks are never looked for by weak hash, see
+		// fixedBlocks.
+		var weakFinder *weakhash.Finder
+		weakTried := !fixedBlocks(state.file.Blocks)
+
+		// In an encrypted folder the hashes are encrypted and can't be
+		// verified. As the encryption is deterministic, blocks with the same
+		// encrypted hash still have the same encrypted data.
+		encrypted := p.model.folderEncrypted(p.folder)
+
 		for _, block := range state.blocks {
 			buf = buf[:int(block.Size)]
-			found := p.model.finder.Iterate(block.Hash, func(folder, file string, index int32) bool {
+			found := p.model.finder.Iterate(block.Hash, func(folder, file string, index int32, offset int64) bool {
 				fd, err := os.Open(filepath.Join(folderRoots[folder], file))
 				if err != nil {
 					return false
 				}
 
-				_, err = fd.ReadAt(buf, protocol.BlockSize*int64(index))
+				_, err = fd.ReadAt(buf, offset)
 				fd.Close()
 				if err != nil {
 					return false
 				}
 
 				hash, err := scanner.VerifyBuffer(buf, block)
-				if err != nil {
+				if err != nil && !encrypted {
 					if hash != nil {
 						if debug {
 							l.Debugf("Finder block mismatch in %s:%s:%d expected %q got %q", folder, file, index, block.Hash, hash)
 						}
-						err = p.model.finder.Fix(folder, file, index, block.Hash, hash)
+						err = p.model.finder.Fix(folder, file, index, offset, block.Hash, hash)
 						if err != nil {
 							l.Warnln("finder fix:", err)
 						}
@@ -907,6 +1192,28 @@ func (p *rwFolder) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pull
 				return true
 			})
 
+			if !found && block.WeakHash != 0 && block.Size == protocol.BlockSize {
+				// The block may still be in the old version of the file, at
+				// an offset that isn't a multiple of the block size because
+				// data was inserted or removed before it. Sliding over the
+				// file is expensive, so we only do it once we need to.
+				if !weakTried {
+					weakFinder = p.weakHashFinder(state)
+					weakTried = true
+				}
+				found = weakFinder.Iterate(block.WeakHash, buf, func(offset int64) bool {
+					if _, err := scanner.VerifyBuffer(buf, block); err != nil {
+						return false
+					}
+
+					if _, err := dstFd.WriteAt(buf, block.Offset); err != nil {
+						state.fail("dst write", err)
+					}
+					state.copiedFromOrigin()
+					return true
+				})
+			}
+
 			if state.failed() != nil {
 				break
 			}
@@ -919,13 +1226,48 @@ func (p *rwFolder) copierRoutine(in <-chan copyBlocksState, pullChan chan<- pull
 				}
 				pullChan <- ps
 			} else {
-				state.copyDone()
+				state.copyDone(block)
 			}
 		}
+		weakFinder.Close()
 		out <- state.sharedPullerState
 	}
 }
 
+// fixedBlocks returns whether the blocks are all of the standard size, but
+// for the last one. The weak hash finder slides a window of a single size
+// over the old file, so it can't find content defined chunks of varying
+// size. It isn't used for those at all; as their boundaries move along with
+// inserted or removed data, shifted chunks are found by their hashes.
+func fixedBlocks(blocks []protocol.BlockInfo) bool {
+	for i, block := range blocks {
+		if block.Size != protocol.BlockSize && i != len(blocks)-1 {
+			return false
+		}
+	}
+	return true
+}
+
+// weakHashFinder returns a finder for the blocks in the old version of the
+// file that have a weak hash, or nil if there is no such file.
+func (p *rwFolder) weakHashFinder(state copyBlocksState) *weakhash.Finder {
+	var hashes []uint32
+	for _, block := range state.blocks {
+		if block.WeakHash != 0 && block.Size == protocol.BlockSize {
+			hashes = append(hashes, block.WeakHash)
+		}
+	}
+
+	finder, err := weakhash.NewFinder(state.realName, protocol.BlockSize, hashes)
+	if err != nil {
+		if debug {
+			l.Debugln(p, "weak hash finder:", err)
+		}
+		return nil
+	}
+	return finder
+}
+
 func (p *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPullerState) {
 	for state := range in {
 		if state.failed() != nil {
@@ -940,56 +1282,124 @@ func (p *rwFolder) pullerRoutine(in <-chan pullBlockState, out chan<- *sharedPul
 			continue
 		}
 
-		var lastError error
-		potentialDevices := p.model.Availability(p.folder, state.file.Name)
-		for {
-			// Select the least busy device to pull the block from. If we found no
-			// feasible device at all, fail the block (and in the long run, the
-			// file).
-			selected := activity.leastBusy(potentialDevices)
-			if selected == (protocol.DeviceID{}) {
-				if lastError != nil {
-					state.fail("pull", lastError)
-				} else {
-					state.fail("pull", errNoDevice)
-				}
-				break
-			}
-
-			potentialDevices = removeDevice(potentialDevices, selected)
-
-			// Fetch the block, while marking the selected device as in use so that
-			// leastBusy can select another device when someone else asks.
-			activity.using(selected)
-			buf, lastError := p.model.requestGlobal(selected, p.folder, state.file.Name, state.block.Offset, int(state.block.Size), state.block.Hash, 0, nil)
-			activity.done(selected)
-			if lastError != nil {
-				continue
-			}
-
-			// Verify that the received block matches the desired hash, if not
-			// try pulling it from another device.
-			_, lastError = scanner.VerifyBuffer(buf, state.block)
-			if lastError != nil {
-				continue
-			}
-
+		buf, err := p.pullBlock(state)
+		if err != nil {
+			state.fail("pull", err)
+		} else {
 			// Save the block data we got from the cluster
 			_, err = fd.WriteAt(buf, state.block.Offset)
 			if err != nil {
 				state.fail("save", err)
 			} else {
-				state.pullDone()
+				state.pullDone(state.block)
 			}
-			break
 		}
 		out <- state.sharedPullerState
 	}
 }
 
+// A pullResult is the outcome of a block request to a single device.
+type pullResult struct {
+	buf []byte
+	err error
+}
+
+// pullBlock fetches the block from the devices that have it. The block is
+// requested from the device expected to deliver it the soonest. Should that
+// device fail, or take much longer than expected, the block is requested
+// from the next best device as well and the first valid response is used.
+func (p *rwFolder) pullBlock(state pullBlockState) ([]byte, error) {
+	candidates := p.model.blockAvailability(p.folder, state.file, state.block)
+
+	// Buffered so that requests we stop waiting for can finish on their own
+	results := make(chan pullResult, len(candidates))
+	lastError := errNoDevice
+	outstanding := 0
+
+	for {
+		var slow <-chan time.Time
+		var timer *time.Timer
+		if len(candidates) > 0 {
+			selected := activity.leastBusy(candidates)
+			candidates = removeAvailability(candidates, selected)
+
+			timer = time.NewTimer(activity.timeout(selected.ID))
+			slow = timer.C
+
+			outstanding++
+			go p.requestBlock(selected, state, results)
+		}
+
+		if outstanding == 0 {
+			// We found no feasible device at all, or every one we tried
+			// failed.
+			return nil, lastError
+		}
+
+		select {
+		case res := <-results:
+			outstanding--
+			if res.err == nil {
+				if timer != nil {
+					timer.Stop()
+				}
+				return res.buf, nil
+			}
+			lastError = res.err
+
+		case <-slow:
+			if debug {
+				l.Debugf("%v block request for %q o=%d is slow", p, state.file.Name, state.block.Offset)
+			}
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// requestBlock requests the block from the selected device, verifies it and
+// sends the result on the results channel.
+func (p *rwFolder) requestBlock(selected Availability, state pullBlockState, results chan<- pullResult) {
+	// Blocks that the device only has in the temporary file of a download
+	// in progress need to be requested as such.
+	var flags uint32
+	if selected.FromTemporary {
+		flags = protocol.FlagRequestTemporary
+	}
+
+	// Fetch the block, while marking the selected device as in use so that
+	// leastBusy can select another device when someone else asks.
+	activity.using(selected.ID)
+	t0 := time.Now()
+	buf, err := p.model.requestGlobal(selected.ID, p.folder, state.file.Name, state.block.Offset, int(state.block.Size), state.block.Hash, flags, nil)
+	if err == nil {
+		activity.measure(selected.ID, len(buf), time.Since(t0))
+	}
+	activity.done(selected.ID)
+
+	// Verify that the received block matches the desired hash, if not
+	// try pulling it from another device. We can't do that for encrypted
+	// data, which is verified by whoever decrypts it.
+	if err == nil && !p.model.folderEncrypted(p.folder) {
+		_, err = scanner.VerifyBuffer(buf, state.block)
+	}
+
+	results <- pullResult{buf, err}
+}
+
 func (p *rwFolder) performFinish(state *sharedPullerState) {
+	// The version may be merged below; failures are recorded against the
+	// global version we were asked for.
+	global := state.file.Version.Copy()
 	var err error
 	defer func() {
+		if err != nil {
+			failed := state.file
+			failed.Version = global
+			p.newError(failed, err)
+		}
 		events.Default.Log(events.ItemFinished, map[string]interface{}{
 			"folder": p.folder,
 			"item":   state.file.Name,
@@ -1022,13 +1432,19 @@ func (p *rwFolder) performFinish(state *sharedPullerState) {
 		}
 	}
 
-	if p.inConflict(state.version, state.file.Version) {
-		// The new file has been changed in conflict with the existing one. We
-		// should file it away as a conflict instead of just removing or
-		// archiving. Also merge with the version vector we had, to indicate
-		// we have resolved the conflict.
+	var by uint64
+	if state.conflict != conflictNone {
+		// The new file has been changed in conflict with the existing one.
+		// Merge with the version vector we had, to indicate we have resolved
+		// the conflict.
+		by = conflictingDevice(state.version, state.file.Version)
 		state.file.Version = state.file.Version.Merge(state.version)
-		err = osutil.InWritableDir(moveForConflict, state.realName)
+	}
+
+	if state.conflict == conflictKeepBoth {
+		// We should file the existing one away as a conflict instead of just
+		// removing or archiving.
+		err = p.fileConflict(state.file.Name, state.version, state.file.Version, by)
 	} else if p.versioner != nil {
 		// If we should use versioning, let the versioner archive the old
 		// file before we replace it. Archiving a non-existent file is not
@@ -1057,7 +1473,8 @@ func (p *rwFolder) performFinish(state *sharedPullerState) {
 
 	// If it's a symlink, the target of the symlink is inside the file.
 	if state.file.IsSymlink() {
-		content, err := ioutil.ReadFile(state.realName)
+		var content []byte
+		content, err = ioutil.ReadFile(state.realName)
 		if err != nil {
 			l.Warnln("Puller: final: reading symlink:", err)
 			return
@@ -1080,12 +1497,18 @@ func (p *rwFolder) performFinish(state *sharedPullerState) {
 
 func (p *rwFolder) finisherRoutine(in <-chan *sharedPullerState) {
 	for state := range in {
-		if closed, err := state.finalClose(); closed {
+		closed, err := state.finalClose()
+		if closed || state.failed() != nil {
+			// Nothing more is written to the temp file
+			p.releaseSpace(state.file.Name)
+		}
+		if closed {
 			if debug {
 				l.Debugln(p, "closing", state.file.Name)
 			}
 			if err != nil {
 				l.Warnln("Puller: final:", err)
+				p.newError(state.file, err)
 				continue
 			}
 
@@ -1093,6 +1516,7 @@ func (p *rwFolder) finisherRoutine(in <-chan *sharedPullerState) {
 			if state.failed() == nil {
 				p.performFinish(state)
 			} else {
+				p.newError(state.file, state.failed())
 				events.Default.Log(events.ItemFinished, map[string]interface{}{
 					"folder": p.folder,
 					"item":   state.file.Name,
@@ -1107,12 +1531,21 @@ func (p *rwFolder) finisherRoutine(in <-chan *sharedPullerState) {
 	}
 }
 
+// IndexUpdated schedules a pull, as there may be something new to pull.
+func (p *rwFolder) IndexUpdated() {
+	select {
+	case p.remoteIndex <- struct{}{}:
+	default:
+		// A pull is already pending
+	}
+}
+
 // Moves the given filename to the front of the job queue
 func (p *rwFolder) BringToFront(filename string) {
 	p.queue.BringToFront(filename)
 }
 
-func (p *rwFolder) Jobs() ([]string, []string) {
+func (p *rwFolder) Jobs() ([]string, []string, []string) {
 	return p.queue.Jobs()
 }
 
@@ -1138,6 +1571,7 @@ loop:
 
 			file.LocalVersion = 0
 			batch = append(batch, file)
+			p.clearError(file.Name)
 
 			if len(batch) == maxBatchSize {
 				p.model.updateLocals(p.folder, batch)
@@ -1157,11 +1591,276 @@ loop:
 	}
 }
 
+// checkFreeSpace returns an error if pulling the file would leave less free
+// space than configured. When there is no room left at all, the folder is
+// put in an error state until the next health check finds enough space. The
+// space that the files already being pulled have yet to write counts as used.
+func (p *rwFolder) checkFreeSpace(file protocol.FileInfo) error {
+	headroom, ok := diskHeadroom(p.dir, p.minDiskFree)
+	switch {
+	case !ok:
+		return nil
+	case headroom <= 0:
+		p.model.cfg.SetFolderError(p.folder, errOutOfSpace)
+		return errOutOfSpace
+	case file.Size() > headroom-p.reservedSpace():
+		return fmt.Errorf("insufficient free disk space for %d bytes", file.Size())
+	}
+	return nil
+}
+
+// reserveSpace records that the named file is about to write the given
+// number of bytes to its temp file.
+func (p *rwFolder) reserveSpace(name string, bytes int64) {
+	p.reservedMut.Lock()
+	if p.reserved == nil {
+		p.reserved = make(map[string]int64)
+	}
+	p.reserved[name] = bytes
+	p.reservedMut.Unlock()
+}
+
+// releaseSpace forgets the space reserved by the named file, as it is done
+// writing.
+func (p *rwFolder) releaseSpace(name string) {
+	p.reservedMut.Lock()
+	delete(p.reserved, name)
+	p.reservedMut.Unlock()
+}
+
+// reservedSpace returns the total space reserved by the files being pulled.
+func (p *rwFolder) reservedSpace() int64 {
+	p.reservedMut.Lock()
+	defer p.reservedMut.Unlock()
+	var total int64
+	for _, bytes := range p.reserved {
+		total += bytes
+	}
+	return total
+}
+
+// newError records that the file failed to sync, and delays the next
+// attempt at it. Not finding a device to pull from isn't held against the
+// file, as it says nothing about the file itself.
+func (p *rwFolder) newError(file protocol.FileInfo, err error) {
+	p.errorsMut.Lock()
+	if p.errors == nil {
+		p.errors = make(map[string]FileError)
+	}
+	p.errors[file.Name] = FileError{
+		Path:  file.Name,
+		Err:   err.Error(),
+		Time:  time.Now(),
+		Retry: p.queue.Delay(file.Name, file.Version, err != errNoDevice),
+	}
+	p.errorsMut.Unlock()
+}
+
+// clearError forgets any failure of the named file, as it has now synced.
+func (p *rwFolder) clearError(name string) {
+	p.errorsMut.Lock()
+	delete(p.errors, name)
+	p.queue.Forget(name)
+	p.errorsMut.Unlock()
+}
+
+// clearErrors forgets the failures of the given files.
+func (p *rwFolder) clearErrors(names map[string]struct{}) {
+	p.errorsMut.Lock()
+	for name := range names {
+		delete(p.errors, name)
+		p.queue.Forget(name)
+	}
+	p.errorsMut.Unlock()
+}
+
+// errorNames returns the set of files that currently have errors.
+func (p *rwFolder) errorNames() map[string]struct{} {
+	p.errorsMut.Lock()
+	names := make(map[string]struct{}, len(p.errors))
+	for name := range p.errors {
+		names[name] = struct{}{}
+	}
+	p.errorsMut.Unlock()
+	return names
+}
+
+// Errors returns the files that failed to sync, sorted by name.
+func (p *rwFolder) Errors() []FileError {
+	p.errorsMut.Lock()
+	errs := make([]FileError, 0, len(p.errors))
+	for _, err := range p.errors {
+		errs = append(errs, err)
+	}
+	p.errorsMut.Unlock()
+	sort.Sort(fileErrorList(errs))
+	return errs
+}
+
+// logErrors emits a FolderErrors event with the current errors, if there
+// are any or there were some the last time.
+func (p *rwFolder) logErrors() {
+	errs := p.Errors()
+	if len(errs) == 0 && !p.errorsLogged {
+		return
+	}
+	p.errorsLogged = len(errs) > 0
+	events.Default.Log(events.FolderErrors, map[string]interface{}{
+		"folder": p.folder,
+		"errors": errs,
+	})
+}
+
+// sortQueue puts the queued files in the configured pull order.
+func (p *rwFolder) sortQueue() {
+	switch p.pullOrder {
+	case config.PullOrderRandom:
+		p.queue.Shuffle()
+	case config.PullOrderSmallestFirst:
+		p.queue.SortSmallestFirst()
+	case config.PullOrderLargestFirst:
+		p.queue.SortLargestFirst()
+	case config.PullOrderOldestFirst:
+		p.queue.SortOldestFirst()
+	case config.PullOrderNewestFirst:
+		p.queue.SortNewestFirst()
+	}
+
+	if p.pullFirst != nil || p.pullLast != nil {
+		p.queue.Prioritize(p.pullPriority)
+	}
+}
+
+// pullPriority ranks the file by the PullFirst and PullLast patterns.
+func (p *rwFolder) pullPriority(file string) int {
+	switch {
+	case p.pullFirst != nil && p.pullFirst.Match(file):
+		return 0
+	case p.pullLast != nil && p.pullLast.Match(file):
+		return 2
+	default:
+		return 1
+	}
+}
+
+// priorityMatcher returns a matcher for the given patterns, or nil if there
+// are none.
+func priorityMatcher(folder string, patterns []string) *ignore.Matcher {
+	if len(patterns) == 0 {
+		return nil
+	}
+	m := ignore.New(false)
+	if err := m.Parse(strings.NewReader(strings.Join(patterns, "\n")), ""); err != nil {
+		l.Warnf("Folder %q: pull priority patterns: %v", folder, err)
+		return nil
+	}
+	return m
+}
+
+// resolveConflict returns how the replacement of the current file is to be
+// handled according to the folder's conflict policy; conflictNone if there is
+// no conflict.
+func (p *rwFolder) resolveConflict(cur, file protocol.FileInfo) conflictResolution {
+	if !p.inConflict(cur.Version, file.Version) {
+		return conflictNone
+	}
+	if len(cur.Version) == 0 || p.receiveOnly {
+		// We don't know what we have, or we are not to let our changes win
+		// over others'. Keep both to be safe.
+		return conflictKeepBoth
+	}
+
+	switch p.conflictPolicy {
+	case config.ConflictLocalWins:
+		return conflictKeepLocal
+
+	case config.ConflictNewestWins:
+		if cur.Modified > file.Modified {
+			return conflictKeepLocal
+		} else if cur.Modified < file.Modified {
+			return conflictKeepRemote
+		}
+
+	case config.ConflictDeviceWins:
+		if p.conflictDevice == 0 {
+			break
+		}
+		if conflictingDevice(cur.Version, file.Version) == p.conflictDevice {
+			return conflictKeepRemote
+		}
+		if conflictingDevice(file.Version, cur.Version) == p.conflictDevice {
+			return conflictKeepLocal
+		}
+	}
+
+	// Either the policy is to keep both, or it can't pick a winner
+	return conflictKeepBoth
+}
+
+// keepLocal resolves a conflict in favour of the file we have, by giving it a
+// version that supersedes both.
+func (p *rwFolder) keepLocal(cur, file protocol.FileInfo) {
+	if debug {
+		l.Debugf("%v keeping local version of %s in conflict", p, file.Name)
+	}
+	cur.Version = cur.Version.Merge(file.Version).Update(p.shortID)
+	p.dbUpdates <- cur
+}
+
+// conflictingDevice returns the short ID of the device that made the most of
+// the changes in replacement that are not in current, or zero if there are
+// none.
+func conflictingDevice(current, replacement protocol.Vector) uint64 {
+	var id, most uint64
+	for _, c := range replacement {
+		if have := current.Counter(c.ID); c.Value > have && c.Value-have > most {
+			id, most = c.ID, c.Value-have
+		}
+	}
+	return id
+}
+
+// fileConflict moves the named file away to a conflict copy marked with the
+// device that caused the conflict, and records the conflict. The oldest
+// copies beyond the configured maximum are removed.
+func (p *rwFolder) fileConflict(name string, moved, kept protocol.Vector, by uint64) error {
+	realName := filepath.Join(p.dir, name)
+	var conflictName string
+	err := osutil.InWritableDir(func(path string) error {
+		var err error
+		conflictName, err = moveForConflict(path, by)
+		return err
+	}, realName)
+	if err != nil {
+		return err
+	}
+
+	p.model.conflictDetected(p.folder, db.Conflict{
+		Name:            name,
+		ConflictName:    filepath.Join(filepath.Dir(name), filepath.Base(conflictName)),
+		Version:         kept.Copy(),
+		ConflictVersion: moved.Copy(),
+		Device:          p.model.deviceByShortID(by),
+		Time:            time.Now(),
+	})
+
+	if p.maxConflicts > 0 {
+		for _, removed := range removeOldConflicts(realName, p.maxConflicts) {
+			p.model.conflictRemoved(p.folder, filepath.Join(filepath.Dir(name), removed))
+		}
+	}
+	return nil
+}
+
 func (p *rwFolder) inConflict(current, replacement protocol.Vector) bool {
 	if current.Concurrent(replacement) {
 		// Obvious case
 		return true
 	}
+	if p.receiveOnly && len(current) == 0 {
+		// A reverted local change, which is meant to be replaced.
+		return false
+	}
 	if replacement.Counter(p.shortID) > current.Counter(p.shortID) {
 		// The replacement file contains a higher version for ourselves than
 		// what we have. This isn't supposed to be possible, since it's only
@@ -1183,19 +1882,81 @@ func invalidateFolder(cfg *config.Configuration, folderID string, err error) {
 	}
 }
 
-func removeDevice(devices []protocol.DeviceID, device protocol.DeviceID) []protocol.DeviceID {
-	for i := range devices {
-		if devices[i] == device {
-			devices[i] = devices[len(devices)-1]
-			return devices[:len(devices)-1]
+func removeAvailability(availabilities []Availability, availability Availability) []Availability {
+	for i := range availabilities {
+		if availabilities[i] == availability {
+			availabilities[i] = availabilities[len(availabilities)-1]
+			return availabilities[:len(availabilities)-1]
 		}
 	}
-	return devices
+	return availabilities
 }
 
-func moveForConflict(name string) error {
+// moveForConflict renames the file to a conflict copy, returning the new
+// name.
+func moveForConflict(name string, by uint64) (string, error) {
 	ext := filepath.Ext(name)
 	withoutExt := name[:len(name)-len(ext)]
-	newName := withoutExt + time.Now().Format(".sync-conflict-20060102-150405") + ext
-	return os.Rename(name, newName)
+	newName := withoutExt + time.Now().Format(".sync-conflict-20060102-150405")
+	if by != 0 {
+		newName += "-" + shortIDString(by)
+	}
+	newName += ext
+	return newName, os.Rename(name, newName)
+}
+
+// removeOldConflicts removes the oldest conflict copies of the named file, so
+// that at most max remain. It returns the names of the removed copies.
+func removeOldConflicts(name string, max int) []string {
+	ext := filepath.Ext(name)
+	prefix := filepath.Base(name[:len(name)-len(ext)]) + ".sync-conflict-"
+	dir := filepath.Dir(name)
+
+	fd, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	names, err := fd.Readdirnames(-1)
+	fd.Close()
+	if err != nil {
+		return nil
+	}
+
+	var copies []string
+	for _, n := range names {
+		if !strings.HasPrefix(n, prefix) || !strings.HasSuffix(n, ext) || len(n) < len(prefix)+len(ext) {
+			continue
+		}
+		// What's between is the timestamp and possibly a device ID. A dot
+		// means it's a copy of another file with the same base name.
+		stamp := n[len(prefix) : len(n)-len(ext)]
+		if len(stamp) < 15 || strings.Contains(stamp, ".") {
+			continue
+		}
+		if _, err := time.Parse("20060102-150405", stamp[:15]); err != nil {
+			continue
+		}
+		copies = append(copies, n)
+	}
+
+	// The names sort by time
+	sort.Strings(copies)
+	var removed []string
+	for len(copies) > max {
+		if err := os.Remove(filepath.Join(dir, copies[0])); err != nil {
+			l.Infof("Removing old conflict copy %s: %v", copies[0], err)
+		} else {
+			removed = append(removed, copies[0])
+		}
+		copies = copies[1:]
+	}
+	return removed
+}
+
+// shortIDString returns the short form of the device ID, as shown in the GUI,
+// for the given short ID.
+func shortIDString(id uint64) string {
+	var n protocol.DeviceID
+	binary.BigEndian.PutUint64(n[:], id)
+	return n.String()[:7]
 }
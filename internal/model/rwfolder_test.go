@@ -7,12 +7,23 @@
 package model
 
 import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/config"
+	"github.com/syncthing/syncthing/internal/db"
+	"github.com/syncthing/syncthing/internal/encryption"
+	"github.com/syncthing/syncthing/internal/events"
+	"github.com/syncthing/syncthing/internal/ignore"
 	"github.com/syncthing/syncthing/internal/scanner"
 
 	"github.com/syndtr/goleveldb/leveldb"
@@ -30,7 +41,7 @@ func init() {
 }
 
 var blocks = []protocol.BlockInfo{
-	{Hash: []uint8{0xfa, 0x43, 0x23, 0x9b, 0xce, 0xe7, 0xb9, 0x7c, 0xa6, 0x2f, 0x0, 0x7c, 0xc6, 0x84, 0x87, 0x56, 0xa, 0x39, 0xe1, 0x9f, 0x74, 0xf3, 0xdd, 0xe7, 0x48, 0x6d, 0xb3, 0xf9, 0x8d, 0xf8, 0xe4, 0x71}}, // Zero'ed out block
+	{Size: 0x20000, Hash: []uint8{0xfa, 0x43, 0x23, 0x9b, 0xce, 0xe7, 0xb9, 0x7c, 0xa6, 0x2f, 0x0, 0x7c, 0xc6, 0x84, 0x87, 0x56, 0xa, 0x39, 0xe1, 0x9f, 0x74, 0xf3, 0xdd, 0xe7, 0x48, 0x6d, 0xb3, 0xf9, 0x8d, 0xf8, 0xe4, 0x71}}, // Zero'ed out block
 	{Offset: 0, Size: 0x20000, Hash: []uint8{0x7e, 0xad, 0xbc, 0x36, 0xae, 0xbb, 0xcf, 0x74, 0x43, 0xe2, 0x7a, 0x5a, 0x4b, 0xb8, 0x5b, 0xce, 0xe6, 0x9e, 0x1e, 0x10, 0xf9, 0x8a, 0xbc, 0x77, 0x95, 0x2, 0x29, 0x60, 0x9e, 0x96, 0xae, 0x6c}},
 	{Offset: 131072, Size: 0x20000, Hash: []uint8{0x3c, 0xc4, 0x20, 0xf4, 0xb, 0x2e, 0xcb, 0xb9, 0x5d, 0xce, 0x34, 0xa8, 0xc3, 0x92, 0xea, 0xf3, 0xda, 0x88, 0x33, 0xee, 0x7a, 0xb6, 0xe, 0xf1, 0x82, 0x5e, 0xb0, 0xa9, 0x26, 0xa9, 0xc0, 0xef}},
 	{Offset: 262144, Size: 0x20000, Hash: []uint8{0x76, 0xa8, 0xc, 0x69, 0xd7, 0x5c, 0x52, 0xfd, 0xdf, 0x55, 0xef, 0x44, 0xc1, 0xd6, 0x25, 0x48, 0x4d, 0x98, 0x48, 0x4d, 0xaa, 0x50, 0xf6, 0x6b, 0x32, 0x47, 0x55, 0x81, 0x6b, 0xed, 0xee, 0xfb}},
@@ -186,7 +197,7 @@ func TestCopierFinder(t *testing.T) {
 	// Update index
 	m.updateLocals("default", []protocol.FileInfo{existingFile})
 
-	iterFn := func(folder, file string, index int32) bool {
+	iterFn := func(folder, file string, index int32, offset int64) bool {
 		return true
 	}
 
@@ -251,7 +262,7 @@ func TestCopierFinder(t *testing.T) {
 
 // Test that updating a file removes it's old blocks from the blockmap
 func TestCopierCleanup(t *testing.T) {
-	iterFn := func(folder, file string, index int32) bool {
+	iterFn := func(folder, file string, index int32, offset int64) bool {
 		return true
 	}
 
@@ -301,6 +312,94 @@ func TestCopierCleanup(t *testing.T) {
 	}
 }
 
+// Test that the copier finds blocks in the old version of the file when data
+// has been inserted before them, shifting them off the block boundaries.
+func TestCopierWeakHash(t *testing.T) {
+	data := make([]byte, 3*protocol.BlockSize)
+	rand.New(rand.NewSource(42)).Read(data)
+
+	// The file on disk has some data inserted at the start, and is in the
+	// index as such.
+	oldData := append([]byte("inserted"), data...)
+	oldName := filepath.Join("testdata", "weakhash")
+	if err := ioutil.WriteFile(oldName, oldData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(oldName)
+
+	oldBlocks, _ := scanner.Blocks(bytes.NewReader(oldData), protocol.BlockSize, 0)
+	newBlocks, _ := scanner.Blocks(bytes.NewReader(data), protocol.BlockSize, 0)
+
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+	m.updateLocals("default", []protocol.FileInfo{{Name: "weakhash", Blocks: oldBlocks}})
+
+	p := rwFolder{
+		folder: "default",
+		dir:    "testdata",
+		model:  m,
+	}
+
+	copyChan := make(chan copyBlocksState)
+	pullChan := make(chan pullBlockState, len(newBlocks))
+	finisherChan := make(chan *sharedPullerState, 1)
+
+	go p.copierRoutine(copyChan, pullChan, finisherChan)
+
+	file := protocol.FileInfo{
+		Name:    "weakhash",
+		Version: protocol.Vector{{ID: 1, Value: 1}},
+		Blocks:  newBlocks,
+	}
+	p.handleFile(file, copyChan, finisherChan)
+
+	finish := <-finisherChan
+	finish.fd.Close()
+	defer os.Remove(filepath.Join("testdata", defTempNamer.TempName("weakhash")))
+
+	select {
+	case <-pullChan:
+		t.Fatal("Unexpected block pull")
+	default:
+	}
+
+	if finish.copyOrigin != len(newBlocks) {
+		t.Errorf("Incorrect number of blocks copied from origin; %d != %d", finish.copyOrigin, len(newBlocks))
+	}
+
+	bs, err := ioutil.ReadFile(filepath.Join("testdata", defTempNamer.TempName("weakhash")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, data) {
+		t.Error("Temp file does not contain the expected data")
+	}
+}
+
+func TestFixedBlocks(t *testing.T) {
+	cases := []struct {
+		sizes []int32
+		fixed bool
+	}{
+		{nil, true},
+		{[]int32{100}, true},
+		{[]int32{protocol.BlockSize, protocol.BlockSize, 100}, true},
+		{[]int32{protocol.BlockSize, 100, protocol.BlockSize}, false},
+		{[]int32{protocol.BlockSize / 2, protocol.BlockSize, protocol.BlockSize / 3}, false},
+	}
+
+	for _, tc := range cases {
+		var blocks []protocol.BlockInfo
+		for _, size := range tc.sizes {
+			blocks = append(blocks, protocol.BlockInfo{Size: size})
+		}
+		if fixed := fixedBlocks(blocks); fixed != tc.fixed {
+			t.Errorf("fixedBlocks(%v) = %v, expected %v", tc.sizes, fixed, tc.fixed)
+		}
+	}
+}
+
 // Make sure that the copier routine hashes the content when asked, and pulls
 // if it fails to find the block.
 func TestLastResortPulling(t *testing.T) {
@@ -309,12 +408,13 @@ func TestLastResortPulling(t *testing.T) {
 	m.AddFolder(defaultFolderConfig)
 
 	// Add a file to index (with the incorrect block representation, as content
-	// doesn't actually match the block list)
+	// doesn't actually match the block list). The block is given the size of
+	// the empty file, so that reading it succeeds.
 	file := protocol.FileInfo{
 		Name:     "empty",
 		Flags:    0,
 		Modified: 0,
-		Blocks:   []protocol.BlockInfo{blocks[0]},
+		Blocks:   []protocol.BlockInfo{{Hash: blocks[0].Hash}},
 	}
 	m.updateLocals("default", []protocol.FileInfo{file})
 
@@ -322,7 +422,7 @@ func TestLastResortPulling(t *testing.T) {
 	// with a different name (causing to copy that particular block)
 	file.Name = "newfile"
 
-	iterFn := func(folder, file string, index int32) bool {
+	iterFn := func(folder, file string, index int32, offset int64) bool {
 		return true
 	}
 
@@ -393,7 +493,7 @@ func TestDeregisterOnFailInCopy(t *testing.T) {
 	}
 
 	// queue.Done should be called by the finisher routine
-	p.queue.Push("filex")
+	p.queue.Push("filex", 0, 0)
 	p.queue.Pop()
 
 	if len(p.queue.progress) != 1 {
@@ -480,7 +580,7 @@ func TestDeregisterOnFailInPull(t *testing.T) {
 	}
 
 	// queue.Done should be called by the finisher routine
-	p.queue.Push("filex")
+	p.queue.Push("filex", 0, 0)
 	p.queue.Pop()
 
 	if len(p.queue.progress) != 1 {
@@ -531,3 +631,361 @@ func TestDeregisterOnFailInPull(t *testing.T) {
 		t.Fatal("Didn't get anything to the finisher")
 	}
 }
+
+func TestIndexUpdateWakesPuller(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+
+	p := newRWFolder(m, 0, defaultFolderConfig)
+	m.fmut.Lock()
+	m.folderRunners["default"] = p
+	m.fmut.Unlock()
+
+	m.Index(device1, "default", []protocol.FileInfo{{Name: "a", Version: protocol.Vector{{ID: 1, Value: 1}}}}, 0, nil)
+	for i := 0; i < 10; i++ {
+		m.IndexUpdate(device1, "default", []protocol.FileInfo{{Name: "a", Version: protocol.Vector{{ID: 1, Value: uint64(i + 2)}}}}, 0, nil)
+	}
+
+	// The updates are coalesced into a single pending wakeup.
+	if l := len(p.remoteIndex); l != 1 {
+		t.Fatalf("Incorrect number of pending wakeups %d != 1", l)
+	}
+	<-p.remoteIndex
+	p.IndexUpdated()
+	if l := len(p.remoteIndex); l != 1 {
+		t.Fatalf("Incorrect number of pending wakeups %d != 1", l)
+	}
+}
+
+func TestStopWaitsForServe(t *testing.T) {
+	db, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", db)
+	m.AddFolder(defaultFolderConfig)
+	m.AddConnection(ioutil.NopCloser(nil), &FakeConnection{id: device1, closed: make(chan struct{})}, false)
+	m.Index(device1, "default", []protocol.FileInfo{{Name: "a", Version: protocol.Vector{{ID: 1, Value: 1}}, Blocks: blocks[1:2]}}, 0, nil)
+
+	p := newRWFolder(m, 0, defaultFolderConfig)
+	go p.Serve()
+	p.Stop()
+	select {
+	case <-p.done:
+	default:
+		t.Fatal("Stop returned before Serve")
+	}
+
+	// A puller iteration that is stopped leaves the rest of the queue for
+	// the next time the folder is started.
+	if changed := p.pullerIteration(ignore.New(false)); changed != 1 {
+		t.Errorf("Incorrect number of changed files %d != 1", changed)
+	}
+	if _, queued, _ := p.queue.Jobs(); !reflect.DeepEqual(queued, []string{"a"}) {
+		t.Errorf("Incorrect queue %v after stop", queued)
+	}
+}
+
+func TestResolveConflict(t *testing.T) {
+	const us, them, other = 1, 2, 3
+	base := protocol.Vector{{ID: them, Value: 1}}
+	local := protocol.FileInfo{Modified: 100, Version: base.Copy().Update(us)}
+	remote := protocol.FileInfo{Modified: 200, Version: base.Copy().Update(them)}
+	newer := protocol.FileInfo{Modified: 200, Version: local.Version.Copy().Update(them)}
+
+	cases := []struct {
+		policy   string
+		device   uint64
+		cur      protocol.FileInfo
+		file     protocol.FileInfo
+		expected conflictResolution
+	}{
+		{"", 0, local, newer, conflictNone},
+		{"", 0, local, remote, conflictKeepBoth},
+		{config.ConflictKeepBoth, 0, local, remote, conflictKeepBoth},
+		{config.ConflictLocalWins, 0, local, remote, conflictKeepLocal},
+		{config.ConflictNewestWins, 0, local, remote, conflictKeepRemote},
+		{config.ConflictNewestWins, 0, remote, local, conflictKeepLocal},
+		{config.ConflictNewestWins, 0, local, protocol.FileInfo{Modified: 100, Version: remote.Version}, conflictKeepBoth},
+		{config.ConflictDeviceWins, them, local, remote, conflictKeepRemote},
+		{config.ConflictDeviceWins, us, local, remote, conflictKeepLocal},
+		{config.ConflictDeviceWins, other, local, remote, conflictKeepBoth},
+	}
+
+	for i, tc := range cases {
+		p := rwFolder{shortID: us, conflictPolicy: tc.policy, conflictDevice: tc.device}
+		if res := p.resolveConflict(tc.cur, tc.file); res != tc.expected {
+			t.Errorf("%d: unexpected resolution %d != %d", i, res, tc.expected)
+		}
+	}
+}
+
+func TestConflictCopies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-conflicts-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{
+		"file.sync-conflict-20150101-120000.txt",
+		"file.sync-conflict-20150102-120000-AIR6LPZ.txt",
+		"file.sync-conflict-20150103-120000-GYRZZQB.txt",
+		"file.sync-conflict-20150101-120000",     // another file
+		"file.txt.sync-conflict-20150101-120000", // not a conflict copy
+		"file.txt",
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	conflicts := db.NewConflictSet(ldb, "default")
+	conflicts.Add(db.Conflict{Name: "file.txt", ConflictName: names[0]})
+
+	p := rwFolder{model: m, folder: "default", dir: dir, maxConflicts: 2}
+	if err := p.fileConflict("file.txt", protocol.Vector{{ID: 1, Value: 1}}, protocol.Vector{{ID: 2, Value: 1}}, device1.Short()); err != nil {
+		t.Fatal(err)
+	}
+
+	copies, _ := filepath.Glob(filepath.Join(dir, "file.sync-conflict-*.txt"))
+	if len(copies) != 2 {
+		t.Fatalf("Expected two conflict copies to remain, not %v", copies)
+	}
+	if !strings.HasSuffix(copies[0], "-GYRZZQB.txt") || !strings.HasSuffix(copies[1], "-AIR6LPZ.txt") {
+		t.Errorf("Unexpected conflict copies %v", copies)
+	}
+	for _, name := range names[3:5] {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("Unrelated file %s should remain", name)
+		}
+	}
+
+	// The new conflict is recorded, while the removed one is forgotten
+	list := conflicts.List()
+	if len(list) != 1 {
+		t.Fatalf("Expected one recorded conflict, not %v", list)
+	}
+	if c := list[0]; c.Name != "file.txt" || c.ConflictName != filepath.Base(copies[1]) || c.Device != device1 || !c.ConflictVersion.Equal(protocol.Vector{{ID: 1, Value: 1}}) {
+		t.Errorf("Incorrectly recorded conflict %+v", c)
+	}
+}
+
+func TestPullOrder(t *testing.T) {
+	p := rwFolder{
+		queue:     newJobQueue(),
+		pullOrder: config.PullOrderLargestFirst,
+		pullFirst: priorityMatcher("default", []string{"*.md"}),
+		pullLast:  priorityMatcher("default", []string{"*.iso", "video"}),
+	}
+	p.queue.Push("README.md", 1000, 0)
+	p.queue.Push("docs/index.md", 10, 0)
+	p.queue.Push("image.iso", 40e9, 0)
+	p.queue.Push("notes.txt", 5, 0)
+	p.queue.Push("photo.jpg", 2000, 0)
+	p.queue.Push("video/talk.mp4", 30e9, 0)
+
+	p.sortQueue()
+
+	expected := []string{"README.md", "docs/index.md", "photo.jpg", "notes.txt", "image.iso", "video/talk.mp4"}
+	if _, queued, _ := p.queue.Jobs(); !reflect.DeepEqual(queued, expected) {
+		t.Errorf("Incorrect pull order %v != %v", queued, expected)
+	}
+}
+
+func TestFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-errors-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	p := rwFolder{model: m, folder: "default", dir: dir, ignorePerms: true, queue: newJobQueue(), dbUpdates: make(chan protocol.FileInfo, 1)}
+
+	// The parent directory doesn't exist, so this fails
+	file := protocol.FileInfo{Name: filepath.Join("parent", "dir"), Flags: protocol.FlagDirectory}
+	p.handleDir(file)
+
+	errs := p.Errors()
+	if len(errs) != 1 || errs[0].Path != file.Name || errs[0].Err == "" || !errs[0].Retry.After(errs[0].Time) {
+		t.Fatalf("Unexpected errors %v", errs)
+	}
+	if _, _, delayed := p.queue.Jobs(); !reflect.DeepEqual(delayed, []string{file.Name}) {
+		t.Errorf("Failed file should be delayed, not %v", delayed)
+	}
+
+	sub := events.Default.Subscribe(events.FolderErrors)
+	defer events.Default.Unsubscribe(sub)
+	p.logErrors()
+	if ev, err := sub.Poll(time.Second); err != nil {
+		t.Fatal(err)
+	} else if data := ev.Data.(map[string]interface{}); !reflect.DeepEqual(data["errors"], errs) {
+		t.Errorf("Unexpected event data %v", data)
+	}
+
+	// Once the file syncs the error is cleared
+	os.Mkdir(filepath.Join(dir, "parent"), 0755)
+	p.handleDir(file)
+	select {
+	case f := <-p.dbUpdates:
+		p.clearError(f.Name)
+	default:
+		t.Fatal("Directory was not created")
+	}
+	if errs := p.Errors(); len(errs) != 0 {
+		t.Errorf("Unexpected errors %v", errs)
+	}
+	if p.queue.Delayed(file.Name, file.Version) {
+		t.Error("Synced file should not be delayed")
+	}
+
+	// An event is sent for the errors going away, but only once
+	p.logErrors()
+	if _, err := sub.Poll(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	p.logErrors()
+	if _, err := sub.Poll(10 * time.Millisecond); err != events.ErrTimeout {
+		t.Error("Unexpected event without errors")
+	}
+}
+
+func TestHandleFileOutOfSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-diskfree-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fcfg := config.FolderConfiguration{ID: "diskfree", RawPath: dir}
+	cfg := config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}})
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+	p := rwFolder{
+		model:  m,
+		folder: "diskfree",
+		dir:    dir,
+		queue:  newJobQueue(),
+		// Keeping all of the disk free leaves no room for anything
+		minDiskFree: config.Size{Value: 100, Percent: true},
+	}
+
+	if _, ok := diskHeadroom(dir, p.minDiskFree); !ok {
+		t.Skip("free disk space is not available on this platform")
+	}
+
+	file := protocol.FileInfo{Name: "file", Blocks: blocks[1:2]}
+	copyChan := make(chan copyBlocksState, 1)
+	p.handleFile(file, copyChan, nil)
+
+	select {
+	case <-copyChan:
+		t.Error("File should not be pulled without free space")
+	default:
+	}
+	if errs := p.Errors(); len(errs) != 1 || errs[0].Path != file.Name {
+		t.Errorf("Unexpected errors %v", errs)
+	}
+	if inv := cfg.Folders()["diskfree"].Invalid; inv != errOutOfSpace.Error() {
+		t.Errorf("Unexpected folder error %q", inv)
+	}
+}
+
+func TestHandleFileReservedSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-diskfree-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fcfg := config.FolderConfiguration{ID: "diskfree", RawPath: dir}
+	cfg := config.Wrap("/tmp/test", config.Configuration{Folders: []config.FolderConfiguration{fcfg}})
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(cfg, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+	p := rwFolder{model: m, folder: "diskfree", dir: dir, queue: newJobQueue()}
+
+	headroom, ok := diskHeadroom(dir, p.minDiskFree)
+	if !ok {
+		t.Skip("free disk space is not available on this platform")
+	}
+
+	// The files being pulled are going to take all of the free space
+	p.reserveSpace("other", headroom)
+	file := protocol.FileInfo{Name: "file", Blocks: blocks[1:2]}
+	copyChan := make(chan copyBlocksState, 1)
+	p.handleFile(file, copyChan, nil)
+	select {
+	case <-copyChan:
+		t.Error("File should not be pulled without free space")
+	default:
+	}
+	if errs := p.Errors(); len(errs) != 1 || errs[0].Path != file.Name {
+		t.Errorf("Unexpected errors %v", errs)
+	}
+	if inv := cfg.Folders()["diskfree"].Invalid; inv != "" {
+		t.Errorf("Unexpected folder error %q", inv)
+	}
+
+	// Once they are done, the file is pulled and reserves its own space
+	p.releaseSpace("other")
+	p.handleFile(file, copyChan, nil)
+	var state *sharedPullerState
+	select {
+	case cs := <-copyChan:
+		state = cs.sharedPullerState
+	default:
+		t.Fatal("File was not pulled")
+	}
+	if r := p.reservedSpace(); r != file.Size() {
+		t.Errorf("Reserved %d bytes, not %d", r, file.Size())
+	}
+
+	// The space is released when the file fails
+	state.fail("test", errors.New("failed"))
+	finisherChan := make(chan *sharedPullerState, 1)
+	finisherChan <- state
+	close(finisherChan)
+	p.finisherRoutine(finisherChan)
+	if r := p.reservedSpace(); r != 0 {
+		t.Errorf("Reserved %d bytes after the file failed", r)
+	}
+}
+
+func TestEncryptedLongNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "syncthing-encrypted-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fcfg := config.FolderConfiguration{ID: "encrypted", RawPath: dir, Encrypted: true}
+	ldb, _ := leveldb.Open(storage.NewMemStorage(), nil)
+	m := NewModel(defaultConfig, protocol.LocalDeviceID, "device", "syncthing", "dev", ldb)
+	m.AddFolder(fcfg)
+	p := rwFolder{model: m, folder: "encrypted", dir: dir, ignorePerms: true, queue: newJobQueue(), dbUpdates: make(chan protocol.FileInfo, 4)}
+
+	// A long name is split over directories that aren't in the index
+	key := encryption.NewKey("encrypted", "password")
+	long := protocol.FileInfo{Name: key.EncryptName(strings.Repeat("x", 255)), Flags: protocol.FlagDirectory}
+	sub := protocol.FileInfo{Name: key.EncryptName(filepath.Join(strings.Repeat("x", 255), "sub")), Flags: protocol.FlagDirectory}
+	p.handleDir(long)
+	p.handleDir(sub)
+	if errs := p.Errors(); len(errs) != 0 {
+		t.Fatalf("Unexpected errors %v", errs)
+	}
+	if _, err := os.Stat(filepath.Join(dir, sub.Name)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The directories go away along with the name
+	p.deleteDir(sub)
+	p.deleteDir(long)
+	if names, _ := ioutil.ReadDir(dir); len(names) != 0 {
+		t.Errorf("Unexpected files left behind: %v", names)
+	}
+}
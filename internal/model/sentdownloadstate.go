@@ -0,0 +1,120 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package model
+
+import "github.com/syncthing/protocol"
+
+// sentFolderFileDownloadState is what we have announced to a remote device
+// about the blocks available in the temporary file of a single file.
+type sentFolderFileDownloadState struct {
+	blockIndexes []int32
+	version      protocol.Vector
+}
+
+// sentFolderDownloadState is what we have announced to a remote device about
+// the files being downloaded in a single folder.
+type sentFolderDownloadState struct {
+	files map[string]*sentFolderFileDownloadState
+}
+
+// update takes the set of currently active pullers for the folder and
+// returns the updates we need to send for the remote device to be up to
+// date.
+func (s *sentFolderDownloadState) update(pullers []*sharedPullerState) []protocol.FileDownloadProgressUpdate {
+	var updates []protocol.FileDownloadProgressUpdate
+
+	seen := make(map[string]struct{}, len(pullers))
+	for _, puller := range pullers {
+		name := puller.file.Name
+		version := puller.file.Version
+		available := puller.Available()
+
+		seen[name] = struct{}{}
+
+		sent, ok := s.files[name]
+		if ok && !sent.version.Equal(version) {
+			// We've announced another version of the file, which is no
+			// longer being downloaded.
+			updates = append(updates, protocol.FileDownloadProgressUpdate{
+				UpdateType: protocol.UpdateTypeForget,
+				Name:       name,
+				Version:    sent.version,
+			})
+			delete(s.files, name)
+			ok = false
+		}
+
+		if !ok {
+			if len(available) == 0 {
+				// Nothing to announce yet
+				continue
+			}
+			s.files[name] = &sentFolderFileDownloadState{
+				blockIndexes: available,
+				version:      version,
+			}
+			updates = append(updates, protocol.FileDownloadProgressUpdate{
+				UpdateType:   protocol.UpdateTypeAppend,
+				Name:         name,
+				Version:      version,
+				BlockIndexes: available,
+			})
+			continue
+		}
+
+		// The set of available blocks only ever grows, in order, so we only
+		// need to announce what has been added since last time.
+		if len(available) > len(sent.blockIndexes) {
+			updates = append(updates, protocol.FileDownloadProgressUpdate{
+				UpdateType:   protocol.UpdateTypeAppend,
+				Name:         name,
+				Version:      version,
+				BlockIndexes: available[len(sent.blockIndexes):],
+			})
+			sent.blockIndexes = available
+		}
+	}
+
+	for name, sent := range s.files {
+		if _, ok := seen[name]; !ok {
+			updates = append(updates, protocol.FileDownloadProgressUpdate{
+				UpdateType: protocol.UpdateTypeForget,
+				Name:       name,
+				Version:    sent.version,
+			})
+			delete(s.files, name)
+		}
+	}
+
+	return updates
+}
+
+// sentDownloadState is what we have announced to a remote device about the
+// files we are currently downloading. It is only used from the progress
+// emitter routine and so needs no locking.
+type sentDownloadState struct {
+	folderStates map[string]*sentFolderDownloadState
+}
+
+func newSentDownloadState() *sentDownloadState {
+	return &sentDownloadState{
+		folderStates: make(map[string]*sentFolderDownloadState),
+	}
+}
+
+// update returns the updates we need to send for the remote device to be up
+// to date with the given set of active pullers for the folder.
+func (s *sentDownloadState) update(folder string, pullers []*sharedPullerState) []protocol.FileDownloadProgressUpdate {
+	fs, ok := s.folderStates[folder]
+	if !ok {
+		fs = &sentFolderDownloadState{
+			files: make(map[string]*sentFolderFileDownloadState),
+		}
+		s.folderStates[folder] = fs
+	}
+	return fs.update(pullers)
+}
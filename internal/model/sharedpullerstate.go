@@ -10,6 +10,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 
 	"github.com/syncthing/protocol"
@@ -27,6 +28,7 @@ type sharedPullerState struct {
 	reused      int // Number of blocks reused from temporary file
 	ignorePerms bool
 	version     protocol.Vector // The current (old) version
+	conflict    conflictResolution
 
 	// Mutable, must be locked for access
 	err        error      // The first error we hit
@@ -36,6 +38,7 @@ type sharedPullerState struct {
 	copyOrigin int        // Number of blocks copied from the original file
 	copyNeeded int        // Number of copy actions still pending
 	pullNeeded int        // Number of block pulls still pending
+	available  []int32    // Indexes of the blocks present in the temp file, in the order they got there
 	mut        sync.Mutex // Protects the above
 }
 
@@ -173,9 +176,10 @@ func (s *sharedPullerState) failed() error {
 	return s.err
 }
 
-func (s *sharedPullerState) copyDone() {
+func (s *sharedPullerState) copyDone(block protocol.BlockInfo) {
 	s.mut.Lock()
 	s.copyNeeded--
+	s.blockAvailableLocked(block)
 	if debug {
 		l.Debugln("sharedPullerState", s.folder, s.file.Name, "copyNeeded ->", s.copyNeeded)
 	}
@@ -200,15 +204,34 @@ func (s *sharedPullerState) pullStarted() {
 	s.mut.Unlock()
 }
 
-func (s *sharedPullerState) pullDone() {
+func (s *sharedPullerState) pullDone(block protocol.BlockInfo) {
 	s.mut.Lock()
 	s.pullNeeded--
+	s.blockAvailableLocked(block)
 	if debug {
 		l.Debugln("sharedPullerState", s.folder, s.file.Name, "pullNeeded done ->", s.pullNeeded)
 	}
 	s.mut.Unlock()
 }
 
+// blockAvailableLocked records that the given block is now present in the
+// temp file.
+func (s *sharedPullerState) blockAvailableLocked(block protocol.BlockInfo) {
+	if i, ok := blockIndex(s.file.Blocks, block); ok {
+		s.available = append(s.available, i)
+	}
+}
+
+// Available returns the indexes of the blocks that are present in the temp
+// file. The list only ever grows, in the order the blocks were written.
+func (s *sharedPullerState) Available() []int32 {
+	s.mut.Lock()
+	available := make([]int32, len(s.available))
+	copy(available, s.available)
+	s.mut.Unlock()
+	return available
+}
+
 // finalClose atomically closes and returns closed status of a file. A true
 // first return value means the file was closed and should be finished, with
 // the error indicating the success or failure of the close. A false first
@@ -247,3 +270,15 @@ func (s *sharedPullerState) Progress() *pullerProgress {
 		BytesDone:           db.BlocksToSize(done),
 	}
 }
+
+// blockIndex returns the index of the given block in the list of blocks,
+// which must have the offsets populated.
+func blockIndex(blocks []protocol.BlockInfo, block protocol.BlockInfo) (int32, bool) {
+	i := sort.Search(len(blocks), func(i int) bool {
+		return blocks[i].Offset >= block.Offset
+	})
+	if i < len(blocks) && blocks[i].Offset == block.Offset {
+		return int32(i), true
+	}
+	return 0, false
+}
@@ -68,3 +68,17 @@ func TestInWriteableDir(t *testing.T) {
 		t.Error("testdata/file/foo returned nil error")
 	}
 }
+
+func TestDiskFree(t *testing.T) {
+	free, total, err := osutil.DiskFree(".")
+	if err != nil {
+		t.Skip("DiskFree:", err)
+	}
+	if free <= 0 || total < free {
+		t.Errorf("Unexpected free space %d of %d", free, total)
+	}
+
+	if _, _, err := osutil.DiskFree("testdata/nonexistent"); err == nil {
+		t.Error("Unexpected nil error for nonexistent path")
+	}
+}
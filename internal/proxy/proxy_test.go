@@ -0,0 +1,307 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// echoServer echoes everything back to the sender.
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+// socksServer is a minimal SOCKS5 proxy, optionally requiring a username
+// and password.
+func socksServer(t *testing.T, user, pass string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS(c, user, pass)
+		}
+	}()
+	return l
+}
+
+func serveSOCKS(c net.Conn, user, pass string) {
+	defer c.Close()
+
+	var hdr [2]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return
+	}
+	methods := make([]byte, hdr[1])
+	io.ReadFull(c, methods)
+
+	if user != "" {
+		c.Write([]byte{socksVersion, socksAuthPassword})
+		io.ReadFull(c, hdr[:])
+		u := make([]byte, hdr[1])
+		io.ReadFull(c, u)
+		io.ReadFull(c, hdr[:1])
+		p := make([]byte, hdr[0])
+		io.ReadFull(c, p)
+		if string(u) != user || string(p) != pass {
+			c.Write([]byte{1, 1})
+			return
+		}
+		c.Write([]byte{1, 0})
+	} else {
+		c.Write([]byte{socksVersion, socksAuthNone})
+	}
+
+	var req [3]byte
+	if _, err := io.ReadFull(c, req[:]); err != nil {
+		return
+	}
+	addr, err := readSOCKSAddr(c)
+	if err != nil {
+		return
+	}
+
+	switch req[1] {
+	case socksCmdConnect:
+		t, err := net.Dial("tcp", addr)
+		if err != nil {
+			c.Write([]byte{socksVersion, 5, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer t.Close()
+		res, _ := appendSOCKSAddr([]byte{socksVersion, 0, 0}, t.LocalAddr().String())
+		c.Write(res)
+		go io.Copy(t, c)
+		io.Copy(c, t)
+
+	case socksCmdUDPAssociate:
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		res, _ := appendSOCKSAddr([]byte{socksVersion, 0, 0}, relay.LocalAddr().String())
+		c.Write(res)
+		go serveUDPRelay(relay)
+		io.Copy(ioutil.Discard, c)
+	}
+}
+
+func serveUDPRelay(relay *net.UDPConn) {
+	var client net.Addr
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := relay.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() {
+			client = from
+			r := bytes.NewReader(buf[3:n])
+			dst, err := readSOCKSAddr(r)
+			if err != nil {
+				continue
+			}
+			addr, _ := net.ResolveUDPAddr("udp", dst)
+			rest, _ := ioutil.ReadAll(r)
+			relay.WriteTo(rest, addr)
+		} else {
+			pkt, _ := appendSOCKSAddr([]byte{0, 0, 0}, from.String())
+			relay.WriteTo(append(pkt, buf[:n]...), client)
+		}
+	}
+}
+
+// httpServer is a minimal HTTP CONNECT proxy.
+func httpServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "Not a CONNECT", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			http.Error(w, "Unauthorized", http.StatusProxyAuthRequired)
+			return
+		}
+		t, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer t.Close()
+		c, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(t, c)
+		io.Copy(c, t)
+	}))
+	return l
+}
+
+func testEcho(t *testing.T, proxy *url.URL, addr string) {
+	c, err := Dial(proxy, "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	var buf [5]byte
+	if _, err := io.ReadFull(c, buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:]) != "hello" {
+		t.Errorf("Incorrect echo %q", buf[:])
+	}
+
+	ra, ok := c.RemoteAddr().(Addr)
+	if !ok {
+		t.Fatalf("Remote address %v is not a proxy address", c.RemoteAddr())
+	}
+	if ra.String() != addr {
+		t.Errorf("Incorrect remote address %q != %q", ra.String(), addr)
+	}
+	if ra.Proxy != proxy.Scheme+"://"+proxy.Host {
+		t.Errorf("Incorrect proxy %q", ra.Proxy)
+	}
+}
+
+func TestDialSOCKS5(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	proxy := socksServer(t, "", "")
+	defer proxy.Close()
+
+	testEcho(t, &url.URL{Scheme: "socks5", Host: proxy.Addr().String()}, echo.Addr().String())
+}
+
+func TestDialSOCKS5Auth(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	proxy := socksServer(t, "user", "pass")
+	defer proxy.Close()
+
+	testEcho(t, &url.URL{
+		Scheme: "socks5",
+		Host:   proxy.Addr().String(),
+		User:   url.UserPassword("user", "pass"),
+	}, echo.Addr().String())
+
+	_, err := Dial(&url.URL{
+		Scheme: "socks5",
+		Host:   proxy.Addr().String(),
+		User:   url.UserPassword("user", "wrong"),
+	}, "tcp", echo.Addr().String())
+	if err != errSOCKSAuth {
+		t.Errorf("Unexpected error %v for incorrect password", err)
+	}
+}
+
+func TestDialHTTP(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+	proxy := httpServer(t)
+	defer proxy.Close()
+
+	testEcho(t, &url.URL{
+		Scheme: "http",
+		Host:   proxy.Addr().String(),
+		User:   url.UserPassword("user", "pass"),
+	}, echo.Addr().String())
+
+	_, err := Dial(&url.URL{Scheme: "http", Host: proxy.Addr().String()}, "tcp", echo.Addr().String())
+	if err == nil {
+		t.Error("Unexpected nil error without credentials")
+	}
+}
+
+func TestDialUnsupported(t *testing.T) {
+	if _, err := Dial(&url.URL{Scheme: "ftp", Host: "127.0.0.1:1"}, "tcp", "127.0.0.1:2"); err == nil {
+		t.Error("Unexpected nil error for unsupported scheme")
+	}
+	if _, err := ListenPacket(&url.URL{Scheme: "http", Host: "127.0.0.1:1"}); err == nil {
+		t.Error("Unexpected nil error for UDP through HTTP proxy")
+	}
+}
+
+func TestDialUDP(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	proxy := socksServer(t, "", "")
+	defer proxy.Close()
+
+	c, err := DialUDP(&url.URL{Scheme: "socks5", Host: proxy.Addr().String()}, echo.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Errorf("Incorrect echo %q", buf[:n])
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 as per RFC 1928, with username and password authentication as per
+// RFC 1929.
+
+const (
+	socksVersion = 5
+
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksAuthNoneOK   = 0xff
+
+	socksCmdConnect      = 0x01
+	socksCmdUDPAssociate = 0x03
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+)
+
+var socksErrors = []string{
+	"",
+	"general failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+var errSOCKSAuth = errors.New("proxy: SOCKS5 authentication failed")
+
+func dialSOCKS5(proxy *url.URL, network, addr string) (net.Conn, error) {
+	if network != "tcp" {
+		// The proxy would resolve the name to any address family, so we
+		// resolve it ourselves.
+		raddr, err := net.ResolveTCPAddr(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		addr = raddr.String()
+	}
+
+	c, err := net.DialTimeout("tcp", proxy.Host, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(dialTimeout))
+
+	if _, err := socksRequest(c, proxy, socksCmdConnect, addr); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	c.SetDeadline(time.Time{})
+	return &conn{
+		Conn:   c,
+		remote: Addr{network, addr, String(proxy)},
+	}, nil
+}
+
+// socksRequest authenticates with the proxy and sends the command, returning
+// the address bound by the proxy.
+func socksRequest(c net.Conn, proxy *url.URL, cmd byte, addr string) (string, error) {
+	methods := []byte{socksAuthNone}
+	if proxy.User != nil {
+		methods = append(methods, socksAuthPassword)
+	}
+	if _, err := c.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return "", err
+	}
+
+	var res [2]byte
+	if _, err := io.ReadFull(c, res[:]); err != nil {
+		return "", err
+	}
+	if res[0] != socksVersion {
+		return "", fmt.Errorf("proxy: unexpected SOCKS version %d", res[0])
+	}
+
+	switch res[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if proxy.User == nil {
+			return "", errSOCKSAuth
+		}
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return "", errSOCKSAuth
+		}
+		req := []byte{1, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := c.Write(req); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(c, res[:]); err != nil {
+			return "", err
+		}
+		if res[1] != 0 {
+			return "", errSOCKSAuth
+		}
+	default:
+		return "", errSOCKSAuth
+	}
+
+	req := []byte{socksVersion, cmd, 0}
+	req, err := appendSOCKSAddr(req, addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := c.Write(req); err != nil {
+		return "", err
+	}
+
+	var hdr [3]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[1] != 0 {
+		msg := "unknown error"
+		if int(hdr[1]) < len(socksErrors) {
+			msg = socksErrors[hdr[1]]
+		}
+		return "", fmt.Errorf("proxy: %s: %s", String(proxy), msg)
+	}
+	return readSOCKSAddr(c)
+}
+
+// appendSOCKSAddr appends the address in the SOCKS5 wire format.
+func appendSOCKSAddr(bs []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("proxy: host name too long: %s", host)
+		}
+		bs = append(bs, socksAtypDomain, byte(len(host)))
+		bs = append(bs, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		bs = append(bs, socksAtypIPv4)
+		bs = append(bs, ip4...)
+	} else {
+		bs = append(bs, socksAtypIPv6)
+		bs = append(bs, ip.To16()...)
+	}
+
+	return append(bs, byte(port>>8), byte(port)), nil
+}
+
+// readSOCKSAddr reads an address in the SOCKS5 wire format.
+func readSOCKSAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case socksAtypIPv4, socksAtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == socksAtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAtypDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", fmt.Errorf("proxy: unknown SOCKS address type %d", atyp[0])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// packetConn sends and receives datagrams through a SOCKS5 UDP relay. The
+// relay stays open for as long as the control connection does.
+type packetConn struct {
+	*net.UDPConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+}
+
+// ListenPacket returns a packet connection that sends and receives UDP
+// datagrams through the proxy. Only SOCKS5 proxies can relay datagrams.
+func ListenPacket(proxy *url.URL) (net.PacketConn, error) {
+	if proxy.Scheme != "socks5" {
+		return nil, fmt.Errorf("proxy: UDP is not supported by %s proxies", proxy.Scheme)
+	}
+
+	ctrl, err := net.DialTimeout("tcp", proxy.Host, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Now().Add(dialTimeout))
+
+	// We don't know the address our datagrams will be coming from, as seen
+	// by the proxy, so we let it accept them from anywhere.
+	bound, err := socksRequest(ctrl, proxy, socksCmdUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	relay, err := net.ResolveUDPAddr("udp", bound)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	if relay.IP.IsUnspecified() {
+		// The relay is on the same host as the proxy.
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	return &packetConn{
+		UDPConn: udp,
+		ctrl:    ctrl,
+		relay:   relay,
+	}, nil
+}
+
+func (c *packetConn) WriteTo(bs []byte, addr net.Addr) (int, error) {
+	pkt, err := appendSOCKSAddr([]byte{0, 0, 0}, addr.String())
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.UDPConn.WriteTo(append(pkt, bs...), c.relay); err != nil {
+		return 0, err
+	}
+	return len(bs), nil
+}
+
+func (c *packetConn) ReadFrom(bs []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(bs)+262)
+	for {
+		n, from, err := c.UDPConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.(*net.UDPAddr).IP.Equal(c.relay.IP) {
+			// Not from the relay
+			continue
+		}
+
+		// Fragmented datagrams are not supported, as per the RFC.
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		src, err := readSOCKSAddr(r)
+		if err != nil {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr("udp", src)
+		if err != nil {
+			continue
+		}
+		return copy(bs, buf[n-r.Len():n]), addr, nil
+	}
+}
+
+func (c *packetConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
+
+// udpConn is a packet connection that only talks to a single address.
+type udpConn struct {
+	net.PacketConn
+	remote net.Addr
+}
+
+// DialUDP returns a connection that sends to and receives from the given
+// address through the proxy.
+func DialUDP(proxy *url.URL, raddr *net.UDPAddr) (net.Conn, error) {
+	pc, err := ListenPacket(proxy)
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{
+		PacketConn: pc,
+		remote:     Addr{"udp", raddr.String(), String(proxy)},
+	}, nil
+}
+
+func (c *udpConn) Read(bs []byte) (int, error) {
+	for {
+		n, from, err := c.ReadFrom(bs)
+		if err != nil {
+			return 0, err
+		}
+		if from.String() == c.remote.String() {
+			return n, nil
+		}
+	}
+}
+
+func (c *udpConn) Write(bs []byte) (int, error) {
+	return c.WriteTo(bs, c.remote)
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.remote
+}
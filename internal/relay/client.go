@@ -0,0 +1,210 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package relay
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/syncthing/protocol"
+)
+
+const dialTimeout = 10 * time.Second
+
+// Dial makes the TCP connections to relays. It can be replaced to connect
+// through a proxy.
+var Dial = func(network, addr string) (net.Conn, error) {
+	return net.DialTimeout(network, addr, dialTimeout)
+}
+
+// A Client is a standing connection to a relay, through which we are sent
+// invitations to sessions that other devices set up with us.
+type Client struct {
+	conn *tls.Conn
+	wmut sync.Mutex
+}
+
+// Join connects to the relay at the given relay:// URI and makes us
+// reachable through it until the Client is closed.
+func Join(uri *url.URL, tlsCfg *tls.Config) (*Client, error) {
+	conn, err := dial(uri, tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := request(conn, JoinRelayRequest{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &Client{conn: conn}, nil
+}
+
+// Receive waits for the next session invitation, answering pings from the
+// relay while doing so. An error is returned when the connection to the
+// relay fails; the Client should then be closed.
+func (c *Client) Receive() (SessionInvitation, error) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(pingTimeout))
+		msg, err := ReadMessage(c.conn)
+		if err != nil {
+			return SessionInvitation{}, err
+		}
+
+		switch msg := msg.(type) {
+		case Ping:
+			c.wmut.Lock()
+			err = WriteMessage(c.conn, Pong{})
+			c.wmut.Unlock()
+			if err != nil {
+				return SessionInvitation{}, err
+			}
+		case SessionInvitation:
+			return msg, nil
+		case Response:
+			return SessionInvitation{}, responseError(msg)
+		default:
+			return SessionInvitation{}, fmt.Errorf("relay: unexpected message %T", msg)
+		}
+	}
+}
+
+// Close closes the connection to the relay.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// GetInvitation asks the relay at the given URI to set up a session with the
+// given device, which must have joined the relay.
+func GetInvitation(uri *url.URL, tlsCfg *tls.Config, id protocol.DeviceID) (SessionInvitation, error) {
+	conn, err := dial(uri, tlsCfg)
+	if err != nil {
+		return SessionInvitation{}, err
+	}
+	defer conn.Close()
+
+	if err := WriteMessage(conn, ConnectRequest{ID: id[:]}); err != nil {
+		return SessionInvitation{}, err
+	}
+
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		return SessionInvitation{}, err
+	}
+
+	switch msg := msg.(type) {
+	case SessionInvitation:
+		if len(msg.From) != len(id) || protocol.DeviceIDFromBytes(msg.From) != id {
+			return SessionInvitation{}, fmt.Errorf("relay: invitation for the wrong device")
+		}
+		return msg, nil
+	case Response:
+		if err := responseError(msg); err != nil {
+			return SessionInvitation{}, err
+		}
+	}
+	return SessionInvitation{}, fmt.Errorf("relay: unexpected message %T", msg)
+}
+
+// JoinSession joins the session we were invited to, returning the
+// connection to the other device once it has joined as well.
+func JoinSession(uri *url.URL, tlsCfg *tls.Config, invitation SessionInvitation) (net.Conn, error) {
+	conn, err := dial(uri, tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The other side may take a while to join.
+	conn.SetDeadline(time.Now().Add(sessionTimeout))
+	if err := request(conn, JoinSessionRequest{Key: invitation.Key}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return conn, nil
+}
+
+// dial connects to the relay. If the URI has an id parameter, the relay must
+// present the certificate for that device ID.
+func dial(uri *url.URL, tlsCfg *tls.Config) (*tls.Conn, error) {
+	if uri.Scheme != "relay" {
+		return nil, fmt.Errorf("relay: unsupported scheme %q", uri.Scheme)
+	}
+
+	host := uri.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, strconv.Itoa(DefaultPort))
+	}
+
+	var id protocol.DeviceID
+	if s := uri.Query().Get("id"); s != "" {
+		var err error
+		id, err = protocol.DeviceIDFromString(s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := Dial("tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tls.Config{
+		Certificates:           tlsCfg.Certificates,
+		NextProtos:             []string{ProtocolName},
+		ClientAuth:             tlsCfg.ClientAuth,
+		SessionTicketsDisabled: tlsCfg.SessionTicketsDisabled,
+		InsecureSkipVerify:     tlsCfg.InsecureSkipVerify,
+		MinVersion:             tlsCfg.MinVersion,
+		CipherSuites:           tlsCfg.CipherSuites,
+	}
+	tc := tls.Client(conn, cfg)
+	tc.SetDeadline(time.Now().Add(requestTimeout))
+	if err := tc.Handshake(); err != nil {
+		tc.Close()
+		return nil, err
+	}
+
+	if id != (protocol.DeviceID{}) {
+		certs := tc.ConnectionState().PeerCertificates
+		if len(certs) != 1 || protocol.NewDeviceID(certs[0].Raw) != id {
+			tc.Close()
+			return nil, fmt.Errorf("relay: %s is not %s", host, id)
+		}
+	}
+
+	if debug {
+		l.Debugln("relay: connected to", host)
+	}
+
+	return tc, nil
+}
+
+// request sends the request and waits for a successful response.
+func request(conn *tls.Conn, req interface{}) error {
+	if err := WriteMessage(conn, req); err != nil {
+		return err
+	}
+
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		return err
+	}
+	res, ok := msg.(Response)
+	if !ok {
+		return fmt.Errorf("relay: unexpected message %T", msg)
+	}
+	return responseError(res)
+}
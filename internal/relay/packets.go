@@ -0,0 +1,36 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:generate -command genxdr go run ../../Godeps/_workspace/src/github.com/calmh/xdr/cmd/genxdr/main.go
+//go:generate genxdr -o packets_xdr.go packets.go
+
+package relay
+
+// JoinSessionRequest is sent by both ends of a session, on a new connection
+// to the relay, to join the session they were invited to.
+type JoinSessionRequest struct {
+	Key []byte // max:32
+}
+
+// Response is the relay's answer to a request. A zero Code means success.
+type Response struct {
+	Code    int32
+	Message string
+}
+
+// ConnectRequest asks the relay to set up a session with the given device.
+type ConnectRequest struct {
+	ID []byte // max:32
+}
+
+// SessionInvitation tells a device that a session has been set up with the
+// From device, and that it can be joined with the key. ServerSocket tells
+// which side of the TLS handshake to take over the session connection.
+type SessionInvitation struct {
+	From         []byte // max:32
+	Key          []byte // max:32
+	ServerSocket bool
+}
@@ -0,0 +1,165 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package relay implements a relay that lets devices that can't connect to
+// each other directly set up a connection through a third party.
+//
+// A device that wants to be reachable keeps a standing connection to the
+// relay, over which it is sent invitations to sessions. A device that wants
+// to connect asks the relay for a session with the other device. Both then
+// open a new connection to the relay and join the session, after which the
+// relay passes data between them. The devices run their own TLS session
+// over that, so the relay never sees the plain text.
+//
+// All connections to the relay are themselves TLS, which tells the relay
+// the device ID of the connecting device.
+package relay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// ProtocolName is the TLS next protocol name used towards the relay.
+	ProtocolName = "bep-relay"
+
+	// DefaultPort is the port relays listen on by default.
+	DefaultPort = 22067
+
+	magic            = 0x9E79BC40
+	maxMessageLength = 1024
+)
+
+const (
+	messageTypePing int32 = iota
+	messageTypePong
+	messageTypeJoinRelayRequest
+	messageTypeJoinSessionRequest
+	messageTypeResponse
+	messageTypeConnectRequest
+	messageTypeSessionInvitation
+)
+
+// Ping is sent by the relay on standing connections, and answered with a
+// Pong.
+type Ping struct{}
+
+// Pong is the answer to a Ping.
+type Pong struct{}
+
+// JoinRelayRequest makes the device reachable through the relay for as long
+// as the connection stays up.
+type JoinRelayRequest struct{}
+
+var (
+	ResponseSuccess           = Response{0, "success"}
+	ResponseNotFound          = Response{1, "not found"}
+	ResponseAlreadyConnected  = Response{2, "already connected"}
+	ResponseUnexpectedMessage = Response{100, "unexpected message"}
+)
+
+var errMessageLength = errors.New("relay: message too long")
+
+// responseError returns the response as an error, or nil for a successful
+// response.
+func responseError(r Response) error {
+	if r.Code == 0 {
+		return nil
+	}
+	return fmt.Errorf("relay: %s (%d)", r.Message, r.Code)
+}
+
+// WriteMessage writes the message, prefixed with the message header.
+func WriteMessage(w io.Writer, message interface{}) error {
+	var msgType int32
+	var payload []byte
+	var err error
+
+	switch msg := message.(type) {
+	case Ping:
+		msgType = messageTypePing
+	case Pong:
+		msgType = messageTypePong
+	case JoinRelayRequest:
+		msgType = messageTypeJoinRelayRequest
+	case JoinSessionRequest:
+		msgType = messageTypeJoinSessionRequest
+		payload, err = msg.MarshalXDR()
+	case Response:
+		msgType = messageTypeResponse
+		payload, err = msg.MarshalXDR()
+	case ConnectRequest:
+		msgType = messageTypeConnectRequest
+		payload, err = msg.MarshalXDR()
+	case SessionInvitation:
+		msgType = messageTypeSessionInvitation
+		payload, err = msg.MarshalXDR()
+	default:
+		return fmt.Errorf("relay: unknown message type %T", message)
+	}
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 12+len(payload))
+	binary.BigEndian.PutUint32(buf, magic)
+	binary.BigEndian.PutUint32(buf[4:], uint32(msgType))
+	binary.BigEndian.PutUint32(buf[8:], uint32(len(payload)))
+	copy(buf[12:], payload)
+
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadMessage reads a message written by WriteMessage.
+func ReadMessage(r io.Reader) (interface{}, error) {
+	var hdr [12]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if m := binary.BigEndian.Uint32(hdr[:]); m != magic {
+		return nil, fmt.Errorf("relay: incorrect magic 0x%08x", m)
+	}
+	msgType := int32(binary.BigEndian.Uint32(hdr[4:]))
+	length := binary.BigEndian.Uint32(hdr[8:])
+	if length > maxMessageLength {
+		return nil, errMessageLength
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	switch msgType {
+	case messageTypePing:
+		return Ping{}, nil
+	case messageTypePong:
+		return Pong{}, nil
+	case messageTypeJoinRelayRequest:
+		return JoinRelayRequest{}, nil
+	case messageTypeJoinSessionRequest:
+		var msg JoinSessionRequest
+		err := msg.UnmarshalXDR(payload)
+		return msg, err
+	case messageTypeResponse:
+		var msg Response
+		err := msg.UnmarshalXDR(payload)
+		return msg, err
+	case messageTypeConnectRequest:
+		var msg ConnectRequest
+		err := msg.UnmarshalXDR(payload)
+		return msg, err
+	case messageTypeSessionInvitation:
+		var msg SessionInvitation
+		err := msg.UnmarshalXDR(payload)
+		return msg, err
+	}
+	return nil, fmt.Errorf("relay: unknown message type %d", msgType)
+}
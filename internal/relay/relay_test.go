@@ -0,0 +1,195 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package relay
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/syncthing/protocol"
+)
+
+func testTLSConfig(t *testing.T) (*tls.Config, protocol.DeviceID) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "syncthing"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  priv,
+		}},
+		ClientAuth:         tls.RequestClientCert,
+		InsecureSkipVerify: true,
+	}
+	return cfg, protocol.NewDeviceID(der)
+}
+
+func testServer(t *testing.T) (*url.URL, func()) {
+	cfg, id := testTLSConfig(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewServer(cfg).Serve(listener)
+
+	uri, err := url.Parse("relay://" + listener.Addr().String() + "/?id=" + id.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uri, func() { listener.Close() }
+}
+
+func TestMessages(t *testing.T) {
+	msgs := []interface{}{
+		Ping{},
+		Pong{},
+		JoinRelayRequest{},
+		JoinSessionRequest{Key: []byte("key")},
+		ResponseNotFound,
+		ConnectRequest{ID: protocol.LocalDeviceID[:]},
+		SessionInvitation{From: protocol.LocalDeviceID[:], Key: []byte("key"), ServerSocket: true},
+	}
+
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		if err := WriteMessage(&buf, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, msg := range msgs {
+		read, err := ReadMessage(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(read, msg) {
+			t.Errorf("Incorrect message %#v != %#v", read, msg)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	uri, stop := testServer(t)
+	defer stop()
+
+	cfgA, idA := testTLSConfig(t)
+	cfgB, idB := testTLSConfig(t)
+
+	client, err := Join(uri, cfgB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	invA, err := GetInvitation(uri, cfgA, idB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if invA.ServerSocket {
+		t.Error("Connecting side should be the TLS client")
+	}
+
+	invB, err := client.Receive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !invB.ServerSocket {
+		t.Error("Invited side should be the TLS server")
+	}
+	if !bytes.Equal(invB.From, idA[:]) {
+		t.Errorf("Incorrect invitation from %x", invB.From)
+	}
+
+	conns := make(chan net.Conn)
+	go func() {
+		conn, err := JoinSession(uri, cfgB, invB)
+		if err != nil {
+			t.Error(err)
+		}
+		conns <- conn
+	}()
+	connA, err := JoinSession(uri, cfgA, invA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connA.Close()
+	connB := <-conns
+	if connB == nil {
+		t.FailNow()
+	}
+	defer connB.Close()
+
+	go connA.Write([]byte("hello from A"))
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(connB, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello from A" {
+		t.Errorf("Incorrect data %q", buf)
+	}
+
+	go connB.Write([]byte("hello from B"))
+	if _, err := io.ReadFull(connA, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello from B" {
+		t.Errorf("Incorrect data %q", buf)
+	}
+}
+
+func TestInvitationNotFound(t *testing.T) {
+	uri, stop := testServer(t)
+	defer stop()
+
+	cfg, _ := testTLSConfig(t)
+	_, other := testTLSConfig(t)
+
+	if _, err := GetInvitation(uri, cfg, other); err == nil {
+		t.Error("Unexpected nil error for device that hasn't joined")
+	}
+}
+
+func TestRelayID(t *testing.T) {
+	uri, stop := testServer(t)
+	defer stop()
+
+	cfg, _ := testTLSConfig(t)
+	_, other := testTLSConfig(t)
+
+	q := uri.Query()
+	q.Set("id", other.String())
+	uri.RawQuery = q.Encode()
+
+	if _, err := Join(uri, cfg); err == nil {
+		t.Error("Unexpected nil error for relay with the wrong ID")
+	}
+}
@@ -0,0 +1,331 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package relay
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/syncthing/protocol"
+)
+
+const (
+	// How often the relay pings devices with a standing connection, and how
+	// long it waits for the answer.
+	pingInterval = time.Minute
+	pingTimeout  = 2 * pingInterval
+
+	// How long both sides of a session have to join it.
+	sessionTimeout = 30 * time.Second
+
+	// How long a device has to send its request after connecting.
+	requestTimeout = 10 * time.Second
+)
+
+// A Server accepts connections from devices and relays sessions between
+// them.
+type Server struct {
+	tlsCfg *tls.Config
+
+	mut      sync.Mutex
+	joined   map[protocol.DeviceID]*joinedDevice // devices reachable through us
+	sessions map[string]*session                 // session key -> session
+}
+
+// A joinedDevice is the standing connection from a device.
+type joinedDevice struct {
+	conn *tls.Conn
+	wmut sync.Mutex // serializes writes to conn
+}
+
+func (d *joinedDevice) write(msg interface{}) error {
+	d.wmut.Lock()
+	defer d.wmut.Unlock()
+	d.conn.SetWriteDeadline(time.Now().Add(requestTimeout))
+	return WriteMessage(d.conn, msg)
+}
+
+// A session is a pair of connections to be joined. Each side has its own
+// key, so that neither can pose as the other.
+type session struct {
+	keys    [2]string
+	waiting net.Conn // the side that joined first
+	done    bool     // paired or expired
+}
+
+// NewServer returns a relay server using the given TLS configuration, which
+// should request client certificates.
+func NewServer(tlsCfg *tls.Config) *Server {
+	return &Server{
+		tlsCfg:   tlsCfg,
+		joined:   make(map[protocol.DeviceID]*joinedDevice),
+		sessions: make(map[string]*session),
+	}
+}
+
+// Serve accepts connections on the listener until it fails.
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		if debug {
+			l.Debugln("relay: connect from", conn.RemoteAddr())
+		}
+
+		go s.handle(tls.Server(conn, s.tlsCfg))
+	}
+}
+
+func (s *Server) handle(conn *tls.Conn) {
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+	if err := conn.Handshake(); err != nil {
+		if debug {
+			l.Debugln("relay: TLS handshake:", conn.RemoteAddr(), err)
+		}
+		conn.Close()
+		return
+	}
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) != 1 {
+		if debug {
+			l.Debugf("relay: %d certificates from %s", len(certs), conn.RemoteAddr())
+		}
+		conn.Close()
+		return
+	}
+	id := protocol.NewDeviceID(certs[0].Raw)
+
+	msg, err := ReadMessage(conn)
+	if err != nil {
+		if debug {
+			l.Debugln("relay: read request:", id, err)
+		}
+		conn.Close()
+		return
+	}
+
+	switch msg := msg.(type) {
+	case JoinRelayRequest:
+		s.handleJoinRelay(id, conn)
+	case ConnectRequest:
+		s.handleConnect(id, conn, msg)
+	case JoinSessionRequest:
+		s.handleJoinSession(id, conn, msg)
+	default:
+		WriteMessage(conn, ResponseUnexpectedMessage)
+		conn.Close()
+	}
+}
+
+func (s *Server) handleJoinRelay(id protocol.DeviceID, conn *tls.Conn) {
+	dev := &joinedDevice{conn: conn}
+
+	s.mut.Lock()
+	old, ok := s.joined[id]
+	s.joined[id] = dev
+	s.mut.Unlock()
+
+	if ok {
+		// The device has reconnected before we noticed that the old
+		// connection went away.
+		old.conn.Close()
+	}
+
+	if debug {
+		l.Debugln("relay: joined", id, conn.RemoteAddr())
+	}
+
+	defer func() {
+		s.mut.Lock()
+		if s.joined[id] == dev {
+			delete(s.joined, id)
+		}
+		s.mut.Unlock()
+		conn.Close()
+
+		if debug {
+			l.Debugln("relay: left", id, conn.RemoteAddr())
+		}
+	}()
+
+	conn.SetDeadline(time.Time{})
+	if err := dev.write(ResponseSuccess); err != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		t := time.NewTicker(pingInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := dev.write(Ping{}); err != nil {
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(pingTimeout))
+		msg, err := ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		if _, ok := msg.(Pong); !ok {
+			dev.write(ResponseUnexpectedMessage)
+			return
+		}
+	}
+}
+
+func (s *Server) handleConnect(id protocol.DeviceID, conn *tls.Conn, req ConnectRequest) {
+	defer conn.Close()
+
+	if len(req.ID) != len(protocol.DeviceID{}) {
+		WriteMessage(conn, ResponseNotFound)
+		return
+	}
+	target := protocol.DeviceIDFromBytes(req.ID)
+
+	s.mut.Lock()
+	dev, ok := s.joined[target]
+	s.mut.Unlock()
+	if !ok || target == id {
+		if debug {
+			l.Debugln("relay: connect from", id, "to unknown device", target)
+		}
+		WriteMessage(conn, ResponseNotFound)
+		return
+	}
+
+	sess := &session{
+		keys: [2]string{string(randomKey()), string(randomKey())},
+	}
+	s.mut.Lock()
+	s.sessions[sess.keys[0]] = sess
+	s.sessions[sess.keys[1]] = sess
+	s.mut.Unlock()
+	time.AfterFunc(sessionTimeout, func() {
+		s.expire(sess)
+	})
+
+	if debug {
+		l.Debugln("relay: session from", id, "to", target)
+	}
+
+	err := dev.write(SessionInvitation{
+		From:         id[:],
+		Key:          []byte(sess.keys[1]),
+		ServerSocket: true,
+	})
+	if err != nil {
+		dev.conn.Close()
+		s.expire(sess)
+		WriteMessage(conn, ResponseNotFound)
+		return
+	}
+
+	WriteMessage(conn, SessionInvitation{
+		From:         target[:],
+		Key:          []byte(sess.keys[0]),
+		ServerSocket: false,
+	})
+}
+
+func (s *Server) handleJoinSession(id protocol.DeviceID, conn *tls.Conn, req JoinSessionRequest) {
+	s.mut.Lock()
+	sess, ok := s.sessions[string(req.Key)]
+	if !ok {
+		s.mut.Unlock()
+		WriteMessage(conn, ResponseNotFound)
+		conn.Close()
+		return
+	}
+	// Each key can only be used once.
+	delete(s.sessions, string(req.Key))
+
+	if sess.waiting == nil {
+		// The other side will come along, or the session expires.
+		sess.waiting = conn
+		s.mut.Unlock()
+		return
+	}
+
+	other := sess.waiting
+	sess.waiting = nil
+	sess.done = true
+	s.mut.Unlock()
+
+	if debug {
+		l.Debugln("relay: session joined by", id)
+	}
+
+	other.SetDeadline(time.Time{})
+	conn.SetDeadline(time.Time{})
+	if WriteMessage(other, ResponseSuccess) != nil || WriteMessage(conn, ResponseSuccess) != nil {
+		other.Close()
+		conn.Close()
+		return
+	}
+
+	proxy(other, conn)
+}
+
+// expire removes a session that hasn't been joined by both sides.
+func (s *Server) expire(sess *session) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if sess.done {
+		return
+	}
+	sess.done = true
+	delete(s.sessions, sess.keys[0])
+	delete(s.sessions, sess.keys[1])
+	if sess.waiting != nil {
+		WriteMessage(sess.waiting, ResponseNotFound)
+		sess.waiting.Close()
+		sess.waiting = nil
+	}
+}
+
+// proxy passes data between the two connections until either side closes.
+func proxy(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+func randomKey() []byte {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		panic(err)
+	}
+	return key
+}
@@ -17,15 +17,16 @@ import (
 // The parallell hasher reads FileInfo structures from the inbox, hashes the
 // file to populate the Blocks element and sends it to the outbox. A number of
 // workers are used in parallel. The outbox will become closed when the inbox
-// is closed and all items handled.
+// is closed and all items handled. Files are split into blocks at content
+// defined boundaries instead of every blockSize bytes if chunked is set.
 
-func newParallelHasher(dir string, blockSize, workers int, outbox, inbox chan protocol.FileInfo) {
+func newParallelHasher(dir string, blockSize int, chunked bool, workers int, outbox, inbox chan protocol.FileInfo) {
 	var wg sync.WaitGroup
 	wg.Add(workers)
 
 	for i := 0; i < workers; i++ {
 		go func() {
-			hashFiles(dir, blockSize, outbox, inbox)
+			hashFiles(dir, blockSize, chunked, outbox, inbox)
 			wg.Done()
 		}()
 	}
@@ -37,6 +38,10 @@ func newParallelHasher(dir string, blockSize, workers int, outbox, inbox chan pr
 }
 
 func HashFile(path string, blockSize int) ([]protocol.BlockInfo, error) {
+	return hashFile(path, blockSize, false)
+}
+
+func hashFile(path string, blockSize int, chunked bool) ([]protocol.BlockInfo, error) {
 	fd, err := os.Open(path)
 	if err != nil {
 		if debug {
@@ -54,17 +59,20 @@ func HashFile(path string, blockSize int) ([]protocol.BlockInfo, error) {
 		return []protocol.BlockInfo{}, err
 	}
 	defer fd.Close()
+	if chunked {
+		return ChunkedBlocks(fd, fi.Size())
+	}
 	return Blocks(fd, blockSize, fi.Size())
 }
 
-func hashFiles(dir string, blockSize int, outbox, inbox chan protocol.FileInfo) {
+func hashFiles(dir string, blockSize int, chunked bool, outbox, inbox chan protocol.FileInfo) {
 	for f := range inbox {
 		if f.IsDirectory() || f.IsDeleted() || f.IsSymlink() {
 			outbox <- f
 			continue
 		}
 
-		blocks, err := HashFile(filepath.Join(dir, f.Name), blockSize)
+		blocks, err := hashFile(filepath.Join(dir, f.Name), blockSize, chunked)
 		if err != nil {
 			if debug {
 				l.Debugln("hash error:", f.Name, err)
@@ -13,6 +13,7 @@ import (
 	"io"
 
 	"github.com/syncthing/protocol"
+	"github.com/syncthing/syncthing/internal/weakhash"
 )
 
 var SHA256OfNothing = []uint8{0xe3, 0xb0, 0xc4, 0x42, 0x98, 0xfc, 0x1c, 0x14, 0x9a, 0xfb, 0xf4, 0xc8, 0x99, 0x6f, 0xb9, 0x24, 0x27, 0xae, 0x41, 0xe4, 0x64, 0x9b, 0x93, 0x4c, 0xa4, 0x95, 0x99, 0x1b, 0x78, 0x52, 0xb8, 0x55}
@@ -25,9 +26,11 @@ func Blocks(r io.Reader, blocksize int, sizehint int64) ([]protocol.BlockInfo, e
 	}
 	var offset int64
 	hf := sha256.New()
+	wf := weakhash.New()
+	mw := io.MultiWriter(hf, wf)
 	for {
 		lr := &io.LimitedReader{R: r, N: int64(blocksize)}
-		n, err := io.Copy(hf, lr)
+		n, err := io.Copy(mw, lr)
 		if err != nil {
 			return nil, err
 		}
@@ -37,14 +40,16 @@ func Blocks(r io.Reader, blocksize int, sizehint int64) ([]protocol.BlockInfo, e
 		}
 
 		b := protocol.BlockInfo{
-			Size:   int32(n),
-			Offset: offset,
-			Hash:   hf.Sum(nil),
+			Size:     int32(n),
+			Offset:   offset,
+			Hash:     hf.Sum(nil),
+			WeakHash: wf.Sum32(),
 		}
 		blocks = append(blocks, b)
 		offset += int64(n)
 
 		hf.Reset()
+		wf.Reset()
 	}
 
 	if len(blocks) == 0 {
@@ -69,7 +74,10 @@ func PopulateOffsets(blocks []protocol.BlockInfo) {
 }
 
 // BlockDiff returns lists of common and missing (to transform src into tgt)
-// blocks. Both block lists must have been created with the same block size.
+// blocks. A block is common if src has a block with the same offset, size
+// and hash, so the block lists may have been created with different block
+// sizes or with content defined chunking. Both lists must have their offsets
+// populated.
 func BlockDiff(src, tgt []protocol.BlockInfo) (have, need []protocol.BlockInfo) {
 	if len(tgt) == 0 && len(src) != 0 {
 		return nil, nil
@@ -80,12 +88,17 @@ func BlockDiff(src, tgt []protocol.BlockInfo) (have, need []protocol.BlockInfo)
 		return nil, tgt
 	}
 
-	for i := range tgt {
-		if i >= len(src) || bytes.Compare(tgt[i].Hash, src[i].Hash) != 0 {
-			// Copy differing block
-			need = append(need, tgt[i])
+	// The blocks are sorted by offset, so we can walk both lists at once.
+	j := 0
+	for _, block := range tgt {
+		for j < len(src) && src[j].Offset < block.Offset {
+			j++
+		}
+		if j < len(src) && src[j].Offset == block.Offset && src[j].Size == block.Size && bytes.Equal(src[j].Hash, block.Hash) {
+			have = append(have, block)
 		} else {
-			have = append(have, tgt[i])
+			// Copy differing block
+			need = append(need, block)
 		}
 	}
 
@@ -94,10 +107,10 @@ func BlockDiff(src, tgt []protocol.BlockInfo) (have, need []protocol.BlockInfo)
 
 // Verify returns nil or an error describing the mismatch between the block
 // list and actual reader contents
-func Verify(r io.Reader, blocksize int, blocks []protocol.BlockInfo) error {
+func Verify(r io.Reader, blocks []protocol.BlockInfo) error {
 	hf := sha256.New()
 	for i, block := range blocks {
-		lr := &io.LimitedReader{R: r, N: int64(blocksize)}
+		lr := &io.LimitedReader{R: r, N: int64(block.Size)}
 		_, err := io.Copy(hf, lr)
 		if err != nil {
 			return err
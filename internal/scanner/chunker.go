@@ -0,0 +1,119 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/syncthing/protocol"
+)
+
+// Content defined chunking places block boundaries where a rolling hash of
+// the preceding bytes matches a pattern, instead of at fixed offsets. An
+// insertion or deletion in a file then only changes the blocks around the
+// edit, and the blocks after it can still be found by the block finder.
+//
+// The maximum chunk size is protocol.BlockSize, so chunked files can be
+// handled by devices that only know about fixed size blocks.
+const (
+	minChunkSize = protocol.BlockSize / 4
+	maxChunkSize = protocol.BlockSize
+
+	// With the hash bits being uniformly distributed, a boundary is found
+	// on average every 1<<chunkMaskBits bytes after the minimum chunk size.
+	chunkMaskBits = 15
+	// The low bits of the gear hash only depend on the last few bytes, so
+	// we look at the top bits instead.
+	chunkMask = (1<<chunkMaskBits - 1) << (64 - chunkMaskBits)
+)
+
+// The gear table maps each byte value to a pseudo random number. It must be
+// the same on all devices for them to find the same boundaries.
+var gearTable [256]uint64
+
+func init() {
+	for i := range gearTable {
+		hash := sha256.Sum256([]byte{byte(i)})
+		gearTable[i] = binary.BigEndian.Uint64(hash[:])
+	}
+}
+
+// ChunkedBlocks returns the hash of the reader, split into blocks of varying
+// size at content defined boundaries.
+func ChunkedBlocks(r io.Reader, sizehint int64) ([]protocol.BlockInfo, error) {
+	var blocks []protocol.BlockInfo
+	if sizehint > 0 {
+		blocks = make([]protocol.BlockInfo, 0, int(sizehint/(minChunkSize+1<<chunkMaskBits)))
+	}
+
+	buf := make([]byte, maxChunkSize)
+	var offset int64
+	var buffered int
+	eof := false
+	hf := sha256.New()
+	for {
+		if !eof {
+			n, err := io.ReadFull(r, buf[buffered:])
+			buffered += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+
+		if buffered == 0 {
+			break
+		}
+
+		size := nextBoundary(buf[:buffered])
+
+		hf.Write(buf[:size])
+		// No weak hash; the puller only looks for shifted blocks of the
+		// standard size.
+		blocks = append(blocks, protocol.BlockInfo{
+			Size:   int32(size),
+			Offset: offset,
+			Hash:   hf.Sum(nil),
+		})
+		offset += int64(size)
+		hf.Reset()
+
+		buffered = copy(buf, buf[size:buffered])
+	}
+
+	if len(blocks) == 0 {
+		// Empty file
+		blocks = append(blocks, protocol.BlockInfo{
+			Offset: 0,
+			Size:   0,
+			Hash:   SHA256OfNothing,
+		})
+	}
+
+	return blocks, nil
+}
+
+// nextBoundary returns the size of the chunk starting at the beginning of
+// data. The whole of data is returned if no boundary is found, so data is
+// expected to be maxChunkSize long unless it's the end of the file.
+func nextBoundary(data []byte) int {
+	if len(data) <= minChunkSize {
+		return len(data)
+	}
+
+	var hash uint64
+	for i := minChunkSize; i < len(data); i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	return len(data)
+}
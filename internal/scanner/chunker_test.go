@@ -0,0 +1,125 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package scanner
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/syncthing/protocol"
+)
+
+func chunkerTestData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(42)).Read(data)
+	return data
+}
+
+func TestChunkedBlocks(t *testing.T) {
+	data := chunkerTestData(4 << 20)
+
+	blocks, err := ChunkedBlocks(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var offset int64
+	for i, b := range blocks {
+		if b.Offset != offset {
+			t.Errorf("Incorrect offset for block %d; %d != %d", i, b.Offset, offset)
+		}
+		if b.Size > protocol.BlockSize {
+			t.Errorf("Block %d too large; %d > %d", i, b.Size, protocol.BlockSize)
+		}
+		if b.Size < minChunkSize && i != len(blocks)-1 {
+			t.Errorf("Block %d too small; %d < %d", i, b.Size, minChunkSize)
+		}
+		offset += int64(b.Size)
+	}
+	if offset != int64(len(data)) {
+		t.Errorf("Incorrect total size %d != %d", offset, len(data))
+	}
+
+	// Not all blocks should be the maximum size, or we're not really doing
+	// content defined chunking.
+	if len(blocks) <= len(data)/protocol.BlockSize {
+		t.Errorf("Too few blocks; %d", len(blocks))
+	}
+
+	if err := Verify(bytes.NewReader(data), blocks); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChunkedBlocksEmpty(t *testing.T) {
+	blocks, err := ChunkedBlocks(bytes.NewReader(nil), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 || blocks[0].Size != 0 || !bytes.Equal(blocks[0].Hash, SHA256OfNothing) {
+		t.Errorf("Incorrect blocks for empty file: %v", blocks)
+	}
+}
+
+func TestChunkedBlocksInsert(t *testing.T) {
+	data := chunkerTestData(4 << 20)
+	modified := append(append(append([]byte{}, data[:1000]...), "inserted"...), data[1000:]...)
+
+	a, err := ChunkedBlocks(bytes.NewReader(data), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ChunkedBlocks(bytes.NewReader(modified), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashes := make(map[string]struct{}, len(a))
+	for _, block := range a {
+		hashes[string(block.Hash)] = struct{}{}
+	}
+
+	// Only the blocks around the insertion should differ; everything after
+	// should have been found at the same boundaries, shifted.
+	var differ int
+	for _, block := range b {
+		if _, ok := hashes[string(block.Hash)]; !ok {
+			differ++
+		}
+	}
+	if differ > 2 {
+		t.Errorf("%d of %d blocks changed after a small insert", differ, len(b))
+	}
+
+	// With fixed size blocks, everything after the insertion changes.
+	a, _ = Blocks(bytes.NewReader(data), protocol.BlockSize, 0)
+	b, _ = Blocks(bytes.NewReader(modified), protocol.BlockSize, 0)
+	if have, _ := BlockDiff(a, b); len(have) != 0 {
+		t.Errorf("Unexpected common fixed size blocks: %d", len(have))
+	}
+}
+
+func TestBlockDiffChunked(t *testing.T) {
+	data := chunkerTestData(1 << 20)
+	modified := append([]byte{}, data...)
+	modified[len(modified)/2] ^= 0xff
+
+	a, _ := ChunkedBlocks(bytes.NewReader(data), 0)
+	b, _ := ChunkedBlocks(bytes.NewReader(modified), 0)
+
+	have, need := BlockDiff(a, b)
+	if len(need) != 1 {
+		t.Fatalf("Incorrect number of needed blocks; %d != 1", len(need))
+	}
+	if len(have)+len(need) != len(b) {
+		t.Errorf("Incorrect number of blocks; %d + %d != %d", len(have), len(need), len(b))
+	}
+	if need[0].Offset > int64(len(data)/2) || need[0].Offset+int64(need[0].Size) <= int64(len(data)/2) {
+		t.Errorf("Needed block %v does not cover the change", need[0])
+	}
+}
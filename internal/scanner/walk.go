@@ -43,6 +43,9 @@ type Walker struct {
 	Subs []string
 	// BlockSize controls the size of the block used when hashing.
 	BlockSize int
+	// If ContentChunking is true, files are split into blocks of varying
+	// size at content defined boundaries instead of every BlockSize bytes.
+	ContentChunking bool
 	// If Matcher is not nil, it is used to identify files to ignore which were specified by the user.
 	Matcher *ignore.Matcher
 	// If TempNamer is not nil, it is used to ignore tempory files when walking.
@@ -95,7 +98,7 @@ func (w *Walker) Walk() (chan protocol.FileInfo, error) {
 
 	files := make(chan protocol.FileInfo)
 	hashedFiles := make(chan protocol.FileInfo)
-	newParallelHasher(w.Dir, w.BlockSize, workers, hashedFiles, files)
+	newParallelHasher(w.Dir, w.BlockSize, w.ContentChunking, workers, hashedFiles, files)
 
 	go func() {
 		hashFiles := w.walkAndHashFiles(files)
@@ -10,6 +10,7 @@ package upgrade
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"runtime"
 	"strconv"
 	"strings"
@@ -34,6 +35,10 @@ var (
 	ErrUpgradeUnsupported = errors.New("upgrade unsupported")
 	ErrUpgradeInProgress  = errors.New("upgrade already in progress")
 	upgradeUnlocked       = make(chan bool, 1)
+
+	// HTTPClient is used to check for and download releases. It can be
+	// replaced to go through a proxy.
+	HTTPClient = http.DefaultClient
 )
 
 func init() {
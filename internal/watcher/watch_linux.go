@@ -0,0 +1,192 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_ATTRIB | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_DELETE_SELF | syscall.IN_MODIFY | syscall.IN_MOVE_SELF |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DONT_FOLLOW |
+	syscall.IN_ONLYDIR
+
+// Room for a bunch of events with maximum length names.
+const eventBufferSize = 64 * (syscall.SizeofInotifyEvent + 256)
+
+// An inotify watches the directories of a tree, each with a watch of its
+// own; inotify isn't recursive.
+type inotify struct {
+	fd      int
+	dir     string
+	ignored func(string) bool
+	dirs    map[int32]string // watch descriptor -> directory, relative to dir
+}
+
+// watch sends the names, relative to dir, of the files and directories that
+// change under dir, until the stop channel is closed. An empty name means
+// that changes may have been missed, so everything needs to be scanned.
+func watch(dir string, ignored func(string) bool, changes chan<- string, stop <-chan struct{}) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// The reads block, so we wait for either the inotify descriptor or the
+	// pipe that is written to on stop to become readable first.
+	var pipe [2]int
+	if err := syscall.Pipe(pipe[:]); err != nil {
+		return err
+	}
+	defer syscall.Close(pipe[0])
+	defer syscall.Close(pipe[1])
+	epfd, err := syscall.EpollCreate(2)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(epfd)
+	for _, rfd := range []int{fd, pipe[0]} {
+		ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(rfd)}
+		if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, rfd, &ev); err != nil {
+			return err
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			syscall.Write(pipe[1], []byte{0})
+		case <-done:
+		}
+	}()
+
+	w := &inotify{
+		fd:      fd,
+		dir:     dir,
+		ignored: ignored,
+		dirs:    make(map[int32]string),
+	}
+	if err := w.addTree(""); err != nil {
+		return err
+	}
+
+	send := func(name string) bool {
+		select {
+		case changes <- name:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+
+	buf := make([]byte, eventBufferSize)
+	events := make([]syscall.EpollEvent, 2)
+	for {
+		n, err := syscall.EpollWait(epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, ev := range events[:n] {
+			if int(ev.Fd) == pipe[0] {
+				return nil
+			}
+		}
+
+		n, err = syscall.Read(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(ev.Len)
+			name := strings.TrimRight(string(buf[start:offset]), "\x00")
+
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				if !send("") {
+					return nil
+				}
+				continue
+			}
+
+			parent, ok := w.dirs[ev.Wd]
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				// The watch is gone, as the directory was removed
+				delete(w.dirs, ev.Wd)
+				continue
+			}
+			if !ok {
+				continue
+			}
+
+			rel := parent
+			if name != "" {
+				rel = filepath.Join(parent, name)
+			}
+			if rel != "" && ignored(rel) {
+				continue
+			}
+
+			if ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+				// New directories need watches of their own. Anything
+				// created in them before the watches are set up is found by
+				// the scan of the directory.
+				if err := w.addTree(rel); err != nil {
+					return err
+				}
+			}
+
+			if !send(rel) {
+				return nil
+			}
+		}
+	}
+}
+
+// addTree adds watches for the directory and all directories below it that
+// aren't ignored. Directories that disappear while we're at it are skipped.
+func (w *inotify) addTree(rel string) error {
+	return filepath.Walk(filepath.Join(w.dir, rel), func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+
+		name, err := filepath.Rel(w.dir, path)
+		if err != nil {
+			return nil
+		}
+		if name == "." {
+			name = ""
+		} else if w.ignored(name) {
+			return filepath.SkipDir
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+		if err == syscall.ENOSPC {
+			return errWatchLimit
+		} else if err != nil {
+			if debug {
+				l.Debugf("watcher: watching %s: %v", path, err)
+			}
+			return nil
+		}
+		w.dirs[int32(wd)] = name
+		return nil
+	})
+}
@@ -0,0 +1,178 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package watcher watches a folder for changes and has the changed parts of
+// it scanned, once the changes have had some time to settle.
+package watcher
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var (
+	ErrUnsupported = errors.New("filesystem watching is not supported on this platform")
+
+	// errWatchLimit is returned by watch when the system won't let us watch
+	// any more directories.
+	errWatchLimit = errors.New("too many watched directories")
+)
+
+const (
+	// With more changed paths than this, we might as well scan everything.
+	maxSubs = 100
+
+	// With more changes than this in a single directory, the directory is
+	// scanned as a whole.
+	maxDirChanges = 10
+)
+
+// A Watcher watches the folder at Dir and calls Scan with the changed paths,
+// relative to Dir, at most once every Delay. A nil list of paths means the
+// whole folder should be scanned. Ignored returns whether changes to a path
+// are of no interest.
+type Watcher struct {
+	Dir     string
+	Delay   time.Duration
+	Ignored func(name string) bool
+	Scan    func(subs []string) error
+
+	stop chan struct{}
+}
+
+func New(dir string, delay time.Duration, ignored func(string) bool, scan func([]string) error) *Watcher {
+	return &Watcher{
+		Dir:     dir,
+		Delay:   delay,
+		Ignored: ignored,
+		Scan:    scan,
+		stop:    make(chan struct{}),
+	}
+}
+
+// Serve watches the folder until Stop is called. If the folder can't be
+// watched, or there are too many directories to watch, Serve returns and
+// the folder is left to the regular full scans.
+func (w *Watcher) Serve() {
+	changes := make(chan string)
+	done := make(chan error, 1)
+	go func() {
+		done <- watch(w.Dir, w.Ignored, changes, w.stop)
+	}()
+
+	if debug {
+		l.Debugln("watcher: watching", w.Dir)
+	}
+
+	pending := make(map[string]struct{})
+	var timer <-chan time.Time
+	for {
+		select {
+		case name := <-changes:
+			if debug {
+				l.Debugf("watcher: %s: change in %q", w.Dir, name)
+			}
+			pending[name] = struct{}{}
+			if timer == nil {
+				timer = time.After(w.Delay)
+			}
+
+		case <-timer:
+			timer = nil
+			subs := aggregate(pending)
+			pending = make(map[string]struct{})
+			if debug {
+				l.Debugf("watcher: %s: scanning %q", w.Dir, subs)
+			}
+			if err := w.Scan(subs); err != nil {
+				l.Infof("Scanning changes in %s: %v", w.Dir, err)
+			}
+
+		case err := <-done:
+			switch err {
+			case nil:
+			case ErrUnsupported:
+				l.Infoln("Not watching", w.Dir+":", err)
+			case errWatchLimit:
+				l.Warnf("Watching %s: %v; falling back to full scans. Increasing fs.inotify.max_user_watches may help.", w.Dir, err)
+				if err := w.Scan(nil); err != nil {
+					l.Infof("Scanning %s: %v", w.Dir, err)
+				}
+			default:
+				l.Warnf("Watching %s: %v; falling back to full scans.", w.Dir, err)
+			}
+			return
+
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Stop stops watching the folder.
+func (w *Watcher) Stop() {
+	close(w.stop)
+}
+
+// aggregate returns the minimal set of paths to scan to cover the changed
+// ones; that is, without any paths that are within another, and with the
+// paths in directories with a lot of changes replaced by the directory. The
+// empty path stands for the whole folder, for which nil is returned.
+func aggregate(changed map[string]struct{}) []string {
+	perDir := make(map[string][]string)
+	for name := range changed {
+		if name == "" {
+			return nil
+		}
+		dir := filepath.Dir(name)
+		if dir == "." {
+			dir = ""
+		}
+		perDir[dir] = append(perDir[dir], name)
+	}
+
+	var subs []string
+	for dir, names := range perDir {
+		if len(names) > maxDirChanges {
+			if dir == "" {
+				return nil
+			}
+			subs = append(subs, dir)
+		} else {
+			subs = append(subs, names...)
+		}
+	}
+
+	isSub := make(map[string]bool, len(subs))
+	for _, sub := range subs {
+		isSub[sub] = true
+	}
+	var res []string
+	for _, sub := range subs {
+		if !hasParentIn(sub, isSub) {
+			res = append(res, sub)
+		}
+	}
+	sort.Strings(res)
+
+	if len(res) > maxSubs {
+		return nil
+	}
+	return res
+}
+
+// hasParentIn returns whether any of the parent directories of name is in
+// the set.
+func hasParentIn(name string, set map[string]bool) bool {
+	for dir := filepath.Dir(name); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		if set[dir] {
+			return true
+		}
+	}
+	return false
+}
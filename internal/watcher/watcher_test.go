@@ -0,0 +1,175 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package watcher
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func set(names ...string) map[string]struct{} {
+	m := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		m[filepath.FromSlash(name)] = struct{}{}
+	}
+	return m
+}
+
+func TestAggregate(t *testing.T) {
+	many := func(dir string, n int) []string {
+		var names []string
+		for i := 0; i < n; i++ {
+			names = append(names, fmt.Sprintf("%s/file%d", dir, i))
+		}
+		return names
+	}
+
+	cases := []struct {
+		changed  map[string]struct{}
+		expected []string
+	}{
+		{set("a", "b/c"), []string{"a", "b/c"}},
+		{set("a", "a/b", "a/b/c", "a b"), []string{"a", "a b"}},
+		{set("a/b/c", "a/b", "x/y"), []string{"a/b", "x/y"}},
+		{set("a", ""), nil},
+		{set(append(many("dir", maxDirChanges+1), "dir/sub/file", "other")...), []string{"dir", "other"}},
+		{set(many("dir", maxDirChanges)...), many("dir", maxDirChanges)},
+		{set(many(".", maxDirChanges+1)...), nil},
+	}
+
+	for i, tc := range cases {
+		for j := range tc.expected {
+			tc.expected[j] = filepath.FromSlash(tc.expected[j])
+		}
+		res := aggregate(tc.changed)
+		if tc.expected == nil {
+			if res != nil {
+				t.Errorf("%d: expected a full scan, got %q", i, res)
+			}
+			continue
+		}
+		sorted := append([]string(nil), tc.expected...)
+		sort.Strings(sorted)
+		if !reflect.DeepEqual(res, sorted) {
+			t.Errorf("%d: incorrect subs %q != %q", i, res, sorted)
+		}
+	}
+
+	// Too many separate paths result in a full scan
+	var names []string
+	for i := 0; i < maxSubs+1; i++ {
+		names = append(names, fmt.Sprintf("dir%d/file", i))
+	}
+	if res := aggregate(set(names...)); res != nil {
+		t.Errorf("Expected a full scan for %d paths, got %d", len(names), len(res))
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Watching is only supported on Linux")
+	}
+
+	dir, err := ioutil.TempDir("", "watcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "existing"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "ignored"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	scans := make(chan []string, 10)
+	ignored := func(name string) bool {
+		return strings.HasPrefix(name, "ignored")
+	}
+	w := New(dir, 100*time.Millisecond, ignored, func(subs []string) error {
+		scans <- subs
+		return nil
+	})
+	go w.Serve()
+	defer w.Stop()
+
+	// Give the watches time to be set up
+	time.Sleep(100 * time.Millisecond)
+
+	expect := func(expected ...string) {
+		select {
+		case subs := <-scans:
+			if !reflect.DeepEqual(subs, expected) {
+				t.Errorf("Incorrect subs %q != %q", subs, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for scan of %q", expected)
+		}
+	}
+
+	// Changes close together are scanned together
+	ioutil.WriteFile(filepath.Join(dir, "existing", "file"), []byte("data"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "ignored", "file"), []byte("data"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "root"), []byte("data"), 0644)
+	expect(filepath.Join("existing", "file"), "root")
+
+	// New directories are watched too
+	os.Mkdir(filepath.Join(dir, "new"), 0755)
+	expect("new")
+	ioutil.WriteFile(filepath.Join(dir, "new", "file"), []byte("data"), 0644)
+	expect(filepath.Join("new", "file"))
+
+	os.Remove(filepath.Join(dir, "root"))
+	expect("root")
+
+	// Nothing is scanned for ignored changes
+	ioutil.WriteFile(filepath.Join(dir, "ignored", "file"), []byte("more"), 0644)
+	select {
+	case subs := <-scans:
+		t.Errorf("Unexpected scan of %q", subs)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestWatchStop(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Watching is only supported on Linux")
+	}
+
+	dir, err := ioutil.TempDir("", "watcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- watch(dir, func(string) bool { return false }, make(chan string), stop)
+	}()
+
+	// Nothing happens in the directory, so the watch is waiting for events
+	// when stopped.
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Watch not stopped")
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package weakhash implements a cheap rolling checksum of blocks of data, in
+// the style of the one used by rsync, and a finder that uses it to locate
+// blocks at any offset in a file.
+package weakhash
+
+import (
+	"bufio"
+	"hash"
+	"io"
+	"os"
+)
+
+// Size is the size of the checksum in bytes.
+const Size = 4
+
+// The maximum number of offsets we remember for a single hash. Files with
+// lots of repeated data would otherwise produce a match at almost every
+// offset.
+const maxHits = 10
+
+// digest is an Adler-32 like checksum that, unlike the one in hash/adler32,
+// can be rolled over the data one byte at a time.
+type digest struct {
+	a, b uint32
+	n    uint32
+}
+
+// New returns a new hash.Hash32 computing the weak checksum.
+func New() hash.Hash32 {
+	d := &digest{}
+	d.Reset()
+	return d
+}
+
+func (d *digest) Reset() {
+	d.a = 1
+	d.b = 0
+	d.n = 0
+}
+
+func (d *digest) Size() int { return Size }
+
+func (d *digest) BlockSize() int { return 1 }
+
+func (d *digest) Write(data []byte) (int, error) {
+	for _, c := range data {
+		d.a += uint32(c)
+		d.b += d.a
+	}
+	d.n += uint32(len(data))
+	return len(data), nil
+}
+
+// Sum32 returns the checksum. A zero checksum is never returned, so that
+// zero can be used to signify that there is no checksum.
+func (d *digest) Sum32() uint32 {
+	if s := d.a&0xffff | d.b<<16; s != 0 {
+		return s
+	}
+	return 1
+}
+
+func (d *digest) Sum(b []byte) []byte {
+	s := d.Sum32()
+	return append(b, byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
+}
+
+// roll updates the checksum to cover a window of the same size, moved one
+// byte forward: out is the byte leaving the window and in the one entering.
+func (d *digest) roll(out, in byte) {
+	d.a += uint32(in) - uint32(out)
+	d.b += d.a - 1 - d.n*uint32(out)
+}
+
+// Block returns the checksum of the data.
+func Block(data []byte) uint32 {
+	d := New()
+	d.Write(data)
+	return d.Sum32()
+}
+
+// Finder knows the offsets in a file where blocks with a given set of
+// checksums start.
+type Finder struct {
+	fd      *os.File
+	size    int
+	offsets map[uint32][]int64
+}
+
+// NewFinder slides over the file, looking for blocks of the given size with
+// any of the given checksums. The Finder must be closed after use.
+func NewFinder(path string, size int, hashesToFind []uint32) (*Finder, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	want := make(map[uint32]struct{}, len(hashesToFind))
+	for _, h := range hashesToFind {
+		want[h] = struct{}{}
+	}
+
+	offsets, err := find(bufio.NewReader(fd), size, want)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	return &Finder{
+		fd:      fd,
+		size:    size,
+		offsets: offsets,
+	}, nil
+}
+
+// Iterate reads each of the blocks with the given checksum into buf, which
+// must be of the Finder block size, and calls iterFn with the offset of the
+// block. The iteration stops when iterFn returns true. Iterate returns
+// whether it was stopped that way.
+func (f *Finder) Iterate(hash uint32, buf []byte, iterFn func(int64) bool) bool {
+	if f == nil || len(buf) != f.size {
+		return false
+	}
+
+	for _, offset := range f.offsets[hash] {
+		if _, err := f.fd.ReadAt(buf, offset); err != nil {
+			continue
+		}
+		if iterFn(offset) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes the underlying file.
+func (f *Finder) Close() error {
+	if f == nil {
+		return nil
+	}
+	return f.fd.Close()
+}
+
+func find(r io.ByteReader, size int, want map[uint32]struct{}) (map[uint32][]int64, error) {
+	offsets := make(map[uint32][]int64)
+	if len(want) == 0 || size <= 0 {
+		return offsets, nil
+	}
+
+	// The window is a ring buffer holding the last size bytes read.
+	window := make([]byte, size)
+	d := &digest{}
+	d.Reset()
+	for i := range window {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			// The file is shorter than a block
+			return offsets, nil
+		} else if err != nil {
+			return nil, err
+		}
+		window[i] = c
+	}
+	d.Write(window)
+
+	var offset int64
+	for {
+		hash := d.Sum32()
+		if _, ok := want[hash]; ok && len(offsets[hash]) < maxHits {
+			offsets[hash] = append(offsets[hash], offset)
+		}
+
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			return offsets, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		i := int(offset % int64(size))
+		d.roll(window[i], c)
+		window[i] = c
+		offset++
+	}
+}
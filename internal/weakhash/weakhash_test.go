@@ -0,0 +1,109 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package weakhash
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+func TestRoll(t *testing.T) {
+	data := make([]byte, 4096)
+	rand.New(rand.NewSource(42)).Read(data)
+
+	const size = 512
+	d := &digest{}
+	d.Reset()
+	d.Write(data[:size])
+	for i := 0; i+size < len(data); i++ {
+		if exp := Block(data[i : i+size]); d.Sum32() != exp {
+			t.Fatalf("Incorrect rolled hash at offset %d; %08x != %08x", i, d.Sum32(), exp)
+		}
+		d.roll(data[i], data[i+size])
+	}
+}
+
+func TestBlockNonZero(t *testing.T) {
+	if Block(make([]byte, 1024)) == 0 {
+		t.Error("Zero checksum for zero block")
+	}
+	if Block(nil) == 0 {
+		t.Error("Zero checksum for empty block")
+	}
+}
+
+func TestFinder(t *testing.T) {
+	data := make([]byte, 64<<10)
+	rand.New(rand.NewSource(42)).Read(data)
+
+	const size = 1024
+	// Blocks at offsets that aren't multiples of the block size
+	blocks := [][]byte{data[1000 : 1000+size], data[33333 : 33333+size]}
+
+	fd, err := ioutil.TempFile("", "weakhash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fd.Write(data)
+	fd.Close()
+
+	finder, err := NewFinder(fd.Name(), size, []uint32{Block(blocks[0]), Block(blocks[1]), 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer finder.Close()
+
+	buf := make([]byte, size)
+	for i, expected := range []int64{1000, 33333} {
+		found := finder.Iterate(Block(blocks[i]), buf, func(offset int64) bool {
+			if offset != expected {
+				t.Errorf("Incorrect offset %d != %d", offset, expected)
+			}
+			if !bytes.Equal(buf, blocks[i]) {
+				t.Error("Incorrect block data")
+			}
+			return true
+		})
+		if !found {
+			t.Errorf("Block %d not found", i)
+		}
+	}
+
+	if finder.Iterate(42, buf, func(int64) bool { return true }) {
+		t.Error("Unexpected block found")
+	}
+}
+
+func TestFinderRepeated(t *testing.T) {
+	fd, err := ioutil.TempFile("", "weakhash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fd.Write(make([]byte, 64<<10))
+	fd.Close()
+
+	const size = 1024
+	finder, err := NewFinder(fd.Name(), size, []uint32{Block(make([]byte, size))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer finder.Close()
+
+	hits := 0
+	finder.Iterate(Block(make([]byte, size)), make([]byte, size), func(int64) bool {
+		hits++
+		return false
+	})
+	if hits != maxHits {
+		t.Errorf("Incorrect number of hits %d != %d", hits, maxHits)
+	}
+}
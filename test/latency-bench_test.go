@@ -0,0 +1,106 @@
+// Copyright (C) 2015 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// +build integration,benchmark
+
+package integration
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestBenchmarkSyncLatency measures the time from a file being changed on
+// the sender to it being changed on the receiver, for a number of single
+// file changes in a row.
+func TestBenchmarkSyncLatency(t *testing.T) {
+	const rounds = 20
+
+	log.Println("Cleaning...")
+	err := removeAll("s1", "s2", "h1/index*", "h2/index*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll("s1", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll("s2", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	log.Println("Starting up...")
+	sender := syncthingProcess{ // id1
+		instance: "1",
+		argv:     []string{"-home", "h1"},
+		port:     8081,
+		apiKey:   apiKey,
+	}
+	if err := sender.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sender.stop()
+
+	receiver := syncthingProcess{ // id2
+		instance: "2",
+		argv:     []string{"-home", "h2"},
+		port:     8082,
+		apiKey:   apiKey,
+	}
+	if err := receiver.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.stop()
+
+	// Wait for the devices to connect and get in sync with the empty
+	// folders.
+	for {
+		time.Sleep(time.Second)
+		if err := allDevicesInSync([]syncthingProcess{sender, receiver}); err == nil {
+			break
+		}
+	}
+
+	var total, min, max time.Duration
+	for i := 0; i < rounds; i++ {
+		data := []byte(fmt.Sprintf("round %d at %v", i, time.Now()))
+		if err := ioutil.WriteFile(filepath.Join("s1", "latency"), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		t0 := time.Now()
+		if err := sender.rescan("default"); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			bs, err := ioutil.ReadFile(filepath.Join("s2", "latency"))
+			if err == nil && bytes.Equal(bs, data) {
+				break
+			}
+			if time.Since(t0) > time.Minute {
+				t.Fatalf("Round %d: change did not arrive", i)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		d := time.Since(t0)
+
+		log.Printf("Round %d: %v", i, d)
+		total += d
+		if min == 0 || d < min {
+			min = d
+		}
+		if d > max {
+			max = d
+		}
+	}
+
+	log.Printf("Sync latency over %d rounds: min %v, avg %v, max %v", rounds, min, total/rounds, max)
+}